@@ -0,0 +1,109 @@
+package ast
+
+import "strings"
+
+// Features is a set of features standardized after the first version of
+// WebAssembly (the MVP), which modules may use only if they are enabled.
+// The parser accepts the constructs of all of them, and the validator
+// rejects those of the features that are not enabled.
+type Features uint
+
+const (
+	// SignExtension enables the sign-extension operators, which extend the
+	// low bits of an integer: i32.extend8_s, i32.extend16_s,
+	// i64.extend8_s, i64.extend16_s and i64.extend32_s.
+	SignExtension Features = 1 << iota
+
+	// SaturatingFloatToInt enables the non-trapping float-to-int
+	// conversions, such as i32.trunc_sat_f32_s, which saturate at the
+	// bounds of the integer type and convert NaN to 0.
+	SaturatingFloatToInt
+
+	// MultiValue enables functions and blocks with several results, and
+	// blocks with parameters, which they take from the operand stack.
+	MultiValue
+
+	// BulkMemory enables passive segments and the bulk memory operators,
+	// which copy, fill and initialize ranges of memories and tables, and
+	// drop segments: memory.copy, memory.fill, memory.init, data.drop,
+	// table.copy, table.init and elem.drop.
+	BulkMemory
+
+	// ReferenceTypes enables the reference types funcref and externref as
+	// value types, tables of externref, multiple tables, declarative
+	// element segments, typed select, the reference operators ref.null,
+	// ref.is_null and ref.func, and the table operators table.get,
+	// table.set, table.size, table.grow and table.fill.
+	ReferenceTypes
+
+	// SIMD enables the value type v128 and the 128-bit vector
+	// instructions, which operate on its lanes as integers or floats of
+	// a shape such as i32x4, and load and store them.
+	SIMD
+
+	// TailCall enables the tail calls return_call and return_call_indirect,
+	// which return from the function with the results of the call, so that
+	// the callee takes the place of the caller.
+	TailCall
+
+	// Threads enables shared memories, which several instances may access
+	// concurrently, and the atomic memory instructions: the atomic loads,
+	// stores and read-modify-writes such as i32.atomic.rmw.add,
+	// memory.atomic.wait32, memory.atomic.wait64, memory.atomic.notify and
+	// atomic.fence.
+	Threads
+)
+
+var featureNames = []string{
+	"sign-extension",
+	"saturating-float-to-int",
+	"multi-value",
+	"bulk-memory",
+	"reference-types",
+	"simd",
+	"tail-call",
+	"threads",
+}
+
+// String returns the names of the features of f, separated by |.
+func (f Features) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "mvp"
+	}
+	return strings.Join(names, "|")
+}
+
+// feature returns the feature that in belongs to, or zero if it is an
+// instruction of the MVP.
+func (in *Instruction) feature() Features {
+	if in.IsVector() {
+		return SIMD
+	}
+	switch in.Op {
+	case EXTEND:
+		if in.From == 0 {
+			return SignExtension
+		}
+	case TRUNC_SAT:
+		return SaturatingFloatToInt
+	case MEMORY_COPY, MEMORY_FILL, MEMORY_INIT, DATA_DROP, TABLE_COPY, TABLE_INIT, ELEM_DROP:
+		return BulkMemory
+	case REF_NULL, REF_IS_NULL, REF_FUNC, TABLE_GET, TABLE_SET, TABLE_SIZE, TABLE_GROW, TABLE_FILL:
+		return ReferenceTypes
+	case SELECT:
+		if in.Type != 0 {
+			return ReferenceTypes
+		}
+	case RETURN_CALL, RETURN_CALL_INDIRECT:
+		return TailCall
+	case ATOMIC_FENCE, ATOMIC_LOAD, ATOMIC_RMW, ATOMIC_STORE, MEMORY_ATOMIC_NOTIFY, MEMORY_ATOMIC_WAIT:
+		return Threads
+	}
+	return 0
+}
@@ -0,0 +1,259 @@
+package ast
+
+// Unfold rewrites the body of fn in flat form, where no instruction has
+// folded operands: ( i32.add ( get_local 0 ) ( i32.const 1 ) ) becomes
+// get_local 0, i32.const 1, i32.add.
+// The bodies of blocks are unfolded too.
+func Unfold(fn *Func) {
+	fn.Body = unfold(nil, fn.Body)
+}
+
+// Fold rewrites the body of fn in folded form, where every instruction
+// whose operands are computed by the instructions immediately preceding it
+// has these instructions folded into it: get_local 0, i32.const 1, i32.add
+// becomes ( i32.add ( get_local 0 ) ( i32.const 1 ) ).
+// The bodies of blocks are folded too, and so is the condition of an if.
+//
+// Instructions whose stack effect is unknown, such as unreachable, are left
+// flat, as are the instructions that consume their results.
+// Unfolding the result yields the original instruction sequence.
+func Fold(m *Module, fn *Func) {
+	f := &folder{m: m, foldable: func([]Instr) bool { return true }}
+	fn.Body = f.foldFunc(fn)
+}
+
+// FoldMinimal rewrites the body of fn in minimally folded form, where only
+// the instructions whose operands are all computed by operand-free
+// instructions, such as get_local or i32.const, are folded:
+// ( i32.add ( get_local 0 ) ( i32.const 1 ) ) is folded, but its result
+// is left on the stack rather than folded into the instruction using it.
+func FoldMinimal(m *Module, fn *Func) {
+	f := &folder{m: m, foldable: func(operands []Instr) bool {
+		for _, op := range operands {
+			if in, ok := op.(*Instruction); !ok || len(in.Operands) > 0 {
+				return false
+			}
+		}
+		return true
+	}}
+	fn.Body = f.foldFunc(fn)
+}
+
+// unfold appends the instructions of body in flat form to dst.
+func unfold(dst, body []Instr) []Instr {
+	for _, in := range body {
+		switch in := in.(type) {
+		case *Instruction:
+			dst = unfold(dst, in.Operands)
+			flat := *in
+			flat.Operands = nil
+			dst = append(dst, &flat)
+		case *Block:
+			flat := *in
+			flat.Body = unfold(nil, in.Body)
+			dst = append(dst, &flat)
+		case *Loop:
+			flat := *in
+			flat.Body = unfold(nil, in.Body)
+			dst = append(dst, &flat)
+		case *If:
+			dst = unfold(dst, in.Cond)
+			flat := *in
+			flat.Cond = nil
+			flat.Then = unfold(nil, in.Then)
+			if in.Else != nil {
+				flat.Else = unfold(make([]Instr, 0, len(in.Else)), in.Else)
+			}
+			dst = append(dst, &flat)
+		}
+	}
+	return dst
+}
+
+type folder struct {
+	m        *Module
+	foldable func(operands []Instr) bool // reports whether to fold operands
+
+	// labels holds the number of values that a branch to each enclosing
+	// block takes, innermost last, or -1 if it is unknown.
+	labels []int
+}
+
+func (f *folder) foldFunc(fn *Func) []Instr {
+	arity := -1
+	if sig := f.m.Signature(fn.Signature); sig != nil {
+		arity = len(sig.Results)
+	}
+	f.labels = []int{arity}
+	return f.fold(unfold(nil, fn.Body))
+}
+
+// fold folds the flat instruction sequence body.
+func (f *folder) fold(body []Instr) []Instr {
+	var (
+		out []Instr
+		// values[i] reports whether out[i] is a complete expression
+		// that leaves exactly one value on the stack.
+		values []bool
+	)
+	for _, in := range body {
+		pops, pushes, ok := f.stackEffect(in)
+		if !ok {
+			out = append(out, in)
+			values = append(values, false)
+			continue
+		}
+		n := len(out) - pops
+		complete := pops == 0
+		if n >= 0 && pops > 0 && allTrue(values[n:]) && f.foldable(out[n:]) {
+			operands := append([]Instr(nil), out[n:]...)
+			switch in := in.(type) {
+			case *Instruction:
+				in.Operands = operands
+			case *If:
+				in.Cond = operands
+			}
+			out, values = out[:n], values[:n]
+			complete = true
+		}
+		out = append(out, in)
+		values = append(values, complete && pushes == 1)
+	}
+	return out
+}
+
+// foldBlock folds the flat instruction sequence body of a block
+// whose label takes arity values.
+func (f *folder) foldBlock(body []Instr, arity int) []Instr {
+	f.labels = append(f.labels, arity)
+	body = f.fold(body)
+	f.labels = f.labels[:len(f.labels)-1]
+	return body
+}
+
+func allTrue(a []bool) bool {
+	for _, b := range a {
+		if !b {
+			return false
+		}
+	}
+	return true
+}
+
+// stackEffect returns the number of operands in pops off the stack and
+// the number of results it pushes onto it, or ok == false if they are
+// unknown. It folds the bodies of blocks.
+func (f *folder) stackEffect(in Instr) (pops, pushes int, ok bool) {
+	switch in := in.(type) {
+	case *Instruction:
+		return f.instrEffect(in)
+	case *Block:
+		params, results := f.blockArity(in.Type)
+		in.Body = f.foldBlock(in.Body, results)
+		return 0, results, params == 0 && results >= 0
+	case *Loop:
+		params, results := f.blockArity(in.Type)
+		in.Body = f.foldBlock(in.Body, params)
+		return 0, results, params == 0 && results >= 0
+	case *If:
+		params, results := f.blockArity(in.Type)
+		in.Then = f.foldBlock(in.Then, results)
+		if in.Else != nil {
+			in.Else = f.foldBlock(in.Else, results)
+		}
+		return 1, results, params == 0 && results >= 0
+	}
+	return 0, 0, false
+}
+
+// blockArity returns the number of parameters and results of a block of
+// type sig, or -1 if they are unknown. The parameters of a block are not
+// folded: its effect is unknown if it has some.
+func (f *folder) blockArity(sig *FuncSig) (params, results int) {
+	if sig = f.m.Signature(sig); sig == nil {
+		return -1, -1
+	}
+	return len(sig.ParamTypes()), len(sig.Results)
+}
+
+func (f *folder) instrEffect(in *Instruction) (pops, pushes int, ok bool) {
+	if in.IsVector() {
+		params, result, ok := in.VectorType()
+		if result != 0 {
+			pushes = 1
+		}
+		return len(params), pushes, ok
+	}
+	switch {
+	case in.Op == CONST:
+		return 0, 1, true
+	case beginUnOp < in.Op && in.Op < endUnOp, in.Op.isCvtOp():
+		return 1, 1, true
+	case beginBinOp < in.Op && in.Op < endBinOp, beginRelOp < in.Op && in.Op < endRelOp:
+		return 2, 1, true
+	}
+	switch in.Op {
+	case NOP:
+		return 0, 0, true
+	case GET_LOCAL, GET_GLOBAL, CURRENT_MEMORY, TABLE_SIZE, REF_NULL, REF_FUNC:
+		return 0, 1, true
+	case SET_LOCAL, SET_GLOBAL, DROP:
+		return 1, 0, true
+	case TEE_LOCAL, GROW_MEMORY, LOAD, TABLE_GET, REF_IS_NULL:
+		return 1, 1, true
+	case STORE, TABLE_SET:
+		return 2, 0, true
+	case TABLE_GROW:
+		return 2, 1, true
+	case MEMORY_COPY, MEMORY_FILL, MEMORY_INIT, TABLE_COPY, TABLE_INIT, TABLE_FILL:
+		return 3, 0, true
+	case DATA_DROP, ELEM_DROP, ATOMIC_FENCE:
+		return 0, 0, true
+	case ATOMIC_LOAD:
+		return 1, 1, true
+	case ATOMIC_STORE:
+		return 2, 0, true
+	case ATOMIC_RMW:
+		if in.RMW == CMPXCHG {
+			return 3, 1, true
+		}
+		return 2, 1, true
+	case MEMORY_ATOMIC_NOTIFY:
+		return 2, 1, true
+	case MEMORY_ATOMIC_WAIT:
+		return 3, 1, true
+	case SELECT:
+		return 3, 1, true
+	case RETURN:
+		if arity := f.labels[0]; arity >= 0 {
+			return arity, 0, true
+		}
+	case BR_IF:
+		if d := in.Var.Index; d < len(f.labels) {
+			if arity := f.labels[len(f.labels)-1-d]; arity >= 0 {
+				return arity + 1, arity, true
+			}
+		}
+	case CALL:
+		if fn := f.m.lookupFunc(in.Var); fn != nil {
+			if sig := f.m.Signature(fn.Signature); sig != nil {
+				return len(sig.ParamTypes()), len(sig.Results), true
+			}
+		}
+	case CALL_INDIRECT:
+		if sig := f.m.Signature(in.Sig); sig != nil {
+			return len(sig.ParamTypes()) + 1, len(sig.Results), true
+		}
+	case RETURN_CALL:
+		if fn := f.m.lookupFunc(in.Var); fn != nil {
+			if sig := f.m.Signature(fn.Signature); sig != nil {
+				return len(sig.ParamTypes()), 0, true
+			}
+		}
+	case RETURN_CALL_INDIRECT:
+		if sig := f.m.Signature(in.Sig); sig != nil {
+			return len(sig.ParamTypes()) + 1, 0, true
+		}
+	}
+	return 0, 0, false
+}
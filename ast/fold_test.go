@@ -0,0 +1,179 @@
+package ast
+
+import (
+	"strings"
+	"testing"
+)
+
+const foldinput = `(module
+	(func $g (param i32 i32) (result i32) get_local 0)
+	(func $f (param i32) (result i32)
+		get_local 0
+		i32.const 1
+		i32.add
+		get_local 0
+		i32.const 2
+		i32.mul
+		call $g
+		set_local 0
+		unreachable
+		i32.eqz
+		drop
+		nop
+		get_local 0
+		return))
+`
+
+var foldtests = []struct {
+	name string
+	fold func(*Module, *Func)
+	want string
+}{
+	{"Unfold", func(m *Module, fn *Func) { Unfold(fn) }, `
+    get_local 0
+    i32.const 1
+    i32.add
+    get_local 0
+    i32.const 2
+    i32.mul
+    call $g
+    set_local 0
+    unreachable
+    i32.eqz
+    drop
+    nop
+    get_local 0
+    return)`},
+	{"Fold", Fold, `
+    (set_local 0 (call $g (i32.add (get_local 0) (i32.const 1)) (i32.mul (get_local 0) (i32.const 2))))
+    unreachable
+    i32.eqz
+    drop
+    nop
+    (return (get_local 0)))`},
+	{"FoldMinimal", FoldMinimal, `
+    (i32.add (get_local 0) (i32.const 1))
+    (i32.mul (get_local 0) (i32.const 2))
+    call $g
+    set_local 0
+    unreachable
+    i32.eqz
+    drop
+    nop
+    (return (get_local 0)))`},
+}
+
+func TestFold(t *testing.T) {
+	for _, tt := range foldtests {
+		m, err := Parse(strings.NewReader(foldinput))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := m.Funcs[1]
+		want := printFunc(m, fn)
+		tt.fold(m, fn)
+		got := printFunc(m, fn)
+		if !strings.HasSuffix(got, tt.want+"\n)\n") {
+			t.Errorf("%s: got:\n%s\nwant body:%s", tt.name, got, tt.want)
+		}
+		Unfold(fn)
+		Fold(m, fn) // idempotent up to unfolding
+		Unfold(fn)
+		if got := printFunc(m, fn); got != want {
+			t.Errorf("%s: unfolded:\n%s\nwant:\n%s", tt.name, got, want)
+		}
+	}
+}
+
+func printFunc(m *Module, fn *Func) string {
+	var b strings.Builder
+	Fprint(&b, &Module{Types: m.Types, Funcs: []*Func{fn}})
+	return b.String()
+}
+
+func TestFoldBlocks(t *testing.T) {
+	const in = `(module (func (param i32) (result i32)
+		block (result i32)
+			get_local 0
+			get_local 0
+			br_if 0
+			i32.const 1
+			i32.add
+		end
+		get_local 0
+		if (result i32)
+			i32.const 2
+		else
+			loop
+				br 0
+			end
+			i32.const 3
+		end
+		i32.mul))`
+	const want = `
+    (i32.mul
+      (block (result i32)
+        (i32.add (br_if 0 (get_local 0) (get_local 0)) (i32.const 1)))
+      (if (result i32)
+        (get_local 0)
+        (then
+          i32.const 2)
+        (else
+          (loop
+            br 0)
+          i32.const 3))))
+`
+	m, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := m.Funcs[0]
+	flat := printFunc(m, fn)
+	Fold(m, fn)
+	if got := printFunc(m, fn); !strings.HasSuffix(got, want+")\n") {
+		t.Errorf("got:\n%s\nwant body:%s", got, want)
+	}
+	Unfold(fn)
+	if got := printFunc(m, fn); got != flat {
+		t.Errorf("unfolded:\n%s\nwant:\n%s", got, flat)
+	}
+}
+
+func TestFoldBlockParams(t *testing.T) {
+	const in = `(module (func (param i32) (result i32)
+		get_local 0
+		i32.const 1
+		block (param i32 i32) (result i32)
+			get_local 0
+			i32.eqz
+			drop
+			i32.add
+		end
+		loop (param i32) (result i32)
+			i32.const 2
+			i32.mul
+			get_local 0
+			br_if 0
+		end))`
+	const want = `
+    get_local 0
+    i32.const 1
+    (block (param i32 i32) (result i32)
+      (drop (i32.eqz (get_local 0)))
+      i32.add)
+    (loop (param i32) (result i32)
+      i32.const 2
+      i32.mul
+      get_local 0
+      br_if 0))
+`
+	m, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := m.Funcs[0]
+	Fold(m, fn)
+	if got := printFunc(m, fn); !strings.HasSuffix(got, want+")\n") {
+		t.Errorf("got:\n%s\nwant body:%s", got, want)
+	}
+}
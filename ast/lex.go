@@ -31,6 +31,10 @@ type lexer struct {
 	readErr  error   // last error set by read (non-nil iff it returned eof)
 	token    []byte  // pending input
 	runeSize int     // size of the last rune read (zero if readErr != nil)
+	start    int     // byte offset of the pending input
+	pos      int     // byte offset of the next rune
+	line     int     // number of newlines before the next rune
+	lineAt   int     // number of newlines before the pending input
 	tokens   []token // tokens read so far
 }
 
@@ -59,6 +63,9 @@ func lexAny(l *lexer) stateFn {
 	case containsRune(letters, r):
 		return lexAtom
 	case r == '(':
+		if l.accept(";") {
+			return lexBlockComment
+		}
 		l.emit(LPAREN)
 		return lexAny
 	case r == ')':
@@ -80,6 +87,11 @@ func lexAny(l *lexer) stateFn {
 		return lexName
 	case r == '"':
 		return lexString
+	case r == ';':
+		if !l.accept(";") {
+			return l.errorf("unexpected character: %#U", r)
+		}
+		return lexLineComment
 	case r == '+' || r == '-' || ('0' <= r && r <= '9'):
 		l.unread()
 		return lexNumber
@@ -104,30 +116,86 @@ func lexRightDelim(l *lexer) stateFn {
 // The first character has been scanned.
 func lexAtom(l *lexer) stateFn {
 	l.acceptRun(letters + digits + "_")
+	if l.emitSigned(len(l.token), 0) {
+		return lexAny
+	}
+	// The atom of a vector instruction may end with a modifier, as in
+	// load32_zero or trunc_sat_f64x2_s_zero.
+	if i := bytes.LastIndexByte(l.token, '_'); i >= 0 {
+		if mod := atom[string(l.token[i+1:])]; mod == LANE || mod == SPLAT || mod == ZERO {
+			if l.emitSigned(i, mod) {
+				return lexAny
+			}
+		}
+	}
+	return l.errorf("unexpected token: %s", string(l.token))
+}
+
+// emitSigned emits the pending input if its first end bytes are an atom,
+// possibly followed by a sign, and the rest is the modifier mod, if any.
+// It reports whether they are.
+func (l *lexer) emitSigned(end int, mod tokenType) bool {
+	tok := l.token[:end]
+	var sign tokenType
 	switch {
-	case bytes.HasSuffix(l.token, []byte("_s")):
-		tok := bytes.TrimSuffix(l.token, []byte("_s"))
-		if typ, ok := atom[string(tok)]; ok {
-			l.tokens = append(l.tokens, token{typ: typ, text: tok})
-			l.tokens = append(l.tokens, token{typ: UNDERSCORE, text: []byte("_")})
-			l.tokens = append(l.tokens, token{typ: S, text: []byte("s")})
-			return lexAny
+	case bytes.HasSuffix(tok, []byte("_s")):
+		sign = S
+	case bytes.HasSuffix(tok, []byte("_u")):
+		sign = U
+	}
+	if sign != 0 {
+		if typ, n, ok := lookupAtom(tok[:end-2]); ok {
+			l.emitAtom(typ, n, end-2, sign, mod)
+			return true
 		}
-	case bytes.HasSuffix(l.token, []byte("_u")):
-		tok := bytes.TrimSuffix(l.token, []byte("_u"))
-		if typ, ok := atom[string(tok)]; ok {
-			l.tokens = append(l.tokens, token{typ: typ, text: tok})
-			l.tokens = append(l.tokens, token{typ: UNDERSCORE, text: []byte("_")})
-			l.tokens = append(l.tokens, token{typ: U, text: []byte("u")})
-			return lexAny
+	}
+	if typ, n, ok := lookupAtom(tok); ok {
+		l.emitAtom(typ, n, end, 0, mod)
+		return true
+	}
+	return false
+}
+
+// lookupAtom returns the type of the atom tok and the length of its text.
+// The atoms load, store and rmw may be followed by an access width,
+// as in load8 and rmw16, or by the lanes of an extending vector load, as in
+// load8x8, extend by the width of a sign extension, as in
+// extend16, and wait by the width of its operand, as in wait32, which are
+// not part of their text. Likewise, trunc_sat and
+// the vector conversions are followed by the type or the shape of their
+// operand, as in trunc_sat_f32 and extend_low_i16x8.
+func lookupAtom(tok []byte) (typ tokenType, n int, ok bool) {
+	if typ, ok := atom[string(tok)]; ok {
+		return typ, len(tok), true
+	}
+	if i := bytes.LastIndexByte(tok, '_'); i >= 0 && hasOperandType(atom[string(tok[:i])]) {
+		if t := atom[string(tok[i+1:])]; t.IsValueType() || t.IsShape() {
+			return atom[string(tok[:i])], i, true
 		}
-	default:
-		if typ, ok := atom[string(l.token)]; ok {
-			l.emit(typ)
-			return lexAny
+	}
+	stem := bytes.TrimRight(tok, digits)
+	if bytes.HasSuffix(stem, []byte("x")) && len(stem) < len(tok) {
+		if stem = bytes.TrimRight(stem[:len(stem)-1], digits); atom[string(stem)] == LOAD {
+			return LOAD, len(stem), true
 		}
+		return 0, 0, false
 	}
-	return l.errorf("unexpected token: %s", string(l.token))
+	switch typ := atom[string(stem)]; typ {
+	case LOAD, STORE, EXTEND, RMW, WAIT:
+		return typ, len(stem), true
+	}
+	return 0, 0, false
+}
+
+// hasOperandType reports whether the atom of the operator t is followed by
+// the type or the shape of its operand, as trunc_sat in trunc_sat_f32.
+func hasOperandType(t tokenType) bool {
+	switch t {
+	case TRUNC_SAT, CONVERT, CONVERT_LOW, DEMOTE, DOT_PRODUCT, EXTADD_PAIRWISE,
+		EXTEND_HIGH, EXTEND_LOW, EXTMUL_HIGH, EXTMUL_LOW, NARROW, PROMOTE_LOW:
+		return true
+	}
+	return false
 }
 
 // lexName scans a name literal.
@@ -163,6 +231,38 @@ func lexString(l *lexer) stateFn {
 	return nil
 }
 
+// lexLineComment scans a line comment.
+// The ;; has been scanned.
+func lexLineComment(l *lexer) stateFn {
+	for r := l.read(); r != '\n' && r != eof; r = l.read() {
+	}
+	l.unread()
+	l.emit(COMMENT)
+	return lexAny
+}
+
+// lexBlockComment scans a block comment, which may be nested.
+// The (; has been scanned.
+func lexBlockComment(l *lexer) stateFn {
+	depth := 1
+	for depth > 0 {
+		switch l.read() {
+		case '(':
+			if l.accept(";") {
+				depth++
+			}
+		case ';':
+			if l.accept(")") {
+				depth--
+			}
+		case eof:
+			return l.errorf("unclosed block comment")
+		}
+	}
+	l.emit(COMMENT)
+	return lexAny
+}
+
 // lexNumber scans an number literal.
 // This is not a perfect number scanner, check its output via strconv.
 // FIXME: match the spec.
@@ -198,15 +298,52 @@ func (l *lexer) scanNumber() bool {
 }
 
 func (l *lexer) emit(typ tokenType) {
-	l.tokens = append(l.tokens, token{typ: typ, text: l.token})
-	l.token = nil
-	l.runeSize = 0
+	l.tokens = append(l.tokens, token{typ: typ, text: l.token, pos: l.start, line: l.lineAt + 1})
+	l.ignore()
+}
+
+// emitAtom emits the pending input, an atom of type typ, as separate
+// tokens: typ for its first n bytes, a NUMBER for its access width up to
+// byte w, if any, or an UNDERSCORE followed by the operand type of
+// trunc_sat or of a vector conversion, an UNDERSCORE followed by sign, if
+// sign is non-zero, and an UNDERSCORE followed by the modifier mod, if
+// it is non-zero.
+func (l *lexer) emitAtom(typ tokenType, n, w int, sign, mod tokenType) {
+	end := len(l.token)
+	if mod != 0 {
+		end = bytes.LastIndexByte(l.token, '_')
+	}
+	l.tokens = append(l.tokens, token{typ: typ, text: l.token[:n], pos: l.start, line: l.lineAt + 1})
+	switch {
+	case w > n && l.token[n] == '_':
+		l.tokens = append(l.tokens,
+			token{typ: UNDERSCORE, text: l.token[n : n+1], pos: l.start + n, line: l.lineAt + 1},
+			token{typ: atom[string(l.token[n+1:w])], text: l.token[n+1 : w], pos: l.start + n + 1, line: l.lineAt + 1},
+		)
+	case w > n:
+		l.tokens = append(l.tokens, token{typ: NUMBER, text: l.token[n:w], pos: l.start + n, line: l.lineAt + 1})
+	}
+	if sign != 0 {
+		l.tokens = append(l.tokens,
+			token{typ: UNDERSCORE, text: l.token[w : w+1], pos: l.start + w, line: l.lineAt + 1},
+			token{typ: sign, text: l.token[w+1 : end], pos: l.start + w + 1, line: l.lineAt + 1},
+		)
+	}
+	if mod != 0 {
+		l.tokens = append(l.tokens,
+			token{typ: UNDERSCORE, text: l.token[end : end+1], pos: l.start + end, line: l.lineAt + 1},
+			token{typ: mod, text: l.token[end+1:], pos: l.start + end + 1, line: l.lineAt + 1},
+		)
+	}
+	l.ignore()
 }
 
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
 	l.tokens = append(l.tokens, token{
 		typ:  ERROR,
 		text: []byte(fmt.Sprintf(format, args...)),
+		pos:  l.start,
+		line: l.lineAt + 1,
 	})
 	return nil
 }
@@ -222,6 +359,10 @@ func (l *lexer) read() rune {
 	}
 	l.token = append(l.token, string(r)...)
 	l.runeSize = size
+	l.pos += size
+	if r == '\n' {
+		l.line++
+	}
 	return r
 }
 
@@ -236,7 +377,11 @@ func (l *lexer) unread() {
 		panic("invalid use of unread")
 	}
 	l.r.UnreadRune() // erroneous cases guarded above
+	if l.token[len(l.token)-1] == '\n' {
+		l.line--
+	}
 	l.token = l.token[:len(l.token)-l.runeSize]
+	l.pos -= l.runeSize
 	l.runeSize = 0
 }
 
@@ -253,7 +398,7 @@ func (l *lexer) discard(valid string) {
 		l.unread()
 		return
 	}
-	l.token = nil
+	l.ignore()
 }
 
 // discardRun skips a run of runes from the valid set.
@@ -261,7 +406,7 @@ func (l *lexer) discardRun(valid string) {
 	for containsRune(valid, l.read()) {
 	}
 	l.unread()
-	l.token = nil
+	l.ignore()
 	return
 }
 
@@ -285,6 +430,8 @@ func (l *lexer) acceptRun(valid string) {
 func (l *lexer) ignore() {
 	l.token = nil
 	l.runeSize = 0
+	l.start = l.pos
+	l.lineAt = l.line
 }
 
 // containsRune reports whether r is in s.
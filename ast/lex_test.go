@@ -77,6 +77,12 @@ var lexertests = []struct {
 	//}},
 	//{"nan nan:0xaBc", []token{tNUMBER("nan"), tNUMBER("nan:0xaBc")}},
 
+	// comments
+	{";; foo (bar)\n$x", []token{tok(COMMENT, ";; foo (bar)"), tNAME("$x")}},
+	{"(; a (; b ;) c ;)(", []token{tok(COMMENT, "(; a (; b ;) c ;)"), tok(LPAREN, "(")}},
+	{"(; a (; b ;)", []token{tERROR("unclosed block comment")}},
+	{"; a", []token{tERROR("unexpected character: U+003B ';'")}},
+
 	// atoms
 	{"i32 anyfunc add rotl call_indirect", []token{
 		tok(I32, "i32"),
@@ -106,6 +112,82 @@ var lexertests = []struct {
 		tok(SLASH, "/"),
 		tok(I32, "i32"),
 	}},
+	{"i64.load32_u store8 load", []token{
+		tok(I64, "i64"),
+		tok(DOT, "."),
+		tok(LOAD, "load"),
+		tNUMBER("32"),
+		tok(UNDERSCORE, "_"),
+		tok(U, "u"),
+
+		tok(STORE, "store"),
+		tNUMBER("8"),
+
+		tok(LOAD, "load"),
+	}},
+	{"i32.extend16_s", []token{
+		tok(I32, "i32"),
+		tok(DOT, "."),
+		tok(EXTEND, "extend"),
+		tNUMBER("16"),
+		tok(UNDERSCORE, "_"),
+		tok(S, "s"),
+	}},
+	{"i64.trunc_sat_f32_u", []token{
+		tok(I64, "i64"),
+		tok(DOT, "."),
+		tok(TRUNC_SAT, "trunc_sat"),
+		tok(UNDERSCORE, "_"),
+		tok(F32, "f32"),
+		tok(UNDERSCORE, "_"),
+		tok(U, "u"),
+	}},
+	{"v128.load8x8_s load32_zero store16_lane", []token{
+		tok(V128, "v128"),
+		tok(DOT, "."),
+		tok(LOAD, "load"),
+		tNUMBER("8x8"),
+		tok(UNDERSCORE, "_"),
+		tok(S, "s"),
+
+		tok(LOAD, "load"),
+		tNUMBER("32"),
+		tok(UNDERSCORE, "_"),
+		tok(ZERO, "zero"),
+
+		tok(STORE, "store"),
+		tNUMBER("16"),
+		tok(UNDERSCORE, "_"),
+		tok(LANE, "lane"),
+	}},
+	{"i64.atomic.rmw32.cmpxchg_u wait64", []token{
+		tok(I64, "i64"),
+		tok(DOT, "."),
+		tok(ATOMIC, "atomic"),
+		tok(DOT, "."),
+		tok(RMW, "rmw"),
+		tNUMBER("32"),
+		tok(DOT, "."),
+		tok(CMPXCHG, "cmpxchg"),
+		tok(UNDERSCORE, "_"),
+		tok(U, "u"),
+
+		tok(WAIT, "wait"),
+		tNUMBER("64"),
+	}},
+	{"i32x4.trunc_sat_f64x2_u_zero", []token{
+		tok(I32X4, "i32x4"),
+		tok(DOT, "."),
+		tok(TRUNC_SAT, "trunc_sat"),
+		tok(UNDERSCORE, "_"),
+		tok(F64X2, "f64x2"),
+		tok(UNDERSCORE, "_"),
+		tok(U, "u"),
+		tok(UNDERSCORE, "_"),
+		tok(ZERO, "zero"),
+	}},
+	{"add8", []token{tERROR("unexpected token: add8")}},
+	{"trunc_sat_i31_s", []token{tERROR("unexpected token: trunc_sat_i31_s")}},
 }
 
 func TestLexer(t *testing.T) {
@@ -121,6 +203,31 @@ func TestLexer(t *testing.T) {
 	}
 }
 
+func TestLexerPos(t *testing.T) {
+	const in = "(func $f ;; c\n  i64.trunc_u/f32)"
+	want := []int{0, 1, 6, 9, 16, 19, 20, 25, 26, 27, 28, 31}
+	wantLines := []int{1, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2}
+	l := newLexer(bytes.NewReader([]byte(in)))
+	got, err := l.lex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %d tokens", got, len(want))
+	}
+	for i, tok := range got {
+		if tok.pos != want[i] {
+			t.Errorf("%s: got pos %d, want %d", tok, tok.pos, want[i])
+		}
+		if tok.line != wantLines[i] {
+			t.Errorf("%s: got line %d, want %d", tok, tok.line, wantLines[i])
+		}
+		if s := in[tok.pos : tok.pos+len(tok.text)]; s != string(tok.text) {
+			t.Errorf("%s: input at pos is %q", tok, s)
+		}
+	}
+}
+
 func equal(a, b []token) bool {
 	if len(a) != len(b) {
 		return false
@@ -0,0 +1,55 @@
+package ast
+
+// lookupFunc returns the function v refers to, or nil if there is none.
+func (m *Module) lookupFunc(v *Variable) *Func {
+	if v.Name != "" {
+		for _, fn := range m.Funcs {
+			if fn.Name == v.Name {
+				return fn
+			}
+		}
+		return nil
+	}
+	if v.Index < 0 || v.Index >= len(m.Funcs) {
+		return nil
+	}
+	return m.Funcs[v.Index]
+}
+
+// lookupType returns the type definition v refers to, or nil if there is none.
+func (m *Module) lookupType(v *Variable) *TypeDef {
+	if v.Name != "" {
+		for _, def := range m.Types {
+			if def.Name == v.Name {
+				return def
+			}
+		}
+		return nil
+	}
+	if v.Index < 0 || v.Index >= len(m.Types) {
+		return nil
+	}
+	return m.Types[v.Index]
+}
+
+// Signature returns sig with its type use, if any, resolved,
+// or nil if it refers to an undefined or cyclic type.
+func (m *Module) Signature(sig *FuncSig) *FuncSig {
+	for n := 0; sig != nil && sig.Type != nil; n++ {
+		def := m.lookupType(sig.Type.Var)
+		if def == nil || n == len(m.Types) {
+			return nil
+		}
+		sig = def.Func
+	}
+	return sig
+}
+
+// ParamTypes returns the types of the parameters of sig, in order.
+func (sig *FuncSig) ParamTypes() []tokenType {
+	var types []tokenType
+	for _, p := range sig.Params {
+		types = append(types, p.Types...)
+	}
+	return types
+}
@@ -1,9 +1,16 @@
 package ast
 
 type Module struct {
-	Name  string
-	Types []*TypeDef
-	Funcs []*Func
+	Name     string
+	Types    []*TypeDef
+	Funcs    []*Func   // imported functions first
+	Tables   []*Table  // imported tables first
+	Memories []*Memory // imported memories first
+	Globals  []*Global // imported globals first
+	Exports  []*Export
+	Start    *Variable // function called on instantiation (may be nil)
+	Elems    []*Elem
+	Data     []*Data
 }
 
 type TypeDef struct {
@@ -15,13 +22,208 @@ type Func struct {
 	Name      string
 	Signature *FuncSig
 	Locals    []*Local
+	Body      []Instr
 
 	Export *EmbeddedExport
 	// or
 	Import *EmbeddedImport
 }
 
+// Instr is an instruction: one of *Instruction, *Block, *Loop or *If.
+type Instr interface {
+	isInstr()
+}
+
+func (*Instruction) isInstr() {}
+func (*Block) isInstr()       {}
+func (*Loop) isInstr()        {}
+func (*If) isInstr()          {}
+
+// Instruction is a plain instruction, such as i32.add or get_local $x,
+// possibly folded together with the instructions computing its operands:
+// 	( i32.add ( get_local $x ) ( i32.const 1 ) )
 type Instruction struct {
+	Op   tokenType // e.g. ADD, GET_LOCAL, CONST
+	Type tokenType // value type or shape (may be zero), e.g. I32 in i32.add, FUNCREF in ref.null func
+	Sign tokenType // of S, U (may be zero), e.g. S in i32.div_s
+	From tokenType // type or shape of the operand (may be zero), e.g. F32 in i32.trunc_s/f32
+
+	Var   *Variable   // immediate of call, get_local, br, etc. (may be nil)
+	Table []*Variable // labels of br_table, whose default label is Var
+	Sig   *FuncSig    // expected signature of call_indirect
+	Value uint64      // immediate of const, as the bits of a value of type Type
+
+	// Immediate of v128.const, and the lane indices of i8x16.shuffle, one
+	// per byte, as the low and high 64 bits of a vector, whose lanes are
+	// in little-endian order.
+	Vector [2]uint64
+
+	// Lane index of extract_lane, replace_lane, and of the vector loads and
+	// stores of a single lane, e.g. 3 in i8x16.extract_lane_s 3.
+	Lane int
+
+	// Table of call_indirect and of the table instructions, or the
+	// destination of table.copy, whose source is Var. If nil, it is the
+	// table 0.
+	TableVar *Variable
+
+	// Memory access of load and store, e.g. i64.load32_u offset=8 align=4.
+	// Width is also the width of the sign-extension operators, as in
+	// i64.extend16_s, and of the lanes read by the extending vector loads,
+	// as 8 in v128.load8x8_s, which access 64 bits, and zero for the other
+	// instructions.
+	Width  int    // in bits, 32 in the example; the size of Type unless given
+	Offset uint32 // 8 in the example
+	Align  uint32 // in bytes, 4 in the example; the size of the access unless given
+
+	// Operator of an atomic read-modify-write: one of ADD, AND, CMPXCHG,
+	// OR, SUB, XCHG and XOR, e.g. ADD in i32.atomic.rmw8.add_u.
+	RMW tokenType
+
+	Operands []Instr // folded operands, in evaluation order (may be empty)
+
+	Line int // in the input, starting at 1 (zero if unknown)
+}
+
+// Block is a block:
+// 	block <name>? <block_type> <instr>* end <name>?
+// 	( block <name>? <block_type> <instr>* )
+// 	block_type: ( type <var> ) | <result>*
+type Block struct {
+	Label string   // may be zero
+	Type  *FuncSig // without params
+	Body  []Instr
+
+	Line int // in the input, starting at 1 (zero if unknown)
+}
+
+// Loop is a loop, whose label refers to its beginning:
+// 	loop <name>? <block_type> <instr>* end <name>?
+// 	( loop <name>? <block_type> <instr>* )
+type Loop struct {
+	Label string   // may be zero
+	Type  *FuncSig // without params
+	Body  []Instr
+
+	Line int // in the input, starting at 1 (zero if unknown)
+}
+
+// If is a conditional:
+// 	if <name>? <block_type> <instr>* end <name>?
+// 	if <name>? <block_type> <instr>* else <name>? <instr>* end <name>?
+// 	( if <name>? <block_type> <instr>* ( then <instr>* ) ( else <instr>* )? )
+type If struct {
+	Label string   // may be zero
+	Type  *FuncSig // without params
+	Cond  []Instr  // folded condition (may be empty)
+	Then  []Instr
+	Else  []Instr
+
+	Line int // in the input, starting at 1 (zero if unknown)
+}
+
+// Table is a table of references:
+// 	( table <name>? <limits> <elem_type> )
+// 	( table <name>? ( export <string> ) <limits> <elem_type> )
+// 	( table <name>? ( import <string> <string> ) <limits> <elem_type> )
+type Table struct {
+	Name     string // may be zero
+	Limits   *Limits
+	ElemType tokenType // ANYFUNC, FUNCREF or EXTERNREF
+
+	Export *EmbeddedExport
+	// or
+	Import *EmbeddedImport
+}
+
+// Memory is a linear memory, whose size is counted in pages of 64KiB:
+// 	( memory <name>? <limits> shared? )
+// 	( memory <name>? ( export <string> ) <limits> shared? )
+// 	( memory <name>? ( import <string> <string> ) <limits> shared? )
+type Memory struct {
+	Name   string // may be zero
+	Limits *Limits
+	Shared bool // accessible by several threads, with the threads feature
+
+	Export *EmbeddedExport
+	// or
+	Import *EmbeddedImport
+}
+
+// RefType returns the type of the elements of t: FUNCREF, also written
+// ANYFUNC, or EXTERNREF.
+func (t *Table) RefType() TokenType {
+	if t.ElemType == ANYFUNC {
+		return FUNCREF
+	}
+	return t.ElemType
+}
+
+// PageSize is the size of a page of memory, in bytes.
+const PageSize = 65536
+
+// Global is a global variable:
+// 	( global <name>? <global_type> <instr>* )
+// 	( global <name>? ( export <string> ) <global_type> <instr>* )
+// 	( global <name>? ( import <string> <string> ) <global_type> )
+// 	global_type: <value_type> | ( mut <value_type> )
+type Global struct {
+	Name    string    // may be zero
+	Type    tokenType // a value type
+	Mutable bool
+	Init    []Instr // constant expression (empty if imported)
+
+	Export *EmbeddedExport
+	// or
+	Import *EmbeddedImport
+}
+
+// Limits is the size range of a table or memory:
+// 	<nat> <nat>?
+type Limits struct {
+	Min    uint32
+	Max    uint32 // if HasMax
+	HasMax bool
+}
+
+// Export is an export:
+// 	( export <string> ( func <var> ) )
+// 	( export <string> ( table <var> ) )
+// 	( export <string> ( memory <var> ) )
+// 	( export <string> ( global <var> ) )
+type Export struct {
+	Name string
+	Kind tokenType // of FUNC, TABLE, MEMORY, GLOBAL
+	Var  *Variable
+}
+
+// Elem is an element segment, initializing a range of a table
+// with functions, or a passive one, copied into tables by table.init,
+// or a declarative one, declaring the functions referenced by ref.func:
+// 	( elem <var>? ( offset <instr>* ) <var>* )
+// 	( elem <var>? <expr> <var>* )
+// 	( elem <name>? func <var>* )
+// 	( elem <name>? declare func <var>* )
+type Elem struct {
+	Passive bool
+	Declare bool
+	Name    string    // of a passive or declarative segment (may be zero)
+	Table   *Variable // nil if passive or declarative
+	Offset  []Instr   // constant expression (nil if passive or declarative)
+	Funcs   []*Variable
+}
+
+// Data is a data segment, initializing a range of a memory with bytes,
+// or a passive one, copied into memories by memory.init:
+// 	( data <var>? ( offset <instr>* ) <string>* )
+// 	( data <var>? <expr> <string>* )
+// 	( data <name>? <string>* )
+type Data struct {
+	Passive bool
+	Name    string    // of a passive segment (may be zero)
+	Memory  *Variable // nil if passive
+	Offset  []Instr   // constant expression (nil if passive)
+	Data    []byte    // the strings, concatenated
 }
 
 type EmbeddedExport struct {
@@ -35,14 +237,14 @@ type EmbeddedImport struct {
 
 type Local struct {
 	Name string    // may be zero
-	Type tokenType // of F32, F64, I32, I64
+	Type tokenType // a value type
 }
 
 type FuncSig struct {
 	Type *FuncSigType
 	// or
 	Params  []*Param    // may be empty
-	Results []tokenType // of F32, F64, I32, I64 (may be empty)
+	Results []tokenType // value types (may be empty)
 }
 
 type FuncSigType struct {
@@ -51,11 +253,15 @@ type FuncSigType struct {
 
 type Param struct {
 	Name  string      // may be zero if len(Types) != 1
-	Types []tokenType // of F32, F64, I32, I64
+	Types []tokenType // value types
 }
 
 type Variable struct {
 	// one of
 	Index int
 	Name  string
+	// Variables are resolved when parsed: the Index of a Name is set,
+	// and the Index of a label is the relative depth of its block.
+
+	pos int // byte offset in the input
 }
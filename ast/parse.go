@@ -3,20 +3,69 @@ package ast
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
+	"strings"
 )
 
+// Parse parses a module in the text format read from r.
+func Parse(r io.Reader) (m *Module, err error) {
+	tokens, err := newLexer(r).lex()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if t.typ == ERROR {
+			return nil, fmt.Errorf("offset %d: %s", t.pos, t.text)
+		}
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			perr, ok := e.(parseError)
+			if !ok {
+				panic(e)
+			}
+			err = perr
+		}
+	}()
+	return newParser(tokens).parse(), nil
+}
+
+// parseError is a syntax error, raised by the parser as a panic.
+type parseError struct {
+	pos int // byte offset in the input, -1 if unknown
+	msg string
+}
+
+func (e parseError) Error() string {
+	if e.pos < 0 {
+		return e.msg
+	}
+	return fmt.Sprintf("offset %d: %s", e.pos, e.msg)
+}
+
 type parser struct {
-	buf []token
-	pos int
+	buf     []token
+	pos     int
+	labels  []string // labels of the enclosing blocks, innermost last
+	defined bool     // whether a non-imported definition has been read
 }
 
 func newParser(tokens []token) *parser {
-	return &parser{buf: tokens}
+	p := &parser{buf: make([]token, 0, len(tokens))}
+	for _, t := range tokens {
+		if t.typ != COMMENT {
+			p.buf = append(p.buf, t)
+		}
+	}
+	return p
 }
 
 func (p *parser) parse() *Module {
-	return p.parseModule()
+	m := p.parseModule()
+	p.resolve(m)
+	return m
 }
 
 // parseModule parses a module:
@@ -27,17 +76,304 @@ func (p *parser) parseModule() *Module {
 	p.expect(MODULE)
 	p.maybeName(&m.Name)
 	for {
+		start := p.peek()
 		switch {
 		case p.match(LPAREN, TYPE):
 			m.Types = append(m.Types, p.parseTypeDef())
 		case p.match(LPAREN, FUNC):
-			m.Funcs = append(m.Funcs, p.parseFunc())
+			fn := p.parseFunc()
+			p.checkImportOrder(start, fn.Import != nil)
+			m.Funcs = append(m.Funcs, fn)
+		case p.match(LPAREN, TABLE):
+			t := p.parseTable(m)
+			p.checkImportOrder(start, t.Import != nil)
+			m.Tables = append(m.Tables, t)
+		case p.match(LPAREN, MEMORY):
+			mem := p.parseMemory(m)
+			p.checkImportOrder(start, mem.Import != nil)
+			m.Memories = append(m.Memories, mem)
+		case p.match(LPAREN, GLOBAL):
+			g := p.parseGlobal()
+			p.checkImportOrder(start, g.Import != nil)
+			m.Globals = append(m.Globals, g)
+		case p.match(LPAREN, IMPORT):
+			p.checkImportOrder(start, true)
+			p.parseImport(m)
+		case p.match(LPAREN, EXPORT):
+			m.Exports = append(m.Exports, p.parseExport())
+		case p.match(LPAREN, ELEM):
+			m.Elems = append(m.Elems, p.parseElem())
+		case p.match(LPAREN, DATA):
+			m.Data = append(m.Data, p.parseData())
+		case p.match(LPAREN, START):
+			if m.Start != nil {
+				p.errorAt(start, "multiple start sections")
+			}
+			m.Start = p.parseVariable()
+			p.expect(RPAREN)
 		case p.peek().typ == RPAREN:
+			p.expect(RPAREN)
 			return m
 		default:
-			panic(fmt.Sprintf("malformed module: %s", p.peek()))
+			p.errorf("malformed module: %s", p.peek())
+		}
+	}
+}
+
+// checkImportOrder checks that imports precede definitions,
+// start being the first token of the module field just read.
+func (p *parser) checkImportOrder(start token, isImport bool) {
+	switch {
+	case !isImport:
+		p.defined = true
+	case p.defined:
+		p.errorAt(start, "imports must occur before definitions")
+	}
+}
+
+// parseImport parses an import and adds the imported item to m:
+// 	( import <string> <string> ( func <name>? <func_sig> ) )
+// 	( import <string> <string> ( table <name>? <limits> <elem_type> ) )
+// 	( import <string> <string> ( memory <name>? <limits> ) )
+// 	( import <string> <string> ( global <name>? <global_type> ) )
+//
+// '(' 'import' has been read.
+func (p *parser) parseImport(m *Module) {
+	imp := &EmbeddedImport{Module: p.parseString(), Name: p.parseString()}
+	p.expect(LPAREN)
+	switch p.expect(FUNC, TABLE, MEMORY, GLOBAL).typ {
+	case FUNC:
+		fn := &Func{Import: imp}
+		p.maybeName(&fn.Name)
+		fn.Signature = p.parseFuncSig()
+		m.Funcs = append(m.Funcs, fn)
+	case TABLE:
+		t := &Table{Import: imp}
+		p.maybeName(&t.Name)
+		t.Limits = p.parseLimits()
+		t.ElemType = p.expectElemType().typ
+		m.Tables = append(m.Tables, t)
+	case MEMORY:
+		mem := &Memory{Import: imp}
+		p.maybeName(&mem.Name)
+		mem.Limits = p.parseLimits()
+		_, mem.Shared = p.accept(SHARED)
+		m.Memories = append(m.Memories, mem)
+	case GLOBAL:
+		g := &Global{Import: imp}
+		p.maybeName(&g.Name)
+		p.parseGlobalType(g)
+		m.Globals = append(m.Globals, g)
+	}
+	p.expect(RPAREN)
+	p.expect(RPAREN)
+}
+
+// parseExport parses an export.
+//
+// '(' 'export' has been read.
+func (p *parser) parseExport() *Export {
+	e := &Export{Name: p.parseString()}
+	p.expect(LPAREN)
+	e.Kind = p.expect(FUNC, TABLE, MEMORY, GLOBAL).typ
+	e.Var = p.parseVariable()
+	p.expect(RPAREN)
+	p.expect(RPAREN)
+	return e
+}
+
+// parseTable parses a table (including sugar):
+// 	( table <name>? ( export <string> )? <elem_type> ( elem <var>* ) ) ;; = (table <name>? N N <elem_type>) (elem (i32.const 0) <var>*)
+//
+// The element segment of the abbreviated form is added to m.
+//
+// '(' 'table' has been read.
+func (p *parser) parseTable(m *Module) *Table {
+	t := new(Table)
+	p.maybeName(&t.Name)
+	t.Export, t.Import = p.parseEmbedded()
+	if p.peek().typ.IsElemType() && t.Import == nil {
+		t.ElemType = p.expectElemType().typ
+		p.expect(LPAREN)
+		p.expect(ELEM)
+		elem := &Elem{
+			Table:  &Variable{Index: len(m.Tables)},
+			Offset: []Instr{&Instruction{Op: CONST, Type: I32}},
+			Funcs:  p.parseVariableList(),
+		}
+		p.expect(RPAREN)
+		p.expect(RPAREN)
+		n := uint32(len(elem.Funcs))
+		t.Limits = &Limits{Min: n, Max: n, HasMax: true}
+		m.Elems = append(m.Elems, elem)
+		return t
+	}
+	t.Limits = p.parseLimits()
+	t.ElemType = p.expectElemType().typ
+	p.expect(RPAREN)
+	return t
+}
+
+// parseEmbedded parses the optional inline export or import of a table or
+// memory:
+// 	( export <string> ) | ( import <string> <string> )
+func (p *parser) parseEmbedded() (*EmbeddedExport, *EmbeddedImport) {
+	switch {
+	case p.match(LPAREN, EXPORT):
+		exp := &EmbeddedExport{Name: p.parseString()}
+		p.expect(RPAREN)
+		return exp, nil
+	case p.match(LPAREN, IMPORT):
+		module := p.parseString()
+		name := p.parseString()
+		p.expect(RPAREN)
+		return nil, &EmbeddedImport{Module: module, Name: name}
+	}
+	return nil, nil
+}
+
+// parseMemory parses a memory (including sugar):
+// 	( memory <name>? ( export <string> )? ( data <string>* ) ) ;; = (memory <name>? N N) (data (i32.const 0) <string>*)
+//
+// The data segment of the abbreviated form is added to m; N is the number
+// of pages it spans.
+//
+// '(' 'memory' has been read.
+func (p *parser) parseMemory(m *Module) *Memory {
+	mem := new(Memory)
+	p.maybeName(&mem.Name)
+	mem.Export, mem.Import = p.parseEmbedded()
+	if mem.Import == nil && p.match(LPAREN, DATA) {
+		data := &Data{
+			Memory: &Variable{Index: len(m.Memories)},
+			Offset: []Instr{&Instruction{Op: CONST, Type: I32}},
+			Data:   p.parseStrings(),
+		}
+		p.expect(RPAREN)
+		p.expect(RPAREN)
+		n := uint32((len(data.Data) + PageSize - 1) / PageSize)
+		mem.Limits = &Limits{Min: n, Max: n, HasMax: true}
+		m.Data = append(m.Data, data)
+		return mem
+	}
+	mem.Limits = p.parseLimits()
+	_, mem.Shared = p.accept(SHARED)
+	p.expect(RPAREN)
+	return mem
+}
+
+// parseGlobal parses a global.
+//
+// '(' 'global' has been read.
+func (p *parser) parseGlobal() *Global {
+	g := new(Global)
+	p.maybeName(&g.Name)
+	g.Export, g.Import = p.parseEmbedded()
+	p.parseGlobalType(g)
+	if g.Import == nil {
+		g.Init = p.parseInstrList()
+	}
+	p.expect(RPAREN)
+	return g
+}
+
+// parseGlobalType parses the type of g:
+// 	<value_type> | ( mut <value_type> )
+func (p *parser) parseGlobalType(g *Global) {
+	if p.match(LPAREN, MUT) {
+		g.Type = p.exceptIsType().typ
+		g.Mutable = true
+		p.expect(RPAREN)
+		return
+	}
+	g.Type = p.exceptIsType().typ
+}
+
+// parseLimits parses limits:
+// 	<nat> <nat>?
+func (p *parser) parseLimits() *Limits {
+	l := &Limits{Min: p.parseNat32()}
+	if p.peek().typ == NUMBER {
+		l.Max, l.HasMax = p.parseNat32(), true
+	}
+	return l
+}
+
+// parseElem parses an element segment. It is passive if its functions
+// follow the func keyword, and declarative if they follow declare func,
+// in which case the name is its own instead of that of a table.
+//
+// '(' 'elem' has been read.
+func (p *parser) parseElem() *Elem {
+	elem := &Elem{Table: &Variable{}}
+	index := p.peek().typ == NUMBER
+	if p.peek().isVar() {
+		elem.Table = p.parseVariable()
+	}
+	if t, passive := p.accept(FUNC, DECLARE); passive {
+		if index {
+			p.errorAt(t, "expected offset expression, found %s", t)
 		}
+		if t.typ == DECLARE {
+			p.expect(FUNC)
+			elem.Declare = true
+		} else {
+			elem.Passive = true
+		}
+		elem.Name, elem.Table = elem.Table.Name, nil
+	} else {
+		elem.Offset = p.parseOffset()
 	}
+	elem.Funcs = p.parseVariableList()
+	p.expect(RPAREN)
+	return elem
+}
+
+// parseData parses a data segment. It is passive if it has no offset,
+// in which case the name is its own instead of that of a memory.
+//
+// '(' 'data' has been read.
+func (p *parser) parseData() *Data {
+	data := &Data{Memory: &Variable{}}
+	index := p.peek().typ == NUMBER
+	if p.peek().isVar() {
+		data.Memory = p.parseVariable()
+	}
+	if t := p.peek(); t.typ == STRING || t.typ == RPAREN {
+		if index {
+			p.errorAt(t, "expected offset expression, found %s", t)
+		}
+		data.Passive, data.Name, data.Memory = true, data.Memory.Name, nil
+	} else {
+		data.Offset = p.parseOffset()
+	}
+	data.Data = p.parseStrings()
+	p.expect(RPAREN)
+	return data
+}
+
+// parseStrings parses a possibly empty sequence of strings and returns
+// them concatenated.
+func (p *parser) parseStrings() []byte {
+	var b []byte
+	for p.peek().typ == STRING {
+		b = append(b, p.parseString()...)
+	}
+	return b
+}
+
+// parseOffset parses the offset of a segment:
+// 	( offset <instr>* ) | <expr>
+func (p *parser) parseOffset() []Instr {
+	if p.match(LPAREN, OFFSET) {
+		offset := p.parseInstrList()
+		p.expect(RPAREN)
+		return offset
+	}
+	if p.peek().typ != LPAREN {
+		p.errorf("expected offset expression, found %s", p.peek())
+	}
+	return []Instr{p.parseInstruction()}
 }
 
 // parseTypeDef parses a typedef:
@@ -50,6 +386,8 @@ func (p *parser) parseTypeDef() *TypeDef {
 	p.expect(LPAREN)
 	p.expect(FUNC)
 	def.Func = p.parseFuncSig()
+	p.expect(RPAREN)
+	p.expect(RPAREN)
 	return def
 }
 
@@ -64,27 +402,636 @@ func (p *parser) parseFunc() *Func {
 	p.maybeName(&fn.Name)
 	switch {
 	case p.match(LPAREN, EXPORT):
-		name, _ := strconv.Unquote(string(p.expect(STRING).text))
-		fn.Export = &EmbeddedExport{Name: name}
+		fn.Export = &EmbeddedExport{Name: p.parseString()}
 		p.expect(RPAREN)
 	case p.match(LPAREN, IMPORT):
-		module, _ := strconv.Unquote(string(p.expect(STRING).text))
-		name, _ := strconv.Unquote(string(p.expect(STRING).text))
+		module := p.parseString()
+		name := p.parseString()
 		fn.Import = &EmbeddedImport{Module: module, Name: name}
 		p.expect(RPAREN)
 	}
 	fn.Signature = p.parseFuncSig()
 	if fn.Import != nil {
+		p.expect(RPAREN)
 		return fn
 	}
 	fn.Locals = p.parseLocalList()
+	p.labels = []string{""} // the function body is the outermost block
+	fn.Body = p.parseInstrList()
+	p.labels = nil
 	p.expect(RPAREN)
 	return fn
 }
 
-// parseInstruction parses an instr.
-func (p *parser) parseInstruction() *Instruction {
-	return nil
+// parseInstrList parses instructions up to the closing parenthesis of the
+// enclosing form, or up to the else or end of the enclosing block.
+func (p *parser) parseInstrList() []Instr {
+	var instrs []Instr
+	for {
+		switch p.peek().typ {
+		case RPAREN, ELSE, END, ERROR:
+			return instrs
+		}
+		instrs = append(instrs, p.parseInstruction())
+	}
+}
+
+// parseInstruction parses an instr:
+// 	<plaininstr> | <blockinstr> | ( <plaininstr> <instr>* ) | ( <blockinstr> )
+func (p *parser) parseInstruction() Instr {
+	if _, folded := p.accept(LPAREN); !folded {
+		switch {
+		case p.match(BLOCK):
+			return p.parseBlock(false)
+		case p.match(LOOP):
+			return p.parseLoop(false)
+		case p.match(IF):
+			return p.parseIf(false)
+		}
+		return p.parsePlainInstr()
+	}
+	var in Instr
+	switch {
+	case p.match(BLOCK):
+		in = p.parseBlock(true)
+	case p.match(LOOP):
+		in = p.parseLoop(true)
+	case p.match(IF):
+		in = p.parseIf(true)
+	default:
+		plain := p.parsePlainInstr()
+		for p.peek().typ == LPAREN {
+			plain.Operands = append(plain.Operands, p.parseInstruction())
+		}
+		in = plain
+	}
+	p.expect(RPAREN)
+	return in
+}
+
+// parseBlock parses a block, folded or not, except for the closing
+// parenthesis of the folded form.
+//
+// 'block' has been read.
+func (p *parser) parseBlock(folded bool) *Block {
+	b := &Block{Line: p.prev().line}
+	p.maybeName(&b.Label)
+	b.Type = p.parseBlockType()
+	p.pushLabel(b.Label)
+	b.Body = p.parseInstrList()
+	p.popLabel()
+	if !folded {
+		p.parseEnd(b.Label)
+	}
+	return b
+}
+
+// parseLoop parses a loop, folded or not, except for the closing
+// parenthesis of the folded form.
+//
+// 'loop' has been read.
+func (p *parser) parseLoop(folded bool) *Loop {
+	l := &Loop{Line: p.prev().line}
+	p.maybeName(&l.Label)
+	l.Type = p.parseBlockType()
+	p.pushLabel(l.Label)
+	l.Body = p.parseInstrList()
+	p.popLabel()
+	if !folded {
+		p.parseEnd(l.Label)
+	}
+	return l
+}
+
+// parseIf parses an if, folded or not, except for the closing
+// parenthesis of the folded form.
+//
+// 'if' has been read.
+func (p *parser) parseIf(folded bool) *If {
+	in := &If{Line: p.prev().line}
+	p.maybeName(&in.Label)
+	in.Type = p.parseBlockType()
+	if folded {
+		for !p.match(LPAREN, THEN) {
+			if p.peek().typ != LPAREN {
+				p.errorf("expected then clause, found %s", p.peek())
+			}
+			in.Cond = append(in.Cond, p.parseInstruction())
+		}
+		p.pushLabel(in.Label)
+		in.Then = p.parseInstrList()
+		p.expect(RPAREN)
+		if p.match(LPAREN, ELSE) {
+			in.Else = p.parseInstrList()
+			if in.Else == nil {
+				in.Else = []Instr{}
+			}
+			p.expect(RPAREN)
+		}
+		p.popLabel()
+		return in
+	}
+	p.pushLabel(in.Label)
+	in.Then = p.parseInstrList()
+	if _, hasElse := p.accept(ELSE); hasElse {
+		p.maybeEndName(in.Label)
+		in.Else = p.parseInstrList()
+		if in.Else == nil {
+			in.Else = []Instr{}
+		}
+	}
+	p.popLabel()
+	p.parseEnd(in.Label)
+	return in
+}
+
+// parseBlockType parses a block_type:
+// 	( type <var> ) | <param>* <result>*
+// The params of a block are unnamed.
+func (p *parser) parseBlockType() *FuncSig {
+	if p.match(LPAREN, TYPE) {
+		v := p.parseVariable()
+		p.expect(RPAREN)
+		return &FuncSig{Type: &FuncSigType{Var: v}}
+	}
+	sig := new(FuncSig)
+	for p.match(LPAREN, PARAM) {
+		if t := p.peek(); t.typ == NAME {
+			p.errorAt(t, "unexpected name of block parameter: %s", t.text)
+		}
+		sig.Params = append(sig.Params, p.parseParam())
+	}
+	sig.Results = p.parseResultList()
+	return sig
+}
+
+// parseEnd parses the end of a block whose label is label:
+// 	end <name>?
+func (p *parser) parseEnd(label string) {
+	p.expect(END)
+	p.maybeEndName(label)
+}
+
+// maybeEndName parses the optional name following the else or end of a
+// block, which must repeat the label of the block.
+func (p *parser) maybeEndName(label string) {
+	if tok, isName := p.accept(NAME); isName && extractName(tok) != label {
+		p.errorAt(tok, "mismatching label %s, expected $%s", tok.text, label)
+	}
+}
+
+func (p *parser) pushLabel(label string) { p.labels = append(p.labels, label) }
+func (p *parser) popLabel()              { p.labels = p.labels[:len(p.labels)-1] }
+
+// parseLabel parses a label and resolves it to the relative depth
+// of the block it refers to.
+func (p *parser) parseLabel() *Variable {
+	t := p.peek()
+	v := p.parseVariable()
+	if v.Name == "" {
+		if v.Index >= len(p.labels) {
+			p.errorAt(t, "unknown label: %d", v.Index)
+		}
+		return v
+	}
+	for i := len(p.labels) - 1; i >= 0; i-- {
+		if p.labels[i] == v.Name {
+			v.Index = len(p.labels) - 1 - i
+			return v
+		}
+	}
+	p.errorAt(t, "unknown label: %s", t.text)
+	panic("unreachable")
+}
+
+// parsePlainInstr parses an instruction without its folded operands:
+// 	<op> <var>?
+// 	<type>.const <value>
+// 	<type>.<op>(_<sign>)?(/<type>)?
+// 	<type>.extend(8|16|32)_s
+// 	<type>.trunc_sat_<type>_<sign>
+// 	<type>.load((8|16|32)_<sign>)? <offset>? <align>?
+// 	<type>.store(8|16|32)? <offset>? <align>?
+// 	select ( result <type> )
+// 	call_indirect <var>? <func_sig>
+// 	memory.copy | memory.fill | memory.init <var> | data.drop <var>
+// 	table.copy ( <var> <var> )? | table.init <var>? <var> | elem.drop <var>
+// 	table.get <var>? | table.set <var>? | table.size <var>?
+// 	table.grow <var>? | table.fill <var>?
+// 	ref.null func | ref.null extern | ref.is_null | ref.func <var>
+// 	atomic.fence
+// 	<vector instruction>
+// 	<atomic memory instruction>
+func (p *parser) parsePlainInstr() *Instruction {
+	in := &Instruction{Line: p.peek().line}
+	if t, dotted := p.accept(MEMORY, TABLE, DATA, ELEM, REF, ATOMIC); dotted {
+		p.expect(DOT)
+		op := p.read()
+		if t.typ == MEMORY && op.typ == ATOMIC {
+			p.expect(DOT)
+			p.parseAtomicInstr(in)
+			return in
+		}
+		var ok bool
+		if in.Op, ok = dottedOps[[2]tokenType{t.typ, op.typ}]; !ok {
+			p.errorAt(op, "unexpected instruction: %s.%s", t.text, op.text)
+		}
+		switch in.Op {
+		case MEMORY_INIT, DATA_DROP, ELEM_DROP, REF_FUNC:
+			in.Var = p.parseVariable()
+		case TABLE_GET, TABLE_SET, TABLE_SIZE, TABLE_GROW, TABLE_FILL:
+			if p.peek().isVar() {
+				in.TableVar = p.parseVariable()
+			}
+		case TABLE_COPY:
+			if p.peek().isVar() {
+				in.TableVar = p.parseVariable()
+				in.Var = p.parseVariable()
+			}
+		case TABLE_INIT:
+			in.Var = p.parseVariable()
+			if p.peek().isVar() {
+				in.TableVar, in.Var = in.Var, p.parseVariable()
+			}
+		case REF_NULL:
+			if p.expect(FUNC, EXTERN).typ == FUNC {
+				in.Type = FUNCREF
+			} else {
+				in.Type = EXTERNREF
+			}
+		}
+		return in
+	}
+	if t, vec := p.accept(V128, F32X4, F64X2, I16X8, I32X4, I64X2, I8X16); vec {
+		in.Type = t.typ
+		p.expect(DOT)
+		p.parseVectorInstr(in)
+		return in
+	}
+	if t, isTyp := p.acceptIsType(); isTyp {
+		in.Type = t.typ
+		p.expect(DOT)
+		op := p.read()
+		in.Op = op.typ
+		switch {
+		case op.typ == CONST:
+			in.Value = p.parseValue(in.Type)
+			return in
+		case op.typ == LOAD || op.typ == STORE:
+			p.parseMemoryInstr(in)
+			return in
+		case op.typ == ATOMIC:
+			p.expect(DOT)
+			p.parseAtomicInstr(in)
+			return in
+		case op.typ.isArith() || op.typ.isCvtOp():
+			switch op.typ {
+			case EXTEND:
+				if t, hasWidth := p.accept(NUMBER); hasWidth {
+					in.Width, _ = strconv.Atoi(string(t.text))
+				}
+			case TRUNC_SAT:
+				p.expect(UNDERSCORE)
+				in.From = p.exceptIsType().typ
+			}
+			if _, signed := p.accept(UNDERSCORE); signed {
+				in.Sign = p.expect(S, U).typ
+			}
+			if in.From == 0 {
+				if _, cvt := p.accept(SLASH); cvt {
+					in.From = p.exceptIsType().typ
+				}
+			}
+			if _, _, ok := in.numericType(); !ok {
+				p.errorAt(op, "unknown operator: %s", in)
+			}
+			return in
+		default:
+			p.errorAt(op, "unexpected operator: %s", op)
+		}
+	}
+	op := p.read()
+	in.Op = op.typ
+	switch op.typ {
+	case UNREACHABLE, NOP, DROP, RETURN, CURRENT_MEMORY, GROW_MEMORY:
+	case SELECT:
+		if p.match(LPAREN, RESULT) {
+			in.Type = p.exceptIsType().typ
+			p.expect(RPAREN)
+		}
+	case CALL, RETURN_CALL, GET_LOCAL, SET_LOCAL, TEE_LOCAL, GET_GLOBAL, SET_GLOBAL:
+		in.Var = p.parseVariable()
+	case CALL_INDIRECT, RETURN_CALL_INDIRECT:
+		// A variable is that of the type, unless a signature follows it,
+		// as in call_indirect $table (type $t).
+		if p.peek().isVar() {
+			v := p.parseVariable()
+			if !p.peekFuncSig() {
+				in.Sig = &FuncSig{Type: &FuncSigType{Var: v}}
+				break
+			}
+			in.TableVar = v
+		}
+		in.Sig = p.parseFuncSig()
+	case BR, BR_IF:
+		in.Var = p.parseLabel()
+	case BR_TABLE:
+		in.Var = p.parseLabel()
+		for t := p.peek(); t.isVar(); t = p.peek() {
+			in.Table = append(in.Table, in.Var)
+			in.Var = p.parseLabel()
+		}
+	default:
+		p.errorAt(op, "unexpected instruction: %s", op)
+	}
+	return in
+}
+
+// parseMemoryInstr parses the rest of a load or store:
+// 	(8|16|32)?(_<sign>)? <offset>? <align>?
+// 	offset: offset=<nat>
+// 	align: align=<nat>
+//
+// '<type>' '.' 'load' or '<type>' '.' 'store' has been read.
+func (p *parser) parseMemoryInstr(in *Instruction) {
+	in.Width = typeSize(in.Type) * 8
+	if t, hasWidth := p.accept(NUMBER); hasWidth {
+		w, _ := strconv.Atoi(string(t.text))
+		if w != 8 && w != 16 && w != 32 || w >= in.Width || in.Type == F32 || in.Type == F64 {
+			p.errorAt(t, "invalid access width for %s: %d", keyword[in.Type], w)
+		}
+		in.Width = w
+		if in.Op == LOAD {
+			p.expect(UNDERSCORE)
+			in.Sign = p.expect(S, U).typ
+		}
+	}
+	in.Align = uint32(in.Width / 8)
+	if p.match(OFFSET, EQUAL) {
+		in.Offset = p.parseNat32()
+	}
+	if p.match(ALIGN, EQUAL) {
+		in.Align = p.parseNat32()
+	}
+}
+
+// parseAtomicInstr parses the rest of an atomic memory instruction:
+// 	<type>.atomic.load((8|16|32)_u)? <offset>? <align>?
+// 	<type>.atomic.store(8|16|32)? <offset>? <align>?
+// 	<type>.atomic.rmw(8|16|32)?.<op>(_u)? <offset>? <align>?
+// 	memory.atomic.notify <offset>? <align>?
+// 	memory.atomic.wait(32|64) <offset>? <align>?
+//
+// '<type>' '.' 'atomic' '.' or 'memory' '.' 'atomic' '.' has been read,
+// and in.Type is zero in the latter case.
+func (p *parser) parseAtomicInstr(in *Instruction) {
+	op := p.read()
+	switch {
+	case in.Type == 0 && op.typ == NOTIFY:
+		in.Op, in.Width = MEMORY_ATOMIC_NOTIFY, 32
+	case in.Type == 0 && op.typ == WAIT:
+		in.Op = MEMORY_ATOMIC_WAIT
+		t := p.expect(NUMBER)
+		if in.Width, _ = strconv.Atoi(string(t.text)); in.Width != 32 && in.Width != 64 {
+			p.errorAt(t, "unexpected operator: memory.atomic.wait%s", t.text)
+		}
+	case (in.Type == I32 || in.Type == I64) && (op.typ == LOAD || op.typ == STORE || op.typ == RMW):
+		switch op.typ {
+		case LOAD:
+			in.Op = ATOMIC_LOAD
+		case STORE:
+			in.Op = ATOMIC_STORE
+		case RMW:
+			in.Op = ATOMIC_RMW
+		}
+		in.Width = typeSize(in.Type) * 8
+		if t, hasWidth := p.accept(NUMBER); hasWidth {
+			w, _ := strconv.Atoi(string(t.text))
+			if w != 8 && w != 16 && w != 32 || w >= in.Width {
+				p.errorAt(t, "invalid access width for %s: %d", keyword[in.Type], w)
+			}
+			in.Width = w
+		}
+		if in.Op == ATOMIC_RMW {
+			p.expect(DOT)
+			in.RMW = p.expect(ADD, AND, CMPXCHG, OR, SUB, XCHG, XOR).typ
+		}
+		// The narrow loads and read-modify-writes zero-extend, as in
+		// i32.atomic.load8_u.
+		if in.Op != ATOMIC_STORE && in.Width < typeSize(in.Type)*8 {
+			p.expect(UNDERSCORE)
+			in.Sign = p.expect(U).typ
+		}
+	default:
+		p.errorAt(op, "unexpected operator: %s", op)
+	}
+	in.Align = uint32(in.Width / 8)
+	if p.match(OFFSET, EQUAL) {
+		in.Offset = p.parseNat32()
+	}
+	if p.match(ALIGN, EQUAL) {
+		in.Align = p.parseNat32()
+	}
+}
+
+// parseVectorInstr parses the rest of a vector instruction:
+// 	v128.const <shape> <value>+
+// 	v128.load((8x8|16x4|32x2)_<sign>|(8|16|32|64)_splat|(32|64)_zero)? <offset>? <align>?
+// 	v128.store <offset>? <align>?
+// 	v128.(load|store)(8|16|32|64)_lane <offset>? <align>? <lane>
+// 	<shape>.extract_lane(_<sign>)? <lane> | <shape>.replace_lane <lane>
+// 	i8x16.shuffle <lane>{16}
+// 	(<shape>|v128).<op>(_<shape>)?(_<sign>)?(_zero)?
+//
+// '<shape>' '.' or 'v128' '.' has been read.
+func (p *parser) parseVectorInstr(in *Instruction) {
+	op := p.read()
+	in.Op = op.typ
+	switch {
+	case op.typ == CONST && in.Type == V128:
+		shape := p.expect(F32X4, F64X2, I16X8, I32X4, I64X2, I8X16)
+		in.Vector = p.parseVector(shape.typ)
+		return
+	case (op.typ == LOAD || op.typ == STORE) && in.Type == V128:
+		p.parseVectorMemoryInstr(in)
+		return
+	case !op.typ.IsOperator():
+		p.errorAt(op, "unexpected operator: %s", op)
+	}
+	zero := false
+	for _, ok := p.accept(UNDERSCORE); ok; _, ok = p.accept(UNDERSCORE) {
+		switch t := p.expect(S, U, ZERO, F32X4, F64X2, I16X8, I32X4, I64X2, I8X16); t.typ {
+		case S, U:
+			in.Sign = t.typ
+		case ZERO:
+			zero = true
+		default:
+			in.From = t.typ
+		}
+	}
+	switch in.Op {
+	case EXTRACT_LANE, REPLACE_LANE:
+		in.Lane = p.parseLaneIndex()
+	case SHUFFLE:
+		for i := uint(0); i < 128; i += 8 {
+			in.Vector[i/64] |= uint64(p.parseLaneIndex()) << (i % 64)
+		}
+	}
+	_, _, ok := in.VectorType()
+	if !ok || zero != in.hasZeroSuffix() {
+		p.errorAt(op, "unknown operator: %s", in)
+	}
+}
+
+// parseVectorMemoryInstr parses the rest of a vector load or store:
+// 	((8x8|16x4|32x2)_<sign>|(8|16|32|64)_(splat|zero|lane))? <offset>? <align>? <lane>?
+//
+// 'v128' '.' 'load' or 'v128' '.' 'store' has been read.
+func (p *parser) parseVectorMemoryInstr(in *Instruction) {
+	in.Width = 128
+	if t, hasWidth := p.accept(NUMBER); hasWidth {
+		var w, lanes int
+		if n, _ := fmt.Sscanf(string(t.text), "%dx%d", &w, &lanes); n == 2 {
+			if in.Op != LOAD || lanes*w != 64 {
+				p.errorAt(t, "invalid access width for v128: %s", t.text)
+			}
+			p.expect(UNDERSCORE)
+			in.Sign = p.expect(S, U).typ
+		} else {
+			p.expect(UNDERSCORE)
+			switch mod := p.expect(SPLAT, ZERO, LANE); {
+			case mod.typ == LANE && in.Op == LOAD:
+				in.Op = LOAD_LANE
+			case mod.typ == LANE:
+				in.Op = STORE_LANE
+			case mod.typ == SPLAT && in.Op == LOAD:
+				in.Op = LOAD_SPLAT
+			case mod.typ == ZERO && in.Op == LOAD:
+				in.Op = LOAD_ZERO
+			default:
+				p.errorAt(mod, "unexpected operator: v128.store%s_%s", t.text, mod.text)
+			}
+		}
+		in.Width = w
+	}
+	in.Align = uint32(in.accessWidth() / 8)
+	if p.match(OFFSET, EQUAL) {
+		in.Offset = p.parseNat32()
+	}
+	if p.match(ALIGN, EQUAL) {
+		in.Align = p.parseNat32()
+	}
+	if in.Op == LOAD_LANE || in.Op == STORE_LANE {
+		in.Lane = p.parseLaneIndex()
+	}
+	if _, _, ok := in.VectorType(); !ok {
+		p.errorf("unknown operator: %s", in)
+	}
+}
+
+// parseVector parses the lanes of a vector of the given shape and returns
+// its low and high 64 bits.
+func (p *parser) parseVector(shape tokenType) (v [2]uint64) {
+	n := shape.Lanes()
+	w := uint(128 / n)
+	for i := uint(0); i < uint(n); i++ {
+		var bits uint64
+		switch shape {
+		case I8X16, I16X8:
+			t := p.expect(NUMBER)
+			var err error
+			if bits, err = parseInt(strings.Replace(string(t.text), "_", "", -1), int(w)); err != nil {
+				p.errorAt(t, "invalid i%d literal: %s", w, t.text)
+			}
+		case I32X4:
+			bits = p.parseValue(I32)
+		case I64X2:
+			bits = p.parseValue(I64)
+		default:
+			bits = p.parseValue(shape.LaneType())
+		}
+		v[i*w/64] |= bits << (i * w % 64)
+	}
+	return v
+}
+
+// parseLaneIndex parses the index of a lane of a vector.
+func (p *parser) parseLaneIndex() int {
+	t := p.expect(NUMBER)
+	n, err := strconv.ParseUint(string(t.text), 10, 8)
+	if err != nil {
+		p.errorAt(t, "invalid lane index: %s", t.text)
+	}
+	return int(n)
+}
+
+// parseNat32 parses an unsigned 32-bit integer.
+func (p *parser) parseNat32() uint32 {
+	t := p.expect(NUMBER)
+	n, err := strconv.ParseUint(strings.Replace(string(t.text), "_", "", -1), 0, 32)
+	if err != nil {
+		p.errorAt(t, "invalid unsigned 32-bit integer: %s", t.text)
+	}
+	return uint32(n)
+}
+
+// typeSize returns the size in bytes of a value of type typ.
+func typeSize(typ tokenType) int {
+	switch typ {
+	case I32, F32:
+		return 4
+	case V128:
+		return 16
+	default:
+		return 8
+	}
+}
+
+// parseValue parses a literal of type typ and returns its bits.
+func (p *parser) parseValue(typ tokenType) uint64 {
+	t := p.expect(NUMBER)
+	s := strings.Replace(string(t.text), "_", "", -1)
+	switch typ {
+	case I32, I64:
+		bits := 32
+		if typ == I64 {
+			bits = 64
+		}
+		v, err := parseInt(s, bits)
+		if err != nil {
+			p.errorAt(t, "invalid %s literal: %s", keyword[typ], t.text)
+		}
+		return v
+	default:
+		if (strings.Contains(s, "0x") || strings.Contains(s, "0X")) && !strings.ContainsAny(s, "pP") {
+			s += "p0" // hexadecimal mantissa without exponent
+		}
+		if typ == F32 {
+			f, err := strconv.ParseFloat(s, 32)
+			if err != nil {
+				p.errorAt(t, "invalid f32 literal: %s", t.text)
+			}
+			return uint64(math.Float32bits(float32(f)))
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			p.errorAt(t, "invalid f64 literal: %s", t.text)
+		}
+		return math.Float64bits(f)
+	}
+}
+
+// parseInt parses an integer literal of the given bit size, which may be
+// written as a signed or as an unsigned number, and returns its bits.
+func parseInt(s string, bits int) (uint64, error) {
+	if u, err := strconv.ParseUint(strings.TrimPrefix(s, "+"), 0, bits); err == nil {
+		return u, nil
+	}
+	n, err := strconv.ParseInt(s, 0, bits)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(n) & (1<<uint(bits) - 1), nil
 }
 
 // parseLocalList parses a list of locals.
@@ -93,12 +1040,13 @@ func (p *parser) parseLocalList() []*Local {
 	var locals []*Local
 	for p.match(LPAREN, LOCAL) {
 		if name, hasName := p.accept(NAME); hasName {
-			return []*Local{{
+			locals = append(locals, &Local{
 				Name: extractName(name),
 				Type: p.exceptIsType().typ,
-			}}
+			})
+			p.expect(RPAREN)
+			continue
 		}
-		var locals []*Local
 		for {
 			t, isTyp := p.acceptIsType()
 			if !isTyp {
@@ -106,6 +1054,7 @@ func (p *parser) parseLocalList() []*Local {
 			}
 			locals = append(locals, &Local{Type: t.typ})
 		}
+		p.expect(RPAREN)
 	}
 	return locals
 }
@@ -113,20 +1062,18 @@ func (p *parser) parseLocalList() []*Local {
 // parseFuncSig parses a func_sig:
 // 	( type <var> ) | <param>* <result>*
 // 	param: ( param <type>* ) | ( param <name> <type> )
-// 	result: ( result <type> )
+// 	result: ( result <type>* )
 func (p *parser) parseFuncSig() *FuncSig {
 	switch {
 	case p.match(LPAREN, TYPE):
 		v := p.parseVariable()
+		p.expect(RPAREN)
 		return &FuncSig{Type: &FuncSigType{Var: v}}
-	case p.match(LPAREN, PARAM), p.match(LPAREN, RESULT):
+	default:
 		sig := new(FuncSig)
-		p.unreadN(2)
 		sig.Params = p.parseParamList()
 		sig.Results = p.parseResultList()
 		return sig
-	default:
-		return new(FuncSig)
 	}
 }
 
@@ -141,14 +1088,16 @@ func (p *parser) parseParamList() []*Param {
 
 // parseParam parses a param.
 // 	( param <type>* ) | ( param <name> <type> )
+//
+// '(' 'param' has been read.
 func (p *parser) parseParam() *Param {
-	p.expect(LPAREN)
-	p.expect(PARAM)
 	if name, hasName := p.accept(NAME); hasName {
-		return &Param{
+		param := &Param{
 			Name:  extractName(name),
 			Types: []tokenType{p.exceptIsType().typ},
 		}
+		p.expect(RPAREN)
+		return param
 	}
 	param := new(Param)
 	for {
@@ -163,11 +1112,18 @@ func (p *parser) parseParam() *Param {
 }
 
 // parseResultList parses a list of results.
-// 	result: ( result <type> )
+// 	result: ( result <type>* )
 func (p *parser) parseResultList() []tokenType {
 	var res []tokenType
 	for p.match(LPAREN, RESULT) {
-		res = append(res, p.exceptIsType().typ)
+		for {
+			t, isTyp := p.acceptIsType()
+			if !isTyp {
+				break
+			}
+			res = append(res, t.typ)
+		}
+		p.expect(RPAREN)
 	}
 	return res
 }
@@ -175,9 +1131,58 @@ func (p *parser) parseResultList() []tokenType {
 func (p *parser) parseVariable() *Variable {
 	v := p.expect(NAME, NUMBER)
 	if v.typ == NAME {
-		return &Variable{Name: extractName(v)}
+		return &Variable{Name: extractName(v), pos: v.pos}
 	}
-	return &Variable{Index: extractInteger(v)}
+	return &Variable{Index: extractInteger(v), pos: v.pos}
+}
+
+// parseVariableList parses a possibly empty list of variables.
+func (p *parser) parseVariableList() []*Variable {
+	var vars []*Variable
+	for p.peek().isVar() {
+		vars = append(vars, p.parseVariable())
+	}
+	return vars
+}
+
+// parseString parses a string literal and returns its value.
+func (p *parser) parseString() string {
+	t := p.expect(STRING)
+	s, err := unquote(t.text)
+	if err != nil {
+		p.errorAt(t, "%v", err)
+	}
+	return s
+}
+
+// unquote interprets a string literal of the text format, whose escapes
+// are \n, \t, \\, \', \" and \hh for any byte hh.
+func unquote(text []byte) (string, error) {
+	s := text[1 : len(text)-1]
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			b = append(b, '\n')
+		case 't':
+			b = append(b, '\t')
+		case '\\', '\'', '"':
+			b = append(b, c)
+		default:
+			n, err := strconv.ParseUint(string(s[i:i+2]), 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("illegal escape in string literal: %s", s[i-1:i+2])
+			}
+			b = append(b, byte(n))
+			i++
+		}
+	}
+	return string(b), nil
 }
 
 func (p *parser) maybeName(field *string) {
@@ -199,7 +1204,7 @@ func extractInteger(tok token) int {
 	}
 	n, err := strconv.Atoi(string(tok.text))
 	if err != nil {
-		panic(err)
+		panic(parseError{tok.pos, err.Error()})
 	}
 	return n
 }
@@ -207,7 +1212,7 @@ func extractInteger(tok token) int {
 // read returns the next token.
 // On EOF, it returns the zero value.
 func (p *parser) read() (t token) {
-	if p.pos == len(p.buf) {
+	if p.pos >= len(p.buf) {
 		p.pos++
 		return token{}
 	}
@@ -219,10 +1224,15 @@ func (p *parser) read() (t token) {
 // peek returns the next token without advancing the reader.
 // On EOF, it returns the zero value.
 func (p *parser) peek() token {
-	if p.pos == len(p.buf) {
+	if p.pos >= len(p.buf) {
 		return token{}
 	}
-	return p.buf[p.pos+1]
+	return p.buf[p.pos]
+}
+
+// prev returns the last token read.
+func (p *parser) prev() token {
+	return p.buf[p.pos-1]
 }
 
 func (p *parser) unread() {
@@ -253,7 +1263,9 @@ func (p *parser) accept(v tokenType, alid ...tokenType) (t token, isValid bool)
 	return token{}, false
 }
 
-func (p *parser) acceptIsType() (token, bool) { return p.accept(F32, F64, I32, I64) }
+func (p *parser) acceptIsType() (token, bool) {
+	return p.accept(F32, F64, I32, I64, V128, FUNCREF, EXTERNREF)
+}
 
 func (p *parser) expect(v tokenType, alid ...tokenType) token {
 	valid := append([]tokenType{v}, alid...)
@@ -263,10 +1275,27 @@ func (p *parser) expect(v tokenType, alid ...tokenType) token {
 			return tok
 		}
 	}
-	panic(fmt.Sprintf("expected one of %s, found %s", valid, tok))
+	p.errorAt(tok, "expected one of %s, found %s", valid, tok)
+	panic("unreachable")
+}
+
+func (p *parser) exceptIsType() token {
+	return p.expect(F32, F64, I32, I64, V128, FUNCREF, EXTERNREF)
 }
 
-func (p *parser) exceptIsType() token { return p.expect(F32, F64, I32, I64) }
+func (p *parser) expectElemType() token { return p.expect(ANYFUNC, FUNCREF, EXTERNREF) }
+
+// peekFuncSig reports whether the next tokens begin a non-empty func_sig.
+func (p *parser) peekFuncSig() bool {
+	if p.pos+1 >= len(p.buf) || p.buf[p.pos].typ != LPAREN {
+		return false
+	}
+	switch p.buf[p.pos+1].typ {
+	case TYPE, PARAM, RESULT:
+		return true
+	}
+	return false
+}
 
 func (p *parser) match(h tokenType, t ...tokenType) bool {
 	tokens := append([]tokenType{h}, t...)
@@ -280,3 +1309,16 @@ func (p *parser) match(h tokenType, t ...tokenType) bool {
 	}
 	return true
 }
+
+// errorf reports a syntax error at the next token.
+func (p *parser) errorf(format string, args ...interface{}) {
+	p.errorAt(p.peek(), format, args...)
+}
+
+// errorAt reports a syntax error at tok.
+func (p *parser) errorAt(tok token, format string, args ...interface{}) {
+	if tok.isZero() {
+		panic(parseError{-1, "at EOF: " + fmt.Sprintf(format, args...)})
+	}
+	panic(parseError{tok.pos, fmt.Sprintf(format, args...)})
+}
@@ -18,3 +18,365 @@ func TestParser(t *testing.T) {
 	p := newParser(tokens)
 	p.parse()
 }
+
+var parsetests = []struct {
+	in, want string
+}{
+	{`(module)`, "(module\n)\n"},
+	{`(module $m
+		(type $t (func (param i32) (param i64 f32) (result f64)))
+		(func $imp (import "env" "f\00") (type $t))
+		(func $f (export "f") (param $x i32) (result i32)
+			(local $y i64) (local f32 f64)
+			;; comment
+			get_local $x
+			(i32.add (i32.const -1) (; comment ;) (i32.const 0xffffffff))
+			i64.const 0x7fffffffffffffff
+			f32.const 1.5 f64.const -0x1.8 f64.const 1e+10
+			i32.trunc_s/f32 i64.extend_u/i32 f32.demote/f64 f32.trunc i32.div_s
+			i64.extend32_s i64.trunc_sat_f64_u
+			(call $imp (get_local 0) (nop))
+			(i64.store32 offset=0x10 align=4 (i32.const 0) (i64.load16_u (i32.const 0)))
+			f32.load align=4 f64.load offset=1 align=2
+			return))`,
+		`(module $m
+  (type $t (func (param i32) (param i64 f32) (result f64)))
+  (func $imp (import "env" "f\00") (type $t))
+  (func $f (export "f") (param $x i32) (result i32)
+    (local $y i64)
+    (local f32)
+    (local f64)
+    get_local $x
+    (i32.add (i32.const -1) (i32.const -1))
+    i64.const 9223372036854775807
+    f32.const 1.5
+    f64.const -1.5
+    f64.const 1e+10
+    i32.trunc_s/f32
+    i64.extend_u/i32
+    f32.demote/f64
+    f32.trunc
+    i32.div_s
+    i64.extend32_s
+    i64.trunc_sat_f64_u
+    (call $imp (get_local 0) (nop))
+    (i64.store32 offset=16 (i32.const 0) (i64.load16_u (i32.const 0)))
+    f32.load
+    f64.load offset=1 align=2
+    return)
+)
+`},
+	{`(module (func (result i32)
+		block $exit (result i32)
+			loop $l
+				get_local 0
+				br_if $l
+				(br_if $exit (i32.const 1) (get_local 0))
+				if $i (get_local 0) else $i br 2 end $i
+			end
+			br_table 0 $exit 1 0
+		end $exit
+		(if (result i32) (get_local 0)
+			(then (i32.const 1))
+			(else (block (i32.const 2) (br 0))))
+		(if (then (br 1)) (else))
+		br 0))`,
+		`(module
+  (func (result i32)
+    (block $exit (result i32)
+      (loop $l
+        get_local 0
+        br_if $l
+        (br_if $exit (i32.const 1) (get_local 0))
+        (if $i
+          (then
+            get_local 0)
+          (else
+            br 2)))
+      br_table 0 $exit 1 0)
+    (if (result i32)
+      (get_local 0)
+      (then
+        i32.const 1)
+      (else
+        (block
+          i32.const 2
+          br 0)))
+    (if
+      (then
+        br 1)
+      (else))
+    br 0)
+)
+`},
+	{`(module
+		(type $sig (func (param i32) (result i32)))
+		(import "env" "f" (func $f (type $sig)))
+		(import "env" "tbl" (table $imported 1 anyfunc))
+		(func $g (type 0) (call_indirect (type $sig) (get_local 0) (i32.const 1)))
+		(table $t (export "t") anyfunc (elem $f $g))
+		(table 0 10 anyfunc)
+		(export "g" (func $g))
+		(export "tbl" (table $t))
+		(elem $t (offset (i32.const 1)) $g)
+		(elem (i32.const 0))
+		(func (call_indirect 0 (i32.const 0) (i32.const 0)) drop
+			(call_indirect (param i32) (i32.const 0) (i32.const 0))))`,
+		`(module
+  (type $sig (func (param i32) (result i32)))
+  (func $f (import "env" "f") (type $sig))
+  (table $imported (import "env" "tbl") 1 anyfunc)
+  (table $t (export "t") 2 2 anyfunc)
+  (table 0 10 anyfunc)
+  (func $g (type 0)
+    (call_indirect (type $sig) (get_local 0) (i32.const 1)))
+  (func
+    (call_indirect (type 0) (i32.const 0) (i32.const 0))
+    drop
+    (call_indirect (param i32) (i32.const 0) (i32.const 0)))
+  (export "g" (func $g))
+  (export "tbl" (table $t))
+  (elem 1 (i32.const 0) $f $g)
+  (elem $t (i32.const 1) $g)
+  (elem (i32.const 0))
+)
+`},
+	{`(module
+		(import "env" "mem" (memory $imported 1))
+		(memory $m (export "mem") (data "hello, " "world\n" "\00\ff"))
+		(export "m" (memory $m))
+		(data (i32.const 16) "\t\"\\")
+		(data $m (offset (i32.const 0)))
+		(data 1 (i32.const 1) "a" "b"))`,
+		`(module
+  (memory $imported (import "env" "mem") 1)
+  (memory $m (export "mem") 1 1)
+  (export "m" (memory $m))
+  (data 1 (i32.const 0) "hello, world\0a\00\ff")
+  (data (i32.const 16) "\09\"\\")
+  (data $m (i32.const 0))
+  (data 1 (i32.const 1) "ab")
+)
+`},
+	{`(module
+		(import "env" "base" (global $base i32))
+		(global $g (import "env" "g") (mut f64))
+		(global $sp (export "sp") (mut i32) (get_global $base))
+		(global i64 (i64.const -1))
+		(export "base" (global 0))
+		(func (set_global $sp (i32.add (get_global $sp) (get_global 0)))))`,
+		`(module
+  (global $base (import "env" "base") i32)
+  (global $g (import "env" "g") (mut f64))
+  (global $sp (export "sp") (mut i32) (get_global $base))
+  (global i64 (i64.const -1))
+  (func
+    (set_global $sp (i32.add (get_global $sp) (get_global 0))))
+  (export "base" (global 0))
+)
+`},
+	{`(module (func (param i64) (result i32 i64) (result f32)
+		(get_local 0)
+		(block (param i64) (result i64 i64) (i64.const 1))
+		(loop $l (param i64 i64) (result i64) (br_if $l (i64.const 0) (i64.const 0) (i32.const 0)) i64.add)
+		i32.wrap/i64 (i64.const 2) (f32.const 3)))`,
+		`(module
+  (func (param i64) (result i32) (result i64) (result f32)
+    get_local 0
+    (block (param i64) (result i64) (result i64)
+      i64.const 1)
+    (loop $l (param i64 i64) (result i64)
+      (br_if $l (i64.const 0) (i64.const 0) (i32.const 0))
+      i64.add)
+    i32.wrap/i64
+    i64.const 2
+    f32.const 3)
+)
+`},
+	{`(module (memory 1) (table 2 anyfunc) (func $f)
+		(elem $fs func $f 0) (elem func) (data $d "ab" "c") (data)
+		(func
+			(memory.copy (i32.const 0) (i32.const 1) (i32.const 2))
+			(memory.fill (i32.const 0) (i32.const 255) (i32.const 2))
+			(memory.init $d (i32.const 0) (i32.const 1) (i32.const 2)) data.drop 1
+			(table.init $fs (i32.const 0) (i32.const 0) (i32.const 2)) elem.drop $fs
+			(table.copy (i32.const 1) (i32.const 0) (i32.const 1))))`,
+		`(module
+  (table 2 anyfunc)
+  (memory 1)
+  (func $f)
+  (func
+    (memory.copy (i32.const 0) (i32.const 1) (i32.const 2))
+    (memory.fill (i32.const 0) (i32.const 255) (i32.const 2))
+    (memory.init $d (i32.const 0) (i32.const 1) (i32.const 2))
+    data.drop 1
+    (table.init $fs (i32.const 0) (i32.const 0) (i32.const 2))
+    elem.drop $fs
+    (table.copy (i32.const 1) (i32.const 0) (i32.const 1)))
+  (elem $fs func $f 0)
+  (elem func)
+  (data $d "abc")
+  (data)
+)
+`},
+	{`(module (table $t 2 funcref) (table $e 1 externref) (type $v (func))
+		(global $g (mut funcref) (ref.func $f)) (elem declare func $f)
+		(func $f (param externref) (result externref)
+			(table.set $e (i32.const 0) (get_local 0))
+			(drop (table.grow $e (ref.null extern) (i32.const 1)))
+			(table.fill $e (i32.const 0) (ref.null extern) (table.size $e))
+			(drop (ref.is_null (ref.func $f)))
+			(call_indirect $t (type $v) (i32.const 0))
+			(select (result externref) (get_local 0) (table.get $e (i32.const 0)) (i32.const 1))))`,
+		`(module
+  (type $v (func))
+  (table $t 2 funcref)
+  (table $e 1 externref)
+  (global $g (mut funcref) (ref.func $f))
+  (func $f (param externref) (result externref)
+    (table.set $e (i32.const 0) (get_local 0))
+    (drop (table.grow $e (ref.null extern) (i32.const 1)))
+    (table.fill $e (i32.const 0) (ref.null extern) (table.size $e))
+    (drop (ref.is_null (ref.func $f)))
+    (call_indirect $t (type $v) (i32.const 0))
+    (select (result externref) (get_local 0) (table.get $e (i32.const 0)) (i32.const 1)))
+  (elem declare func $f)
+)
+`},
+	{`(module (memory 1)
+		(func (param v128) (result v128)
+			(v128.store offset=16 (i32.const 0) (v128.const i8x16 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 -1))
+			(v128.store16_lane align=1 7 (i32.const 0) (v128.load8x8_u (i32.const 8)))
+			(drop (v128.load32_zero (i32.const 0)))
+			(drop (i8x16.extract_lane_s 15 (v128.load16_splat (i32.const 0))))
+			(drop (i32x4.trunc_sat_f64x2_u_zero (v128.const f64x2 1.5 -2)))
+			(drop (i16x8.extmul_high_i8x16_s (get_local 0) (v128.const i64x2 -1 0x0102030405060708)))
+			(i8x16.shuffle 0 1 2 3 4 5 6 7 16 17 18 19 20 21 22 31
+				(f32x4.replace_lane 3 (get_local 0) (f32.const 0.5)) (v128.const f32x4 1 2 3 -0))))`,
+		`(module
+  (memory 1)
+  (func (param v128) (result v128)
+    (v128.store offset=16 (i32.const 0) (v128.const i32x4 0x04030201 0x08070605 0x0c0b0a09 0xff0f0e0d))
+    (v128.store16_lane align=1 7 (i32.const 0) (v128.load8x8_u (i32.const 8)))
+    (drop (v128.load32_zero (i32.const 0)))
+    (drop (i8x16.extract_lane_s 15 (v128.load16_splat (i32.const 0))))
+    (drop (i32x4.trunc_sat_f64x2_u_zero (v128.const i32x4 0x00000000 0x3ff80000 0x00000000 0xc0000000)))
+    (drop (i16x8.extmul_high_i8x16_s (get_local 0) (v128.const i32x4 0xffffffff 0xffffffff 0x05060708 0x01020304)))
+    (i8x16.shuffle 0 1 2 3 4 5 6 7 16 17 18 19 20 21 22 31 (f32x4.replace_lane 3 (get_local 0) (f32.const 0.5)) (v128.const i32x4 0x3f800000 0x40000000 0x40400000 0x80000000)))
+)
+`},
+	{`(module (type $t (func (param i32) (result i32))) (table 1 funcref)
+		(func $f (type $t) (return_call $f (get_local 0)))
+		(func (param i32) (result i32) (return_call_indirect (type $t) (get_local 0) (i32.const 0))))`,
+		`(module
+  (type $t (func (param i32) (result i32)))
+  (table 1 funcref)
+  (func $f (type $t)
+    (return_call $f (get_local 0)))
+  (func (param i32) (result i32)
+    (return_call_indirect (type $t) (get_local 0) (i32.const 0)))
+)
+`},
+	{`(module (import "env" "m" (memory 1 2 shared))
+		(func (param i32) (result i64)
+			atomic.fence
+			(i64.atomic.store16 offset=2 (get_local 0) (i64.const 1))
+			(drop (i32.atomic.rmw8.cmpxchg_u (get_local 0) (i32.const 1) (i32.const 2)))
+			(drop (memory.atomic.notify (get_local 0) (i32.const 1)))
+			(drop (memory.atomic.wait32 align=2 (get_local 0) (i32.load8_u (i32.const 0)) (i64.const -1)))
+			(i64.add (i64.atomic.load32_u (get_local 0)) (i64.atomic.rmw.xor (get_local 0) (i64.const 3)))))`,
+		`(module
+  (memory (import "env" "m") 1 2 shared)
+  (func (param i32) (result i64)
+    atomic.fence
+    (i64.atomic.store16 offset=2 (get_local 0) (i64.const 1))
+    (drop (i32.atomic.rmw8.cmpxchg_u (get_local 0) (i32.const 1) (i32.const 2)))
+    (drop (memory.atomic.notify (get_local 0) (i32.const 1)))
+    (drop (memory.atomic.wait32 align=2 (get_local 0) (i32.load8_u (i32.const 0)) (i64.const -1)))
+    (i64.add (i64.atomic.load32_u (get_local 0)) (i64.atomic.rmw.xor (get_local 0) (i64.const 3))))
+)
+`},
+	{`(module (start $main) (func $main))`, `(module
+  (func $main)
+  (start $main)
+)
+`},
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range parsetests {
+		m, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		var b strings.Builder
+		if err := Fprint(&b, m); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.String(); got != tt.want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", tt.in, got, tt.want)
+		}
+	}
+}
+
+var parseerrortests = []struct {
+	in, want string
+}{
+	{`(module`, "at EOF: malformed module: ERROR()"},
+	{`(module (func i32.const 1.5))`, "offset 24: invalid i32 literal: 1.5"},
+	{`(module (func get_local))`, "offset 23: expected one of [NAME NUMBER], found RPAREN())"},
+	{`(module (func i32.foo))`, "offset 18: unexpected token: foo"},
+	{`(module (func i32.select))`, "offset 18: unexpected operator: SELECT(select)"},
+	{`(module (func block $a br $b end))`, "offset 26: unknown label: $b"},
+	{`(module (func (block (br 2))))`, "offset 25: unknown label: 2"},
+	{`(module (func block $a end $b))`, "offset 27: mismatching label $b, expected $a"},
+	{`(module (func i32.load8))`, "offset 23: expected one of [UNDERSCORE], found RPAREN())"},
+	{`(module (func i32.load32_s))`, "offset 22: invalid access width for i32: 32"},
+	{`(module (func f32.store8))`, "offset 23: invalid access width for f32: 8"},
+	{`(module (func i32.load offset=-1))`, "offset 30: invalid unsigned 32-bit integer: -1"},
+	{`(module (func call $f))`, "offset 19: unknown function $f"},
+	{`(module (func $f) (func $f))`, "duplicate function $f"},
+	{`(module (func (param $x i32) (local $x i32)))`, "duplicate local $x"},
+	{`(module (func get_local $x))`, "offset 24: unknown local $x"},
+	{`(module (elem $t (i32.const 0)))`, "offset 14: unknown table $t"},
+	{`(module (func) (import "a" "b" (func)))`, "offset 15: imports must occur before definitions"},
+	{`(module (table 0 anyfunc) (func (import "a" "b")))`, "offset 26: imports must occur before definitions"},
+	{`(module (elem 0 $f))`, "offset 16: expected offset expression, found NAME($f)"},
+	{`(module (func (block (param $x i32))))`, "offset 28: unexpected name of block parameter: $x"},
+	{`(module (func i32.div))`, "offset 18: unknown operator: i32.div"},
+	{`(module (func f32.div_s))`, "offset 18: unknown operator: f32.div_s"},
+	{`(module (func i64.extend_s/i64))`, "offset 18: unknown operator: i64.extend_s/i64"},
+	{`(module (func i32.extend32_s))`, "offset 18: unknown operator: i32.extend32_s"},
+	{`(module (func i64.extend8_u))`, "offset 18: unknown operator: i64.extend8_u"},
+	{`(module (func i64.extend8_s/i32))`, "offset 18: unknown operator: i64.extend8_s/i32"},
+	{`(module (func f32.trunc_sat_f64_s))`, "offset 18: unknown operator: f32.trunc_sat_f64_s"},
+	{`(module (func i32.trunc_sat_i64_s))`, "offset 18: unknown operator: i32.trunc_sat_i64_s"},
+	{`(module (func (if (nop))))`, "offset 23: expected then clause, found RPAREN())"},
+	{`(module (data $m (i32.const 0)))`, "offset 14: unknown memory $m"},
+	{`(module (data 0 "a"))`, "offset 16: expected offset expression, found STRING(\"a\")"},
+	{`(module (func data.drop $d))`, "offset 24: unknown data segment $d"},
+	{`(module (func i64x2.popcnt))`, "offset 20: unknown operator: i64x2.popcnt"},
+	{`(module (func v128.const i8x16 256))`, "offset 31: invalid i8 literal: 256"},
+	{`(module (func v128.store8_splat))`, "offset 26: unexpected operator: v128.store8_splat"},
+	{`(module (func i32.atomic.load8_s))`, "offset 31: expected one of [U], found S(s)"},
+	{`(module (func f32.atomic.load))`, "offset 25: unexpected operator: LOAD(load)"},
+	{`(module (func memory.atomic.wait16))`, "offset 32: unexpected operator: memory.atomic.wait16"},
+	{`(module (func memory.size))`, "offset 21: unexpected instruction: memory.size"},
+	{`(module (func get_global $g))`, "offset 25: unknown global $g"},
+	{`(module (start $f))`, "offset 15: unknown function $f"},
+	{`(module (func) (start 0) (start 0))`, "offset 25: multiple start sections"},
+	{`(module (global (mut i32 (i32.const 0))))`, "offset 25: expected one of [RPAREN], found LPAREN(()"},
+	{`(module (global i32) (import "a" "b" (global i32)))`, "offset 21: imports must occur before definitions"},
+	{`(module (memory 1) (import "a" "b" (memory 1)))`, "offset 19: imports must occur before definitions"},
+	{`(module (memory (data "\1")))`, "offset 22: illegal escape in string literal: U+005C '\\'"},
+}
+
+func TestParseError(t *testing.T) {
+	for _, tt := range parseerrortests {
+		_, err := Parse(strings.NewReader(tt.in))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got error %v, want %s", tt.in, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package ast
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Fprint writes m to w in the text format.
+// Folded instructions are written on one line each.
+func Fprint(w io.Writer, m *Module) error {
+	p := &printer{w: w}
+	p.printModule(m)
+	return p.err
+}
+
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) print(args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprint(p.w, args...)
+}
+
+func (p *printer) printModule(m *Module) {
+	p.print("(module")
+	if m.Name != "" {
+		p.print(" $", m.Name)
+	}
+	for _, def := range m.Types {
+		p.print("\n  (type")
+		if def.Name != "" {
+			p.print(" $", def.Name)
+		}
+		p.print(" (func")
+		p.printFuncSig(def.Func)
+		p.print("))")
+	}
+	// Imports must precede definitions.
+	for _, fn := range m.Funcs {
+		if fn.Import != nil {
+			p.printFunc(fn)
+		}
+	}
+	for _, t := range m.Tables {
+		if t.Import != nil {
+			p.printTable(t)
+		}
+	}
+	for _, mem := range m.Memories {
+		if mem.Import != nil {
+			p.printMemory(mem)
+		}
+	}
+	for _, g := range m.Globals {
+		if g.Import != nil {
+			p.printGlobal(g)
+		}
+	}
+	for _, t := range m.Tables {
+		if t.Import == nil {
+			p.printTable(t)
+		}
+	}
+	for _, mem := range m.Memories {
+		if mem.Import == nil {
+			p.printMemory(mem)
+		}
+	}
+	for _, g := range m.Globals {
+		if g.Import == nil {
+			p.printGlobal(g)
+		}
+	}
+	for _, fn := range m.Funcs {
+		if fn.Import == nil {
+			p.printFunc(fn)
+		}
+	}
+	for _, e := range m.Exports {
+		p.print("\n  (export ", quote(e.Name), " (", keyword[e.Kind], " ", e.Var, "))")
+	}
+	if m.Start != nil {
+		p.print("\n  (start ", m.Start, ")")
+	}
+	for _, elem := range m.Elems {
+		p.print("\n  (elem")
+		switch {
+		case elem.Passive || elem.Declare:
+			if elem.Name != "" {
+				p.print(" $", elem.Name)
+			}
+			if elem.Declare {
+				p.print(" declare")
+			}
+			p.print(" func")
+		default:
+			if elem.Table.Name != "" || elem.Table.Index != 0 {
+				p.print(" ", elem.Table)
+			}
+			p.printOffset(elem.Offset)
+		}
+		for _, f := range elem.Funcs {
+			p.print(" ", f)
+		}
+		p.print(")")
+	}
+	for _, data := range m.Data {
+		p.print("\n  (data")
+		switch {
+		case data.Passive && data.Name != "":
+			p.print(" $", data.Name)
+		case data.Passive:
+		default:
+			if data.Memory.Name != "" || data.Memory.Index != 0 {
+				p.print(" ", data.Memory)
+			}
+			p.printOffset(data.Offset)
+		}
+		if len(data.Data) > 0 {
+			p.print(" ", quote(string(data.Data)))
+		}
+		p.print(")")
+	}
+	p.print("\n)\n")
+}
+
+func (p *printer) printTable(t *Table) {
+	p.print("\n  (table")
+	if t.Name != "" {
+		p.print(" $", t.Name)
+	}
+	p.printEmbedded(t.Export, t.Import)
+	p.printLimits(t.Limits)
+	p.print(" ", keyword[t.ElemType], ")")
+}
+
+func (p *printer) printMemory(mem *Memory) {
+	p.print("\n  (memory")
+	if mem.Name != "" {
+		p.print(" $", mem.Name)
+	}
+	p.printEmbedded(mem.Export, mem.Import)
+	p.printLimits(mem.Limits)
+	if mem.Shared {
+		p.print(" shared")
+	}
+	p.print(")")
+}
+
+func (p *printer) printGlobal(g *Global) {
+	p.print("\n  (global")
+	if g.Name != "" {
+		p.print(" $", g.Name)
+	}
+	p.printEmbedded(g.Export, g.Import)
+	if g.Mutable {
+		p.print(" (mut ", keyword[g.Type], ")")
+	} else {
+		p.print(" ", keyword[g.Type])
+	}
+	for _, in := range g.Init {
+		p.print(" ")
+		p.printFolded(in, "    ")
+	}
+	p.print(")")
+}
+
+func (p *printer) printEmbedded(exp *EmbeddedExport, imp *EmbeddedImport) {
+	if exp != nil {
+		p.print(" (export ", quote(exp.Name), ")")
+	}
+	if imp != nil {
+		p.print(" (import ", quote(imp.Module), " ", quote(imp.Name), ")")
+	}
+}
+
+func (p *printer) printLimits(l *Limits) {
+	p.print(" ", l.Min)
+	if l.HasMax {
+		p.print(" ", l.Max)
+	}
+}
+
+// printOffset prints the offset expression of a segment.
+func (p *printer) printOffset(offset []Instr) {
+	if len(offset) == 1 {
+		p.print(" ")
+		p.printFolded(offset[0], "    ")
+		return
+	}
+	p.print(" (offset")
+	for _, in := range offset {
+		p.print(" ")
+		p.printFolded(in, "    ")
+	}
+	p.print(")")
+}
+
+func (p *printer) printFunc(fn *Func) {
+	p.print("\n  (func")
+	if fn.Name != "" {
+		p.print(" $", fn.Name)
+	}
+	p.printEmbedded(fn.Export, fn.Import)
+	p.printFuncSig(fn.Signature)
+	for _, l := range fn.Locals {
+		p.print("\n    (local")
+		if l.Name != "" {
+			p.print(" $", l.Name)
+		}
+		p.print(" ", keyword[l.Type], ")")
+	}
+	p.printInstrs(fn.Body, "    ")
+	p.print(")")
+}
+
+func (p *printer) printFuncSig(sig *FuncSig) {
+	if sig == nil {
+		return
+	}
+	if sig.Type != nil {
+		p.print(" (type ", sig.Type.Var, ")")
+		return
+	}
+	for _, param := range sig.Params {
+		p.print(" (param")
+		if param.Name != "" {
+			p.print(" $", param.Name)
+		}
+		for _, t := range param.Types {
+			p.print(" ", keyword[t])
+		}
+		p.print(")")
+	}
+	for _, t := range sig.Results {
+		p.print(" (result ", keyword[t], ")")
+	}
+}
+
+// printInstrs prints each instruction of body on its own line.
+func (p *printer) printInstrs(body []Instr, indent string) {
+	for _, in := range body {
+		p.print("\n", indent)
+		if in, ok := in.(*Instruction); ok && len(in.Operands) == 0 {
+			p.print(in)
+			continue
+		}
+		p.printFolded(in, indent)
+	}
+}
+
+// printFolded prints in in folded form. Blocks are printed over several
+// lines, the first of which is assumed to be indented by indent.
+func (p *printer) printFolded(in Instr, indent string) {
+	switch in := in.(type) {
+	case *Instruction:
+		p.print("(", in)
+		inline := isSimple(in)
+		for _, op := range in.Operands {
+			if inline {
+				p.print(" ")
+			} else {
+				p.print("\n", indent, "  ")
+			}
+			p.printFolded(op, indent+"  ")
+		}
+		p.print(")")
+	case *Block:
+		p.print("(block")
+		p.printLabel(in.Label)
+		p.printFuncSig(in.Type)
+		p.printInstrs(in.Body, indent+"  ")
+		p.print(")")
+	case *Loop:
+		p.print("(loop")
+		p.printLabel(in.Label)
+		p.printFuncSig(in.Type)
+		p.printInstrs(in.Body, indent+"  ")
+		p.print(")")
+	case *If:
+		p.print("(if")
+		p.printLabel(in.Label)
+		p.printFuncSig(in.Type)
+		for _, op := range in.Cond {
+			p.print("\n", indent, "  ")
+			p.printFolded(op, indent+"  ")
+		}
+		p.print("\n", indent, "  (then")
+		p.printInstrs(in.Then, indent+"    ")
+		p.print(")")
+		if in.Else != nil {
+			p.print("\n", indent, "  (else")
+			p.printInstrs(in.Else, indent+"    ")
+			p.print(")")
+		}
+		p.print(")")
+	}
+}
+
+func (p *printer) printLabel(label string) {
+	if label != "" {
+		p.print(" $", label)
+	}
+}
+
+// isSimple reports whether in and its operands are all plain instructions,
+// so that it can be printed on one line.
+func isSimple(in Instr) bool {
+	plain, ok := in.(*Instruction)
+	if !ok {
+		return false
+	}
+	for _, op := range plain.Operands {
+		if !isSimple(op) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the instruction in the text format, without its operands.
+func (in *Instruction) String() string {
+	var b strings.Builder
+	switch in.Op {
+	case REF_NULL:
+		if in.Type == FUNCREF {
+			return "ref.null func"
+		}
+		return "ref.null extern"
+	case SELECT:
+		if in.Type != 0 {
+			return "select (result " + keyword[in.Type] + ")"
+		}
+	}
+	if in.IsVector() {
+		return in.vectorString()
+	}
+	if in.Type != 0 {
+		b.WriteString(keyword[in.Type])
+		b.WriteByte('.')
+	}
+	b.WriteString(keyword[in.Op])
+	switch in.Op {
+	case ATOMIC_RMW:
+		// The width precedes the operator, as in i32.atomic.rmw8.add_u.
+		if in.Width != typeSize(in.Type)*8 {
+			b.WriteString(strconv.Itoa(in.Width))
+		}
+		b.WriteByte('.')
+		b.WriteString(keyword[in.RMW])
+	case MEMORY_ATOMIC_WAIT:
+		b.WriteString(strconv.Itoa(in.Width))
+	}
+	if in.Op == TRUNC_SAT {
+		// The operand type precedes the sign, as in i32.trunc_sat_f32_s.
+		b.WriteByte('_')
+		b.WriteString(keyword[in.From])
+		b.WriteByte('_')
+		b.WriteString(keyword[in.Sign])
+		return b.String()
+	}
+	if (in.Op == LOAD || in.Op == STORE || in.Op == ATOMIC_LOAD || in.Op == ATOMIC_STORE) &&
+		in.Width != typeSize(in.Type)*8 ||
+		in.Op == EXTEND && in.Width != 0 {
+		b.WriteString(strconv.Itoa(in.Width))
+	}
+	if in.Sign != 0 {
+		b.WriteByte('_')
+		b.WriteString(keyword[in.Sign])
+	}
+	if in.From != 0 {
+		b.WriteByte('/')
+		b.WriteString(keyword[in.From])
+	}
+	for _, v := range in.Table {
+		b.WriteByte(' ')
+		b.WriteString(v.String())
+	}
+	if in.TableVar != nil {
+		b.WriteByte(' ')
+		b.WriteString(in.TableVar.String())
+	}
+	if in.Var != nil {
+		b.WriteByte(' ')
+		b.WriteString(in.Var.String())
+	}
+	if in.Sig != nil {
+		var sig strings.Builder
+		(&printer{w: &sig}).printFuncSig(in.Sig)
+		b.WriteString(sig.String())
+	}
+	if in.Op == CONST {
+		b.WriteByte(' ')
+		b.WriteString(formatValue(in.Type, in.Value))
+	}
+	if in.Offset != 0 {
+		fmt.Fprintf(&b, " offset=%d", in.Offset)
+	}
+	if in.isMemoryAccess() && in.Align != uint32(in.Width/8) {
+		fmt.Fprintf(&b, " align=%d", in.Align)
+	}
+	return b.String()
+}
+
+// vectorString returns in, a vector instruction, in the text format.
+func (in *Instruction) vectorString() string {
+	var b strings.Builder
+	b.WriteString(keyword[in.Type])
+	b.WriteByte('.')
+	switch in.Op {
+	case CONST:
+		// The lanes are written as i32x4, which every vector has.
+		b.WriteString("const i32x4")
+		for i := uint(0); i < 128; i += 32 {
+			fmt.Fprintf(&b, " 0x%08x", uint32(in.Vector[i/64]>>(i%64)))
+		}
+		return b.String()
+	case LOAD, LOAD_LANE, LOAD_SPLAT, LOAD_ZERO, STORE, STORE_LANE:
+		if in.Op == STORE || in.Op == STORE_LANE {
+			b.WriteString("store")
+		} else {
+			b.WriteString("load")
+		}
+		switch in.Op {
+		case LOAD:
+			if in.Sign != 0 {
+				fmt.Fprintf(&b, "%dx%d_%s", in.Width, 64/in.Width, keyword[in.Sign])
+			}
+		case LOAD_SPLAT:
+			fmt.Fprintf(&b, "%d_splat", in.Width)
+		case LOAD_ZERO:
+			fmt.Fprintf(&b, "%d_zero", in.Width)
+		case LOAD_LANE, STORE_LANE:
+			fmt.Fprintf(&b, "%d_lane", in.Width)
+		}
+		if in.Offset != 0 {
+			fmt.Fprintf(&b, " offset=%d", in.Offset)
+		}
+		if in.Align != uint32(in.accessWidth()/8) {
+			fmt.Fprintf(&b, " align=%d", in.Align)
+		}
+		if in.Op == LOAD_LANE || in.Op == STORE_LANE {
+			fmt.Fprintf(&b, " %d", in.Lane)
+		}
+		return b.String()
+	}
+	b.WriteString(keyword[in.Op])
+	if in.From != 0 {
+		b.WriteByte('_')
+		b.WriteString(keyword[in.From])
+	}
+	if in.Sign != 0 {
+		b.WriteByte('_')
+		b.WriteString(keyword[in.Sign])
+	}
+	if in.hasZeroSuffix() {
+		b.WriteString("_zero")
+	}
+	switch in.Op {
+	case EXTRACT_LANE, REPLACE_LANE:
+		fmt.Fprintf(&b, " %d", in.Lane)
+	case SHUFFLE:
+		for i := uint(0); i < 128; i += 8 {
+			fmt.Fprintf(&b, " %d", uint8(in.Vector[i/64]>>(i%64)))
+		}
+	}
+	return b.String()
+}
+
+// String returns v in the text format: its name, or else its index.
+func (v *Variable) String() string {
+	if v.Name != "" {
+		return "$" + v.Name
+	}
+	return strconv.Itoa(v.Index)
+}
+
+// formatValue formats bits as a literal of type typ.
+func formatValue(typ tokenType, bits uint64) string {
+	switch typ {
+	case I32:
+		return strconv.FormatInt(int64(int32(bits)), 10)
+	case I64:
+		return strconv.FormatInt(int64(bits), 10)
+	case F32:
+		return formatFloat(float64(math.Float32frombits(uint32(bits))), bits>>31&1 != 0, bits&(1<<23-1), 32)
+	default:
+		return formatFloat(math.Float64frombits(bits), bits>>63 != 0, bits&(1<<52-1), 64)
+	}
+}
+
+// formatFloat formats f of the given bit size, whose sign bit is neg.
+// payload holds the bits of its significand, written out if f is a NaN
+// other than the canonical one.
+func formatFloat(f float64, neg bool, payload uint64, bitSize int) string {
+	sign := ""
+	if neg {
+		sign = "-"
+	}
+	switch {
+	case math.IsInf(f, 0):
+		return sign + "inf"
+	case math.IsNaN(f):
+		quiet := uint64(1) << 22
+		if bitSize == 64 {
+			quiet = 1 << 51
+		}
+		if payload == quiet {
+			return sign + "nan"
+		}
+		return sign + "nan:0x" + strconv.FormatUint(payload, 16)
+	}
+	return strconv.FormatFloat(f, 'g', -1, bitSize)
+}
+
+// quote returns s as a string literal of the text format.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
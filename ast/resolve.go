@@ -0,0 +1,157 @@
+package ast
+
+// resolve sets the Index of the named variables of m, which is the last
+// step of parsing. Labels are resolved as they are parsed.
+func (p *parser) resolve(m *Module) {
+	r := &resolver{
+		types:    make(map[string]int),
+		funcs:    make(map[string]int),
+		tables:   make(map[string]int),
+		memories: make(map[string]int),
+		globals:  make(map[string]int),
+		elems:    make(map[string]int),
+		datas:    make(map[string]int),
+	}
+	for i, def := range m.Types {
+		r.define(r.types, def.Name, i, "type")
+	}
+	for i, fn := range m.Funcs {
+		r.define(r.funcs, fn.Name, i, "function")
+	}
+	for i, t := range m.Tables {
+		r.define(r.tables, t.Name, i, "table")
+	}
+	for i, mem := range m.Memories {
+		r.define(r.memories, mem.Name, i, "memory")
+	}
+	for i, g := range m.Globals {
+		r.define(r.globals, g.Name, i, "global")
+	}
+	for i, elem := range m.Elems {
+		r.define(r.elems, elem.Name, i, "element segment")
+	}
+	for i, data := range m.Data {
+		r.define(r.datas, data.Name, i, "data segment")
+	}
+	for _, def := range m.Types {
+		r.resolveFuncSig(def.Func)
+	}
+	for _, fn := range m.Funcs {
+		r.resolveFunc(fn)
+	}
+	for _, e := range m.Exports {
+		switch e.Kind {
+		case FUNC:
+			r.lookup(r.funcs, e.Var, "function")
+		case TABLE:
+			r.lookup(r.tables, e.Var, "table")
+		case MEMORY:
+			r.lookup(r.memories, e.Var, "memory")
+		case GLOBAL:
+			r.lookup(r.globals, e.Var, "global")
+		}
+	}
+	r.locals = nil
+	r.lookup(r.funcs, m.Start, "function")
+	for _, g := range m.Globals {
+		r.resolveInstrs(g.Init)
+	}
+	for _, elem := range m.Elems {
+		r.lookup(r.tables, elem.Table, "table")
+		r.resolveInstrs(elem.Offset)
+		for _, v := range elem.Funcs {
+			r.lookup(r.funcs, v, "function")
+		}
+	}
+	for _, data := range m.Data {
+		r.lookup(r.memories, data.Memory, "memory")
+		r.resolveInstrs(data.Offset)
+	}
+}
+
+type resolver struct {
+	types, funcs, tables, memories, globals map[string]int
+	elems, datas                            map[string]int // segments
+	locals                                  map[string]int // of the function being resolved
+}
+
+// define binds name, if not zero, to index i in the namespace names
+// of the given kind.
+func (r *resolver) define(names map[string]int, name string, i int, kind string) {
+	if name == "" {
+		return
+	}
+	if _, dup := names[name]; dup {
+		panic(parseError{-1, "duplicate " + kind + " $" + name})
+	}
+	names[name] = i
+}
+
+// lookup sets the Index of v, if named, from the namespace names
+// of the given kind.
+func (r *resolver) lookup(names map[string]int, v *Variable, kind string) {
+	if v == nil || v.Name == "" {
+		return
+	}
+	i, ok := names[v.Name]
+	if !ok {
+		panic(parseError{v.pos, "unknown " + kind + " $" + v.Name})
+	}
+	v.Index = i
+}
+
+func (r *resolver) resolveFuncSig(sig *FuncSig) {
+	if sig != nil && sig.Type != nil {
+		r.lookup(r.types, sig.Type.Var, "type")
+	}
+}
+
+func (r *resolver) resolveFunc(fn *Func) {
+	r.resolveFuncSig(fn.Signature)
+	r.locals = make(map[string]int)
+	i := 0
+	if fn.Signature.Type == nil {
+		for _, param := range fn.Signature.Params {
+			r.define(r.locals, param.Name, i, "local")
+			i += len(param.Types)
+		}
+	}
+	for _, l := range fn.Locals {
+		r.define(r.locals, l.Name, i, "local")
+		i++
+	}
+	r.resolveInstrs(fn.Body)
+}
+
+func (r *resolver) resolveInstrs(body []Instr) {
+	walk(body, func(in Instr) {
+		switch in := in.(type) {
+		case *Instruction:
+			switch in.Op {
+			case CALL, RETURN_CALL:
+				r.lookup(r.funcs, in.Var, "function")
+			case CALL_INDIRECT, RETURN_CALL_INDIRECT:
+				r.resolveFuncSig(in.Sig)
+			case REF_FUNC:
+				r.lookup(r.funcs, in.Var, "function")
+			case TABLE_COPY:
+				r.lookup(r.tables, in.Var, "table")
+			case GET_LOCAL, SET_LOCAL, TEE_LOCAL:
+				r.lookup(r.locals, in.Var, "local")
+			case GET_GLOBAL, SET_GLOBAL:
+				r.lookup(r.globals, in.Var, "global")
+			case MEMORY_INIT, DATA_DROP:
+				r.lookup(r.datas, in.Var, "data segment")
+			case TABLE_INIT, ELEM_DROP:
+				r.lookup(r.elems, in.Var, "element segment")
+			}
+			r.lookup(r.tables, in.TableVar, "table")
+		case *Block:
+			r.resolveFuncSig(in.Type)
+		case *Loop:
+			r.resolveFuncSig(in.Type)
+		case *If:
+			r.resolveFuncSig(in.Type)
+		}
+	})
+}
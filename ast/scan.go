@@ -0,0 +1,32 @@
+package ast
+
+import (
+	"fmt"
+	"io"
+)
+
+// Token is a lexical token of the text format.
+type Token struct {
+	Type   tokenType
+	Offset int    // byte offset of Text in the input
+	Text   []byte // as it appears in the input
+}
+
+// Scan returns the tokens of the text format read from r, comments
+// included, in input order.
+// On a lexical error, it returns the tokens scanned before the error.
+func Scan(r io.Reader) ([]Token, error) {
+	l := newLexer(r)
+	tokens, err := l.lex()
+	if err != nil {
+		return nil, err
+	}
+	toks := make([]Token, 0, len(tokens))
+	for _, t := range tokens {
+		if t.typ == ERROR {
+			return toks, fmt.Errorf("offset %d: %s", t.pos, t.text)
+		}
+		toks = append(toks, Token{Type: t.typ, Offset: t.pos, Text: t.text})
+	}
+	return toks, nil
+}
@@ -6,6 +6,8 @@ import "fmt"
 type token struct {
 	typ  tokenType
 	text []byte
+	pos  int // byte offset of text in the input
+	line int // of text in the input, starting at 1
 }
 
 func (t token) String() string {
@@ -22,9 +24,84 @@ func (t token) isVar() bool {
 	return t.typ == NUMBER || t.typ == NAME
 }
 
+// IsValueType reports whether t is one of F32, F64, I32, I64, V128, or a
+// reference type.
+func (t tokenType) IsValueType() bool { return beginType < t && t < endType }
+
+// IsRefType reports whether t is one of the reference types FUNCREF and
+// EXTERNREF.
+func (t tokenType) IsRefType() bool { return t == FUNCREF || t == EXTERNREF }
+
+// IsShape reports whether t is the shape of the lanes of a vector, as
+// I32X4 in i32x4.add.
+func (t tokenType) IsShape() bool { return beginShape < t && t < endShape }
+
+// IsElemType reports whether t is a table element type: ANYFUNC, the
+// name of FUNCREF in the MVP, or a reference type.
+func (t tokenType) IsElemType() bool {
+	return beginElemType < t && t < endElemType || t.IsRefType()
+}
+
+// IsOperator reports whether t names an operator or the opcode part of an
+// instruction, such as ADD in i32.add or GET_LOCAL.
+func (t tokenType) IsOperator() bool {
+	return beginUnOp < t && t < endUnOp ||
+		beginBinOp < t && t < endBinOp ||
+		beginRelOp < t && t < endRelOp ||
+		beginCvtOp < t && t < endCvtOp ||
+		beginInstr < t && t < endInstr ||
+		beginOp < t && t < endOp ||
+		beginVecOp < t && t < endVecOp ||
+		t == ELSE || t == END
+}
+
+// isArith reports whether t is a unary, binary or comparison operator.
+func (t tokenType) isArith() bool {
+	return beginUnOp < t && t < endUnOp ||
+		beginBinOp < t && t < endBinOp ||
+		beginRelOp < t && t < endRelOp
+}
+
+func (t tokenType) isCvtOp() bool { return beginCvtOp < t && t < endCvtOp }
+
+// dottedOps maps the atoms of the operators written with a dot, such as
+// memory and copy in memory.copy, to the operators.
+var dottedOps = map[[2]tokenType]tokenType{
+	{ATOMIC, FENCE}: ATOMIC_FENCE,
+	{DATA, DROP}:    DATA_DROP,
+	{ELEM, DROP}:    ELEM_DROP,
+	{MEMORY, COPY}:  MEMORY_COPY,
+	{MEMORY, FILL}:  MEMORY_FILL,
+	{MEMORY, INIT}:  MEMORY_INIT,
+	{REF, FUNC}:     REF_FUNC,
+	{REF, IS_NULL}:  REF_IS_NULL,
+	{REF, NULL}:     REF_NULL,
+	{TABLE, COPY}:   TABLE_COPY,
+	{TABLE, FILL}:   TABLE_FILL,
+	{TABLE, GET}:    TABLE_GET,
+	{TABLE, GROW}:   TABLE_GROW,
+	{TABLE, INIT}:   TABLE_INIT,
+	{TABLE, SET}:    TABLE_SET,
+	{TABLE, SIZE}:   TABLE_SIZE,
+}
+
+// keyword maps a token type to its text, the reverse of atom.
+var keyword = make(map[tokenType]string, len(atom))
+
+func init() {
+	for s, typ := range atom {
+		keyword[typ] = s
+	}
+	keyword[S], keyword[U] = "s", "u"
+}
+
 //go:generate stringer -type=tokenType
 type tokenType int
 
+// TokenType is the type of tokens, and of the fields of the AST that hold
+// keywords, such as the type of a Local, for use by other packages.
+type TokenType = tokenType
+
 const (
 	ERROR tokenType = iota
 
@@ -38,29 +115,51 @@ const (
 	NAME
 	NUMBER // value
 	STRING
+	COMMENT
 
 	beginType
+	EXTERNREF
 	F32
 	F64
+	FUNCREF
 	I32
 	I64
+	V128
 	endType
 
+	beginShape
+	F32X4
+	F64X2
+	I16X8
+	I32X4
+	I64X2
+	I8X16
+	endShape
+
 	beginElemType
 	ANYFUNC
 	endElemType
 
 	beginUnOp
+	ABS
+	CEIL
 	CLZ
 	CTZ
 	EQZ
+	FLOOR
+	NEAREST
+	NEG
 	POPCNT
+	SQRT
 	endUnOp
 
 	beginBinOp
 	ADD
 	AND
+	COPYSIGN
 	DIV
+	MAX
+	MIN
 	MUL
 	OR
 	REM
@@ -93,11 +192,61 @@ const (
 	PROMOTE
 	REINTERPRET
 	TRUNC
+	TRUNC_SAT
+	WRAP
 	endCvtOp
 
+	beginVecOp
+	ADD_SAT
+	ALL_TRUE
+	ANDNOT
+	ANY_TRUE
+	AVGR
+	BITMASK
+	BITSELECT
+	CONVERT_LOW
+	DOT_PRODUCT
+	EXTADD_PAIRWISE
+	EXTEND_HIGH
+	EXTEND_LOW
+	EXTMUL_HIGH
+	EXTMUL_LOW
+	EXTRACT_LANE
+	NARROW
+	NOT
+	PMAX
+	PMIN
+	PROMOTE_LOW
+	Q15MULR_SAT
+	REPLACE_LANE
+	SHUFFLE
+	SPLAT
+	SUB_SAT
+	SWIZZLE
+	endVecOp
+
 	ALIGN
 	OFFSET
 
+	ATOMIC
+	CMPXCHG
+	COPY
+	FENCE
+	FILL
+	GET
+	GROW
+	INIT
+	IS_NULL
+	LANE
+	NOTIFY
+	NULL
+	RMW
+	SET
+	SIZE
+	WAIT
+	XCHG
+	ZERO
+
 	beginInstr
 	BLOCK
 	IF
@@ -111,30 +260,60 @@ const (
 	MUT
 
 	beginOp
+	ATOMIC_FENCE
+	ATOMIC_LOAD
+	ATOMIC_RMW
+	ATOMIC_STORE
+	BR
 	BR_IF
 	BR_TABLE
 	CALL
 	CALL_INDIRECT
 	CONST
 	CURRENT_MEMORY
+	DATA_DROP
 	DROP
+	ELEM_DROP
 	GET_GLOBAL
 	GET_LOCAL
 	GROW_MEMORY
 	LOAD
+	LOAD_LANE
+	LOAD_SPLAT
+	LOAD_ZERO
+	MEMORY_ATOMIC_NOTIFY
+	MEMORY_ATOMIC_WAIT
+	MEMORY_COPY
+	MEMORY_FILL
+	MEMORY_INIT
 	NOP
+	REF_FUNC
+	REF_IS_NULL
+	REF_NULL
 	RETURN
+	RETURN_CALL
+	RETURN_CALL_INDIRECT
 	SELECT
 	SET_GLOBAL
 	SET_LOCAL
 	STORE
+	STORE_LANE
+	TABLE_COPY
+	TABLE_FILL
+	TABLE_GET
+	TABLE_GROW
+	TABLE_INIT
+	TABLE_SET
+	TABLE_SIZE
 	TEE_LOCAL
 	UNREACHABLE
 	endOp
 
 	DATA
+	DECLARE
 	ELEM
 	EXPORT
+	EXTERN
 	FUNC
 	GLOBAL
 	IMPORT
@@ -142,7 +321,9 @@ const (
 	MEMORY
 	MODULE
 	PARAM
+	REF
 	RESULT
+	SHARED
 	START
 	TABLE
 	TYPE
@@ -154,25 +335,46 @@ var atom = map[string]tokenType{
 	"f32": F32,
 	"f64": F64,
 
+	"v128": V128,
+
+	"f32x4": F32X4,
+	"f64x2": F64X2,
+	"i16x8": I16X8,
+	"i32x4": I32X4,
+	"i64x2": I64X2,
+	"i8x16": I8X16,
+
+	"externref": EXTERNREF,
+	"funcref":   FUNCREF,
+
 	"anyfunc": ANYFUNC,
 
-	"clz":    CLZ,
-	"ctz":    CTZ,
-	"eqz":    EQZ,
-	"popcnt": POPCNT,
-
-	"add":  ADD,
-	"and":  AND,
-	"div":  DIV,
-	"mul":  MUL,
-	"or":   OR,
-	"rem":  REM,
-	"rotl": ROTL,
-	"rotr": ROTR,
-	"shl":  SHL,
-	"shr":  SHR,
-	"sub":  SUB,
-	"xor":  XOR,
+	"abs":     ABS,
+	"ceil":    CEIL,
+	"clz":     CLZ,
+	"ctz":     CTZ,
+	"eqz":     EQZ,
+	"floor":   FLOOR,
+	"nearest": NEAREST,
+	"neg":     NEG,
+	"popcnt":  POPCNT,
+	"sqrt":    SQRT,
+
+	"add":      ADD,
+	"and":      AND,
+	"copysign": COPYSIGN,
+	"div":      DIV,
+	"max":      MAX,
+	"min":      MIN,
+	"mul":      MUL,
+	"or":       OR,
+	"rem":      REM,
+	"rotl":     ROTL,
+	"rotr":     ROTR,
+	"shl":      SHL,
+	"shr":      SHR,
+	"sub":      SUB,
+	"xor":      XOR,
 
 	"eq": EQ,
 	"ge": GE,
@@ -187,11 +389,59 @@ var atom = map[string]tokenType{
 	"promote":     PROMOTE,
 	"reinterpret": REINTERPRET,
 	"trunc":       TRUNC,
+	"trunc_sat":   TRUNC_SAT,
+	"wrap":        WRAP,
+
+	"add_sat":         ADD_SAT,
+	"all_true":        ALL_TRUE,
+	"andnot":          ANDNOT,
+	"any_true":        ANY_TRUE,
+	"avgr":            AVGR,
+	"bitmask":         BITMASK,
+	"bitselect":       BITSELECT,
+	"convert_low":     CONVERT_LOW,
+	"dot":             DOT_PRODUCT,
+	"extadd_pairwise": EXTADD_PAIRWISE,
+	"extend_high":     EXTEND_HIGH,
+	"extend_low":      EXTEND_LOW,
+	"extmul_high":     EXTMUL_HIGH,
+	"extmul_low":      EXTMUL_LOW,
+	"extract_lane":    EXTRACT_LANE,
+	"narrow":          NARROW,
+	"not":             NOT,
+	"pmax":            PMAX,
+	"pmin":            PMIN,
+	"promote_low":     PROMOTE_LOW,
+	"q15mulr_sat":     Q15MULR_SAT,
+	"replace_lane":    REPLACE_LANE,
+	"shuffle":         SHUFFLE,
+	"splat":           SPLAT,
+	"sub_sat":         SUB_SAT,
+	"swizzle":         SWIZZLE,
 
 	"align":  ALIGN,
 	"mut":    MUT,
 	"offset": OFFSET,
 
+	"atomic":  ATOMIC,
+	"cmpxchg": CMPXCHG,
+	"copy":    COPY,
+	"fence":   FENCE,
+	"fill":    FILL,
+	"get":     GET,
+	"grow":    GROW,
+	"init":    INIT,
+	"is_null": IS_NULL,
+	"lane":    LANE,
+	"notify":  NOTIFY,
+	"null":    NULL,
+	"rmw":     RMW,
+	"set":     SET,
+	"size":    SIZE,
+	"wait":    WAIT,
+	"xchg":    XCHG,
+	"zero":    ZERO,
+
 	"block": BLOCK,
 	"else":  ELSE,
 	"end":   END,
@@ -199,38 +449,70 @@ var atom = map[string]tokenType{
 	"loop":  LOOP,
 	"then":  THEN,
 
-	"br_if":          BR_IF,
-	"br_table":       BR_TABLE,
-	"call":           CALL,
-	"call_indirect":  CALL_INDIRECT,
-	"const":          CONST,
-	"current_memory": CURRENT_MEMORY,
-	"drop":           DROP,
-	"get_global":     GET_GLOBAL,
-	"get_local":      GET_LOCAL,
-	"grow_memory":    GROW_MEMORY,
-	"load":           LOAD,
-	"nop":            NOP,
-	"return":         RETURN,
-	"select":         SELECT,
-	"set_global":     SET_GLOBAL,
-	"set_local":      SET_LOCAL,
-	"store":          STORE,
-	"tee_local":      TEE_LOCAL,
-	"unreachable":    UNREACHABLE,
-
-	"data":   DATA,
-	"elem":   ELEM,
-	"export": EXPORT,
-	"func":   FUNC,
-	"global": GLOBAL,
-	"import": IMPORT,
-	"local":  LOCAL,
-	"memory": MEMORY,
-	"module": MODULE,
-	"param":  PARAM,
-	"result": RESULT,
-	"start":  START,
-	"table":  TABLE,
-	"type":   TYPE,
+	"br":                   BR,
+	"br_if":                BR_IF,
+	"br_table":             BR_TABLE,
+	"call":                 CALL,
+	"call_indirect":        CALL_INDIRECT,
+	"const":                CONST,
+	"current_memory":       CURRENT_MEMORY,
+	"drop":                 DROP,
+	"get_global":           GET_GLOBAL,
+	"get_local":            GET_LOCAL,
+	"grow_memory":          GROW_MEMORY,
+	"load":                 LOAD,
+	"nop":                  NOP,
+	"return":               RETURN,
+	"return_call":          RETURN_CALL,
+	"return_call_indirect": RETURN_CALL_INDIRECT,
+	"select":               SELECT,
+	"set_global":           SET_GLOBAL,
+	"set_local":            SET_LOCAL,
+	"store":                STORE,
+	"tee_local":            TEE_LOCAL,
+	"unreachable":          UNREACHABLE,
+
+	// The operators written with a dot are lexed as several atoms, as in
+	// memory.copy, and combined by the parser: see dottedOps and
+	// parseAtomicInstr.
+	"atomic.fence":         ATOMIC_FENCE,
+	"atomic.load":          ATOMIC_LOAD,
+	"atomic.rmw":           ATOMIC_RMW,
+	"atomic.store":         ATOMIC_STORE,
+	"data.drop":            DATA_DROP,
+	"elem.drop":            ELEM_DROP,
+	"memory.atomic.notify": MEMORY_ATOMIC_NOTIFY,
+	"memory.atomic.wait":   MEMORY_ATOMIC_WAIT,
+	"memory.copy":          MEMORY_COPY,
+	"memory.fill":          MEMORY_FILL,
+	"memory.init":          MEMORY_INIT,
+	"ref.func":             REF_FUNC,
+	"ref.is_null":          REF_IS_NULL,
+	"ref.null":             REF_NULL,
+	"table.copy":           TABLE_COPY,
+	"table.fill":           TABLE_FILL,
+	"table.get":            TABLE_GET,
+	"table.grow":           TABLE_GROW,
+	"table.init":           TABLE_INIT,
+	"table.set":            TABLE_SET,
+	"table.size":           TABLE_SIZE,
+
+	"data":    DATA,
+	"declare": DECLARE,
+	"elem":    ELEM,
+	"export":  EXPORT,
+	"extern":  EXTERN,
+	"func":    FUNC,
+	"global":  GLOBAL,
+	"import":  IMPORT,
+	"local":   LOCAL,
+	"memory":  MEMORY,
+	"module":  MODULE,
+	"param":   PARAM,
+	"ref":     REF,
+	"result":  RESULT,
+	"shared":  SHARED,
+	"start":   START,
+	"table":   TABLE,
+	"type":    TYPE,
 }
@@ -4,9 +4,9 @@ package ast
 
 import "fmt"
 
-const _tokenType_name = "ERRORDOTEQUALLPARENRPARENSLASHUNDERSCORENAMENUMBERSTRINGbeginTypeF32F64I32I64endTypebeginElemTypeANYFUNCendElemTypebeginUnOpCLZCTZEQZPOPCNTendUnOpbeginBinOpADDANDDIVMULORREMROTLROTRSHLSHRSUBXORendBinOpbeginRelOpEQGEGTLELTNEendRelOpbeginSignSUendSignbeginCvtOpCONVERTDEMOTEEXTENDPROMOTEREINTERPRETTRUNCendCvtOpALIGNOFFSETbeginInstrBLOCKIFLOOPendInstrELSEENDTHENMUTbeginOpBR_IFBR_TABLECALLCALL_INDIRECTCONSTCURRENT_MEMORYDROPGET_GLOBALGET_LOCALGROW_MEMORYLOADNOPRETURNSELECTSET_GLOBALSET_LOCALSTORETEE_LOCALUNREACHABLEendOpDATAELEMEXPORTFUNCGLOBALIMPORTLOCALMEMORYMODULEPARAMRESULTSTARTTABLETYPE"
+const _tokenType_name = "ERRORDOTEQUALLPARENRPARENSLASHUNDERSCORENAMENUMBERSTRINGCOMMENTbeginTypeEXTERNREFF32F64FUNCREFI32I64V128endTypebeginShapeF32X4F64X2I16X8I32X4I64X2I8X16endShapebeginElemTypeANYFUNCendElemTypebeginUnOpABSCEILCLZCTZEQZFLOORNEARESTNEGPOPCNTSQRTendUnOpbeginBinOpADDANDCOPYSIGNDIVMAXMINMULORREMROTLROTRSHLSHRSUBXORendBinOpbeginRelOpEQGEGTLELTNEendRelOpbeginSignSUendSignbeginCvtOpCONVERTDEMOTEEXTENDPROMOTEREINTERPRETTRUNCTRUNC_SATWRAPendCvtOpbeginVecOpADD_SATALL_TRUEANDNOTANY_TRUEAVGRBITMASKBITSELECTCONVERT_LOWDOT_PRODUCTEXTADD_PAIRWISEEXTEND_HIGHEXTEND_LOWEXTMUL_HIGHEXTMUL_LOWEXTRACT_LANENARROWNOTPMAXPMINPROMOTE_LOWQ15MULR_SATREPLACE_LANESHUFFLESPLATSUB_SATSWIZZLEendVecOpALIGNOFFSETATOMICCMPXCHGCOPYFENCEFILLGETGROWINITIS_NULLLANENOTIFYNULLRMWSETSIZEWAITXCHGZERObeginInstrBLOCKIFLOOPendInstrELSEENDTHENMUTbeginOpATOMIC_FENCEATOMIC_LOADATOMIC_RMWATOMIC_STOREBRBR_IFBR_TABLECALLCALL_INDIRECTCONSTCURRENT_MEMORYDATA_DROPDROPELEM_DROPGET_GLOBALGET_LOCALGROW_MEMORYLOADLOAD_LANELOAD_SPLATLOAD_ZEROMEMORY_ATOMIC_NOTIFYMEMORY_ATOMIC_WAITMEMORY_COPYMEMORY_FILLMEMORY_INITNOPREF_FUNCREF_IS_NULLREF_NULLRETURNRETURN_CALLRETURN_CALL_INDIRECTSELECTSET_GLOBALSET_LOCALSTORESTORE_LANETABLE_COPYTABLE_FILLTABLE_GETTABLE_GROWTABLE_INITTABLE_SETTABLE_SIZETEE_LOCALUNREACHABLEendOpDATADECLAREELEMEXPORTEXTERNFUNCGLOBALIMPORTLOCALMEMORYMODULEPARAMREFRESULTSHAREDSTARTTABLETYPE"
 
-var _tokenType_index = [...]uint16{0, 5, 8, 13, 19, 25, 30, 40, 44, 50, 56, 65, 68, 71, 74, 77, 84, 97, 104, 115, 124, 127, 130, 133, 139, 146, 156, 159, 162, 165, 168, 170, 173, 177, 181, 184, 187, 190, 193, 201, 211, 213, 215, 217, 219, 221, 223, 231, 240, 241, 242, 249, 259, 266, 272, 278, 285, 296, 301, 309, 314, 320, 330, 335, 337, 341, 349, 353, 356, 360, 363, 370, 375, 383, 387, 400, 405, 419, 423, 433, 442, 453, 457, 460, 466, 472, 482, 491, 496, 505, 516, 521, 525, 529, 535, 539, 545, 551, 556, 562, 568, 573, 579, 584, 589, 593}
+var _tokenType_index = [...]uint16{0, 5, 8, 13, 19, 25, 30, 40, 44, 50, 56, 63, 72, 81, 84, 87, 94, 97, 100, 104, 111, 121, 126, 131, 136, 141, 146, 151, 159, 172, 179, 190, 199, 202, 206, 209, 212, 215, 220, 227, 230, 236, 240, 247, 257, 260, 263, 271, 274, 277, 280, 283, 285, 288, 292, 296, 299, 302, 305, 308, 316, 326, 328, 330, 332, 334, 336, 338, 346, 355, 356, 357, 364, 374, 381, 387, 393, 400, 411, 416, 425, 429, 437, 447, 454, 462, 468, 476, 480, 487, 496, 507, 518, 533, 544, 554, 565, 575, 587, 593, 596, 600, 604, 615, 626, 638, 645, 650, 657, 664, 672, 677, 683, 689, 696, 700, 705, 709, 712, 716, 720, 727, 731, 737, 741, 744, 747, 751, 755, 759, 763, 773, 778, 780, 784, 792, 796, 799, 803, 806, 813, 825, 836, 846, 858, 860, 865, 873, 877, 890, 895, 909, 918, 922, 931, 941, 950, 961, 965, 974, 984, 993, 1013, 1031, 1042, 1053, 1064, 1067, 1075, 1086, 1094, 1100, 1111, 1131, 1137, 1147, 1156, 1161, 1171, 1181, 1191, 1200, 1210, 1220, 1229, 1239, 1248, 1259, 1264, 1268, 1275, 1279, 1285, 1291, 1295, 1301, 1307, 1312, 1318, 1324, 1329, 1332, 1338, 1344, 1349, 1354, 1358}
 
 func (i tokenType) String() string {
 	if i < 0 || i >= tokenType(len(_tokenType_index)-1) {
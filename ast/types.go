@@ -0,0 +1,259 @@
+package ast
+
+// numericType returns the operand types and the result type of in, a
+// numeric instruction (a unary, binary, comparison or conversion operator),
+// or ok == false if there is no such instruction, as in i32.div or f32.clz.
+func (in *Instruction) numericType() (params []tokenType, result tokenType, ok bool) {
+	if in.IsVector() {
+		return nil, 0, false
+	}
+	t, from := in.Type, in.From
+	isInt := t == I32 || t == I64
+	isFloat := t == F32 || t == F64
+	signed := in.Sign != 0
+	unary := func(valid bool) ([]tokenType, tokenType, bool) {
+		return []tokenType{t}, t, valid && from == 0
+	}
+	binary := func(valid bool) ([]tokenType, tokenType, bool) {
+		return []tokenType{t, t}, t, valid && from == 0
+	}
+	compare := func(valid bool) ([]tokenType, tokenType, bool) {
+		return []tokenType{t, t}, I32, valid && from == 0
+	}
+	convert := func(valid bool) ([]tokenType, tokenType, bool) {
+		return []tokenType{from}, t, valid
+	}
+	switch in.Op {
+	case CLZ, CTZ, POPCNT:
+		return unary(isInt && !signed)
+	case EQZ:
+		return []tokenType{t}, I32, isInt && !signed && from == 0
+	case ABS, NEG, SQRT, CEIL, FLOOR, NEAREST:
+		return unary(isFloat && !signed)
+	case TRUNC:
+		if from == 0 {
+			return unary(isFloat && !signed)
+		}
+		return convert(isInt && (from == F32 || from == F64) && signed)
+	case TRUNC_SAT:
+		return convert(isInt && (from == F32 || from == F64) && signed)
+	case ADD, SUB, MUL:
+		return binary(!signed)
+	case DIV:
+		return binary(isInt == signed)
+	case REM, SHR:
+		return binary(isInt && signed)
+	case AND, OR, XOR, SHL, ROTL, ROTR:
+		return binary(isInt && !signed)
+	case MIN, MAX, COPYSIGN:
+		return binary(isFloat && !signed)
+	case EQ, NE:
+		return compare(!signed)
+	case LT, GT, LE, GE:
+		return compare(isInt == signed)
+	case WRAP:
+		return convert(t == I32 && from == I64 && !signed)
+	case EXTEND:
+		if from == 0 {
+			w := in.Width
+			return unary(isInt && in.Sign == S && (w == 8 || w == 16 || w == 32 && t == I64))
+		}
+		return convert(t == I64 && from == I32 && signed && in.Width == 0)
+	case CONVERT:
+		return convert(isFloat && (from == I32 || from == I64) && signed)
+	case DEMOTE:
+		return convert(t == F32 && from == F64 && !signed)
+	case PROMOTE:
+		return convert(t == F64 && from == F32 && !signed)
+	case REINTERPRET:
+		return convert(!signed && (t == I32 && from == F32 || t == F32 && from == I32 ||
+			t == I64 && from == F64 || t == F64 && from == I64))
+	}
+	return nil, 0, false
+}
+
+// IsVector reports whether in is a vector instruction, whose type is V128
+// or a shape, as opposed to a select of vectors.
+func (in *Instruction) IsVector() bool {
+	return in.Type.IsShape() || in.Type == V128 && in.Op != SELECT
+}
+
+// Lanes returns the number of lanes of a vector of shape t.
+func (t tokenType) Lanes() int {
+	switch t {
+	case I8X16:
+		return 16
+	case I16X8:
+		return 8
+	case I32X4, F32X4:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// LaneType returns the type of the values of the lanes of a vector of
+// shape t, as extracted or replaced: I32 for the lanes of I8X16 and I16X8.
+func (t tokenType) LaneType() tokenType {
+	switch t {
+	case I64X2:
+		return I64
+	case F32X4:
+		return F32
+	case F64X2:
+		return F64
+	default:
+		return I32
+	}
+}
+
+// halfShape returns the shape of the vectors of lanes of half the width
+// of those of the integer shape t, as I8X16 for I16X8, or zero.
+func halfShape(t tokenType) tokenType {
+	switch t {
+	case I16X8:
+		return I8X16
+	case I32X4:
+		return I16X8
+	case I64X2:
+		return I32X4
+	}
+	return 0
+}
+
+// isMemoryAccess reports whether in accesses the memory at an address, with
+// an offset and an alignment: a load or store, or an atomic memory
+// instruction other than atomic.fence.
+func (in *Instruction) isMemoryAccess() bool {
+	switch in.Op {
+	case LOAD, STORE, ATOMIC_LOAD, ATOMIC_RMW, ATOMIC_STORE, MEMORY_ATOMIC_NOTIFY, MEMORY_ATOMIC_WAIT:
+		return true
+	}
+	return false
+}
+
+// accessWidth returns the number of bits accessed by in, a load or store.
+func (in *Instruction) accessWidth() int {
+	if in.Type == V128 && in.Op == LOAD && in.Sign != 0 {
+		return 64 // extending load, as v128.load8x8_s
+	}
+	return in.Width
+}
+
+// VectorType returns the operand types and the result type, zero if there
+// is none, of in, a vector instruction, or ok == false if there is no such
+// instruction, as in i64x2.popcnt. Its lane indices are not checked.
+func (in *Instruction) VectorType() (params []tokenType, result tokenType, ok bool) {
+	t, from := in.Type, in.From
+	isInt := t == I8X16 || t == I16X8 || t == I32X4 || t == I64X2
+	isFloat := t == F32X4 || t == F64X2
+	signed := in.Sign != 0
+	unary := func(valid bool) ([]tokenType, tokenType, bool) {
+		return []tokenType{V128}, V128, valid && from == 0
+	}
+	binary := func(valid bool) ([]tokenType, tokenType, bool) {
+		return []tokenType{V128, V128}, V128, valid && from == 0
+	}
+	convert := func(valid bool) ([]tokenType, tokenType, bool) {
+		return []tokenType{V128}, V128, valid
+	}
+	if t == V128 {
+		w := in.Width
+		switch in.Op {
+		case CONST:
+			return nil, V128, !signed && from == 0
+		case LOAD:
+			return []tokenType{I32}, V128, w == 128 && !signed || (w == 8 || w == 16 || w == 32) && signed
+		case LOAD_SPLAT:
+			return []tokenType{I32}, V128, w == 8 || w == 16 || w == 32 || w == 64
+		case LOAD_ZERO:
+			return []tokenType{I32}, V128, w == 32 || w == 64
+		case LOAD_LANE:
+			return []tokenType{I32, V128}, V128, w == 8 || w == 16 || w == 32 || w == 64
+		case STORE:
+			return []tokenType{I32, V128}, 0, w == 128
+		case STORE_LANE:
+			return []tokenType{I32, V128}, 0, w == 8 || w == 16 || w == 32 || w == 64
+		case NOT:
+			return unary(!signed)
+		case AND, ANDNOT, OR, XOR:
+			return binary(!signed)
+		case BITSELECT:
+			return []tokenType{V128, V128, V128}, V128, !signed
+		case ANY_TRUE:
+			return []tokenType{V128}, I32, !signed
+		}
+		return nil, 0, false
+	}
+	switch in.Op {
+	case SPLAT:
+		return []tokenType{t.LaneType()}, V128, !signed && from == 0
+	case EXTRACT_LANE:
+		// Lanes narrower than an i32 are extended.
+		narrow := t == I8X16 || t == I16X8
+		return []tokenType{V128}, t.LaneType(), narrow == signed && from == 0
+	case REPLACE_LANE:
+		return []tokenType{V128, t.LaneType()}, V128, !signed && from == 0
+	case SHUFFLE:
+		return binary(t == I8X16 && !signed)
+	case SWIZZLE:
+		return binary(t == I8X16 && !signed)
+	case EQ, NE:
+		return binary(!signed)
+	case LT, GT, LE, GE:
+		return binary(isInt && signed && (t != I64X2 || in.Sign == S) || isFloat && !signed)
+	case ABS, NEG:
+		return unary(!signed)
+	case POPCNT:
+		return unary(t == I8X16 && !signed)
+	case ALL_TRUE, BITMASK:
+		return []tokenType{V128}, I32, isInt && !signed && from == 0
+	case NARROW:
+		return []tokenType{V128, V128}, V128, (t == I8X16 && from == I16X8 || t == I16X8 && from == I32X4) && signed
+	case EXTEND_LOW, EXTEND_HIGH:
+		return convert(from != 0 && from == halfShape(t) && signed)
+	case SHL:
+		return []tokenType{V128, I32}, V128, isInt && !signed && from == 0
+	case SHR:
+		return []tokenType{V128, I32}, V128, isInt && signed && from == 0
+	case ADD, SUB:
+		return binary(!signed)
+	case ADD_SAT, SUB_SAT:
+		return binary((t == I8X16 || t == I16X8) && signed)
+	case MUL:
+		return binary(t != I8X16 && !signed)
+	case MIN, MAX:
+		return binary(isInt && t != I64X2 && signed || isFloat && !signed)
+	case AVGR:
+		return binary((t == I8X16 || t == I16X8) && in.Sign == U)
+	case Q15MULR_SAT:
+		return binary(t == I16X8 && in.Sign == S)
+	case EXTMUL_LOW, EXTMUL_HIGH:
+		return []tokenType{V128, V128}, V128, from != 0 && from == halfShape(t) && signed
+	case EXTADD_PAIRWISE:
+		return convert((t == I16X8 || t == I32X4) && from == halfShape(t) && signed)
+	case DOT_PRODUCT:
+		return []tokenType{V128, V128}, V128, t == I32X4 && from == I16X8 && in.Sign == S
+	case CEIL, FLOOR, TRUNC, NEAREST, SQRT:
+		return unary(isFloat && !signed)
+	case DIV, PMIN, PMAX:
+		return binary(isFloat && !signed)
+	case CONVERT:
+		return convert(t == F32X4 && from == I32X4 && signed)
+	case TRUNC_SAT:
+		return convert(t == I32X4 && (from == F32X4 || from == F64X2) && signed)
+	case DEMOTE:
+		return convert(t == F32X4 && from == F64X2 && !signed)
+	case PROMOTE_LOW:
+		return convert(t == F64X2 && from == F32X4 && !signed)
+	case CONVERT_LOW:
+		return convert(t == F64X2 && from == I32X4 && signed)
+	}
+	return nil, 0, false
+}
+
+// hasZeroSuffix reports whether the name of in, a vector instruction,
+// ends in _zero, as that of i32x4.trunc_sat_f64x2_s_zero.
+func (in *Instruction) hasZeroSuffix() bool {
+	return in.From == F64X2 && (in.Op == TRUNC_SAT || in.Op == DEMOTE)
+}
@@ -0,0 +1,834 @@
+package ast
+
+import "fmt"
+
+// Validate checks that m is a valid module and returns the first
+// violation of the validation rules of the specification found.
+// Function bodies are type-checked. Validation does not modify m.
+// The instructions of the features of Features are invalid: Validate is
+// ValidateFeatures with none enabled.
+func Validate(m *Module) error {
+	return ValidateFeatures(m, 0)
+}
+
+// ValidateFeatures is like Validate, but accepts the instructions of the
+// features enabled in features.
+func ValidateFeatures(m *Module, features Features) error {
+	return validate(m, features, nil)
+}
+
+// ValidateOperandTypes is like ValidateFeatures, but also returns the
+// types of the operands of the drop and select instructions of the
+// function bodies of m, which only type-checking reveals. Instructions
+// whose operands are of an unknown type, in unreachable code, are absent.
+func ValidateOperandTypes(m *Module, features Features) (map[*Instruction]TokenType, error) {
+	types := make(map[*Instruction]TokenType)
+	if err := validate(m, features, types); err != nil {
+		return nil, err
+	}
+	return types, nil
+}
+
+func validate(m *Module, features Features, operandTypes map[*Instruction]tokenType) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			verr, ok := e.(validationError)
+			if !ok {
+				panic(e)
+			}
+			err = verr
+		}
+	}()
+	v := &validator{m: m, features: features, operandTypes: operandTypes}
+	v.validateModule()
+	return nil
+}
+
+// validationError is a validation error, raised by the validator as a panic.
+type validationError string
+
+func (e validationError) Error() string { return string(e) }
+
+type validator struct {
+	m        *Module
+	features Features // enabled
+
+	// where is the location of what is being validated, for error messages.
+	where string
+
+	// refs holds the functions that ref.func may reference: those of the
+	// element segments, exports and global initializers.
+	refs map[int]bool
+
+	// operandTypes, if not nil, records the types of the operands of drop
+	// and select.
+	operandTypes map[*Instruction]tokenType
+
+	// Type-checking state of the function being validated
+	fnWhere string // location of the function
+	locals  []tokenType
+	opds    []tokenType // operand stack; zero is an unknown type
+	ctrls   []ctrlFrame // control stack
+}
+
+// ctrlFrame is the type-checking state of a block.
+type ctrlFrame struct {
+	labelTypes  []tokenType // types of the values that a branch to it takes
+	endTypes    []tokenType // types of its results
+	height      int         // of the operand stack when the block began
+	unreachable bool        // whether the rest of the block is unreachable
+}
+
+func (v *validator) errorf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if v.where != "" {
+		msg = v.where + ": " + msg
+	}
+	panic(validationError(msg))
+}
+
+func (v *validator) validateModule() {
+	m := v.m
+	for i, def := range m.Types {
+		v.where = fmt.Sprintf("type %s", nameOrIndex(def.Name, i))
+		v.validateFuncSig(def.Func)
+	}
+	if len(m.Tables) > 1 && v.features&ReferenceTypes == 0 {
+		v.where = ""
+		v.errorf("multiple tables")
+	}
+	for i, t := range m.Tables {
+		v.where = fmt.Sprintf("table %s", nameOrIndex(t.Name, i))
+		v.validateLimits(t.Limits)
+		if t.RefType() == EXTERNREF {
+			v.requireFeature(ReferenceTypes)
+		}
+	}
+	if len(m.Memories) > 1 {
+		v.where = ""
+		v.errorf("multiple memories")
+	}
+	for i, mem := range m.Memories {
+		v.where = fmt.Sprintf("memory %s", nameOrIndex(mem.Name, i))
+		v.validateLimits(mem.Limits)
+		if mem.Limits.Min > maxPages || mem.Limits.HasMax && mem.Limits.Max > maxPages {
+			v.errorf("memory size must be at most %d pages (4GiB)", maxPages)
+		}
+		if mem.Shared {
+			v.requireFeature(Threads)
+			if !mem.Limits.HasMax {
+				v.errorf("shared memory must have maximum")
+			}
+		}
+	}
+	v.refs = make(map[int]bool)
+	for _, g := range m.Globals {
+		for _, in := range g.Init {
+			if in, ok := in.(*Instruction); ok && in.Op == REF_FUNC {
+				v.refs[in.Var.Index] = true
+			}
+		}
+	}
+	for i, fn := range m.Funcs {
+		if fn.Export != nil {
+			v.refs[i] = true
+		}
+	}
+	for _, e := range m.Exports {
+		if e.Kind == FUNC {
+			v.refs[e.Var.Index] = true
+		}
+	}
+	for _, elem := range m.Elems {
+		for _, f := range elem.Funcs {
+			v.refs[f.Index] = true
+		}
+	}
+	for i, g := range m.Globals {
+		v.where = fmt.Sprintf("global %s", nameOrIndex(g.Name, i))
+		v.validateValueType(g.Type)
+		if g.Import == nil {
+			v.validateConstExpr(g.Init, g.Type)
+		}
+	}
+	names := make(map[string]bool)
+	for i, fn := range m.Funcs {
+		v.where = fmt.Sprintf("func %s", nameOrIndex(fn.Name, i))
+		v.validateFuncSig(fn.Signature)
+		if fn.Export != nil {
+			v.validateExportName(names, fn.Export.Name)
+		}
+	}
+	for i, t := range m.Tables {
+		if t.Export != nil {
+			v.where = fmt.Sprintf("table %s", nameOrIndex(t.Name, i))
+			v.validateExportName(names, t.Export.Name)
+		}
+	}
+	for i, mem := range m.Memories {
+		if mem.Export != nil {
+			v.where = fmt.Sprintf("memory %s", nameOrIndex(mem.Name, i))
+			v.validateExportName(names, mem.Export.Name)
+		}
+	}
+	for i, g := range m.Globals {
+		if g.Export != nil {
+			v.where = fmt.Sprintf("global %s", nameOrIndex(g.Name, i))
+			v.validateExportName(names, g.Export.Name)
+		}
+	}
+	for _, e := range m.Exports {
+		v.where = fmt.Sprintf("export %q", e.Name)
+		v.validateExportName(names, e.Name)
+		switch e.Kind {
+		case FUNC:
+			v.validateIndex(e.Var, len(m.Funcs), "function")
+		case TABLE:
+			v.validateIndex(e.Var, len(m.Tables), "table")
+		case MEMORY:
+			v.validateIndex(e.Var, len(m.Memories), "memory")
+		case GLOBAL:
+			v.validateIndex(e.Var, len(m.Globals), "global")
+		}
+	}
+	if m.Start != nil {
+		v.where = "start"
+		v.validateIndex(m.Start, len(m.Funcs), "function")
+		sig := v.signature(m.Funcs[m.Start.Index].Signature)
+		if len(sig.ParamTypes()) > 0 || len(sig.Results) > 0 {
+			v.errorf("start function must have type [] -> []")
+		}
+	}
+	for i, elem := range m.Elems {
+		v.where = fmt.Sprintf("elem %d", i)
+		switch {
+		case elem.Passive:
+			v.requireFeature(BulkMemory)
+		case elem.Declare:
+			v.requireFeature(ReferenceTypes)
+		default:
+			if t := v.table(elem.Table); t != FUNCREF {
+				v.errorf("type mismatch: expected %s, found funcref", keyword[t])
+			}
+			v.validateConstExpr(elem.Offset, I32)
+		}
+		for _, f := range elem.Funcs {
+			v.validateIndex(f, len(m.Funcs), "function")
+		}
+	}
+	for i, data := range m.Data {
+		v.where = fmt.Sprintf("data %d", i)
+		if data.Passive {
+			v.requireFeature(BulkMemory)
+			continue
+		}
+		v.validateIndex(data.Memory, len(m.Memories), "memory")
+		v.validateConstExpr(data.Offset, I32)
+	}
+	for i, fn := range m.Funcs {
+		if fn.Import == nil {
+			v.where = fmt.Sprintf("func %s", nameOrIndex(fn.Name, i))
+			v.validateFunc(fn)
+		}
+	}
+}
+
+// maxPages is the maximum size of a memory, in pages.
+const maxPages = 65536
+
+// nameOrIndex returns "$name", or the index i if name is zero.
+func nameOrIndex(name string, i int) string {
+	if name != "" {
+		return "$" + name
+	}
+	return fmt.Sprint(i)
+}
+
+func (v *validator) validateFuncSig(sig *FuncSig) {
+	sig = v.signature(sig)
+	if len(sig.Results) > 1 && v.features&MultiValue == 0 {
+		v.errorf("invalid result arity")
+	}
+	v.validateValueTypes(sig.ParamTypes())
+	v.validateValueTypes(sig.Results)
+}
+
+// validateValueType checks that the feature of the value type t, if any,
+// is enabled.
+func (v *validator) validateValueType(t tokenType) {
+	switch {
+	case t.IsRefType():
+		v.requireFeature(ReferenceTypes)
+	case t == V128:
+		v.requireFeature(SIMD)
+	}
+}
+
+func (v *validator) validateValueTypes(types []tokenType) {
+	for _, t := range types {
+		v.validateValueType(t)
+	}
+}
+
+// signature returns sig resolved, which must be valid.
+func (v *validator) signature(sig *FuncSig) *FuncSig {
+	if sig.Type != nil {
+		v.validateIndex(sig.Type.Var, len(v.m.Types), "type")
+	}
+	if sig = v.m.Signature(sig); sig == nil {
+		v.errorf("unknown type")
+	}
+	return sig
+}
+
+func (v *validator) validateLimits(l *Limits) {
+	if l.HasMax && l.Min > l.Max {
+		v.errorf("size minimum must not be greater than maximum")
+	}
+}
+
+func (v *validator) validateExportName(names map[string]bool, name string) {
+	if names[name] {
+		v.errorf("duplicate export name %q", name)
+	}
+	names[name] = true
+}
+
+// validateIndex checks that v refers to one of n items of the given kind.
+func (v *validator) validateIndex(x *Variable, n int, kind string) {
+	if x.Index < 0 || x.Index >= n {
+		v.errorf("unknown %s %s", kind, x)
+	}
+}
+
+// validateConstExpr checks that expr is a constant expression of type typ:
+// a const, a ref.null, a ref.func, or a get_global of an immutable imported
+// global.
+func (v *validator) validateConstExpr(expr []Instr, typ tokenType) {
+	if len(expr) != 1 {
+		v.errorf("constant expression required")
+	}
+	in, ok := expr[0].(*Instruction)
+	if !ok || len(in.Operands) > 0 {
+		v.errorf("constant expression required")
+	}
+	v.requireFeature(in.feature())
+	var t tokenType
+	switch in.Op {
+	case CONST:
+		t = in.Type
+	case REF_NULL:
+		t = in.Type
+	case REF_FUNC:
+		v.validateIndex(in.Var, len(v.m.Funcs), "function")
+		t = FUNCREF
+	case GET_GLOBAL:
+		imported := 0
+		for imported < len(v.m.Globals) && v.m.Globals[imported].Import != nil {
+			imported++
+		}
+		v.validateIndex(in.Var, imported, "global")
+		g := v.m.Globals[in.Var.Index]
+		if g.Mutable {
+			v.errorf("constant expression required")
+		}
+		t = g.Type
+	default:
+		v.errorf("constant expression required")
+	}
+	if t != typ {
+		v.errorf("type mismatch: expected %s, found %s", keyword[typ], keyword[t])
+	}
+}
+
+func (v *validator) validateFunc(fn *Func) {
+	sig := v.signature(fn.Signature)
+	v.fnWhere = v.where
+	v.locals = sig.ParamTypes()
+	for _, l := range fn.Locals {
+		v.validateValueType(l.Type)
+		v.locals = append(v.locals, l.Type)
+	}
+	v.opds, v.ctrls = v.opds[:0], v.ctrls[:0]
+	v.pushCtrl(sig.Results, sig.Results)
+	v.validateInstrs(fn.Body)
+	v.popCtrl()
+}
+
+func (v *validator) validateInstrs(body []Instr) {
+	for _, in := range body {
+		v.validateInstr(in)
+	}
+}
+
+func (v *validator) validateInstr(in Instr) {
+	switch in := in.(type) {
+	case *Instruction:
+		v.validateInstrs(in.Operands)
+		v.validateInstruction(in)
+	case *Block:
+		params, results := v.blockType(in.Type, "block")
+		v.popOpds(params)
+		v.pushCtrl(results, results)
+		v.pushOpds(params)
+		v.validateInstrs(in.Body)
+		v.pushOpds(v.popCtrl())
+	case *Loop:
+		params, results := v.blockType(in.Type, "loop")
+		v.popOpds(params)
+		v.pushCtrl(params, results)
+		v.pushOpds(params)
+		v.validateInstrs(in.Body)
+		v.pushOpds(v.popCtrl())
+	case *If:
+		v.validateInstrs(in.Cond)
+		params, results := v.blockType(in.Type, "if")
+		v.where = v.whereFunc("if")
+		v.popOpd(I32)
+		v.popOpds(params)
+		v.pushCtrl(results, results)
+		v.pushOpds(params)
+		v.validateInstrs(in.Then)
+		if in.Else != nil {
+			v.popCtrl()
+			v.pushCtrl(results, results)
+			v.pushOpds(params)
+			v.validateInstrs(in.Else)
+		} else if !equalTypes(params, results) {
+			v.where = v.whereFunc("if")
+			v.errorf("type mismatch: if without else cannot have results")
+		}
+		v.pushOpds(v.popCtrl())
+	}
+}
+
+// blockType returns the parameter and result types of a block of type
+// sig.
+func (v *validator) blockType(sig *FuncSig, kind string) (params, results []tokenType) {
+	v.where = v.whereFunc(kind)
+	sig = v.signature(sig)
+	if v.features&MultiValue == 0 {
+		if len(sig.Results) > 1 {
+			v.errorf("invalid result arity")
+		}
+		if len(sig.Params) > 0 {
+			v.requireFeature(MultiValue)
+		}
+	}
+	v.validateValueTypes(sig.ParamTypes())
+	v.validateValueTypes(sig.Results)
+	return sig.ParamTypes(), sig.Results
+}
+
+func (v *validator) whereFunc(instr string) string {
+	return v.fnWhere + ": " + instr
+}
+
+// recordOperandType records t, unless unknown, as the type of the
+// operands of in.
+func (v *validator) recordOperandType(in *Instruction, t tokenType) {
+	if v.operandTypes != nil && t != 0 {
+		v.operandTypes[in] = t
+	}
+}
+
+func (v *validator) validateInstruction(in *Instruction) {
+	v.where = v.whereFunc(in.String())
+	v.requireFeature(in.feature())
+	if in.IsVector() {
+		v.validateVectorInstruction(in)
+		return
+	}
+	if params, result, ok := in.numericType(); ok {
+		v.popOpds(params)
+		v.pushOpd(result)
+		return
+	}
+	switch in.Op {
+	case CONST:
+		v.pushOpd(in.Type)
+	case NOP:
+	case UNREACHABLE:
+		v.setUnreachable()
+	case DROP:
+		v.recordOperandType(in, v.popOpd(0))
+	case SELECT:
+		v.popOpd(I32)
+		if in.Type != 0 {
+			v.validateValueType(in.Type)
+			v.popOpds([]tokenType{in.Type, in.Type})
+			v.pushOpd(in.Type)
+			v.recordOperandType(in, in.Type)
+			break
+		}
+		t := v.popOpd(0)
+		if u := v.popOpd(t); t == 0 {
+			t = u
+		}
+		if t.IsRefType() {
+			v.errorf("type mismatch: select of %s without a result type", keyword[t])
+		}
+		v.pushOpd(t)
+		v.recordOperandType(in, t)
+	case GET_LOCAL:
+		v.pushOpd(v.local(in.Var))
+	case SET_LOCAL:
+		v.popOpd(v.local(in.Var))
+	case TEE_LOCAL:
+		t := v.local(in.Var)
+		v.popOpd(t)
+		v.pushOpd(t)
+	case GET_GLOBAL:
+		v.pushOpd(v.global(in.Var).Type)
+	case SET_GLOBAL:
+		g := v.global(in.Var)
+		if !g.Mutable {
+			v.errorf("global is immutable")
+		}
+		v.popOpd(g.Type)
+	case LOAD:
+		v.validateMemArg(in)
+		v.popOpd(I32)
+		v.pushOpd(in.Type)
+	case STORE:
+		v.validateMemArg(in)
+		v.popOpd(in.Type)
+		v.popOpd(I32)
+	case ATOMIC_LOAD:
+		v.validateAtomicMemArg(in)
+		v.popOpd(I32)
+		v.pushOpd(in.Type)
+	case ATOMIC_STORE:
+		v.validateAtomicMemArg(in)
+		v.popOpd(in.Type)
+		v.popOpd(I32)
+	case ATOMIC_RMW:
+		v.validateAtomicMemArg(in)
+		v.popOpd(in.Type)
+		if in.RMW == CMPXCHG {
+			v.popOpd(in.Type) // the expected value, then the replacement
+		}
+		v.popOpd(I32)
+		v.pushOpd(in.Type)
+	case MEMORY_ATOMIC_NOTIFY:
+		v.validateAtomicMemArg(in)
+		v.popOpd(I32)
+		v.popOpd(I32)
+		v.pushOpd(I32)
+	case MEMORY_ATOMIC_WAIT:
+		v.validateAtomicMemArg(in)
+		v.popOpd(I64)
+		if in.Width == 32 {
+			v.popOpd(I32)
+		} else {
+			v.popOpd(I64)
+		}
+		v.popOpd(I32)
+		v.pushOpd(I32)
+	case ATOMIC_FENCE:
+	case CURRENT_MEMORY:
+		v.validateMemory()
+		v.pushOpd(I32)
+	case GROW_MEMORY:
+		v.validateMemory()
+		v.popOpd(I32)
+		v.pushOpd(I32)
+	case CALL:
+		v.validateIndex(in.Var, len(v.m.Funcs), "function")
+		sig := v.signature(v.m.Funcs[in.Var.Index].Signature)
+		v.popOpds(sig.ParamTypes())
+		v.pushOpds(sig.Results)
+	case CALL_INDIRECT:
+		if t := v.table(in.TableVar); t != FUNCREF {
+			v.errorf("type mismatch: expected a table of funcref, found %s", keyword[t])
+		}
+		sig := v.signature(in.Sig)
+		v.popOpd(I32)
+		v.popOpds(sig.ParamTypes())
+		v.pushOpds(sig.Results)
+	case RETURN_CALL:
+		v.validateIndex(in.Var, len(v.m.Funcs), "function")
+		sig := v.signature(v.m.Funcs[in.Var.Index].Signature)
+		v.validateTailCall(sig)
+		v.popOpds(sig.ParamTypes())
+		v.setUnreachable()
+	case RETURN_CALL_INDIRECT:
+		if t := v.table(in.TableVar); t != FUNCREF {
+			v.errorf("type mismatch: expected a table of funcref, found %s", keyword[t])
+		}
+		sig := v.signature(in.Sig)
+		v.validateTailCall(sig)
+		v.popOpd(I32)
+		v.popOpds(sig.ParamTypes())
+		v.setUnreachable()
+	case BR:
+		v.popOpds(v.label(in.Var))
+		v.setUnreachable()
+	case BR_IF:
+		v.popOpd(I32)
+		types := v.label(in.Var)
+		v.popOpds(types)
+		v.pushOpds(types)
+	case BR_TABLE:
+		v.popOpd(I32)
+		types := v.label(in.Var)
+		for _, l := range in.Table {
+			if !equalTypes(v.label(l), types) {
+				v.errorf("type mismatch: br_table labels of different types")
+			}
+		}
+		v.popOpds(types)
+		v.setUnreachable()
+	case RETURN:
+		v.popOpds(v.ctrls[0].labelTypes)
+		v.setUnreachable()
+	case MEMORY_COPY, MEMORY_FILL:
+		v.validateMemory()
+		v.popOpds([]tokenType{I32, I32, I32})
+	case MEMORY_INIT:
+		v.validateMemory()
+		v.validateIndex(in.Var, len(v.m.Data), "data segment")
+		v.popOpds([]tokenType{I32, I32, I32})
+	case DATA_DROP:
+		v.validateIndex(in.Var, len(v.m.Data), "data segment")
+	case TABLE_COPY:
+		if dst, src := v.table(in.TableVar), v.table(in.Var); dst != src {
+			v.errorf("type mismatch: copy of %s into a table of %s", keyword[src], keyword[dst])
+		}
+		v.popOpds([]tokenType{I32, I32, I32})
+	case TABLE_INIT:
+		if t := v.table(in.TableVar); t != FUNCREF {
+			v.errorf("type mismatch: expected a table of funcref, found %s", keyword[t])
+		}
+		v.validateIndex(in.Var, len(v.m.Elems), "element segment")
+		v.popOpds([]tokenType{I32, I32, I32})
+	case ELEM_DROP:
+		v.validateIndex(in.Var, len(v.m.Elems), "element segment")
+	case REF_NULL:
+		v.pushOpd(in.Type)
+	case REF_IS_NULL:
+		if t := v.popOpd(0); !t.IsRefType() && t != 0 {
+			v.errorf("type mismatch: expected a reference, found %s", keyword[t])
+		}
+		v.pushOpd(I32)
+	case REF_FUNC:
+		v.validateIndex(in.Var, len(v.m.Funcs), "function")
+		if !v.refs[in.Var.Index] {
+			v.errorf("undeclared function reference")
+		}
+		v.pushOpd(FUNCREF)
+	case TABLE_GET:
+		t := v.table(in.TableVar)
+		v.popOpd(I32)
+		v.pushOpd(t)
+	case TABLE_SET:
+		v.popOpds([]tokenType{I32, v.table(in.TableVar)})
+	case TABLE_SIZE:
+		v.table(in.TableVar)
+		v.pushOpd(I32)
+	case TABLE_GROW:
+		v.popOpds([]tokenType{v.table(in.TableVar), I32})
+		v.pushOpd(I32)
+	case TABLE_FILL:
+		v.popOpds([]tokenType{I32, v.table(in.TableVar), I32})
+	default:
+		v.errorf("unknown instruction")
+	}
+}
+
+// validateVectorInstruction validates in, a vector instruction.
+func (v *validator) validateVectorInstruction(in *Instruction) {
+	params, result, ok := in.VectorType()
+	if !ok {
+		v.errorf("unknown instruction")
+	}
+	switch in.Op {
+	case EXTRACT_LANE, REPLACE_LANE:
+		if in.Lane >= in.Type.Lanes() {
+			v.errorf("invalid lane index")
+		}
+	case LOAD_LANE, STORE_LANE:
+		if in.Lane >= 128/in.Width {
+			v.errorf("invalid lane index")
+		}
+	case SHUFFLE:
+		for i := uint(0); i < 128; i += 8 {
+			if uint8(in.Vector[i/64]>>(i%64)) >= 32 {
+				v.errorf("invalid lane index")
+			}
+		}
+	}
+	switch in.Op {
+	case LOAD, LOAD_LANE, LOAD_SPLAT, LOAD_ZERO, STORE, STORE_LANE:
+		v.validateMemArg(in)
+	}
+	v.popOpds(params)
+	if result != 0 {
+		v.pushOpd(result)
+	}
+}
+
+// requireFeature checks that the features of f are enabled.
+func (v *validator) requireFeature(f Features) {
+	if f&^v.features != 0 {
+		v.errorf("%s feature not enabled", f&^v.features)
+	}
+}
+
+// validateTailCall checks that the results of the callee sig of a tail
+// call are those of the function, which returns them.
+func (v *validator) validateTailCall(sig *FuncSig) {
+	if !equalTypes(sig.Results, v.ctrls[0].labelTypes) {
+		v.errorf("type mismatch: tail call to a function of different results")
+	}
+}
+
+// validateMemory checks that the module has a memory.
+func (v *validator) validateMemory() {
+	if len(v.m.Memories) == 0 {
+		v.errorf("unknown memory")
+	}
+}
+
+// table returns the type of the elements of the table x, or of the table
+// 0 if x is nil.
+func (v *validator) table(x *Variable) tokenType {
+	if x == nil {
+		if len(v.m.Tables) == 0 {
+			v.errorf("unknown table")
+		}
+		return v.m.Tables[0].RefType()
+	}
+	v.validateIndex(x, len(v.m.Tables), "table")
+	return v.m.Tables[x.Index].RefType()
+}
+
+func (v *validator) validateMemArg(in *Instruction) {
+	v.validateMemory()
+	switch {
+	case in.Align == 0 || in.Align&(in.Align-1) != 0:
+		v.errorf("alignment must be a power of two")
+	case in.Align > uint32(in.accessWidth()/8):
+		v.errorf("alignment must not be larger than natural")
+	}
+}
+
+// validateAtomicMemArg checks the memory access of the atomic instruction
+// in, which must be aligned to its width.
+func (v *validator) validateAtomicMemArg(in *Instruction) {
+	v.validateMemory()
+	if in.Align != uint32(in.Width/8) {
+		v.errorf("alignment must be equal to natural")
+	}
+}
+
+// local returns the type of the local x.
+func (v *validator) local(x *Variable) tokenType {
+	v.validateIndex(x, len(v.locals), "local")
+	return v.locals[x.Index]
+}
+
+// global returns the global x.
+func (v *validator) global(x *Variable) *Global {
+	v.validateIndex(x, len(v.m.Globals), "global")
+	return v.m.Globals[x.Index]
+}
+
+// label returns the types of the values that a branch to the label x takes.
+func (v *validator) label(x *Variable) []tokenType {
+	v.validateIndex(x, len(v.ctrls), "label")
+	return v.ctrls[len(v.ctrls)-1-x.Index].labelTypes
+}
+
+func (v *validator) pushOpd(t tokenType) { v.opds = append(v.opds, t) }
+
+func (v *validator) pushOpds(types []tokenType) {
+	for _, t := range types {
+		v.pushOpd(t)
+	}
+}
+
+// popOpd pops an operand of type want, or of any type if want is zero,
+// and returns its type.
+func (v *validator) popOpd(want tokenType) tokenType {
+	ctrl := &v.ctrls[len(v.ctrls)-1]
+	if len(v.opds) == ctrl.height {
+		if ctrl.unreachable {
+			return want
+		}
+		if want == 0 {
+			v.errorf("type mismatch: expected a value, found nothing")
+		}
+		v.errorf("type mismatch: expected %s, found nothing", keyword[want])
+	}
+	t := v.opds[len(v.opds)-1]
+	v.opds = v.opds[:len(v.opds)-1]
+	if t != 0 && want != 0 && t != want {
+		v.errorf("type mismatch: expected %s, found %s", keyword[want], keyword[t])
+	}
+	if t == 0 {
+		return want
+	}
+	return t
+}
+
+// popOpds pops operands of the given types, the last one first.
+func (v *validator) popOpds(types []tokenType) {
+	for i := len(types) - 1; i >= 0; i-- {
+		v.popOpd(types[i])
+	}
+}
+
+func (v *validator) pushCtrl(label, end []tokenType) {
+	v.ctrls = append(v.ctrls, ctrlFrame{labelTypes: label, endTypes: end, height: len(v.opds)})
+}
+
+// popCtrl ends the current block and returns the types of its results.
+func (v *validator) popCtrl() []tokenType {
+	ctrl := v.ctrls[len(v.ctrls)-1]
+	v.popOpds(ctrl.endTypes)
+	if len(v.opds) != ctrl.height {
+		v.errorf("type mismatch: values remaining on the stack at the end of the block")
+	}
+	v.ctrls = v.ctrls[:len(v.ctrls)-1]
+	return ctrl.endTypes
+}
+
+func (v *validator) setUnreachable() {
+	ctrl := &v.ctrls[len(v.ctrls)-1]
+	v.opds = v.opds[:ctrl.height]
+	ctrl.unreachable = true
+}
+
+func equalTypes(a, b []tokenType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// walk calls f for each instruction of body, in order, including operands
+// and the instructions in blocks, which are visited after the instructions
+// they contain.
+func walk(body []Instr, f func(Instr)) {
+	for _, in := range body {
+		switch in := in.(type) {
+		case *Instruction:
+			walk(in.Operands, f)
+		case *Block:
+			walk(in.Body, f)
+		case *Loop:
+			walk(in.Body, f)
+		case *If:
+			walk(in.Cond, f)
+			walk(in.Then, f)
+			walk(in.Else, f)
+		}
+		f(in)
+	}
+}
@@ -0,0 +1,330 @@
+package ast
+
+import (
+	"strings"
+	"testing"
+)
+
+var validatetests = []struct {
+	in, err string
+}{
+	{`(module (memory 1) (func
+		i32.const 0 i64.load32_u offset=8 align=4 drop
+		i32.const 0 f64.const 0 f64.store align=1
+		i32.const 0 i32.load8_s drop))`, ""},
+	{`(module (memory 1) (func $f (block (drop (i64.load32_u align=8 (i32.const 0))))))`,
+		"func $f: i64.load32_u align=8: alignment must not be larger than natural"},
+	{`(module (memory 1) (func) (func (i32.store16 align=3 (i32.const 0) (i32.const 0))))`,
+		"func 1: i32.store16 align=3: alignment must be a power of two"},
+	{`(module (memory 1) (func (f32.store align=0 (i32.const 0) (f32.const 0))))`,
+		"func 0: f32.store align=0: alignment must be a power of two"},
+	{`(module
+		(type (func (param i32) (result i64)))
+		(table 1 anyfunc)
+		(elem (i32.const 0) 0)
+		(func (param i32) (result i64)
+			(block (result i64)
+				(drop (br_if 0 (i64.const 1) (get_local 0)))
+				(if (result i64) (get_local 0)
+					(then (i64.const 1))
+					(else (call_indirect (type 0) (i32.const 1) (i32.const 0)))))
+			(loop $l (br_table $l $l (get_local 0)))
+			unreachable i32.add drop))`, ""},
+	{`(module (func (result i32) i64.const 0))`,
+		"func 0: i64.const 0: type mismatch: expected i32, found i64"},
+	{`(module (func (result i32)))`,
+		"func 0: type mismatch: expected i32, found nothing"},
+	{`(module (func i32.const 0))`,
+		"func 0: i32.const 0: type mismatch: values remaining on the stack at the end of the block"},
+	{`(module (func (param f32) (drop (i32.eqz (get_local 0)))))`,
+		"func 0: i32.eqz: type mismatch: expected i32, found f32"},
+	{`(module (func (if (result i32) (i32.const 0) (then (i32.const 1)))))`,
+		"func 0: if: type mismatch: if without else cannot have results"},
+	{`(module (func (block (result i32) (br_table 0 1 (i32.const 0) (i32.const 0))) drop))`,
+		"func 0: br_table 0 1: type mismatch: br_table labels of different types"},
+	{`(module (func (call_indirect (type 0) (i32.const 0))))`,
+		"func 0: call_indirect (type 0): unknown table"},
+	{`(module (table 0 anyfunc) (func (call_indirect (type 0) (i32.const 0))))`,
+		"func 0: call_indirect (type 0): unknown type 0"},
+	{`(module (func (result i32) (result i32) unreachable))`, "func 0: invalid result arity"},
+	{`(module (table 1 anyfunc) (table 1 anyfunc))`, "multiple tables"},
+	{`(module (table 2 1 anyfunc))`, "table 0: size minimum must not be greater than maximum"},
+	{`(module (table 1 anyfunc) (elem (i64.const 0)))`, "elem 0: type mismatch: expected i32, found i64"},
+	{`(module (table 1 anyfunc) (elem (offset (i32.const 0) (nop))))`, "elem 0: constant expression required"},
+	{`(module (table 1 anyfunc) (elem (i32.const 0) 0))`, "elem 0: unknown function 0"},
+	{`(module (func (export "f")) (export "f" (func 0)))`, "export \"f\": duplicate export name \"f\""},
+	{`(module (func get_global 0))`, "func 0: get_global 0: unknown global 0"},
+	{`(module (start 0))`, "start: unknown function 0"},
+	{`(module (func (param i32)) (start 0))`, "start: start function must have type [] -> []"},
+	{`(module (type (func (result i32))) (func (type 0) unreachable) (start 0))`,
+		"start: start function must have type [] -> []"},
+	{`(module (import "a" "b" (func)) (start 0))`, ""},
+	{`(module (global $g i32 (i32.const 0)) (func (set_global $g (i32.const 1))))`,
+		"func 0: set_global $g: global is immutable"},
+	{`(module (global (mut i32) (i32.const 0)) (func (set_global 0 (i64.const 1))))`,
+		"func 0: set_global 0: type mismatch: expected i32, found i64"},
+	{`(module (global f32 (f64.const 0)))`, "global 0: type mismatch: expected f32, found f64"},
+	{`(module (global i32))`, "global 0: constant expression required"},
+	{`(module (global i32 (i32.const 0)) (global i32 (get_global 0)))`, "global 1: unknown global 0"},
+	{`(module (import "a" "b" (global (mut i32))) (global i32 (get_global 0)))`,
+		"global 1: constant expression required"},
+	{`(module (global $g (export "g") i32 (i32.const 0)) (export "g" (global $g)))`,
+		"export \"g\": duplicate export name \"g\""},
+	{`(module
+		(import "a" "b" (global i32))
+		(global (mut i32) (get_global 0))
+		(memory 1) (data (get_global 0))
+		(func (result i32) (set_global 1 (get_global 0)) (get_global 1)))`, ""},
+	{`(module (func (drop (i32.load (i32.const 0)))))`, "func 0: i32.load: unknown memory"},
+	{`(module (func (drop (current_memory))))`, "func 0: current_memory: unknown memory"},
+	{`(module (memory 1) (memory 1))`, "multiple memories"},
+	{`(module (memory 2 1))`, "memory 0: size minimum must not be greater than maximum"},
+	{`(module (memory $m 65537))`, "memory $m: memory size must be at most 65536 pages (4GiB)"},
+	{`(module (memory 0 65537))`, "memory 0: memory size must be at most 65536 pages (4GiB)"},
+	{`(module (data (i32.const 0)))`, "data 0: unknown memory 0"},
+	{`(module (memory 1) (data (f32.const 0)))`, "data 0: type mismatch: expected i32, found f32"},
+	{`(module (memory 1) (export "m" (memory 1)))`, "export \"m\": unknown memory 1"},
+	{`(module (memory 1) (data (i32.const 8) "hi") (func (drop (grow_memory (i32.const 1)))))`, ""},
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range validatetests {
+		m, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		err = Validate(m)
+		if got := errString(err); got != tt.err {
+			t.Errorf("%s: got error %q, want %q", tt.in, got, tt.err)
+		}
+	}
+}
+
+func TestValidateFeatures(t *testing.T) {
+	m, err := Parse(strings.NewReader(`(module (func (param i32) (result i64)
+		(i64.extend8_s (i64.extend_u/i32 (i32.extend16_s (get_local 0))))))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "func 0: i32.extend16_s: sign-extension feature not enabled"
+	if err := Validate(m); errString(err) != want {
+		t.Errorf("Validate: got error %v, want %q", err, want)
+	}
+	if err := ValidateFeatures(m, SignExtension); err != nil {
+		t.Errorf("ValidateFeatures(SignExtension): %v", err)
+	}
+
+	m, err = Parse(strings.NewReader(`(module (func (param f32) (result i64)
+		(i64.trunc_sat_f32_u (get_local 0))))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "func 0: i64.trunc_sat_f32_u: saturating-float-to-int feature not enabled"
+	if err := ValidateFeatures(m, SignExtension); errString(err) != want {
+		t.Errorf("ValidateFeatures(SignExtension): got error %v, want %q", err, want)
+	}
+	if err := ValidateFeatures(m, SaturatingFloatToInt); err != nil {
+		t.Errorf("ValidateFeatures(SaturatingFloatToInt): %v", err)
+	}
+
+	for _, tt := range []struct{ in, err string }{
+		{`(module (memory 1) (func (memory.fill (i32.const 0) (i32.const 0) (i32.const 0))))`,
+			"func 0: memory.fill: bulk-memory feature not enabled"},
+		{`(module (data "a"))`, "data 0: bulk-memory feature not enabled"},
+	} {
+		m, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Validate(m); errString(err) != tt.err {
+			t.Errorf("%s: Validate: got error %v, want %q", tt.in, err, tt.err)
+		}
+		if err := ValidateFeatures(m, BulkMemory); err != nil {
+			t.Errorf("%s: ValidateFeatures(BulkMemory): %v", tt.in, err)
+		}
+	}
+
+	for _, tt := range []struct{ in, err, withFeature string }{
+		{`(module (table 1 funcref) (table 1 funcref))`, "multiple tables", ""},
+		{`(module (func (local funcref)))`, "func 0: reference-types feature not enabled", ""},
+		{`(module (func (drop (ref.func 0))))`, "func 0: ref.func 0: reference-types feature not enabled",
+			"func 0: ref.func 0: undeclared function reference"},
+		{`(module (table 1 externref) (func $f) (elem (i32.const 0) $f))`, "table 0: reference-types feature not enabled",
+			"elem 0: type mismatch: expected externref, found funcref"},
+		{`(module (func (param externref) (drop (select (get_local 0) (get_local 0) (i32.const 0)))))`,
+			"func 0: reference-types feature not enabled",
+			"func 0: select: type mismatch: select of externref without a result type"},
+	} {
+		m, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Validate(m); errString(err) != tt.err {
+			t.Errorf("%s: Validate: got error %v, want %q", tt.in, err, tt.err)
+		}
+		if err := ValidateFeatures(m, ReferenceTypes); errString(err) != tt.withFeature {
+			t.Errorf("%s: ValidateFeatures(ReferenceTypes): got error %v, want %q", tt.in, err, tt.withFeature)
+		}
+	}
+
+	for _, tt := range []struct{ in, err, withFeature string }{
+		{`(module (global v128 (v128.const i64x2 0 0)))`, "global 0: simd feature not enabled", ""},
+		{`(module (func (drop (i32x4.extract_lane 4 (v128.const i64x2 0 0)))))`,
+			"func 0: v128.const i32x4 0x00000000 0x00000000 0x00000000 0x00000000: simd feature not enabled",
+			"func 0: i32x4.extract_lane 4: invalid lane index"},
+		{`(module (memory 1) (func (drop (v128.load8_lane 16 (i32.const 0) (v128.const i64x2 0 0)))))`,
+			"func 0: v128.const i32x4 0x00000000 0x00000000 0x00000000 0x00000000: simd feature not enabled",
+			"func 0: v128.load8_lane 16: invalid lane index"},
+		{`(module (func (drop (i8x16.shuffle 0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 32 (v128.const i64x2 0 0) (v128.const i64x2 0 0)))))`,
+			"func 0: v128.const i32x4 0x00000000 0x00000000 0x00000000 0x00000000: simd feature not enabled",
+			"func 0: i8x16.shuffle 0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 32: invalid lane index"},
+		{`(module (memory 1) (func (drop (v128.load8x8_s align=16 (i32.const 0)))))`,
+			"func 0: v128.load8x8_s align=16: simd feature not enabled",
+			"func 0: v128.load8x8_s align=16: alignment must not be larger than natural"},
+		{`(module (func (drop (i32x4.add (v128.const i64x2 0 0) (i32.const 0)))))`,
+			"func 0: v128.const i32x4 0x00000000 0x00000000 0x00000000 0x00000000: simd feature not enabled",
+			"func 0: i32x4.add: type mismatch: expected v128, found i32"},
+	} {
+		m, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Validate(m); errString(err) != tt.err {
+			t.Errorf("%s: Validate: got error %v, want %q", tt.in, err, tt.err)
+		}
+		if err := ValidateFeatures(m, SIMD); errString(err) != tt.withFeature {
+			t.Errorf("%s: ValidateFeatures(SIMD): got error %v, want %q", tt.in, err, tt.withFeature)
+		}
+	}
+
+	for _, tt := range []struct{ in, err, withFeature string }{
+		{`(module (func $f (result i32) (return_call $f)))`, "func $f: return_call $f: tail-call feature not enabled", ""},
+		{`(module (func $f (param i32) (result i32) (return_call $f (i32.const 1)) (drop (i32.const 0))))`,
+			"func $f: return_call $f: tail-call feature not enabled", ""},
+		{`(module (func $f (result i64) (i64.const 0)) (func (result i32) (return_call $f)))`,
+			"func 1: return_call $f: tail-call feature not enabled",
+			"func 1: return_call $f: type mismatch: tail call to a function of different results"},
+		{`(module (func $f (param i32)) (func (return_call $f (i64.const 0))))`,
+			"func 1: return_call $f: tail-call feature not enabled",
+			"func 1: return_call $f: type mismatch: expected i32, found i64"},
+		{`(module (type $t (func (result i32))) (table 1 funcref) (func (result i32) (return_call_indirect (type $t) (i32.const 0))))`,
+			"func 0: return_call_indirect (type $t): tail-call feature not enabled", ""},
+		{`(module (type $t (func)) (table 1 funcref) (func (result i32) (return_call_indirect (type $t) (i32.const 0))))`,
+			"func 0: return_call_indirect (type $t): tail-call feature not enabled",
+			"func 0: return_call_indirect (type $t): type mismatch: tail call to a function of different results"},
+	} {
+		m, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Validate(m); errString(err) != tt.err {
+			t.Errorf("%s: Validate: got error %v, want %q", tt.in, err, tt.err)
+		}
+		if err := ValidateFeatures(m, TailCall); errString(err) != tt.withFeature {
+			t.Errorf("%s: ValidateFeatures(TailCall): got error %v, want %q", tt.in, err, tt.withFeature)
+		}
+	}
+
+	for _, tt := range []struct{ in, err, withFeature string }{
+		{`(module (memory 1 1 shared))`, "memory 0: threads feature not enabled", ""},
+		{`(module (memory 1 shared))`, "memory 0: threads feature not enabled", "memory 0: shared memory must have maximum"},
+		{`(module (memory 1) (func (drop (i32.atomic.load (i32.const 0)))))`,
+			"func 0: i32.atomic.load: threads feature not enabled", ""},
+		{`(module (func (drop (i32.atomic.load (i32.const 0)))))`,
+			"func 0: i32.atomic.load: threads feature not enabled", "func 0: i32.atomic.load: unknown memory"},
+		{`(module (memory 1) (func (drop (i64.atomic.rmw16.add_u align=1 (i32.const 0) (i64.const 0)))))`,
+			"func 0: i64.atomic.rmw16.add_u align=1: threads feature not enabled",
+			"func 0: i64.atomic.rmw16.add_u align=1: alignment must be equal to natural"},
+		{`(module (memory 1) (func (drop (i32.atomic.rmw.cmpxchg (i32.const 0) (i32.const 0)))))`,
+			"func 0: i32.atomic.rmw.cmpxchg: threads feature not enabled",
+			"func 0: i32.atomic.rmw.cmpxchg: type mismatch: expected i32, found nothing"},
+		{`(module (memory 1) (func (drop (memory.atomic.wait64 (i32.const 0) (i32.const 0) (i64.const 0)))))`,
+			"func 0: memory.atomic.wait64: threads feature not enabled",
+			"func 0: memory.atomic.wait64: type mismatch: expected i64, found i32"},
+	} {
+		m, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Validate(m); errString(err) != tt.err {
+			t.Errorf("%s: Validate: got error %v, want %q", tt.in, err, tt.err)
+		}
+		if err := ValidateFeatures(m, Threads); errString(err) != tt.withFeature {
+			t.Errorf("%s: ValidateFeatures(Threads): got error %v, want %q", tt.in, err, tt.withFeature)
+		}
+	}
+}
+
+var multivaluetests = []struct {
+	in, err string
+}{
+	{`(module
+		(type $pair (func (param i32) (result i32 i32)))
+		(func $dup (type $pair) (get_local 0) (get_local 0))
+		(func (param i32) (result i32 i64)
+			(call $dup (get_local 0))
+			(block (param i32 i32) (result i32) i32.add)
+			(if (type $pair) (i32.const 1)
+				(then (br 0 (i32.const 2) (i32.const 3)))
+				(else (i32.const 4)))
+			(if (param i32) (result i32) (get_local 0) (then (br_if 0 (i32.const 1))))
+			drop
+			(loop (param i32) (result i32 i64) (i64.const 1))))`, ""},
+	{`(module (func (result i32 i32) (i32.const 0)))`,
+		"func 0: i32.const 0: type mismatch: expected i32, found nothing"},
+	{`(module (func (i64.const 0) (block (param i32) drop)))`,
+		"func 0: block: type mismatch: expected i32, found i64"},
+	{`(module (func (result i32) (i32.const 0) (loop $l (param i32) (result i32) (br $l (i64.const 0)))))`,
+		"func 0: br $l: type mismatch: expected i32, found i64"},
+	{`(module (func (param i32) (result i32) (get_local 0) (if (param i32) (result i64) (get_local 0) (then drop (i64.const 0)))))`,
+		"func 0: if: type mismatch: if without else cannot have results"},
+}
+
+func TestValidateMultiValue(t *testing.T) {
+	for _, tt := range multivaluetests {
+		m, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if err := Validate(m); err == nil {
+			t.Errorf("%s: valid without the multi-value feature", tt.in)
+		}
+		err = ValidateFeatures(m, MultiValue)
+		if got := errString(err); got != tt.err {
+			t.Errorf("%s: got error %q, want %q", tt.in, got, tt.err)
+		}
+	}
+}
+
+func TestValidateOperandTypes(t *testing.T) {
+	m, err := Parse(strings.NewReader(`(module (func (param v128 i32) (result i32)
+		(drop (get_local 0))
+		(select (get_local 1) (i32.const 0) (get_local 1))
+		unreachable
+		drop))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, err := ValidateOperandTypes(m, SIMD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := m.Funcs[0].Body
+	for i, want := range []TokenType{V128, I32, 0, 0} {
+		if got := types[body[i].(*Instruction)]; got != want {
+			t.Errorf("%s: got operand type %s, want %s", body[i], got, want)
+		}
+	}
+	if len(types) != 2 {
+		t.Errorf("got %d operand types, want 2", len(types))
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,57 @@
+// Command wasm2go translates a module in the text format to a Go package.
+//
+// Usage:
+//
+//	wasm2go [-pkg name] [-o file.go] module.wat
+//
+// The Go source is written to standard output unless -o is given.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sprt/wasm/ast"
+	"github.com/sprt/wasm/wasm2go"
+)
+
+func main() {
+	pkg := flag.String("pkg", "main", "name of the generated `package`")
+	out := flag.String("o", "", "write the output to `file`")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: wasm2go [-pkg name] [-o file.go] module.wat\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0), *pkg, *out); err != nil {
+		fmt.Fprintf(os.Stderr, "wasm2go: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(path, pkg, out string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m, err := ast.Parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	var buf bytes.Buffer
+	if err := wasm2go.Generate(&buf, m, pkg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return os.WriteFile(out, buf.Bytes(), 0666)
+}
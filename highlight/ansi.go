@@ -0,0 +1,37 @@
+package highlight
+
+import (
+	"io"
+	"strings"
+)
+
+// SGR parameters of the ANSI escape sequence used for each class.
+var ansiStyles = [...]string{
+	Plain:       "",
+	Keyword:     "1;35", // bold magenta
+	ValueType:   "36",   // cyan
+	Instruction: "34",   // blue
+	IdentDef:    "1;33", // bold yellow
+	IdentRef:    "33",   // yellow
+	String:      "32",   // green
+	Number:      "31",   // red
+	Comment:     "2",    // faint
+}
+
+// WriteANSI writes src to w, colourized with ANSI escape sequences
+// for display on a terminal.
+func WriteANSI(w io.Writer, src []byte, spans []Span) error {
+	for _, s := range spans {
+		text := string(src[s.Start:s.End])
+		if s.Class > Plain && int(s.Class) < len(ansiStyles) {
+			// Reset before any newline so that pagers such as less -R
+			// don't carry the style over to the next line.
+			style := "\x1b[" + ansiStyles[s.Class] + "m"
+			text = style + strings.Replace(text, "\n", "\x1b[0m\n"+style, -1) + "\x1b[0m"
+		}
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
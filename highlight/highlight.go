@@ -0,0 +1,211 @@
+// Package highlight classifies the text format for syntax highlighting.
+package highlight
+
+import (
+	"bytes"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// Class is the semantic class of a range of source text.
+type Class int
+
+const (
+	Plain       Class = iota // whitespace, parentheses, punctuation
+	Keyword                  // module, func, param, offset, ...
+	ValueType                // i32, f64, anyfunc, ...
+	Instruction              // i32.add, get_local, br_if, ...
+	IdentDef                 // $name where it is declared
+	IdentRef                 // $name where it is used
+	String
+	Number
+	Comment
+)
+
+var classNames = [...]string{
+	Plain:       "plain",
+	Keyword:     "keyword",
+	ValueType:   "type",
+	Instruction: "instr",
+	IdentDef:    "def",
+	IdentRef:    "ref",
+	String:      "string",
+	Number:      "number",
+	Comment:     "comment",
+}
+
+func (c Class) String() string {
+	if c < 0 || int(c) >= len(classNames) {
+		return "plain"
+	}
+	return classNames[c]
+}
+
+// Span is a classified range of source text, src[Start:End].
+type Span struct {
+	Start, End int
+	Class      Class
+}
+
+// Classify splits src into spans that cover it entirely, in order.
+// Adjacent ranges of the same class are merged into one span.
+// If src cannot be scanned, the input after the last good token
+// is returned as Plain along with the error.
+func Classify(src []byte) ([]Span, error) {
+	tokens, err := ast.Scan(bytes.NewReader(src))
+	c := &classifier{tokens: tokens}
+	for i := 0; i < len(tokens); {
+		i = c.classify(i)
+	}
+	c.add(Span{Start: len(src), End: len(src)}) // flush trailing gap
+	return c.spans, err
+}
+
+type classifier struct {
+	tokens []ast.Token
+	heads  []ast.Token // head token of each enclosing form, zero if none
+	spans  []Span
+}
+
+// classify classifies the word that begins with tokens[i]
+// and returns the index of the next token.
+func (c *classifier) classify(i int) int {
+	t := c.tokens[i]
+	switch t.Type {
+	case ast.LPAREN:
+		var head ast.Token
+		if i+1 < len(c.tokens) {
+			head = c.tokens[i+1]
+		}
+		c.heads = append(c.heads, head)
+		c.addToken(t, Plain)
+	case ast.RPAREN:
+		if len(c.heads) > 0 {
+			c.heads = c.heads[:len(c.heads)-1]
+		}
+		c.addToken(t, Plain)
+	case ast.EQUAL:
+		c.addToken(t, Plain)
+	case ast.STRING:
+		c.addToken(t, String)
+	case ast.NUMBER:
+		c.addToken(t, Number)
+	case ast.COMMENT:
+		c.addToken(t, Comment)
+	case ast.NAME:
+		if c.isDef(i) {
+			c.addToken(t, IdentDef)
+		} else {
+			c.addToken(t, IdentRef)
+		}
+	default:
+		j := c.wordEnd(i)
+		class := wordClass(c.tokens[i:j])
+		for _, t := range c.tokens[i:j] {
+			c.addToken(t, class)
+		}
+		return j
+	}
+	return i + 1
+}
+
+// wordEnd returns the index following the last token of the word that
+// begins with tokens[i], such as the four tokens of "i32.trunc_s".
+func (c *classifier) wordEnd(i int) int {
+	j := i + 1
+	for ; j < len(c.tokens); j++ {
+		prev, t := c.tokens[j-1], c.tokens[j]
+		if t.Offset != prev.Offset+len(prev.Text) {
+			break
+		}
+		switch t.Type {
+		case ast.NUMBER:
+			// The access width in i32.load8_s and i32.atomic.rmw8.add_u, or
+			// the width in i32.extend8_s and memory.atomic.wait32
+			switch prev.Type {
+			case ast.LOAD, ast.STORE, ast.EXTEND, ast.RMW, ast.WAIT:
+			default:
+				return j
+			}
+		case ast.LPAREN, ast.RPAREN, ast.EQUAL, ast.STRING, ast.COMMENT, ast.NAME:
+			return j
+		}
+	}
+	return j
+}
+
+func wordClass(word []ast.Token) Class {
+	for _, t := range word {
+		if t.Type == ast.DOT || t.Type.IsOperator() {
+			return Instruction
+		}
+	}
+	if len(word) == 1 && (word[0].Type.IsValueType() || word[0].Type.IsElemType() || word[0].Type.IsShape()) {
+		return ValueType
+	}
+	return Keyword
+}
+
+// isDef reports whether the name tokens[i] is declared at this point,
+// as opposed to referenced.
+func (c *classifier) isDef(i int) bool {
+	if i == 0 {
+		return false
+	}
+	switch c.tokens[i-1].Type {
+	case ast.MODULE, ast.PARAM, ast.LOCAL, ast.BLOCK, ast.LOOP, ast.IF:
+		return true
+	case ast.FUNC, ast.GLOBAL, ast.MEMORY, ast.TABLE:
+		// Declared unless exported: (export "f" (func $f)), the operand of
+		// an instruction: ref.func $f, or in an element segment:
+		// (elem declare func $f)
+		return c.parent().Type != ast.EXPORT && (i < 2 || c.tokens[i-2].Type != ast.DOT) &&
+			c.head().Type != ast.ELEM
+	case ast.DATA, ast.ELEM:
+		// Declared by a segment, not in (table funcref (elem $f))
+		return len(c.heads) < 2 || c.parent().Type == ast.MODULE
+	case ast.TYPE:
+		// Declared at module level only, not in (func (type $t))
+		return len(c.heads) < 2 || c.parent().Type == ast.MODULE
+	}
+	return false
+}
+
+// head returns the head of the current form.
+func (c *classifier) head() ast.Token {
+	if len(c.heads) == 0 {
+		return ast.Token{}
+	}
+	return c.heads[len(c.heads)-1]
+}
+
+// parent returns the head of the form enclosing the current one.
+func (c *classifier) parent() ast.Token {
+	if len(c.heads) < 2 {
+		return ast.Token{}
+	}
+	return c.heads[len(c.heads)-2]
+}
+
+func (c *classifier) addToken(t ast.Token, class Class) {
+	c.add(Span{Start: t.Offset, End: t.Offset + len(t.Text), Class: class})
+}
+
+// add appends s, filling any gap since the previous span with Plain.
+func (c *classifier) add(s Span) {
+	end := 0
+	if n := len(c.spans); n > 0 {
+		end = c.spans[n-1].End
+	}
+	if end < s.Start {
+		c.add(Span{Start: end, End: s.Start, Class: Plain})
+	}
+	if s.Start == s.End {
+		return
+	}
+	if n := len(c.spans); n > 0 && c.spans[n-1].Class == s.Class {
+		c.spans[n-1].End = s.End
+		return
+	}
+	c.spans = append(c.spans, s)
+}
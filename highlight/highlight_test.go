@@ -0,0 +1,136 @@
+package highlight
+
+import (
+	"bytes"
+	"testing"
+)
+
+type classified struct {
+	text  string
+	class Class
+}
+
+var classifytests = []struct {
+	in   string
+	want []classified
+}{
+	{"(module $m)", []classified{
+		{"(", Plain}, {"module", Keyword}, {" ", Plain}, {"$m", IdentDef}, {")", Plain},
+	}},
+	{`(func $f (param $x i32) ;; add
+  i32.add (call $f))`, []classified{
+		{"(", Plain}, {"func", Keyword}, {" ", Plain}, {"$f", IdentDef}, {" (", Plain},
+		{"param", Keyword}, {" ", Plain}, {"$x", IdentDef}, {" ", Plain}, {"i32", ValueType},
+		{") ", Plain}, {";; add", Comment}, {"\n  ", Plain}, {"i32.add", Instruction},
+		{" (", Plain}, {"call", Instruction}, {" ", Plain}, {"$f", IdentRef}, {"))", Plain},
+	}},
+	{`(export "f" (func $f)) (func (type $t)) (type $t)`, []classified{
+		{"(", Plain}, {"export", Keyword}, {" ", Plain}, {`"f"`, String}, {" (", Plain},
+		{"func", Keyword}, {" ", Plain}, {"$f", IdentRef}, {")) (", Plain},
+		{"func", Keyword}, {" (", Plain}, {"type", Keyword}, {" ", Plain}, {"$t", IdentRef}, {")) (", Plain},
+		{"type", Keyword}, {" ", Plain}, {"$t", IdentDef}, {")", Plain},
+	}},
+	{"offset=0x10 i64.extend_s/i32", []classified{
+		{"offset", Keyword}, {"=", Plain}, {"0x10", Number}, {" ", Plain},
+		{"i64.extend_s/i32", Instruction},
+	}},
+	{"i32.extend16_s", []classified{{"i32.extend16_s", Instruction}}},
+	{"(ref.func $f) (ref.null extern) funcref", []classified{
+		{"(", Plain}, {"ref.func", Instruction}, {" ", Plain}, {"$f", IdentRef}, {") (", Plain},
+		{"ref.null", Instruction}, {" ", Plain}, {"extern", Keyword}, {") ", Plain},
+		{"funcref", ValueType},
+	}},
+	{`(elem declare func $f) (elem $e (i32.const 0) func $f $g) (data $d "")`, []classified{
+		{"(", Plain}, {"elem", Keyword}, {" ", Plain}, {"declare", Keyword}, {" ", Plain},
+		{"func", Keyword}, {" ", Plain}, {"$f", IdentRef}, {") (", Plain},
+		{"elem", Keyword}, {" ", Plain}, {"$e", IdentDef}, {" (", Plain}, {"i32.const", Instruction},
+		{" ", Plain}, {"0", Number}, {") ", Plain}, {"func", Keyword}, {" ", Plain},
+		{"$f", IdentRef}, {" ", Plain}, {"$g", IdentRef}, {") (", Plain},
+		{"data", Keyword}, {" ", Plain}, {"$d", IdentDef}, {" ", Plain}, {`""`, String}, {")", Plain},
+	}},
+	{`(table funcref (elem $f)) (data.drop $d)`, []classified{
+		{"(", Plain}, {"table", Keyword}, {" ", Plain}, {"funcref", ValueType}, {" (", Plain},
+		{"elem", Keyword}, {" ", Plain}, {"$f", IdentRef}, {")) (", Plain},
+		{"data.drop", Instruction}, {" ", Plain}, {"$d", IdentRef}, {")", Plain},
+	}},
+	{"i64.load32_u offset=8 align=4", []classified{
+		{"i64.load32_u", Instruction}, {" ", Plain}, {"offset", Keyword}, {"=", Plain}, {"8", Number},
+		{" ", Plain}, {"align", Keyword}, {"=", Plain}, {"4", Number},
+	}},
+	{"v128.const i32x4 1 2 3 4 v128.load8x8_s i32x4.trunc_sat_f64x2_u_zero", []classified{
+		{"v128.const", Instruction}, {" ", Plain}, {"i32x4", ValueType}, {" ", Plain}, {"1", Number},
+		{" ", Plain}, {"2", Number}, {" ", Plain}, {"3", Number}, {" ", Plain}, {"4", Number},
+		{" ", Plain}, {"v128.load8x8_s", Instruction}, {" ", Plain},
+		{"i32x4.trunc_sat_f64x2_u_zero", Instruction},
+	}},
+	{"i32.atomic.rmw8.add_u memory.atomic.wait32 (memory 1 1 shared)", []classified{
+		{"i32.atomic.rmw8.add_u", Instruction}, {" ", Plain}, {"memory.atomic.wait32", Instruction},
+		{" (", Plain}, {"memory", Keyword}, {" ", Plain}, {"1", Number}, {" ", Plain}, {"1", Number},
+		{" ", Plain}, {"shared", Keyword}, {")", Plain},
+	}},
+	{"(; a ;) anyfunc ?", []classified{
+		{"(; a ;)", Comment}, {" ", Plain}, {"anyfunc", ValueType}, {" ?", Plain},
+	}},
+}
+
+func TestClassify(t *testing.T) {
+	for _, tt := range classifytests {
+		spans, _ := Classify([]byte(tt.in))
+		var got []classified
+		for _, s := range spans {
+			got = append(got, classified{tt.in[s.Start:s.End], s.Class})
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s:\ngot  %v\nwant %v", tt.in, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: span %d: got %v, want %v", tt.in, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	const in = "(func) ?"
+	spans, err := Classify([]byte(in))
+	if err == nil {
+		t.Error("got nil error")
+	}
+	if last := spans[len(spans)-1]; last.End != len(in) {
+		t.Errorf("spans end at %d, want %d", last.End, len(in))
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	src := []byte(`(data "<&>")`)
+	spans, err := Classify(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteHTML(&buf, src, spans); err != nil {
+		t.Fatal(err)
+	}
+	const want = `(<span class="wat-keyword">data</span> <span class="wat-string">&#34;&lt;&amp;&gt;&#34;</span>)`
+	if got := buf.String(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestWriteANSI(t *testing.T) {
+	src := []byte("(; a\nb ;) nop")
+	spans, err := Classify(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteANSI(&buf, src, spans); err != nil {
+		t.Fatal(err)
+	}
+	const want = "\x1b[2m(; a\x1b[0m\n\x1b[2mb ;)\x1b[0m \x1b[34mnop\x1b[0m"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
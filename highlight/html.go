@@ -0,0 +1,23 @@
+package highlight
+
+import (
+	"html"
+	"io"
+)
+
+// WriteHTML writes src to w as HTML, wrapping each span that is not Plain
+// in a <span> element whose class is "wat-" followed by the class name,
+// e.g. <span class="wat-instr">i32.add</span>.
+// The caller supplies the enclosing element and the style sheet.
+func WriteHTML(w io.Writer, src []byte, spans []Span) error {
+	for _, s := range spans {
+		text := html.EscapeString(string(src[s.Start:s.End]))
+		if s.Class != Plain {
+			text = `<span class="wat-` + s.Class.String() + `">` + text + `</span>`
+		}
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package interp
+
+import (
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// The atomic accesses of a memory are made with sync/atomic, on the word
+// of 32 or 64 bits that holds the accessed bytes, so that instances that
+// execute concurrently in several goroutines see them whole and in a
+// single order. The words of memories are little-endian, and those of
+// the host are swapped if they are not.
+
+// littleEndian reports whether the host stores words in little-endian
+// byte order.
+var littleEndian = func() bool {
+	w := uint16(1)
+	return *(*byte)(unsafe.Pointer(&w)) == 1
+}()
+
+// le32 converts between the word w of the host and that of a memory.
+func le32(w uint32) uint32 {
+	if littleEndian {
+		return w
+	}
+	return bits.ReverseBytes32(w)
+}
+
+// le64 converts between the word w of the host and that of a memory.
+func le64(w uint64) uint64 {
+	if littleEndian {
+		return w
+	}
+	return bits.ReverseBytes64(w)
+}
+
+// atomicAddr returns the effective address of the atomic access of in to
+// the address addr of mem, or traps if the access is out of bounds or not
+// aligned to its width.
+func (mem *Memory) atomicAddr(in *ast.Instruction, addr uint64) uint64 {
+	ea := uint64(uint32(addr)) + uint64(in.Offset)
+	n := uint64(in.Width / 8)
+	if _, ok := mem.slice(ea, n); !ok {
+		trap(ErrOutOfBounds)
+	}
+	if ea%n != 0 {
+		trap(ErrUnalignedAtomic)
+	}
+	return ea
+}
+
+// atomicLoad returns the value of width bits at the address ea of mem,
+// which is in bounds and aligned to it.
+func (mem *Memory) atomicLoad(ea uint64, width int) uint64 {
+	data := mem.bytes()
+	if width == 64 {
+		return le64(atomic.LoadUint64((*uint64)(unsafe.Pointer(&data[ea]))))
+	}
+	w := le32(atomic.LoadUint32((*uint32)(unsafe.Pointer(&data[ea&^3]))))
+	return uint64(w>>(ea&3*8)) & (1<<uint(width) - 1)
+}
+
+// atomicRMW replaces the value of width bits at the address ea of mem,
+// which is in bounds and aligned to it, with the low bits of f of it, and
+// returns the value that it replaced.
+func (mem *Memory) atomicRMW(ea uint64, width int, f func(old uint64) uint64) uint64 {
+	data := mem.bytes()
+	if width == 64 {
+		p := (*uint64)(unsafe.Pointer(&data[ea]))
+		for {
+			w := atomic.LoadUint64(p)
+			old := le64(w)
+			if atomic.CompareAndSwapUint64(p, w, le64(f(old))) {
+				return old
+			}
+		}
+	}
+	// The other bytes of the word are written back as they were read.
+	p := (*uint32)(unsafe.Pointer(&data[ea&^3]))
+	shift := ea & 3 * 8
+	mask := uint32(1<<uint(width)-1) << shift
+	for {
+		w := atomic.LoadUint32(p)
+		word := le32(w)
+		old := uint64(word & mask >> shift)
+		next := word&^mask | uint32(f(old))<<shift&mask
+		if atomic.CompareAndSwapUint32(p, w, le32(next)) {
+			return old
+		}
+	}
+}
+
+// waiter is a call blocked in memory.atomic.wait, until notified.
+type waiter struct {
+	addr  uint64
+	woken chan struct{} // closed by notify
+}
+
+// wait executes memory.atomic.wait, of width bits, at the address ea of
+// mem: unless the value there differs from expected, it blocks until
+// notified, or for timeout nanoseconds if timeout is not negative. It
+// returns 0 if notified, 1 if the value differs, or 2 if it timed out, and
+// traps if the context of m is done while it waits.
+func (m *machine) wait(mem *Memory, ea uint64, width int, expected uint64, timeout int64) uint64 {
+	if !mem.shared {
+		trap(ErrExpectedSharedMemory)
+	}
+	mem.mu.Lock()
+	if mem.atomicLoad(ea, width) != expected {
+		mem.mu.Unlock()
+		return 1
+	}
+	w := &waiter{addr: ea, woken: make(chan struct{})}
+	mem.waiters = append(mem.waiters, w)
+	mem.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		t := time.NewTimer(time.Duration(timeout))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-w.woken:
+		return 0
+	case <-expired:
+	case <-m.done:
+	}
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	for i, x := range mem.waiters {
+		if x == w {
+			mem.waiters = append(mem.waiters[:i], mem.waiters[i+1:]...)
+			m.checkDone()
+			return 2
+		}
+	}
+	return 0 // notified meanwhile
+}
+
+// notify executes memory.atomic.notify at the address ea of mem: it wakes
+// up to count of the calls waiting there, in order of arrival, and returns
+// their number.
+func notify(mem *Memory, ea uint64, count uint32) uint64 {
+	if !mem.shared {
+		return 0
+	}
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	var n uint32
+	waiters := mem.waiters[:0]
+	for _, w := range mem.waiters {
+		if w.addr == ea && n < count {
+			close(w.woken)
+			n++
+			continue
+		}
+		waiters = append(waiters, w)
+	}
+	for i := len(waiters); i < len(mem.waiters); i++ {
+		mem.waiters[i] = nil
+	}
+	mem.waiters = waiters
+	return uint64(n)
+}
+
+// atomic executes the atomic memory instruction in of inst, whose
+// operands are on the stack.
+func (m *machine) atomic(inst *Instance, in *ast.Instruction) {
+	if in.Op == ast.ATOMIC_FENCE {
+		return // the atomic accesses are already sequentially consistent
+	}
+	mem := inst.memories[0]
+	switch in.Op {
+	case ast.ATOMIC_LOAD:
+		ea := mem.atomicAddr(in, m.pop())
+		m.push(mem.atomicLoad(ea, in.Width))
+	case ast.ATOMIC_STORE:
+		v := m.pop()
+		ea := mem.atomicAddr(in, m.pop())
+		mem.atomicRMW(ea, in.Width, func(uint64) uint64 { return v })
+	case ast.ATOMIC_RMW:
+		v := m.pop()
+		var expected uint64
+		if in.RMW == ast.CMPXCHG {
+			expected = m.pop()
+		}
+		ea := mem.atomicAddr(in, m.pop())
+		m.push(mem.atomicRMW(ea, in.Width, rmwOp(in, expected, v)))
+	case ast.MEMORY_ATOMIC_NOTIFY:
+		count := uint32(m.pop())
+		ea := mem.atomicAddr(in, m.pop())
+		m.push(notify(mem, ea, count))
+	case ast.MEMORY_ATOMIC_WAIT:
+		timeout := int64(m.pop())
+		expected := m.pop()
+		if in.Width == 32 {
+			expected = uint64(uint32(expected))
+		}
+		ea := mem.atomicAddr(in, m.pop())
+		m.push(m.wait(mem, ea, in.Width, expected, timeout))
+	default:
+		panic(fmt.Sprintf("interp: unknown atomic operator %s", in))
+	}
+}
+
+// rmwOp returns the function that computes the new value of the
+// read-modify-write in, of operand v, from the value that it replaces. The
+// expected value of cmpxchg is compared with the low bits of that value,
+// of the width of in.
+func rmwOp(in *ast.Instruction, expected, v uint64) func(old uint64) uint64 {
+	switch in.RMW {
+	case ast.ADD:
+		return func(old uint64) uint64 { return old + v }
+	case ast.SUB:
+		return func(old uint64) uint64 { return old - v }
+	case ast.AND:
+		return func(old uint64) uint64 { return old & v }
+	case ast.OR:
+		return func(old uint64) uint64 { return old | v }
+	case ast.XOR:
+		return func(old uint64) uint64 { return old ^ v }
+	case ast.XCHG:
+		return func(uint64) uint64 { return v }
+	case ast.CMPXCHG:
+		if in.Width < 64 {
+			expected &= 1<<uint(in.Width) - 1
+		}
+		return func(old uint64) uint64 {
+			if old == expected {
+				return v
+			}
+			return old
+		}
+	}
+	panic(fmt.Sprintf("interp: unknown atomic operator %s", in))
+}
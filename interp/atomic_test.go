@@ -0,0 +1,173 @@
+package interp
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/sprt/wasm/ast"
+)
+
+const atomicModule = `(module
+	(import "env" "mem" (memory 1 2 shared))
+	(func (export "load8") (param i32) (result i32) (i32.atomic.load8_u (get_local 0)))
+	(func (export "load") (param i32) (result i64) (i64.atomic.load (get_local 0)))
+	(func (export "store16") (param i32 i32) (i32.atomic.store16 (get_local 0) (get_local 1)))
+	(func (export "add") (param i32 i32) (result i32) (i32.atomic.rmw.add (get_local 0) (get_local 1)))
+	(func (export "sub8") (param i32 i64) (result i64) (i64.atomic.rmw8.sub_u (get_local 0) (get_local 1)))
+	(func (export "xchg") (param i32 i64) (result i64) (i64.atomic.rmw.xchg (get_local 0) (get_local 1)))
+	(func (export "cmpxchg16") (param i32 i32 i32) (result i32)
+		(i32.atomic.rmw16.cmpxchg_u (get_local 0) (get_local 1) (get_local 2)))
+	(func (export "wait") (param i32 i32 i64) (result i32)
+		(memory.atomic.wait32 (get_local 0) (get_local 1) (get_local 2)))
+	(func (export "notify") (param i32 i32) (result i32) (memory.atomic.notify (get_local 0) (get_local 1)))
+	(func (export "count") (param $n i32)
+		(loop $l
+			atomic.fence
+			(drop (i32.atomic.rmw.add (i32.const 0) (i32.const 1)))
+			(br_if $l (tee_local $n (i32.sub (get_local $n) (i32.const 1))))))
+	(func (export "grow") (result i32) (grow_memory (i32.const 1)))
+)`
+
+func instantiateAtomic(t *testing.T, mem *Memory) *Instance {
+	t.Helper()
+	c := &Config{Features: ast.Threads}
+	inst, err := c.Instantiate(context.Background(), parse(t, atomicModule), Imports{"env": {"mem": mem}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+func TestAtomic(t *testing.T) {
+	mem := NewSharedMemory(Limits{Min: 1, Max: 2, HasMax: true})
+	inst := instantiateAtomic(t, mem)
+	runInvokeTests(t, inst, []invokeTest{
+		{"store16", []Value{Int32(2), Int32(0x1234ffff)}, nil, nil},
+		{"load8", []Value{Int32(2)}, []Value{Int32(0xff)}, nil},
+		{"load", []Value{Int32(0)}, []Value{Int64(0xffff0000)}, nil},
+		{"add", []Value{Int32(4), Int32(5)}, []Value{Int32(0)}, nil},
+		{"add", []Value{Int32(4), Int32(-1)}, []Value{Int32(5)}, nil},
+		{"load", []Value{Int32(0)}, []Value{Int64(0x4ffff0000)}, nil},
+		{"sub8", []Value{Int32(3), Int64(1)}, []Value{Int64(0xff)}, nil},
+		{"load8", []Value{Int32(3)}, []Value{Int32(0xfe)}, nil},
+		{"load8", []Value{Int32(4)}, []Value{Int32(4)}, nil},
+		{"xchg", []Value{Int32(8), Int64(-7)}, []Value{Int64(0)}, nil},
+		{"xchg", []Value{Int32(8), Int64(9)}, []Value{Int64(-7)}, nil},
+		// The expected value is compared with the low 16 bits only.
+		{"cmpxchg16", []Value{Int32(2), Int32(0x1feff), Int32(1)}, []Value{Int32(0xfeff)}, nil},
+		{"cmpxchg16", []Value{Int32(2), Int32(0xfeff), Int32(7)}, []Value{Int32(1)}, nil},
+		{"load", []Value{Int32(0)}, []Value{Int64(0x400010000)}, nil},
+
+		{"add", []Value{Int32(1), Int32(1)}, nil, ErrUnalignedAtomic},
+		{"load", []Value{Int32(4)}, nil, ErrUnalignedAtomic},
+		{"store16", []Value{Int32(3), Int32(0)}, nil, ErrUnalignedAtomic},
+		{"add", []Value{Int32(65536), Int32(1)}, nil, ErrOutOfBounds},
+		{"load8", []Value{Int32(-1)}, nil, ErrOutOfBounds},
+
+		{"wait", []Value{Int32(0), Int32(0), Int64(-1)}, []Value{Int32(1)}, nil},
+		{"wait", []Value{Int32(12), Int32(0), Int64(1000)}, []Value{Int32(2)}, nil},
+		{"wait", []Value{Int32(2), Int32(0), Int64(0)}, nil, ErrUnalignedAtomic},
+		{"notify", []Value{Int32(12), Int32(1)}, []Value{Int32(0)}, nil},
+	})
+
+	var snap bytes.Buffer
+	if err := inst.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"grow", nil, []Value{Int32(1)}, nil},
+		{"add", []Value{Int32(65536), Int32(1)}, []Value{Int32(0)}, nil},
+	})
+	if err := inst.Restore(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if mem.Size() != 1 {
+		t.Errorf("restored size = %d, want 1", mem.Size())
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"load", []Value{Int32(8)}, []Value{Int64(9)}, nil},
+		{"grow", nil, []Value{Int32(1)}, nil},
+		{"add", []Value{Int32(65536), Int32(0)}, []Value{Int32(0)}, nil},
+	})
+}
+
+func TestAtomicUnshared(t *testing.T) {
+	c := &Config{Features: ast.Threads}
+	inst, err := c.Instantiate(context.Background(), parse(t, `(module (memory 1)
+		(func (export "wait") (result i32) (memory.atomic.wait64 (i32.const 0) (i64.const 0) (i64.const -1)))
+		(func (export "notify") (result i32) (memory.atomic.notify (i32.const 0) (i32.const 1))))`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"wait", nil, nil, ErrExpectedSharedMemory},
+		{"notify", nil, []Value{Int32(0)}, nil},
+	})
+
+	_, err = c.Instantiate(context.Background(), parse(t, atomicModule), Imports{"env": {"mem": NewMemory(Limits{Min: 1})}})
+	if err == nil || err.Error() != `import "env" "mem": incompatible import type` {
+		t.Errorf("got error %v, want incompatible import type", err)
+	}
+}
+
+// TestAtomicConcurrent runs instances sharing a memory in several
+// goroutines, one of which grows it as the others access it.
+func TestAtomicConcurrent(t *testing.T) {
+	const goroutines, n = 8, 10000
+	mem := NewSharedMemory(Limits{Min: 1, Max: 2, HasMax: true})
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		inst := instantiateAtomic(t, mem)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				if _, err := inst.Invoke(context.Background(), "grow"); err != nil {
+					t.Error(err)
+				}
+			}
+			if _, err := inst.Invoke(context.Background(), "count", Int32(n)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got, err := mem.LoadUint32(0); err != nil || got != goroutines*n {
+		t.Errorf("count = %d, %v, want %d", got, err, goroutines*n)
+	}
+	if mem.Size() != 2 {
+		t.Errorf("size = %d, want 2", mem.Size())
+	}
+
+	// A call waiting in one goroutine is woken by a notify in another.
+	waiter, notifier := instantiateAtomic(t, mem), instantiateAtomic(t, mem)
+	done := make(chan []Value)
+	go func() {
+		results, err := waiter.Invoke(context.Background(), "wait", Int32(16), Int32(0), Int64(-1))
+		if err != nil {
+			t.Error(err)
+		}
+		done <- results
+	}()
+	for {
+		results, err := notifier.Invoke(context.Background(), "notify", Int32(16), Int32(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Int32() == 1 {
+			break
+		}
+	}
+	if results := <-done; len(results) != 1 || results[0].Int32() != 0 {
+		t.Errorf("wait = %v, want 0", results)
+	}
+
+	// A wait ends when its context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	if _, err := waiter.Invoke(ctx, "wait", Int32(16), Int32(0), Int64(-1)); err == nil {
+		t.Error("wait returned after its context was canceled")
+	}
+}
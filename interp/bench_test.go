@@ -0,0 +1,109 @@
+package interp
+
+import (
+	"context"
+	"testing"
+)
+
+const benchModule = `(module
+	(memory 1)
+	(func $fib (export "fib") (param $n i32) (result i32)
+		(if (result i32) (i32.lt_u (get_local $n) (i32.const 2))
+			(then (get_local $n))
+			(else (i32.add
+				(call $fib (i32.sub (get_local $n) (i32.const 1)))
+				(call $fib (i32.sub (get_local $n) (i32.const 2)))))))
+	(func (export "sum") (param $n i64) (result i64) (local $s i64)
+		(block $done
+			(loop $next
+				(br_if $done (i64.eqz (get_local $n)))
+				(set_local $s (i64.add (get_local $s) (i64.mul (get_local $n) (get_local $n))))
+				(set_local $n (i64.sub (get_local $n) (i64.const 1)))
+				(br $next)))
+		(get_local $s))
+	(func (export "sieve") (param $n i32) (result i32) (local $i i32) (local $j i32) (local $count i32)
+		(block $cleared
+			(loop $clear
+				(br_if $cleared (i32.ge_u (get_local $i) (get_local $n)))
+				(i32.store8 (get_local $i) (i32.const 0))
+				(set_local $i (i32.add (get_local $i) (i32.const 1)))
+				(br $clear)))
+		(set_local $i (i32.const 2))
+		(block $done
+			(loop $outer
+				(br_if $done (i32.ge_u (get_local $i) (get_local $n)))
+				(if (i32.eqz (i32.load8_u (get_local $i)))
+					(then
+						(set_local $count (i32.add (get_local $count) (i32.const 1)))
+						(set_local $j (i32.mul (get_local $i) (get_local $i)))
+						(block $marked
+							(loop $inner
+								(br_if $marked (i32.ge_u (get_local $j) (get_local $n)))
+								(i32.store8 (get_local $j) (i32.const 1))
+								(set_local $j (i32.add (get_local $j) (get_local $i)))
+								(br $inner)))))
+				(set_local $i (i32.add (get_local $i) (i32.const 1)))
+				(br $outer)))
+		(get_local $count))
+	(func (export "mandel") (param $steps i32) (result i32) (local $x f64) (local $y f64) (local $t f64) (local $i i32)
+		(block $done
+			(loop $next
+				(br_if $done (i32.ge_u (get_local $i) (get_local $steps)))
+				(br_if $done (f64.gt
+					(f64.add (f64.mul (get_local $x) (get_local $x)) (f64.mul (get_local $y) (get_local $y)))
+					(f64.const 4)))
+				(set_local $t (f64.add (f64.sub (f64.mul (get_local $x) (get_local $x)) (f64.mul (get_local $y) (get_local $y))) (f64.const -0.1)))
+				(set_local $y (f64.add (f64.mul (f64.const 2) (f64.mul (get_local $x) (get_local $y))) (f64.const 0.1)))
+				(set_local $x (get_local $t))
+				(set_local $i (i32.add (get_local $i) (i32.const 1)))
+				(br $next)))
+		(get_local $i)))`
+
+func benchmarkEngines(b *testing.B, name string, args ...Value) {
+	m := parse(b, benchModule)
+	for _, e := range []Engine{Bytecode, TreeWalker} {
+		b.Run(e.String(), func(b *testing.B) {
+			cfg := &Config{Engine: e}
+			inst, err := cfg.Instantiate(context.Background(), m, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := inst.Invoke(ctx, name, args...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFib(b *testing.B)        { benchmarkEngines(b, "fib", Int32(20)) }
+func BenchmarkSum(b *testing.B)        { benchmarkEngines(b, "sum", Int64(10000)) }
+func BenchmarkSieve(b *testing.B)      { benchmarkEngines(b, "sieve", Int32(65536)) }
+func BenchmarkMandelbrot(b *testing.B) { benchmarkEngines(b, "mandel", Int32(10000)) }
+
+func BenchmarkInstantiate(b *testing.B) {
+	m := parse(b, benchModule)
+	ctx := context.Background()
+	b.Run("compiled", func(b *testing.B) {
+		cm, err := Compile(m)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := InstantiateCompiled(ctx, cm, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("module", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := Instantiate(ctx, m, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package interp
+
+import "github.com/sprt/wasm/ast"
+
+// bulk executes the bulk memory instruction in of inst, whose operands
+// are on the stack. The accesses are checked before any byte or element
+// is written: an instruction that traps has no effect.
+func (m *machine) bulk(inst *Instance, in *ast.Instruction) {
+	switch in.Op {
+	case ast.DATA_DROP:
+		inst.droppedData[in.Var.Index] = true
+		return
+	case ast.ELEM_DROP:
+		inst.droppedElems[in.Var.Index] = true
+		return
+	}
+	// The destination, the source (or the value of memory.fill), and the
+	// number of bytes or elements.
+	n := uint64(uint32(m.pop()))
+	s := uint64(uint32(m.pop()))
+	d := uint64(uint32(m.pop()))
+	switch in.Op {
+	case ast.MEMORY_COPY:
+		mem := inst.memories[0].bytes()
+		if s+n > uint64(len(mem)) || d+n > uint64(len(mem)) {
+			trap(ErrOutOfBounds)
+		}
+		copy(mem[d:d+n], mem[s:s+n])
+	case ast.MEMORY_FILL:
+		mem := inst.memories[0].bytes()
+		if d+n > uint64(len(mem)) {
+			trap(ErrOutOfBounds)
+		}
+		b := mem[d : d+n]
+		for i := range b {
+			b[i] = byte(s)
+		}
+	case ast.MEMORY_INIT:
+		mem := inst.memories[0].bytes()
+		var seg []byte // empty once dropped
+		if !inst.droppedData[in.Var.Index] {
+			seg = inst.module.Data[in.Var.Index].Data
+		}
+		if s+n > uint64(len(seg)) || d+n > uint64(len(mem)) {
+			trap(ErrOutOfBounds)
+		}
+		copy(mem[d:d+n], seg[s:s+n])
+	case ast.TABLE_COPY:
+		dst, src := inst.table(in.TableVar).elems, inst.table(in.Var).elems
+		if s+n > uint64(len(src)) || d+n > uint64(len(dst)) {
+			trap(ErrTableOutOfBounds)
+		}
+		copy(dst[d:d+n], src[s:s+n])
+	case ast.TABLE_INIT:
+		elems := inst.table(in.TableVar).elems
+		var seg []*ast.Variable // empty once dropped
+		if !inst.droppedElems[in.Var.Index] {
+			seg = inst.module.Elems[in.Var.Index].Funcs
+		}
+		if s+n > uint64(len(seg)) || d+n > uint64(len(elems)) {
+			trap(ErrTableOutOfBounds)
+		}
+		for i, v := range seg[s : s+n] {
+			elems[d+uint64(i)] = inst.funcs[v.Index]
+		}
+	}
+}
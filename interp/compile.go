@@ -0,0 +1,598 @@
+package interp
+
+import "github.com/sprt/wasm/ast"
+
+// compiledFunc is the body of a function lowered to bytecode: a sequence
+// of ops operating on the stack of the machine, whose branches are
+// resolved to the index of their target op.
+type compiledFunc struct {
+	code []op
+	srcs []ast.Instr // of each op, for backtraces
+	// immediates of br_table and call_indirect
+	tables [][]branch // default branch last
+	sigs   []FuncType
+}
+
+// opcode is the operation of an op.
+type opcode uint32
+
+const (
+	opNop                opcode = iota // charges the fuel of syntax nodes without ops
+	opUnreachable                      //
+	opBr                               // branch to a
+	opBrIf                             // branch to a if the popped value is non-zero
+	opBrUnless                         // jump to a if the popped value is zero, for if
+	opBrTable                          // branch to one of tables[a]
+	opReturn                           //
+	opCall                             // call funcs[a]
+	opCallIndirect                     // call the element of table imm, of type sigs[a]
+	opReturnCall                       // tail call funcs[a]
+	opReturnCallIndirect               // tail call the element of table imm, of type sigs[a]
+	opDrop                             //
+	opSelect                           //
+	opGetLocal                         // of the local of slot a
+	opSetLocal                         //
+	opTeeLocal                         //
+	opGetGlobal                        // of global a
+	opSetGlobal                        //
+	opGetGlobalRef                     // of global a, of a reference type
+	opSetGlobalRef                     //
+	opConst                            // push imm
+	opCurrentMemory                    //
+	opGrowMemory                       //
+	opBulk                             // executed from its syntax node
+	opRef                              // executed from its syntax node
+	opVector                           // executed from its syntax node
+	opAtomic                           // executed from its syntax node
+
+	// the above on values of type v128, which take two slots
+	opDrop128
+	opSelect128
+	opGetLocal128
+	opSetLocal128
+	opTeeLocal128
+	opGetGlobal128
+	opSetGlobal128
+
+	// loads and stores at offset a, by width, sign and type of the
+	// extended value
+	opLoad8U
+	opLoad8S32
+	opLoad8S64
+	opLoad16U
+	opLoad16S32
+	opLoad16S64
+	opLoad32U
+	opLoad32S64
+	opLoad64
+	opStore8
+	opStore16
+	opStore32
+	opStore64
+
+	// numeric instructions with an op of their own; the others are
+	// executed by opNumeric, from their syntax node
+	opNumeric
+	opI32Eqz
+	opI32Add
+	opI32Sub
+	opI32Mul
+	opI32And
+	opI32Or
+	opI32Xor
+	opI32Shl
+	opI32ShrS
+	opI32ShrU
+	opI32Eq
+	opI32Ne
+	opI32LtS
+	opI32LtU
+	opI32GtS
+	opI32GtU
+	opI32LeS
+	opI32LeU
+	opI32GeS
+	opI32GeU
+	opI64Eqz
+	opI64Add
+	opI64Sub
+	opI64Mul
+	opI64And
+	opI64Or
+	opI64Xor
+	opI64Shl
+	opI64ShrS
+	opI64ShrU
+	opI64Eq
+	opI64Ne
+	opI64LtS
+	opI64LtU
+	opI64GtS
+	opI64GtU
+	opI64LeS
+	opI64LeU
+	opI64GeS
+	opI64GeU
+	opF64Add
+	opF64Sub
+	opF64Mul
+	opF64Div
+	opF64Lt
+	opF64Gt
+)
+
+// op is an instruction of the bytecode.
+type op struct {
+	code opcode
+	cost uint32 // fuel charged: the number of syntax nodes it accounts for
+	a    uint32 // index, offset or target, depending on code
+
+	// of a branch: the height of the stack above the frame at its target,
+	// and the number of values it carries there
+	height, arity uint32
+
+	imm uint64 // of opConst
+}
+
+// branch is a target of br_table.
+type branch struct {
+	pc, height, arity uint32
+}
+
+type numericKey struct {
+	op, typ, sign ast.TokenType
+}
+
+var numericOps = map[numericKey]opcode{
+	{ast.EQZ, ast.I32, 0}:     opI32Eqz,
+	{ast.ADD, ast.I32, 0}:     opI32Add,
+	{ast.SUB, ast.I32, 0}:     opI32Sub,
+	{ast.MUL, ast.I32, 0}:     opI32Mul,
+	{ast.AND, ast.I32, 0}:     opI32And,
+	{ast.OR, ast.I32, 0}:      opI32Or,
+	{ast.XOR, ast.I32, 0}:     opI32Xor,
+	{ast.SHL, ast.I32, 0}:     opI32Shl,
+	{ast.SHR, ast.I32, ast.S}: opI32ShrS,
+	{ast.SHR, ast.I32, ast.U}: opI32ShrU,
+	{ast.EQ, ast.I32, 0}:      opI32Eq,
+	{ast.NE, ast.I32, 0}:      opI32Ne,
+	{ast.LT, ast.I32, ast.S}:  opI32LtS,
+	{ast.LT, ast.I32, ast.U}:  opI32LtU,
+	{ast.GT, ast.I32, ast.S}:  opI32GtS,
+	{ast.GT, ast.I32, ast.U}:  opI32GtU,
+	{ast.LE, ast.I32, ast.S}:  opI32LeS,
+	{ast.LE, ast.I32, ast.U}:  opI32LeU,
+	{ast.GE, ast.I32, ast.S}:  opI32GeS,
+	{ast.GE, ast.I32, ast.U}:  opI32GeU,
+	{ast.EQZ, ast.I64, 0}:     opI64Eqz,
+	{ast.ADD, ast.I64, 0}:     opI64Add,
+	{ast.SUB, ast.I64, 0}:     opI64Sub,
+	{ast.MUL, ast.I64, 0}:     opI64Mul,
+	{ast.AND, ast.I64, 0}:     opI64And,
+	{ast.OR, ast.I64, 0}:      opI64Or,
+	{ast.XOR, ast.I64, 0}:     opI64Xor,
+	{ast.SHL, ast.I64, 0}:     opI64Shl,
+	{ast.SHR, ast.I64, ast.S}: opI64ShrS,
+	{ast.SHR, ast.I64, ast.U}: opI64ShrU,
+	{ast.EQ, ast.I64, 0}:      opI64Eq,
+	{ast.NE, ast.I64, 0}:      opI64Ne,
+	{ast.LT, ast.I64, ast.S}:  opI64LtS,
+	{ast.LT, ast.I64, ast.U}:  opI64LtU,
+	{ast.GT, ast.I64, ast.S}:  opI64GtS,
+	{ast.GT, ast.I64, ast.U}:  opI64GtU,
+	{ast.LE, ast.I64, ast.S}:  opI64LeS,
+	{ast.LE, ast.I64, ast.U}:  opI64LeU,
+	{ast.GE, ast.I64, ast.S}:  opI64GeS,
+	{ast.GE, ast.I64, ast.U}:  opI64GeU,
+	{ast.ADD, ast.F64, 0}:     opF64Add,
+	{ast.SUB, ast.F64, 0}:     opF64Sub,
+	{ast.MUL, ast.F64, 0}:     opF64Mul,
+	{ast.DIV, ast.F64, 0}:     opF64Div,
+	{ast.LT, ast.F64, 0}:      opF64Lt,
+	{ast.GT, ast.F64, 0}:      opF64Gt,
+}
+
+// compiler lowers the body of a validated function to bytecode.
+//
+// It tracks the height of the operand stack, which is known statically,
+// to precompute the unwinding done by branches. Heights and arities are
+// counted in slots, of which a v128 takes two.
+// Fuel is charged for each syntax node as by the tree-walker: the cost of
+// block, loop and if nodes is added to the next op, or to a nop if a
+// branch target intervenes, so that the fuel used by a call is the same
+// with both engines.
+type compiler struct {
+	m            *ast.Module
+	types        []FuncType                         // of the functions of m
+	operandTypes map[*ast.Instruction]ast.TokenType // of drop and select
+	offsets      []int                              // of the locals, as returned by localOffsets
+	fn           *compiledFunc
+
+	height  int      // of the operand stack
+	labels  []*label // innermost last
+	pending uint32   // cost of the syntax nodes not charged by an op yet
+	dead    bool     // whether the code being compiled is unreachable
+}
+
+// label is a label in scope.
+type label struct {
+	height, arity int
+	loop          bool
+	pc            int // start of a loop
+
+	// branches to the end of a block, patched when it is reached
+	fixups      []int // indexes of ops
+	tableFixups []*branch
+}
+
+// compile lowers the body of the function of index i of the module of cm
+// to bytecode.
+func compile(cm *CompiledModule, i int) *compiledFunc {
+	m, types := cm.module, cm.types
+	c := &compiler{
+		m:            m,
+		types:        types,
+		operandTypes: cm.operandTypes,
+		offsets:      localOffsets(types[i], m.Funcs[i]),
+		fn:           new(compiledFunc),
+	}
+	results := typeSlots(types[i].Results)
+	l := c.pushLabel(0, results, false)
+	c.body(m.Funcs[i].Body)
+	c.popLabel(l, results)
+	c.emit(op{code: opReturn}, nil)
+	return c.fn
+}
+
+// emit appends o, compiled from the syntax node src, charging it with
+// the pending cost, and returns its index.
+func (c *compiler) emit(o op, src ast.Instr) int {
+	o.cost += c.pending
+	c.pending = 0
+	c.fn.code = append(c.fn.code, o)
+	c.fn.srcs = append(c.fn.srcs, src)
+	return len(c.fn.code) - 1
+}
+
+// flush emits a nop charging the pending cost, if any, so that the next
+// op can be the target of branches.
+func (c *compiler) flush(src ast.Instr) {
+	if c.pending != 0 {
+		c.emit(op{code: opNop}, src)
+	}
+}
+
+// unreachable marks the following code as unreachable, up to the end of
+// the enclosing block.
+func (c *compiler) unreachable() {
+	c.dead = true
+	c.pending = 0
+}
+
+// pushLabel begins a block with the given number of parameters, which
+// are on the stack, and results.
+func (c *compiler) pushLabel(params, results int, loop bool) *label {
+	l := &label{height: c.height - params, arity: results, loop: loop, pc: len(c.fn.code)}
+	if loop {
+		l.arity = params
+	}
+	c.labels = append(c.labels, l)
+	return l
+}
+
+// popLabel ends the block of l, which has the given number of results,
+// resolving the branches to its end.
+func (c *compiler) popLabel(l *label, results int) {
+	c.labels = c.labels[:len(c.labels)-1]
+	if len(l.fixups) != 0 || len(l.tableFixups) != 0 {
+		c.flush(nil)
+	}
+	pc := uint32(len(c.fn.code))
+	for _, i := range l.fixups {
+		c.fn.code[i].a = pc
+	}
+	for _, br := range l.tableFixups {
+		br.pc = pc
+	}
+	c.height = l.height + results
+	c.dead = false
+}
+
+// branch emits a branch op to the label of relative depth depth.
+func (c *compiler) branch(code opcode, depth int, src ast.Instr) {
+	l := c.labels[len(c.labels)-1-depth]
+	o := op{code: code, cost: 1, a: uint32(l.pc), height: uint32(l.height), arity: uint32(l.arity)}
+	i := c.emit(o, src)
+	if !l.loop {
+		l.fixups = append(l.fixups, i)
+	}
+}
+
+func (c *compiler) body(body []ast.Instr) {
+	for _, in := range body {
+		if c.dead {
+			return
+		}
+		c.instr(in)
+	}
+}
+
+func (c *compiler) instr(in ast.Instr) {
+	switch in := in.(type) {
+	case *ast.Instruction:
+		c.body(in.Operands)
+		if !c.dead {
+			c.plainInstr(in)
+		}
+	case *ast.Block:
+		c.pending++
+		params, results := c.blockArity(in.Type)
+		l := c.pushLabel(params, results, false)
+		c.body(in.Body)
+		c.popLabel(l, results)
+	case *ast.Loop:
+		c.pending++
+		c.flush(in)
+		params, results := c.blockArity(in.Type)
+		l := c.pushLabel(params, results, true)
+		c.body(in.Body)
+		c.popLabel(l, results)
+	case *ast.If:
+		c.pending++
+		c.body(in.Cond)
+		if c.dead {
+			return
+		}
+		c.height--
+		params, results := c.blockArity(in.Type)
+		cond := c.emit(op{code: opBrUnless}, in)
+		l := c.pushLabel(params, results, false)
+		c.body(in.Then)
+		if in.Else == nil {
+			l.fixups = append(l.fixups, cond)
+		} else {
+			if !c.dead {
+				l.fixups = append(l.fixups, c.emit(op{code: opBr, height: uint32(l.height), arity: uint32(results)}, in))
+			}
+			c.flush(in)
+			c.fn.code[cond].a = uint32(len(c.fn.code))
+			c.height, c.dead = l.height+params, false
+			c.body(in.Else)
+		}
+		c.popLabel(l, results)
+	}
+}
+
+// blockArity returns the number of slots of the parameters and results
+// of a block of type sig.
+func (c *compiler) blockArity(sig *ast.FuncSig) (params, results int) {
+	sig = c.m.Signature(sig)
+	return tokenSlots(sig.ParamTypes()...), tokenSlots(sig.Results...)
+}
+
+// plainInstr compiles the plain instruction in, whose operands have been
+// compiled.
+func (c *compiler) plainInstr(in *ast.Instruction) {
+	o := op{cost: 1}
+	if in.IsVector() {
+		params, result, _ := in.VectorType()
+		c.height -= tokenSlots(params...)
+		if result != 0 {
+			c.height += tokenSlots(result)
+		}
+		o.code = opVector
+		if in.Op == ast.CONST {
+			c.emit(op{code: opConst, cost: 1, imm: in.Vector[0]}, in)
+			o = op{code: opConst, imm: in.Vector[1]}
+		}
+		c.emit(o, in)
+		return
+	}
+	switch in.Op {
+	case ast.UNREACHABLE:
+		o.code = opUnreachable
+		c.emit(o, in)
+		c.unreachable()
+		return
+	case ast.NOP:
+		o.code = opNop
+	case ast.BR:
+		c.branch(opBr, in.Var.Index, in)
+		c.unreachable()
+		return
+	case ast.BR_IF:
+		c.height--
+		c.branch(opBrIf, in.Var.Index, in)
+		return
+	case ast.BR_TABLE:
+		c.height--
+		table := make([]branch, len(in.Table)+1)
+		for i := range table {
+			v := in.Var
+			if i < len(in.Table) {
+				v = in.Table[i]
+			}
+			l := c.labels[len(c.labels)-1-v.Index]
+			table[i] = branch{uint32(l.pc), uint32(l.height), uint32(l.arity)}
+			if !l.loop {
+				l.tableFixups = append(l.tableFixups, &table[i])
+			}
+		}
+		o.code, o.a = opBrTable, uint32(len(c.fn.tables))
+		c.fn.tables = append(c.fn.tables, table)
+		c.emit(o, in)
+		c.unreachable()
+		return
+	case ast.RETURN:
+		o.code = opReturn
+		c.emit(o, in)
+		c.unreachable()
+		return
+	case ast.CALL:
+		typ := c.types[in.Var.Index]
+		c.height += typeSlots(typ.Results) - typeSlots(typ.Params)
+		o.code, o.a = opCall, uint32(in.Var.Index)
+	case ast.CALL_INDIRECT:
+		typ := funcType(c.m, in.Sig)
+		c.height += typeSlots(typ.Results) - typeSlots(typ.Params) - 1
+		o.code, o.a = opCallIndirect, uint32(len(c.fn.sigs))
+		if in.TableVar != nil {
+			o.imm = uint64(in.TableVar.Index)
+		}
+		c.fn.sigs = append(c.fn.sigs, typ)
+	case ast.RETURN_CALL:
+		o.code, o.a = opReturnCall, uint32(in.Var.Index)
+		c.emit(o, in)
+		c.unreachable()
+		return
+	case ast.RETURN_CALL_INDIRECT:
+		o.code, o.a = opReturnCallIndirect, uint32(len(c.fn.sigs))
+		if in.TableVar != nil {
+			o.imm = uint64(in.TableVar.Index)
+		}
+		c.fn.sigs = append(c.fn.sigs, funcType(c.m, in.Sig))
+		c.emit(o, in)
+		c.unreachable()
+		return
+	case ast.DROP:
+		n := tokenSlots(c.operandTypes[in])
+		c.height -= n
+		o.code = pick(n, opDrop, opDrop128)
+	case ast.SELECT:
+		n := tokenSlots(c.operandTypes[in])
+		c.height -= 1 + n
+		o.code = pick(n, opSelect, opSelect128)
+	case ast.GET_LOCAL:
+		slot, n := localSlot(c.offsets, in.Var.Index)
+		c.height += n
+		o.code, o.a = pick(n, opGetLocal, opGetLocal128), uint32(slot)
+	case ast.SET_LOCAL:
+		slot, n := localSlot(c.offsets, in.Var.Index)
+		c.height -= n
+		o.code, o.a = pick(n, opSetLocal, opSetLocal128), uint32(slot)
+	case ast.TEE_LOCAL:
+		slot, n := localSlot(c.offsets, in.Var.Index)
+		o.code, o.a = pick(n, opTeeLocal, opTeeLocal128), uint32(slot)
+	case ast.GET_GLOBAL:
+		t := c.m.Globals[in.Var.Index].Type
+		c.height += tokenSlots(t)
+		o.code, o.a = pick(tokenSlots(t), opGetGlobal, opGetGlobal128), uint32(in.Var.Index)
+		if t.IsRefType() {
+			o.code = opGetGlobalRef
+		}
+	case ast.SET_GLOBAL:
+		t := c.m.Globals[in.Var.Index].Type
+		c.height -= tokenSlots(t)
+		o.code, o.a = pick(tokenSlots(t), opSetGlobal, opSetGlobal128), uint32(in.Var.Index)
+		if t.IsRefType() {
+			o.code = opSetGlobalRef
+		}
+	case ast.CONST:
+		c.height++
+		o.code, o.imm = opConst, in.Value
+	case ast.LOAD:
+		o.code, o.a = loadOp(in), in.Offset
+	case ast.STORE:
+		c.height -= 2
+		o.code, o.a = storeOp(in), in.Offset
+	case ast.CURRENT_MEMORY:
+		c.height++
+		o.code = opCurrentMemory
+	case ast.GROW_MEMORY:
+		o.code = opGrowMemory
+	case ast.MEMORY_COPY, ast.MEMORY_FILL, ast.MEMORY_INIT, ast.TABLE_COPY, ast.TABLE_INIT:
+		c.height -= 3
+		o.code = opBulk
+	case ast.DATA_DROP, ast.ELEM_DROP:
+		o.code = opBulk
+	case ast.REF_NULL, ast.REF_FUNC, ast.TABLE_SIZE:
+		c.height++
+		o.code = opRef
+	case ast.REF_IS_NULL, ast.TABLE_GET:
+		o.code = opRef
+	case ast.TABLE_GROW:
+		c.height--
+		o.code = opRef
+	case ast.TABLE_SET:
+		c.height -= 2
+		o.code = opRef
+	case ast.TABLE_FILL:
+		c.height -= 3
+		o.code = opRef
+	case ast.ATOMIC_LOAD, ast.ATOMIC_FENCE:
+		o.code = opAtomic
+	case ast.ATOMIC_STORE:
+		c.height -= 2
+		o.code = opAtomic
+	case ast.ATOMIC_RMW:
+		c.height--
+		if in.RMW == ast.CMPXCHG {
+			c.height--
+		}
+		o.code = opAtomic
+	case ast.MEMORY_ATOMIC_NOTIFY:
+		c.height--
+		o.code = opAtomic
+	case ast.MEMORY_ATOMIC_WAIT:
+		c.height -= 2
+		o.code = opAtomic
+	default:
+		if in.From == 0 && !isUnary(in.Op) {
+			c.height--
+		}
+		var ok bool
+		if o.code, ok = numericOps[numericKey{in.Op, in.Type, in.Sign}]; !ok || in.From != 0 {
+			o.code = opNumeric
+		}
+	}
+	c.emit(o, in)
+}
+
+// pick returns the opcode for a value of n slots: code if 1, or code128
+// if 2.
+func pick(n int, code, code128 opcode) opcode {
+	if n == 2 {
+		return code128
+	}
+	return code
+}
+
+func loadOp(in *ast.Instruction) opcode {
+	signed, i64 := in.Sign == ast.S, in.Type == ast.I64
+	switch in.Width {
+	case 8:
+		switch {
+		case !signed:
+			return opLoad8U
+		case i64:
+			return opLoad8S64
+		}
+		return opLoad8S32
+	case 16:
+		switch {
+		case !signed:
+			return opLoad16U
+		case i64:
+			return opLoad16S64
+		}
+		return opLoad16S32
+	case 32:
+		if signed && i64 {
+			return opLoad32S64
+		}
+		return opLoad32U
+	}
+	return opLoad64
+}
+
+func storeOp(in *ast.Instruction) opcode {
+	switch in.Width {
+	case 8:
+		return opStore8
+	case 16:
+		return opStore16
+	case 32:
+		return opStore32
+	}
+	return opStore64
+}
@@ -0,0 +1,95 @@
+package interp
+
+import (
+	"context"
+	"testing"
+)
+
+const branchModule = `(module
+	(memory 1)
+	(func $id (param i32) (result i32) (get_local 0))
+	(func (export "nested") (param i32) (result i32)
+		(i32.add (i32.const 100)
+			(block $out (result i32)
+				(i32.const 7) (drop)
+				(i32.add (i32.const 1000)
+					(block $in (result i32)
+						(drop (br_if $out (i32.const 1) (i32.eqz (get_local 0))))
+						(drop (br_if $in (i32.const 2) (i32.eq (get_local 0) (i32.const 1))))
+						(i32.const 3))))))
+	(func (export "table") (param i32) (result i32) (local $n i32)
+		(loop $again
+			(set_local $n (i32.add (get_local $n) (i32.const 1)))
+			(block $a (block $b (block $c
+				(br_table $a $b $again $c (i32.sub (get_local 0) (get_local $n))))
+				(return (i32.const -3)))
+				(return (i32.mul (get_local $n) (i32.const 2))))
+			(return (get_local $n)))
+		(i32.const -1))
+	(func (export "select_if") (param i32) (result i64)
+		(if (result i64) (call $id (get_local 0))
+			(then (select (i64.const 1) (i64.const 2) (i32.gt_s (get_local 0) (i32.const 5))))
+			(else (i64.const 3))))
+	(func (export "dead") (param i32) (result i32)
+		(block $b (result i32)
+			(br $b (i32.const 5))
+			(i32.add (unreachable) (i32.const 1))))
+	(func (export "memory") (param i32) (result i64)
+		(i64.store16 offset=2 (get_local 0) (i64.const -2))
+		(i64.add (i64.load16_s offset=2 (get_local 0)) (i64.load8_u offset=3 (get_local 0))))
+	(func (export "float") (param f64 f64) (result i32)
+		(f64.lt (f64.div (get_local 0) (get_local 1)) (f64.const 0.5))))`
+
+func TestCompiledBranches(t *testing.T) {
+	inst := instantiate(t, branchModule, nil)
+	runInvokeTests(t, inst, []invokeTest{
+		{"nested", []Value{Int32(0)}, []Value{Int32(101)}, nil},
+		{"nested", []Value{Int32(1)}, []Value{Int32(1102)}, nil},
+		{"nested", []Value{Int32(2)}, []Value{Int32(1103)}, nil},
+		{"table", []Value{Int32(1)}, []Value{Int32(1)}, nil},
+		{"table", []Value{Int32(2)}, []Value{Int32(2)}, nil},
+		{"table", []Value{Int32(3)}, []Value{Int32(4)}, nil},
+		{"table", []Value{Int32(5)}, []Value{Int32(-3)}, nil},
+		{"table", []Value{Int32(0)}, []Value{Int32(-3)}, nil},
+		{"select_if", []Value{Int32(0)}, []Value{Int64(3)}, nil},
+		{"select_if", []Value{Int32(1)}, []Value{Int64(2)}, nil},
+		{"select_if", []Value{Int32(6)}, []Value{Int64(1)}, nil},
+		{"dead", []Value{Int32(0)}, []Value{Int32(5)}, nil},
+		{"memory", []Value{Int32(0)}, []Value{Int64(-2 + 0xff)}, nil},
+		{"memory", []Value{Int32(65533)}, nil, ErrOutOfBounds},
+		{"memory", []Value{Int32(-1)}, nil, ErrOutOfBounds},
+		{"float", []Value{Float64(1), Float64(4)}, []Value{Int32(1)}, nil},
+		{"float", []Value{Float64(1), Float64(0)}, []Value{Int32(0)}, nil},
+	})
+}
+
+func TestEnginesFuel(t *testing.T) {
+	m := parse(t, branchModule)
+	const fuel = 1 << 20
+	var used []uint64
+	for _, e := range []Engine{Bytecode, TreeWalker} {
+		cfg := &Config{Engine: e, FuelMetering: true, Fuel: fuel}
+		inst, err := cfg.Instantiate(context.Background(), m, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"nested", "table", "select_if", "dead", "memory"} {
+			if _, err := inst.Invoke(context.Background(), name, Int32(2)); err != nil {
+				t.Fatalf("%s: %s: %v", e, name, err)
+			}
+		}
+		left, _ := inst.Fuel()
+		used = append(used, fuel-left)
+	}
+	if used[0] != used[1] {
+		t.Errorf("bytecode used %d units of fuel, tree-walker %d", used[0], used[1])
+	}
+}
+
+func TestUnknownEngine(t *testing.T) {
+	cfg := &Config{Engine: 3}
+	_, err := cfg.Instantiate(context.Background(), parse(t, `(module)`), nil)
+	if want := "unknown engine: Engine(3)"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,117 @@
+package interp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/sprt/wasm/ast"
+)
+
+const counterModule = `(module
+	(memory 1)
+	(table 1 anyfunc)
+	(global $n (mut i32) (i32.const 0))
+	(func $get (result i32) (get_global $n))
+	(elem (i32.const 0) $get)
+	(func (export "add") (param i32) (result i32)
+		(set_global $n (i32.add (get_global $n) (get_local 0)))
+		(i32.store (i32.const 0) (i32.add (i32.load (i32.const 0)) (get_local 0)))
+		(i32.add
+			(call_indirect (result i32) (i32.const 0))
+			(i32.load (i32.const 0)))))`
+
+func TestCompiledModuleInstances(t *testing.T) {
+	cm, err := Compile(parse(t, counterModule))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inst, err := InstantiateCompiled(ctx, cm, nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			// Each instance has its own global, memory and table.
+			for j := 1; j <= 100; j++ {
+				got, err := inst.Invoke(ctx, "add", Int32(int32(i)))
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				if want := Int32(int32(2 * i * j)); got[0] != want {
+					errs[i] = fmt.Errorf("call %d: got %v, want %v", j, got[0], want)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("instance %d: %v", i, err)
+		}
+	}
+}
+
+func TestCompileEngine(t *testing.T) {
+	m := parse(t, counterModule)
+	for _, e := range []Engine{Bytecode, TreeWalker} {
+		cm, err := (&Config{Engine: e}).Compile(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The engine of the compiled module prevails.
+		inst, err := (&Config{Engine: Bytecode + TreeWalker - e}).InstantiateCompiled(context.Background(), cm, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compiled := inst.funcs[1].compiled != nil; compiled != (e == Bytecode) {
+			t.Errorf("%s: compiled = %v", e, compiled)
+		}
+	}
+}
+
+// TestInstantiateConcurrent instantiates a module in several goroutines
+// at once, which validation does not modify.
+func TestInstantiateConcurrent(t *testing.T) {
+	m := parse(t, `(module (func (export "f") (param i32 v128) (result i64)
+		(drop (get_local 1))
+		(i64x2.extract_lane 1 (select (get_local 1) (v128.const i64x2 1 2) (get_local 0)))))`)
+	c := &Config{Features: ast.SIMD}
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inst, err := c.Instantiate(ctx, m, nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			got, err := inst.Invoke(ctx, "f", Int32(int32(i%2)), Vector128(3, 4))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if want := Int64(int64(2 + 2*(i%2))); got[0] != want {
+				errs[i] = fmt.Errorf("got %v, want %v", got[0], want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("instance %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package interp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestContextDeadline(t *testing.T) {
+	inst := instantiate(t, `(module (func (export "spin") (loop (br 0))))`, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := inst.Invoke(ctx, "spin")
+	var trap *Trap
+	if !errors.As(err, &trap) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want trap wrapping %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	stop := NewHostFunc(FuncType{}, func(context.Context, []Value) ([]Value, error) {
+		calls++
+		cancel()
+		return nil, nil
+	})
+	inst := instantiate(t, `(module
+		(import "env" "stop" (func $stop))
+		(func $f)
+		(func (export "run") (call $stop) (call $f) (call $stop)))`,
+		Imports{"env": {"stop": stop}})
+	if _, err := inst.Invoke(ctx, "run"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if calls != 1 {
+		t.Errorf("host function called %d times, want 1", calls)
+	}
+
+	// A cancelled context stops the call before it starts.
+	if _, err := inst.Invoke(ctx, "run"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if calls != 1 {
+		t.Errorf("host function called %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,356 @@
+package interp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// noBranch is returned by exec when its instructions complete normally.
+const noBranch = -1
+
+// machine executes functions. Values are held on its stack as their bits.
+type machine struct {
+	ctx   context.Context
+	done  <-chan struct{} // ctx.Done()
+	stack []uint64
+
+	frames  []*frame // of the functions being executed, innermost last
+	nlocals int      // number of locals of frames
+	locals  []uint64 // of the frames of compiled functions, in order
+
+	// The referents of the references held by m: see ref.go.
+	refs   []interface{}
+	refIDs map[interface{}]uint64
+
+	// Limits on the number of frames and values (operands and locals),
+	// which include those of the machines whose host functions made the
+	// call that m executes, if any.
+	maxDepth, maxValues     int
+	outerDepth, outerValues int
+}
+
+// machineKey is the context key of the machine calling a host function.
+type machineKey struct{}
+
+// newMachine returns a machine executing a call with ctx, with the limits
+// of inst, or the default limits if nil.
+func newMachine(ctx context.Context, inst *Instance) *machine {
+	m := &machine{
+		ctx:       ctx,
+		done:      ctx.Done(),
+		maxDepth:  DefaultMaxCallDepth,
+		maxValues: DefaultMaxStackValues,
+	}
+	if inst != nil {
+		m.maxDepth, m.maxValues = inst.maxDepth, inst.maxValues
+	}
+	if outer, ok := ctx.Value(machineKey{}).(*machine); ok {
+		m.outerDepth = outer.outerDepth + len(outer.frames)
+		m.outerValues = outer.outerValues + len(outer.stack) + outer.nlocals
+	}
+	return m
+}
+
+// checkDone traps if the context of m is done.
+func (m *machine) checkDone() {
+	select {
+	case <-m.done:
+		trap(m.ctx.Err())
+	default:
+	}
+}
+
+// frame is the activation of a function of a module instance.
+type frame struct {
+	fn *Func
+
+	// of the tree-walker
+	locals []uint64  // including the parameters
+	labels int       // number of labels in scope, excluding the function's
+	instr  ast.Instr // being executed
+
+	// or of compiled code
+	pc int // of the op being executed
+
+	tail *Func // callee of a tail call made by fn, to be called in its place
+}
+
+func (m *machine) push(v uint64) { m.stack = append(m.stack, v) }
+
+func (m *machine) pop() uint64 {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+// unwind removes the values above height h from the stack,
+// except for the top n.
+func (m *machine) unwind(h, n int) {
+	m.stack = unwind(m.stack, h, n)
+}
+
+func unwind(stack []uint64, h, n int) []uint64 {
+	top := len(stack) - n
+	if top != h {
+		copy(stack[h:], stack[top:])
+		stack = stack[:h+n]
+	}
+	return stack
+}
+
+// call calls fn, whose arguments are on the top of the stack,
+// and replaces them with its results.
+func (m *machine) call(fn *Func) {
+	m.checkDone()
+	if fn.host != nil {
+		m.callHost(fn)
+		return
+	}
+	if m.outerDepth+len(m.frames) >= m.maxDepth ||
+		m.outerValues+len(m.stack)+m.nlocals+fn.nlocals > m.maxValues {
+		trap(ErrCallStackExhausted)
+	}
+	base := len(m.stack) - typeSlots(fn.typ.Params)
+	f := &frame{fn: fn}
+	m.frames = append(m.frames, f)
+	m.nlocals += fn.nlocals
+	fn.inst.active++
+	for {
+		if fn.compiled != nil {
+			m.run(f, base)
+		} else {
+			f.locals = make([]uint64, fn.nlocals)
+			copy(f.locals, m.stack[base:])
+			m.stack = m.stack[:base]
+			m.exec(f, fn.code.Body)
+		}
+		fn.inst.active--
+		m.nlocals -= fn.nlocals
+		if f.tail == nil {
+			break
+		}
+
+		// The callee of a tail call takes the place of fn in its frame,
+		// so that tail recursion runs in constant depth.
+		fn = f.tail
+		m.unwind(base, typeSlots(fn.typ.Params))
+		if fn.host != nil {
+			m.frames = m.frames[:len(m.frames)-1]
+			m.call(fn)
+			return
+		}
+		*f = frame{fn: fn}
+		m.nlocals += fn.nlocals
+		fn.inst.active++
+		m.checkDone()
+		if m.outerValues+len(m.stack)+m.nlocals > m.maxValues {
+			trap(ErrCallStackExhausted)
+		}
+	}
+	m.frames = m.frames[:len(m.frames)-1]
+	m.unwind(base, typeSlots(fn.typ.Results))
+}
+
+func (m *machine) callHost(fn *Func) {
+	base := len(m.stack) - typeSlots(fn.typ.Params)
+	args := m.values(fn.typ.Params, m.stack[base:])
+	m.stack = m.stack[:base]
+	results, err := fn.host(context.WithValue(m.ctx, machineKey{}, m), args)
+	if t, ok := err.(*Trap); ok {
+		// A trap of a call made by fn: extend its backtrace.
+		panic(t)
+	}
+	if err != nil {
+		trap(err)
+	}
+	if len(results) != len(fn.typ.Results) {
+		trap(fmt.Errorf("host function returned %d results, want %d", len(results), len(fn.typ.Results)))
+	}
+	for i, r := range results {
+		if r.typ != fn.typ.Results[i] {
+			trap(fmt.Errorf("host function result %d: got %s, want %s", i, r.typ, fn.typ.Results[i]))
+		}
+		m.pushValue(r)
+	}
+}
+
+// exec executes body in f. It returns the relative depth of the label
+// targeted by a branch out of body, or noBranch if body completes normally.
+func (m *machine) exec(f *frame, body []ast.Instr) int {
+	inst := f.fn.inst
+	for _, in := range body {
+		f.instr = in
+		if inst.metered {
+			if inst.fuel == 0 {
+				trap(ErrOutOfFuel)
+			}
+			inst.fuel--
+		}
+		var br int
+		switch in := in.(type) {
+		case *ast.Instruction:
+			if br = m.exec(f, in.Operands); br == noBranch {
+				f.instr = in
+				br = m.execInstr(f, in)
+			}
+		case *ast.Block:
+			br = m.block(f, in.Type, in.Body)
+		case *ast.Loop:
+			br = m.loop(f, in.Type, in.Body)
+		case *ast.If:
+			if br = m.exec(f, in.Cond); br != noBranch {
+				break
+			}
+			f.instr = in
+			if uint32(m.pop()) != 0 {
+				br = m.block(f, in.Type, in.Then)
+			} else {
+				br = m.block(f, in.Type, in.Else)
+			}
+		}
+		if br != noBranch {
+			return br
+		}
+	}
+	return noBranch
+}
+
+// block executes body as the body of a block of type sig, whose
+// parameters are on the stack.
+func (m *machine) block(f *frame, sig *ast.FuncSig, body []ast.Instr) int {
+	sig = f.fn.inst.module.Signature(sig)
+	h := len(m.stack) - tokenSlots(sig.ParamTypes()...)
+	f.labels++
+	br := m.exec(f, body)
+	f.labels--
+	switch {
+	case br == 0:
+		m.unwind(h, tokenSlots(sig.Results...))
+		return noBranch
+	case br > 0:
+		return br - 1
+	}
+	return noBranch
+}
+
+// loop executes body as the body of a loop of type sig, whose parameters
+// are on the stack, until it does not branch to the loop.
+func (m *machine) loop(f *frame, sig *ast.FuncSig, body []ast.Instr) int {
+	params := tokenSlots(f.fn.inst.module.Signature(sig).ParamTypes()...)
+	h := len(m.stack) - params
+	for {
+		f.labels++
+		br := m.exec(f, body)
+		f.labels--
+		switch {
+		case br == 0:
+			m.unwind(h, params)
+			m.checkDone()
+		case br > 0:
+			return br - 1
+		default:
+			return noBranch
+		}
+	}
+}
+
+// execInstr executes the plain instruction in, whose operands are on the
+// stack.
+func (m *machine) execInstr(f *frame, in *ast.Instruction) int {
+	if in.IsVector() {
+		m.vector(f.fn.inst, in)
+		return noBranch
+	}
+	switch in.Op {
+	case ast.UNREACHABLE:
+		trap(ErrUnreachable)
+	case ast.NOP:
+	case ast.BR:
+		return in.Var.Index
+	case ast.BR_IF:
+		if uint32(m.pop()) != 0 {
+			return in.Var.Index
+		}
+	case ast.BR_TABLE:
+		if i := uint32(m.pop()); uint64(i) < uint64(len(in.Table)) {
+			return in.Table[i].Index
+		}
+		return in.Var.Index
+	case ast.RETURN:
+		return f.labels
+	case ast.CALL:
+		m.call(f.fn.inst.funcs[in.Var.Index])
+	case ast.CALL_INDIRECT:
+		m.call(m.indirectCallee(f, in))
+	case ast.RETURN_CALL:
+		f.tail = f.fn.inst.funcs[in.Var.Index]
+		return f.labels
+	case ast.RETURN_CALL_INDIRECT:
+		f.tail = m.indirectCallee(f, in)
+		return f.labels
+	case ast.DROP:
+		m.stack = m.stack[:len(m.stack)-tokenSlots(f.fn.inst.operandTypes[in])]
+	case ast.SELECT:
+		c, n := m.pop(), tokenSlots(f.fn.inst.operandTypes[in])
+		top := len(m.stack) - n
+		if uint32(c) == 0 {
+			copy(m.stack[top-n:top], m.stack[top:])
+		}
+		m.stack = m.stack[:top]
+	case ast.GET_LOCAL:
+		i, n := localSlot(f.fn.offsets, in.Var.Index)
+		m.stack = append(m.stack, f.locals[i:i+n]...)
+	case ast.SET_LOCAL:
+		i, n := localSlot(f.fn.offsets, in.Var.Index)
+		copy(f.locals[i:i+n], m.stack[len(m.stack)-n:])
+		m.stack = m.stack[:len(m.stack)-n]
+	case ast.TEE_LOCAL:
+		i, n := localSlot(f.fn.offsets, in.Var.Index)
+		copy(f.locals[i:i+n], m.stack[len(m.stack)-n:])
+	case ast.GET_GLOBAL:
+		m.pushGlobal(f.fn.inst.globals[in.Var.Index])
+	case ast.SET_GLOBAL:
+		m.popGlobal(f.fn.inst.globals[in.Var.Index])
+	case ast.CONST:
+		m.push(in.Value)
+	case ast.LOAD:
+		ea := uint64(uint32(m.pop())) + uint64(in.Offset)
+		m.push(f.fn.inst.memories[0].load(in, ea))
+	case ast.STORE:
+		v := m.pop()
+		ea := uint64(uint32(m.pop())) + uint64(in.Offset)
+		f.fn.inst.memories[0].store(in, ea, v)
+	case ast.CURRENT_MEMORY:
+		m.push(uint64(f.fn.inst.memories[0].Size()))
+	case ast.GROW_MEMORY:
+		prev, ok := f.fn.inst.memories[0].Grow(uint32(m.pop()))
+		if !ok {
+			prev = ^uint32(0) // -1
+		}
+		m.push(uint64(prev))
+	case ast.MEMORY_COPY, ast.MEMORY_FILL, ast.MEMORY_INIT, ast.DATA_DROP,
+		ast.TABLE_COPY, ast.TABLE_INIT, ast.ELEM_DROP:
+		m.bulk(f.fn.inst, in)
+	case ast.REF_NULL, ast.REF_IS_NULL, ast.REF_FUNC, ast.TABLE_GET,
+		ast.TABLE_SET, ast.TABLE_SIZE, ast.TABLE_GROW, ast.TABLE_FILL:
+		m.reference(f.fn.inst, in)
+	case ast.ATOMIC_LOAD, ast.ATOMIC_STORE, ast.ATOMIC_RMW, ast.ATOMIC_FENCE,
+		ast.MEMORY_ATOMIC_NOTIFY, ast.MEMORY_ATOMIC_WAIT:
+		m.atomic(f.fn.inst, in)
+	default:
+		m.numeric(in)
+	}
+	return noBranch
+}
+
+// indirectCallee pops an index into the table of in, and returns the
+// function that it holds, which must be of the type of in.
+func (m *machine) indirectCallee(f *frame, in *ast.Instruction) *Func {
+	fn := f.fn.inst.table(in.TableVar).function(uint32(m.pop()))
+	if !fn.typ.matches(f.fn.inst.module, in.Sig) {
+		trap(ErrIndirectCallTypeMismatch)
+	}
+	return fn
+}
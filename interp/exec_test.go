@@ -0,0 +1,371 @@
+package interp
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sprt/wasm/ast"
+)
+
+func parse(t testing.TB, src string) *ast.Module {
+	t.Helper()
+	m, err := ast.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return m
+}
+
+func instantiate(t *testing.T, src string, imports Imports) *Instance {
+	t.Helper()
+	inst, err := Instantiate(context.Background(), parse(t, src), imports)
+	if err != nil {
+		t.Fatalf("Instantiate: %v", err)
+	}
+	return inst
+}
+
+type invokeTest struct {
+	name string
+	args []Value
+	want []Value
+	err  error // if the call traps
+}
+
+func runInvokeTests(t *testing.T, inst *Instance, tests []invokeTest) {
+	t.Helper()
+	for _, tt := range tests {
+		got, err := inst.Invoke(context.Background(), tt.name, tt.args...)
+		if tt.err != nil {
+			var trap *Trap
+			if !errors.As(err, &trap) || !errors.Is(err, tt.err) {
+				t.Errorf("%s%v: got error %v, want trap %v", tt.name, tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s%v: %v", tt.name, tt.args, err)
+			continue
+		}
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s%v = %v, want %v", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+const numericModule = `(module
+	(func (export "i32.add") (param i32 i32) (result i32) (i32.add (get_local 0) (get_local 1)))
+	(func (export "i32.div_s") (param i32 i32) (result i32) (i32.div_s (get_local 0) (get_local 1)))
+	(func (export "i32.div_u") (param i32 i32) (result i32) (i32.div_u (get_local 0) (get_local 1)))
+	(func (export "i32.rem_s") (param i32 i32) (result i32) (i32.rem_s (get_local 0) (get_local 1)))
+	(func (export "i32.shr_s") (param i32 i32) (result i32) (i32.shr_s (get_local 0) (get_local 1)))
+	(func (export "i32.rotl") (param i32 i32) (result i32) (i32.rotl (get_local 0) (get_local 1)))
+	(func (export "i32.clz") (param i32) (result i32) (i32.clz (get_local 0)))
+	(func (export "i32.lt_u") (param i32 i32) (result i32) (i32.lt_u (get_local 0) (get_local 1)))
+	(func (export "i64.mul") (param i64 i64) (result i64) (i64.mul (get_local 0) (get_local 1)))
+	(func (export "i64.shl") (param i64 i64) (result i64) (i64.shl (get_local 0) (get_local 1)))
+	(func (export "i64.ge_s") (param i64 i64) (result i32) (i64.ge_s (get_local 0) (get_local 1)))
+	(func (export "i64.popcnt") (param i64) (result i64) (i64.popcnt (get_local 0)))
+	(func (export "f32.div") (param f32 f32) (result f32) (f32.div (get_local 0) (get_local 1)))
+	(func (export "f32.nearest") (param f32) (result f32) (f32.nearest (get_local 0)))
+	(func (export "f64.min") (param f64 f64) (result f64) (f64.min (get_local 0) (get_local 1)))
+	(func (export "f64.copysign") (param f64 f64) (result f64) (f64.copysign (get_local 0) (get_local 1)))
+	(func (export "f64.neg") (param f64) (result f64) (f64.neg (get_local 0)))
+	(func (export "i32.trunc_s/f32") (param f32) (result i32) (i32.trunc_s/f32 (get_local 0)))
+	(func (export "i64.trunc_u/f64") (param f64) (result i64) (i64.trunc_u/f64 (get_local 0)))
+	(func (export "i64.extend_s/i32") (param i32) (result i64) (i64.extend_s/i32 (get_local 0)))
+	(func (export "i32.wrap/i64") (param i64) (result i32) (i32.wrap/i64 (get_local 0)))
+	(func (export "f32.convert_u/i64") (param i64) (result f32) (f32.convert_u/i64 (get_local 0)))
+	(func (export "f64.promote/f32") (param f32) (result f64) (f64.promote/f32 (get_local 0)))
+	(func (export "i32.reinterpret/f32") (param f32) (result i32) (i32.reinterpret/f32 (get_local 0)))
+)`
+
+func TestNumeric(t *testing.T) {
+	inst := instantiate(t, numericModule, nil)
+	nan := math.NaN()
+	runInvokeTests(t, inst, []invokeTest{
+		{"i32.add", []Value{Int32(math.MaxInt32), Int32(1)}, []Value{Int32(math.MinInt32)}, nil},
+		{"i32.div_s", []Value{Int32(-7), Int32(2)}, []Value{Int32(-3)}, nil},
+		{"i32.div_s", []Value{Int32(1), Int32(0)}, nil, ErrIntegerDivideByZero},
+		{"i32.div_s", []Value{Int32(math.MinInt32), Int32(-1)}, nil, ErrIntegerOverflow},
+		{"i32.div_u", []Value{Int32(-1), Int32(2)}, []Value{Int32(math.MaxInt32)}, nil},
+		{"i32.rem_s", []Value{Int32(-7), Int32(2)}, []Value{Int32(-1)}, nil},
+		{"i32.rem_s", []Value{Int32(math.MinInt32), Int32(-1)}, []Value{Int32(0)}, nil},
+		{"i32.shr_s", []Value{Int32(-8), Int32(33)}, []Value{Int32(-4)}, nil},
+		{"i32.rotl", []Value{Int32(math.MinInt32 | 1), Int32(1)}, []Value{Int32(3)}, nil},
+		{"i32.clz", []Value{Int32(1)}, []Value{Int32(31)}, nil},
+		{"i32.lt_u", []Value{Int32(1), Int32(-1)}, []Value{Int32(1)}, nil},
+		{"i64.mul", []Value{Int64(1 << 40), Int64(1 << 30)}, []Value{Int64(0)}, nil},
+		{"i64.shl", []Value{Int64(1), Int64(65)}, []Value{Int64(2)}, nil},
+		{"i64.ge_s", []Value{Int64(-1), Int64(0)}, []Value{Int32(0)}, nil},
+		{"i64.popcnt", []Value{Int64(-1)}, []Value{Int64(64)}, nil},
+		{"f32.div", []Value{Float32(1), Float32(3)}, []Value{Float32(1.0 / 3)}, nil},
+		{"f32.nearest", []Value{Float32(2.5)}, []Value{Float32(2)}, nil},
+		{"f32.nearest", []Value{Float32(-3.5)}, []Value{Float32(-4)}, nil},
+		{"f64.min", []Value{Float64(0), Float64(math.Copysign(0, -1))}, []Value{Float64(math.Copysign(0, -1))}, nil},
+		{"f64.copysign", []Value{Float64(2), Float64(-0.5)}, []Value{Float64(-2)}, nil},
+		{"f64.neg", []Value{ValueOf(F64, 0x7ff0000000000001)}, []Value{ValueOf(F64, 0xfff0000000000001)}, nil},
+		{"i32.trunc_s/f32", []Value{Float32(-3.9)}, []Value{Int32(-3)}, nil},
+		{"i32.trunc_s/f32", []Value{Float32(2147483648)}, nil, ErrIntegerOverflow},
+		{"i32.trunc_s/f32", []Value{Float32(float32(nan))}, nil, ErrInvalidConversion},
+		{"i64.trunc_u/f64", []Value{Float64(-0.9)}, []Value{Int64(0)}, nil},
+		{"i64.trunc_u/f64", []Value{Float64(1 << 63)}, []Value{Int64(math.MinInt64)}, nil},
+		{"i64.trunc_u/f64", []Value{Float64(-1)}, nil, ErrIntegerOverflow},
+		{"i64.extend_s/i32", []Value{Int32(-2)}, []Value{Int64(-2)}, nil},
+		{"i32.wrap/i64", []Value{Int64(1<<32 | 5)}, []Value{Int32(5)}, nil},
+		{"f32.convert_u/i64", []Value{Int64(-1)}, []Value{Float32(1 << 64)}, nil},
+		{"f64.promote/f32", []Value{Float32(0.1)}, []Value{Float64(float64(float32(0.1)))}, nil},
+		{"i32.reinterpret/f32", []Value{Float32(-0.0)}, []Value{Int32(0)}, nil},
+	})
+}
+
+const signExtensionModule = `(module
+	(func (export "i32.extend8_s") (param i32) (result i32) (i32.extend8_s (get_local 0)))
+	(func (export "i32.extend16_s") (param i32) (result i32) (i32.extend16_s (get_local 0)))
+	(func (export "i64.extend8_s") (param i64) (result i64) (i64.extend8_s (get_local 0)))
+	(func (export "i64.extend16_s") (param i64) (result i64) (i64.extend16_s (get_local 0)))
+	(func (export "i64.extend32_s") (param i64) (result i64) (i64.extend32_s (get_local 0)))
+)`
+
+func TestSignExtension(t *testing.T) {
+	m := parse(t, signExtensionModule)
+	if _, err := Instantiate(context.Background(), m, nil); err == nil {
+		t.Fatal("Instantiate without the sign-extension feature succeeded")
+	}
+	c := &Config{Features: ast.SignExtension}
+	inst, err := c.Instantiate(context.Background(), m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"i32.extend8_s", []Value{Int32(0x7f)}, []Value{Int32(0x7f)}, nil},
+		{"i32.extend8_s", []Value{Int32(0x1280)}, []Value{Int32(-128)}, nil},
+		{"i32.extend16_s", []Value{Int32(0x7fff)}, []Value{Int32(0x7fff)}, nil},
+		{"i32.extend16_s", []Value{Int32(0x18000)}, []Value{Int32(-0x8000)}, nil},
+		{"i64.extend8_s", []Value{Int64(0x0123456789abcdef)}, []Value{Int64(-0x11)}, nil},
+		{"i64.extend16_s", []Value{Int64(0x8000)}, []Value{Int64(-0x8000)}, nil},
+		{"i64.extend32_s", []Value{Int64(0x7fffffff)}, []Value{Int64(0x7fffffff)}, nil},
+		{"i64.extend32_s", []Value{Int64(0x180000000)}, []Value{Int64(math.MinInt32)}, nil},
+	})
+}
+
+const truncSatModule = `(module
+	(func (export "i32.trunc_sat_f32_s") (param f32) (result i32) (i32.trunc_sat_f32_s (get_local 0)))
+	(func (export "i32.trunc_sat_f64_u") (param f64) (result i32) (i32.trunc_sat_f64_u (get_local 0)))
+	(func (export "i64.trunc_sat_f64_s") (param f64) (result i64) (i64.trunc_sat_f64_s (get_local 0)))
+	(func (export "i64.trunc_sat_f32_u") (param f32) (result i64) (i64.trunc_sat_f32_u (get_local 0)))
+)`
+
+func TestTruncSat(t *testing.T) {
+	m := parse(t, truncSatModule)
+	if _, err := Instantiate(context.Background(), m, nil); err == nil {
+		t.Fatal("Instantiate without the saturating-float-to-int feature succeeded")
+	}
+	c := &Config{Features: ast.SaturatingFloatToInt}
+	inst, err := c.Instantiate(context.Background(), m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nan, inf := math.NaN(), math.Inf(1)
+	runInvokeTests(t, inst, []invokeTest{
+		{"i32.trunc_sat_f32_s", []Value{Float32(-3.9)}, []Value{Int32(-3)}, nil},
+		{"i32.trunc_sat_f32_s", []Value{Float32(2147483648)}, []Value{Int32(math.MaxInt32)}, nil},
+		{"i32.trunc_sat_f32_s", []Value{Float32(-2147483904)}, []Value{Int32(math.MinInt32)}, nil},
+		{"i32.trunc_sat_f32_s", []Value{Float32(float32(nan))}, []Value{Int32(0)}, nil},
+		{"i32.trunc_sat_f64_u", []Value{Float64(-0.9)}, []Value{Int32(0)}, nil},
+		{"i32.trunc_sat_f64_u", []Value{Float64(-1)}, []Value{Int32(0)}, nil},
+		{"i32.trunc_sat_f64_u", []Value{Float64(4294967295.5)}, []Value{Int32(-1)}, nil},
+		{"i32.trunc_sat_f64_u", []Value{Float64(inf)}, []Value{Int32(-1)}, nil},
+		{"i64.trunc_sat_f64_s", []Value{Float64(-inf)}, []Value{Int64(math.MinInt64)}, nil},
+		{"i64.trunc_sat_f64_s", []Value{Float64(1 << 63)}, []Value{Int64(math.MaxInt64)}, nil},
+		{"i64.trunc_sat_f64_s", []Value{Float64(-nan)}, []Value{Int64(0)}, nil},
+		{"i64.trunc_sat_f32_u", []Value{Float32(1 << 64)}, []Value{Int64(-1)}, nil},
+		{"i64.trunc_sat_f32_u", []Value{Float32(1 << 63)}, []Value{Int64(math.MinInt64)}, nil},
+	})
+}
+
+const controlModule = `(module
+	(func $fac (export "fac") (param i64) (result i64)
+		(if (result i64) (i64.eqz (get_local 0))
+			(then (i64.const 1))
+			(else (i64.mul (get_local 0) (call $fac (i64.sub (get_local 0) (i64.const 1)))))))
+	(func (export "fib") (param $n i32) (result i32)
+		(local $a i32) (local $b i32)
+		(set_local $b (i32.const 1))
+		(block $done
+			(loop $next
+				(br_if $done (i32.eqz (get_local $n)))
+				(set_local $b (i32.add (get_local $a) (tee_local $a (get_local $b))))
+				(set_local $n (i32.sub (get_local $n) (i32.const 1)))
+				(br $next)))
+		(get_local $a))
+	(func (export "switch") (param i32) (result i32)
+		(block $default
+			(block $two
+				(block $one
+					(block $zero
+						(br_table $zero $one $two $default (get_local 0)))
+					(return (i32.const 100)))
+				(return (i32.const 101)))
+			(return (i32.const 102)))
+		(i32.const 103))
+	(func (export "select") (param i32) (result i64)
+		(select (i64.const 1) (i64.const 2) (get_local 0)))
+	(func (export "return") (result i32)
+		(block (loop (block (return (i32.const 7)))))
+		(i32.const 8))
+	(func (export "unreachable") unreachable)
+	(func (export "nested") (result i32)
+		(i32.add (i32.const 1) (block (result i32) (i32.const 2) (br 0 (i32.const 3)))))
+)`
+
+func TestControl(t *testing.T) {
+	inst := instantiate(t, controlModule, nil)
+	runInvokeTests(t, inst, []invokeTest{
+		{"fac", []Value{Int64(20)}, []Value{Int64(2432902008176640000)}, nil},
+		{"fib", []Value{Int32(0)}, []Value{Int32(0)}, nil},
+		{"fib", []Value{Int32(10)}, []Value{Int32(55)}, nil},
+		{"switch", []Value{Int32(0)}, []Value{Int32(100)}, nil},
+		{"switch", []Value{Int32(1)}, []Value{Int32(101)}, nil},
+		{"switch", []Value{Int32(2)}, []Value{Int32(102)}, nil},
+		{"switch", []Value{Int32(3)}, []Value{Int32(103)}, nil},
+		{"switch", []Value{Int32(-1)}, []Value{Int32(103)}, nil},
+		{"select", []Value{Int32(1)}, []Value{Int64(1)}, nil},
+		{"select", []Value{Int32(0)}, []Value{Int64(2)}, nil},
+		{"return", nil, []Value{Int32(7)}, nil},
+		{"unreachable", nil, nil, ErrUnreachable},
+		{"nested", nil, []Value{Int32(4)}, nil},
+	})
+}
+
+const multiValueModule = `(module
+	(type $pair (func (param i32 i32) (result i32 i32)))
+	(import "env" "divmod" (func $divmod (type $pair)))
+	(table 1 anyfunc)
+	(elem (i32.const 0) $swap)
+	(func $swap (export "swap") (type $pair) (get_local 1) (get_local 0))
+	(func (export "swap_indirect") (type $pair)
+		(call_indirect (type $pair) (get_local 0) (get_local 1) (i32.const 0)))
+	(func (export "divmod") (type $pair) (call $divmod (get_local 0) (get_local 1)))
+	(func (export "sum") (param i32) (result i32)
+		(i32.const 0) (get_local 0)
+		(loop $l (param i32 i32) (result i32)
+			(set_local 0)
+			(i32.add (get_local 0))
+			(tee_local 0 (i32.sub (get_local 0) (i32.const 1)))
+			(br_if $l (get_local 0))
+			drop))
+	(func (export "br") (param i32) (result i32 i64)
+		(block $b (result i32 i64)
+			(get_local 0) (i64.const 7)
+			(br_if $b (get_local 0))
+			drop drop
+			(i32.const -1) (i64.const -1)))
+	(func (export "if") (param i32 i32) (result i32)
+		(get_local 1)
+		(if (param i32) (result i32) (get_local 0)
+			(then (i32.add (i32.const 10)))
+			(else (i32.mul (i32.const 20)))))
+	(func (export "return") (result i32 i32 i32)
+		(return (i32.const 1) (i32.const 2) (i32.const 3)))
+)`
+
+func TestMultiValue(t *testing.T) {
+	m := parse(t, multiValueModule)
+	divmod := NewHostFunc(FuncType{Params: []ValueType{I32, I32}, Results: []ValueType{I32, I32}},
+		func(_ context.Context, args []Value) ([]Value, error) {
+			x, y := args[0].Int32(), args[1].Int32()
+			return []Value{Int32(x / y), Int32(x % y)}, nil
+		})
+	imports := Imports{"env": {"divmod": divmod}}
+	if _, err := Instantiate(context.Background(), m, imports); err == nil {
+		t.Fatal("Instantiate without the multi-value feature succeeded")
+	}
+	c := &Config{Features: ast.MultiValue}
+	inst, err := c.Instantiate(context.Background(), m, imports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"swap", []Value{Int32(1), Int32(2)}, []Value{Int32(2), Int32(1)}, nil},
+		{"swap_indirect", []Value{Int32(1), Int32(2)}, []Value{Int32(2), Int32(1)}, nil},
+		{"divmod", []Value{Int32(17), Int32(5)}, []Value{Int32(3), Int32(2)}, nil},
+		{"sum", []Value{Int32(1)}, []Value{Int32(1)}, nil},
+		{"sum", []Value{Int32(4)}, []Value{Int32(10)}, nil},
+		{"br", []Value{Int32(3)}, []Value{Int32(3), Int64(7)}, nil},
+		{"br", []Value{Int32(0)}, []Value{Int32(-1), Int64(-1)}, nil},
+		{"if", []Value{Int32(1), Int32(5)}, []Value{Int32(15)}, nil},
+		{"if", []Value{Int32(0), Int32(5)}, []Value{Int32(100)}, nil},
+		{"return", nil, []Value{Int32(1), Int32(2), Int32(3)}, nil},
+	})
+}
+
+func TestHostFunc(t *testing.T) {
+	var got []int32
+	log := NewHostFunc(FuncType{Params: []ValueType{I32}}, func(_ context.Context, args []Value) ([]Value, error) {
+		got = append(got, args[0].Int32())
+		return nil, nil
+	})
+	errFail := errors.New("fail")
+	fail := NewHostFunc(FuncType{}, func(context.Context, []Value) ([]Value, error) {
+		return nil, errFail
+	})
+	inst := instantiate(t, `(module
+		(import "env" "log" (func $log (param i32)))
+		(import "env" "fail" (func $fail))
+		(func (export "run") (call $log (i32.const 1)) (call $log (i32.const 2)))
+		(func (export "fail") (call $fail)))`,
+		Imports{"env": {"log": log, "fail": fail}})
+	runInvokeTests(t, inst, []invokeTest{
+		{"run", nil, nil, nil},
+		{"fail", nil, nil, errFail},
+	})
+	if want := []int32{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %v, want %v", got, want)
+	}
+}
+
+func TestInvokeErrors(t *testing.T) {
+	inst := instantiate(t, `(module (func (export "f") (param i32)))`, nil)
+	for _, tt := range []struct {
+		name string
+		args []Value
+		err  string
+	}{
+		{"g", nil, `no exported function "g"`},
+		{"f", nil, "wrong number of arguments: got 0, want 1"},
+		{"f", []Value{Int64(0)}, "argument 0: got i64, want i32"},
+	} {
+		_, err := inst.Invoke(context.Background(), tt.name, tt.args...)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("Invoke(%q, %v): got error %v, want %q", tt.name, tt.args, err, tt.err)
+		}
+	}
+}
+
+// TestMain runs the tests with each engine, and benchmarks, which choose
+// their engines, once.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	for _, e := range []Engine{Bytecode, TreeWalker} {
+		defaultEngine = e
+		if code := m.Run(); code != 0 {
+			fmt.Fprintf(os.Stderr, "FAIL with the %s engine\n", e)
+			os.Exit(code)
+		}
+		if flag.Lookup("test.bench").Value.String() != "" {
+			break
+		}
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,91 @@
+package interp
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+const fuelModule = `(module
+	(func (export "add") (result i32) (i32.add (i32.const 1) (i32.const 2)))
+	(func (export "sum") (param $n i32) (result i32) (local $s i32)
+		(block $done
+			(loop $next
+				(br_if $done (i32.eqz (get_local $n)))
+				(set_local $s (i32.add (get_local $s) (get_local $n)))
+				(set_local $n (i32.sub (get_local $n) (i32.const 1)))
+				(br $next)))
+		(get_local $s))
+	(func (export "spin") (loop (br 0))))`
+
+func meteredInstance(t *testing.T, fuel uint64) *Instance {
+	t.Helper()
+	cfg := &Config{FuelMetering: true, Fuel: fuel}
+	inst, err := cfg.Instantiate(context.Background(), parse(t, fuelModule), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+func TestFuel(t *testing.T) {
+	inst := meteredInstance(t, 3)
+	runInvokeTests(t, inst, []invokeTest{
+		{"add", nil, []Value{Int32(3)}, nil},
+		{"add", nil, nil, ErrOutOfFuel},
+	})
+	if fuel, metered := inst.Fuel(); fuel != 0 || !metered {
+		t.Errorf("Fuel() = %d, %v, want 0, true", fuel, metered)
+	}
+	inst.AddFuel(3)
+	runInvokeTests(t, inst, []invokeTest{
+		{"add", nil, []Value{Int32(3)}, nil},
+	})
+
+	inst.AddFuel(1_000_000)
+	runInvokeTests(t, inst, []invokeTest{
+		{"spin", nil, nil, ErrOutOfFuel},
+	})
+	if fuel, _ := inst.Fuel(); fuel != 0 {
+		t.Errorf("Fuel() = %d after running out, want 0", fuel)
+	}
+
+	inst.AddFuel(1 << 63)
+	inst.AddFuel(1 << 63)
+	inst.AddFuel(1 << 63)
+	if fuel, _ := inst.Fuel(); fuel != 1<<64-1 {
+		t.Errorf("Fuel() = %d, want saturation at %d", fuel, uint64(1<<64-1))
+	}
+}
+
+func TestFuelDeterministic(t *testing.T) {
+	const fuel = 10000
+	var used uint64
+	for i := 0; i < 3; i++ {
+		inst := meteredInstance(t, fuel)
+		if _, err := inst.Invoke(context.Background(), "sum", Int32(100)); err != nil {
+			t.Fatal(err)
+		}
+		left, _ := inst.Fuel()
+		if i > 0 && fuel-left != used {
+			t.Errorf("run %d used %d units of fuel, want %d", i, fuel-left, used)
+		}
+		used = fuel - left
+	}
+
+	// The call fails with exactly one unit less.
+	inst := meteredInstance(t, used-1)
+	if _, err := inst.Invoke(context.Background(), "sum", Int32(100)); !errors.Is(err, ErrOutOfFuel) {
+		t.Errorf("got error %v, want %v", err, ErrOutOfFuel)
+	}
+}
+
+func TestFuelUnmetered(t *testing.T) {
+	inst := instantiate(t, fuelModule, nil)
+	runInvokeTests(t, inst, []invokeTest{
+		{"sum", []Value{Int32(1000)}, []Value{Int32(500500)}, nil},
+	})
+	if _, metered := inst.Fuel(); metered {
+		t.Errorf("instance is metered by default")
+	}
+}
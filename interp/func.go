@@ -0,0 +1,178 @@
+package interp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// FuncType is the type of a function.
+type FuncType struct {
+	Params  []ValueType
+	Results []ValueType
+}
+
+func (t FuncType) equal(u FuncType) bool {
+	return equalTypes(t.Params, u.Params) && equalTypes(t.Results, u.Results)
+}
+
+func equalTypes(a, b []ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns t in the form (i32, i64) -> (f32).
+func (t FuncType) String() string {
+	return formatTypes(t.Params) + " -> " + formatTypes(t.Results)
+}
+
+func formatTypes(types []ValueType) string {
+	s := make([]string, len(types))
+	for i, t := range types {
+		s[i] = t.String()
+	}
+	return "(" + strings.Join(s, ", ") + ")"
+}
+
+// funcType returns the type of the functions of signature sig in m.
+func funcType(m *ast.Module, sig *ast.FuncSig) FuncType {
+	sig = m.Signature(sig)
+	return FuncType{
+		Params:  valueTypes(sig.ParamTypes()),
+		Results: valueTypes(sig.Results),
+	}
+}
+
+// matches reports whether t is the type of the functions of signature sig
+// in m, without allocating.
+func (t FuncType) matches(m *ast.Module, sig *ast.FuncSig) bool {
+	sig = m.Signature(sig)
+	if len(t.Results) != len(sig.Results) {
+		return false
+	}
+	for i, r := range sig.Results {
+		if t.Results[i] != valueType(r) {
+			return false
+		}
+	}
+	i := 0
+	for _, p := range sig.Params {
+		for _, typ := range p.Types {
+			if i >= len(t.Params) || t.Params[i] != valueType(typ) {
+				return false
+			}
+			i++
+		}
+	}
+	return i == len(t.Params)
+}
+
+// HostFunc is the implementation of a host function. It is called with
+// the context of the call and arguments of the types of the parameters of
+// the function, and must return results of the types of its results, or
+// an error, which traps.
+type HostFunc func(ctx context.Context, args []Value) ([]Value, error)
+
+// Func is a function: either a function of a module instance, or a host
+// function implemented in Go.
+type Func struct {
+	typ FuncType
+
+	// function of a module instance
+	inst     *Instance
+	index    int // in the module of inst
+	code     *ast.Func
+	nlocals  int           // number of slots of the locals, including the parameters
+	offsets  []int         // of the first slot of each local and past the last, if any is a V128
+	compiled *compiledFunc // if executed by the Bytecode engine
+
+	// or host function
+	host HostFunc
+}
+
+// NewHostFunc returns a function of type typ implemented by fn,
+// which can be imported by modules.
+func NewHostFunc(typ FuncType, fn HostFunc) *Func {
+	return &Func{typ: typ, host: fn}
+}
+
+// Type returns the type of f.
+func (f *Func) Type() FuncType { return f.typ }
+
+// Call calls f with args and returns its results.
+// If the execution of f traps, the error is a *Trap. In particular, if ctx
+// is done before f returns, execution stops at the next call or loop
+// iteration, and the Trap wraps ctx.Err().
+func (f *Func) Call(ctx context.Context, args ...Value) (results []Value, err error) {
+	if len(args) != len(f.typ.Params) {
+		return nil, fmt.Errorf("wrong number of arguments: got %d, want %d", len(args), len(f.typ.Params))
+	}
+	for i, arg := range args {
+		if arg.typ != f.typ.Params[i] {
+			return nil, fmt.Errorf("argument %d: got %s, want %s", i, arg.typ, f.typ.Params[i])
+		}
+	}
+
+	m := newMachine(ctx, f.inst)
+	defer func() {
+		if e := recover(); e != nil {
+			t, ok := e.(*Trap)
+			if !ok {
+				panic(e)
+			}
+			t.Frames = append(t.Frames, m.backtrace()...)
+			for _, f := range m.frames {
+				f.fn.inst.active--
+			}
+			results, err = nil, t
+		}
+	}()
+	for _, arg := range args {
+		m.pushValue(arg)
+	}
+	m.call(f)
+	return m.values(f.typ.Results, m.stack), nil
+}
+
+// localSlot returns the index of the first slot of the local i of a
+// function whose locals begin at the given offsets, as returned by
+// localOffsets, and its number of slots.
+func localSlot(offsets []int, i int) (slot, n int) {
+	if offsets == nil {
+		return i, 1
+	}
+	return offsets[i], offsets[i+1] - offsets[i]
+}
+
+// localOffsets returns the index of the first slot of each local of fn,
+// of type typ, including its parameters, followed by their number of
+// slots, or nil if the locals take a slot each.
+func localOffsets(typ FuncType, fn *ast.Func) []int {
+	vector := typeSlots(typ.Params) != len(typ.Params)
+	for _, l := range fn.Locals {
+		vector = vector || l.Type == ast.V128
+	}
+	if !vector {
+		return nil
+	}
+	offsets := make([]int, 0, len(typ.Params)+len(fn.Locals)+1)
+	slot := 0
+	for _, t := range typ.Params {
+		offsets = append(offsets, slot)
+		slot += t.slots()
+	}
+	for _, l := range fn.Locals {
+		offsets = append(offsets, slot)
+		slot += tokenSlots(l.Type)
+	}
+	return append(offsets, slot)
+}
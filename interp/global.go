@@ -0,0 +1,42 @@
+package interp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Global is a global variable.
+type Global struct {
+	typ     ValueType
+	mutable bool
+	bits    uint64
+	hi      uint64      // if typ is V128, as in Value
+	ref     interface{} // if typ is a reference type, as in Value
+}
+
+// NewGlobal returns a new global holding v, which can be set if mutable.
+func NewGlobal(v Value, mutable bool) *Global {
+	return &Global{typ: v.typ, mutable: mutable, bits: v.bits, hi: v.hi, ref: v.ref}
+}
+
+// Type returns the type of the value of g.
+func (g *Global) Type() ValueType { return g.typ }
+
+// Mutable reports whether g can be set.
+func (g *Global) Mutable() bool { return g.mutable }
+
+// Get returns the value of g.
+func (g *Global) Get() Value { return Value{typ: g.typ, bits: g.bits, hi: g.hi, ref: g.ref} }
+
+// Set sets the value of g to v, which must be of its type.
+// It returns an error if g is immutable.
+func (g *Global) Set(v Value) error {
+	if !g.mutable {
+		return errors.New("global is immutable")
+	}
+	if v.typ != g.typ {
+		return fmt.Errorf("type mismatch: got %s, want %s", v.typ, g.typ)
+	}
+	g.bits, g.hi, g.ref = v.bits, v.hi, v.ref
+	return nil
+}
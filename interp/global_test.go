@@ -0,0 +1,60 @@
+package interp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGlobals(t *testing.T) {
+	base := NewGlobal(Int32(1000), false)
+	counter := NewGlobal(Int64(0), true)
+	inst := instantiate(t, `(module
+		(import "env" "base" (global $base i32))
+		(global $counter (import "env" "counter") (mut i64))
+		(global $sp (export "sp") (mut i32) (get_global $base))
+		(global $pi (export "pi") f64 (f64.const 3.14))
+		(func (export "alloc") (param i32) (result i32)
+			(set_global $counter (i64.add (get_global $counter) (i64.const 1)))
+			(set_global $sp (i32.sub (get_global $sp) (get_local 0)))
+			(get_global $sp)))`,
+		Imports{"env": {"base": base, "counter": counter}})
+	runInvokeTests(t, inst, []invokeTest{
+		{"alloc", []Value{Int32(16)}, []Value{Int32(984)}, nil},
+		{"alloc", []Value{Int32(8)}, []Value{Int32(976)}, nil},
+	})
+	if got := counter.Get(); got != Int64(2) {
+		t.Errorf("counter = %v, want %v", got, Int64(2))
+	}
+
+	sp := inst.Export("sp").(*Global)
+	if got := sp.Get(); got != Int32(976) {
+		t.Errorf("sp = %v, want %v", got, Int32(976))
+	}
+	if err := sp.Set(Int32(2000)); err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"alloc", []Value{Int32(1)}, []Value{Int32(1999)}, nil},
+	})
+	if err := sp.Set(Int64(0)); err == nil || err.Error() != "type mismatch: got i64, want i32" {
+		t.Errorf("Set(i64) on i32 global: got error %v", err)
+	}
+
+	pi := inst.Export("pi").(*Global)
+	if pi.Mutable() || pi.Type() != F64 || pi.Get().Float64() != 3.14 {
+		t.Errorf("pi = %v (mutable %v)", pi.Get(), pi.Mutable())
+	}
+	if err := pi.Set(Float64(3)); err == nil || err.Error() != "global is immutable" {
+		t.Errorf("Set on immutable global: got error %v", err)
+	}
+}
+
+func TestImportGlobalMismatch(t *testing.T) {
+	for _, g := range []*Global{NewGlobal(Int32(0), true), NewGlobal(Int64(0), false)} {
+		m := parse(t, `(module (import "env" "g" (global i32)))`)
+		_, err := Instantiate(context.Background(), m, Imports{"env": {"g": g}})
+		if want := `import "env" "g": incompatible import type`; err == nil || err.Error() != want {
+			t.Errorf("importing %s global (mutable %v): got error %v, want %q", g.Type(), g.Mutable(), err, want)
+		}
+	}
+}
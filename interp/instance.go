@@ -0,0 +1,529 @@
+// Package interp executes WebAssembly modules by interpreting their AST.
+package interp
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// Extern is an entity that a module instance exports, or that is
+// provided to it as an import: one of *Func, *Table, *Memory or *Global.
+type Extern interface {
+	isExtern()
+}
+
+func (*Func) isExtern()   {}
+func (*Table) isExtern()  {}
+func (*Memory) isExtern() {}
+func (*Global) isExtern() {}
+
+// Imports maps the module and field names of imports to their values.
+type Imports map[string]map[string]Extern
+
+// Instance is an instance of a module.
+type Instance struct {
+	module   *ast.Module
+	funcs    []*Func
+	tables   []*Table
+	memories []*Memory
+	globals  []*Global
+	exports  map[string]Extern
+	start    *Func // may be nil
+
+	operandTypes map[*ast.Instruction]ast.TokenType // of drop and select
+
+	// whether each segment was dropped, by data.drop or elem.drop, or
+	// because it is active and was applied on instantiation
+	droppedData, droppedElems []bool
+
+	metered bool   // whether fuel is metered
+	fuel    uint64 // remaining fuel, if metered
+
+	maxDepth, maxValues int // limits of calls
+
+	active int // number of calls of its functions being executed
+}
+
+// Engine is a way of executing the functions of instances.
+type Engine int
+
+// Engines. The zero Engine of a Config means Bytecode.
+const (
+	// Bytecode lowers function bodies to a compact bytecode on
+	// instantiation, with precomputed branch targets and locals held in
+	// flat slots, and executes it.
+	Bytecode Engine = iota + 1
+
+	// TreeWalker executes function bodies by walking their syntax tree.
+	// It does no work on instantiation, but executes code more slowly.
+	TreeWalker
+)
+
+func (e Engine) String() string {
+	switch e {
+	case Bytecode:
+		return "bytecode"
+	case TreeWalker:
+		return "tree-walker"
+	}
+	return fmt.Sprintf("Engine(%d)", int(e))
+}
+
+// defaultEngine is the Engine used when a Config does not set one.
+var defaultEngine = Bytecode
+
+// Config configures the instantiation of modules.
+// The zero Config instantiates them with the default settings.
+type Config struct {
+	// Engine executes the functions of instances, and is the engine that
+	// Compile lowers them for. Functions called across instances run with
+	// the engine of the instance of the callee.
+	Engine Engine
+
+	// MaxMemoryPages caps the size, in pages, of the memories defined by
+	// instances, whatever their declared maximum: instantiation fails if
+	// the minimum size of one exceeds it, and grow_memory past it fails.
+	// Zero means the limit of 65536 pages (4GiB).
+	MaxMemoryPages uint32
+
+	// Features are the features that modules may use beyond the MVP.
+	Features ast.Features
+
+	// FuelMetering enables fuel metering: each instruction that the
+	// functions of an instance execute consumes one unit of its fuel, and
+	// execution traps with ErrOutOfFuel when there is none left.
+	// Instances start with Fuel units, and more can be added with
+	// Instance.AddFuel.
+	FuelMetering bool
+	Fuel         uint64
+
+	// MaxCallDepth is the maximum number of nested calls of functions of
+	// instances, and MaxStackValues the maximum number of values, operands
+	// and locals, that they can hold, beyond which calls trap with
+	// ErrCallStackExhausted. Zero means DefaultMaxCallDepth and
+	// DefaultMaxStackValues.
+	MaxCallDepth   int
+	MaxStackValues int
+
+	// SkipStart disables the call of the start function of modules on
+	// instantiation. It can be called later through Instance.StartFunc.
+	SkipStart bool
+
+	// PreStart and PostStart, if not nil, are called with the new instance,
+	// once its tables and memories are initialized, before and after its
+	// start function is called, even if it has none or SkipStart is set.
+	// An error returned by either of them fails the instantiation.
+	PreStart  func(*Instance) error
+	PostStart func(*Instance) error
+}
+
+// Default limits of calls.
+const (
+	DefaultMaxCallDepth   = 10000
+	DefaultMaxStackValues = 1 << 20
+)
+
+// CompiledModule is a validated module, whose functions are lowered for
+// the engine that executes them. Any number of instances, each with its
+// own memories, globals and tables, can be created from it, concurrently:
+// it is immutable, and does not change when they execute.
+type CompiledModule struct {
+	module   *ast.Module
+	engine   Engine
+	features ast.Features
+	types    []FuncType      // of the functions, imported first
+	code     []*compiledFunc // of the defined functions, if Bytecode
+	exports  []export
+
+	operandTypes map[*ast.Instruction]ast.TokenType // of drop and select, found by validation
+}
+
+// export is an export of a compiled module: the entity of kind Kind and
+// index Index.
+type export struct {
+	name  string
+	kind  ast.TokenType
+	index int
+}
+
+// Compile compiles m with the default Config.
+func Compile(m *ast.Module) (*CompiledModule, error) {
+	return new(Config).Compile(m)
+}
+
+// Compile validates m and lowers its functions for c.Engine. The other
+// settings of c only apply to instantiation. The module must not be
+// modified afterwards.
+func (c *Config) Compile(m *ast.Module) (*CompiledModule, error) {
+	engine := c.Engine
+	switch engine {
+	case 0:
+		engine = defaultEngine
+	case Bytecode, TreeWalker:
+	default:
+		return nil, fmt.Errorf("unknown engine: %s", engine)
+	}
+	operandTypes, err := ast.ValidateOperandTypes(m, c.Features)
+	if err != nil {
+		return nil, err
+	}
+	cm := &CompiledModule{module: m, engine: engine, features: c.Features, operandTypes: operandTypes}
+	for _, fn := range m.Funcs {
+		cm.types = append(cm.types, funcType(m, fn.Signature))
+	}
+	if engine == Bytecode {
+		cm.code = make([]*compiledFunc, len(m.Funcs))
+		for i, fn := range m.Funcs {
+			if fn.Import == nil {
+				cm.code[i] = compile(cm, i)
+			}
+		}
+	}
+
+	add := func(e *ast.EmbeddedExport, kind ast.TokenType, i int) {
+		if e != nil {
+			cm.exports = append(cm.exports, export{e.Name, kind, i})
+		}
+	}
+	for i, fn := range m.Funcs {
+		add(fn.Export, ast.FUNC, i)
+	}
+	for i, t := range m.Tables {
+		add(t.Export, ast.TABLE, i)
+	}
+	for i, mem := range m.Memories {
+		add(mem.Export, ast.MEMORY, i)
+	}
+	for i, g := range m.Globals {
+		add(g.Export, ast.GLOBAL, i)
+	}
+	for _, e := range m.Exports {
+		cm.exports = append(cm.exports, export{e.Name, e.Kind, e.Var.Index})
+	}
+	return cm, nil
+}
+
+// Instantiate instantiates m with the default Config.
+func Instantiate(ctx context.Context, m *ast.Module, imports Imports) (*Instance, error) {
+	return new(Config).Instantiate(ctx, m, imports)
+}
+
+// Instantiate validates m and returns a new instance of it, whose imports
+// are taken from imports, and calls its start function with ctx.
+// It returns an error if m is invalid, if an import is missing or of the
+// wrong type, if a memory exceeds c.MaxMemoryPages, if a segment does not
+// fit in its table or memory, or if the start function traps.
+//
+// To create several instances of m, compile it once with Compile, and
+// instantiate it with InstantiateCompiled.
+func (c *Config) Instantiate(ctx context.Context, m *ast.Module, imports Imports) (*Instance, error) {
+	cm, err := c.Compile(m)
+	if err != nil {
+		return nil, err
+	}
+	return c.InstantiateCompiled(ctx, cm, imports)
+}
+
+// InstantiateCompiled instantiates cm with the default Config.
+func InstantiateCompiled(ctx context.Context, cm *CompiledModule, imports Imports) (*Instance, error) {
+	return new(Config).InstantiateCompiled(ctx, cm, imports)
+}
+
+// InstantiateCompiled is like Instantiate, but instantiates a compiled
+// module, whose functions are executed by the engine it was compiled for,
+// whatever c.Engine.
+func (c *Config) InstantiateCompiled(ctx context.Context, cm *CompiledModule, imports Imports) (*Instance, error) {
+	m := cm.module
+	inst := &Instance{
+		module:       m,
+		exports:      make(map[string]Extern, len(cm.exports)),
+		operandTypes: cm.operandTypes,
+		metered:      c.FuelMetering,
+		fuel:         c.Fuel,
+		maxDepth:     c.MaxCallDepth,
+		maxValues:    c.MaxStackValues,
+	}
+	if inst.maxDepth == 0 {
+		inst.maxDepth = DefaultMaxCallDepth
+	}
+	if inst.maxValues == 0 {
+		inst.maxValues = DefaultMaxStackValues
+	}
+
+	inst.funcs = make([]*Func, len(m.Funcs))
+	defined := make([]Func, len(m.Funcs)) // allocated at once
+	for i, fn := range m.Funcs {
+		typ := cm.types[i]
+		if fn.Import != nil {
+			ext, err := imports.lookup(fn.Import)
+			if err != nil {
+				return nil, err
+			}
+			f, ok := ext.(*Func)
+			if !ok || !f.typ.equal(typ) {
+				return nil, importError(fn.Import, "incompatible import type")
+			}
+			inst.funcs[i] = f
+			continue
+		}
+		f := &defined[i]
+		*f = Func{
+			typ:     typ,
+			inst:    inst,
+			index:   i,
+			code:    fn,
+			nlocals: len(typ.Params) + len(fn.Locals),
+			offsets: localOffsets(typ, fn),
+		}
+		if f.offsets != nil {
+			f.nlocals = f.offsets[len(f.offsets)-1]
+		}
+		if cm.code != nil {
+			f.compiled = cm.code[i]
+		}
+		inst.funcs[i] = f
+	}
+
+	for _, t := range m.Tables {
+		typ, lim := valueType(t.RefType()), limits(t.Limits)
+		if t.Import != nil {
+			ext, err := imports.lookup(t.Import)
+			if err != nil {
+				return nil, err
+			}
+			table, ok := ext.(*Table)
+			if !ok || table.typ != typ || !table.limits().matches(lim) {
+				return nil, importError(t.Import, "incompatible import type")
+			}
+			inst.tables = append(inst.tables, table)
+			continue
+		}
+		inst.tables = append(inst.tables, NewTableOf(typ, lim))
+	}
+
+	for _, mem := range m.Memories {
+		lim := limits(mem.Limits)
+		if mem.Import != nil {
+			ext, err := imports.lookup(mem.Import)
+			if err != nil {
+				return nil, err
+			}
+			memory, ok := ext.(*Memory)
+			if !ok || !memory.limits().matches(lim) || memory.shared != mem.Shared {
+				return nil, importError(mem.Import, "incompatible import type")
+			}
+			inst.memories = append(inst.memories, memory)
+			continue
+		}
+		limit := c.MaxMemoryPages
+		if limit == 0 {
+			limit = maxPages
+		}
+		if lim.Min > limit {
+			return nil, fmt.Errorf("memory size of %d pages exceeds the limit of %d", lim.Min, limit)
+		}
+		inst.memories = append(inst.memories, newMemory(lim, mem.Shared, limit))
+	}
+
+	for _, g := range m.Globals {
+		typ := valueType(g.Type)
+		if g.Import != nil {
+			ext, err := imports.lookup(g.Import)
+			if err != nil {
+				return nil, err
+			}
+			global, ok := ext.(*Global)
+			if !ok || global.typ != typ || global.mutable != g.Mutable {
+				return nil, importError(g.Import, "incompatible import type")
+			}
+			inst.globals = append(inst.globals, global)
+			continue
+		}
+		inst.globals = append(inst.globals, NewGlobal(inst.evalConst(typ, g.Init), g.Mutable))
+	}
+
+	for _, e := range cm.exports {
+		switch e.kind {
+		case ast.FUNC:
+			inst.exports[e.name] = inst.funcs[e.index]
+		case ast.TABLE:
+			inst.exports[e.name] = inst.tables[e.index]
+		case ast.MEMORY:
+			inst.exports[e.name] = inst.memories[e.index]
+		case ast.GLOBAL:
+			inst.exports[e.name] = inst.globals[e.index]
+		}
+	}
+
+	if err := inst.initSegments(cm.features&ast.BulkMemory != 0); err != nil {
+		return nil, err
+	}
+
+	if m.Start != nil {
+		inst.start = inst.funcs[m.Start.Index]
+	}
+	if c.PreStart != nil {
+		if err := c.PreStart(inst); err != nil {
+			return nil, err
+		}
+	}
+	if inst.start != nil && !c.SkipStart {
+		if _, err := inst.start.Call(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if c.PostStart != nil {
+		if err := c.PostStart(inst); err != nil {
+			return nil, err
+		}
+	}
+	return inst, nil
+}
+
+// initSegments initializes the tables with the active element segments
+// and the memories with the active data segments, and drops them and the
+// declarative element segments. Without the bulk memory feature, it
+// checks that all the active segments fit before applying any of them.
+// With it, they are applied in order, as by table.init and memory.init,
+// up to the first one that does not fit, and the previous ones remain.
+func (inst *Instance) initSegments(bulk bool) error {
+	m := inst.module
+	inst.droppedElems = make([]bool, len(m.Elems))
+	inst.droppedData = make([]bool, len(m.Data))
+	errElem := fmt.Errorf("elements segment does not fit")
+	errData := fmt.Errorf("data segment does not fit")
+	elemOffsets := make([]uint32, len(m.Elems))
+	for i, elem := range m.Elems {
+		if elem.Passive || elem.Declare {
+			continue
+		}
+		elemOffsets[i] = uint32(inst.evalConst(I32, elem.Offset).bits)
+		if !bulk && !inst.elemFits(elem, elemOffsets[i]) {
+			return errElem
+		}
+	}
+	dataOffsets := make([]uint32, len(m.Data))
+	for i, data := range m.Data {
+		if data.Passive {
+			continue
+		}
+		dataOffsets[i] = uint32(inst.evalConst(I32, data.Offset).bits)
+		if !bulk && !inst.dataFits(data, dataOffsets[i]) {
+			return errData
+		}
+	}
+	for i, elem := range m.Elems {
+		if elem.Declare {
+			inst.droppedElems[i] = true
+		}
+		if elem.Passive || elem.Declare {
+			continue
+		}
+		if bulk && !inst.elemFits(elem, elemOffsets[i]) {
+			return errElem
+		}
+		table := inst.tables[elem.Table.Index]
+		for j, v := range elem.Funcs {
+			table.elems[elemOffsets[i]+uint32(j)] = inst.funcs[v.Index]
+		}
+		inst.droppedElems[i] = true
+	}
+	for i, data := range m.Data {
+		if data.Passive {
+			continue
+		}
+		if bulk && !inst.dataFits(data, dataOffsets[i]) {
+			return errData
+		}
+		copy(inst.memories[data.Memory.Index].bytes()[dataOffsets[i]:], data.Data)
+		inst.droppedData[i] = true
+	}
+	return nil
+}
+
+// elemFits reports whether the active segment elem fits in its table at
+// offset.
+func (inst *Instance) elemFits(elem *ast.Elem, offset uint32) bool {
+	table := inst.tables[elem.Table.Index]
+	return uint64(offset)+uint64(len(elem.Funcs)) <= uint64(len(table.elems))
+}
+
+// dataFits reports whether the active segment data fits in its memory at
+// offset.
+func (inst *Instance) dataFits(data *ast.Data, offset uint32) bool {
+	mem := inst.memories[data.Memory.Index]
+	return uint64(offset)+uint64(len(data.Data)) <= uint64(len(mem.bytes()))
+}
+
+// evalConst returns the value of type t of the validated constant
+// expression expr, which may only refer to imported globals.
+func (inst *Instance) evalConst(t ValueType, expr []ast.Instr) Value {
+	in := expr[0].(*ast.Instruction)
+	switch in.Op {
+	case ast.GET_GLOBAL:
+		return inst.globals[in.Var.Index].Get()
+	case ast.REF_FUNC:
+		return RefFunc(inst.funcs[in.Var.Index])
+	case ast.REF_NULL:
+		return Value{typ: t}
+	}
+	if t == V128 {
+		return Vector128(in.Vector[0], in.Vector[1])
+	}
+	return Value{typ: t, bits: in.Value}
+}
+
+// AddFuel adds n units of fuel to inst, saturating at 1<<64 - 1 units.
+// It has no effect on execution unless fuel is metered.
+func (inst *Instance) AddFuel(n uint64) {
+	if inst.fuel+n < inst.fuel {
+		n = math.MaxUint64 - inst.fuel
+	}
+	inst.fuel += n
+}
+
+// Fuel returns the remaining fuel of inst, and whether fuel is metered.
+func (inst *Instance) Fuel() (fuel uint64, metered bool) {
+	return inst.fuel, inst.metered
+}
+
+// StartFunc returns the start function of inst, or nil if it has none.
+func (inst *Instance) StartFunc() *Func { return inst.start }
+
+// Memory returns the memory of inst, exported or not, or nil if it has none.
+func (inst *Instance) Memory() *Memory {
+	if len(inst.memories) == 0 {
+		return nil
+	}
+	return inst.memories[0]
+}
+
+// Export returns the export of inst named name, or nil if there is none.
+func (inst *Instance) Export(name string) Extern {
+	return inst.exports[name]
+}
+
+// Invoke calls the function exported by inst as name with args.
+// See Func.Call.
+func (inst *Instance) Invoke(ctx context.Context, name string, args ...Value) ([]Value, error) {
+	fn, ok := inst.exports[name].(*Func)
+	if !ok {
+		return nil, fmt.Errorf("no exported function %q", name)
+	}
+	return fn.Call(ctx, args...)
+}
+
+func (imports Imports) lookup(imp *ast.EmbeddedImport) (Extern, error) {
+	ext, ok := imports[imp.Module][imp.Name]
+	if !ok || ext == nil {
+		return nil, importError(imp, "unknown import")
+	}
+	return ext, nil
+}
+
+func importError(imp *ast.EmbeddedImport, msg string) error {
+	return fmt.Errorf("import %q %q: %s", imp.Module, imp.Name, msg)
+}
@@ -0,0 +1,83 @@
+package interp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// Linker links modules together: it instantiates modules with imports
+// resolved against the exports of the instances registered with it, as by
+// the register command of the spec tests, and against the entities
+// defined with it, such as host functions.
+//
+// The entities are shared by reference: an instance importing a memory,
+// table or global of another one uses it, not a copy, and sees its
+// changes.
+//
+// The zero Linker has no definitions and instantiates modules with the
+// default Config. A Linker must not be modified concurrently with its
+// other uses.
+type Linker struct {
+	// Config configures the instantiations. Nil means the default Config.
+	Config *Config
+
+	defs Imports
+}
+
+// Define defines the import name of module as ext.
+// It returns an error if it is already defined.
+func (l *Linker) Define(module, name string, ext Extern) error {
+	if _, ok := l.defs[module][name]; ok {
+		return fmt.Errorf("import %q %q is already defined", module, name)
+	}
+	if l.defs == nil {
+		l.defs = make(Imports)
+	}
+	if l.defs[module] == nil {
+		l.defs[module] = make(map[string]Extern)
+	}
+	l.defs[module][name] = ext
+	return nil
+}
+
+// Register defines the exports of inst as the imports of module, under
+// their names. It returns an error, defining none of them, if one is
+// already defined.
+func (l *Linker) Register(module string, inst *Instance) error {
+	for name := range inst.exports {
+		if _, ok := l.defs[module][name]; ok {
+			return fmt.Errorf("import %q %q is already defined", module, name)
+		}
+	}
+	for name, ext := range inst.exports {
+		l.Define(module, name, ext)
+	}
+	return nil
+}
+
+// Get returns the definition of the import name of module, or nil if
+// there is none.
+func (l *Linker) Get(module, name string) Extern {
+	return l.defs[module][name]
+}
+
+func (l *Linker) config() *Config {
+	if l.Config == nil {
+		return new(Config)
+	}
+	return l.Config
+}
+
+// Instantiate instantiates m as by Config.Instantiate, with the
+// definitions of l as imports.
+func (l *Linker) Instantiate(ctx context.Context, m *ast.Module) (*Instance, error) {
+	return l.config().Instantiate(ctx, m, l.defs)
+}
+
+// InstantiateCompiled instantiates cm as by Config.InstantiateCompiled,
+// with the definitions of l as imports.
+func (l *Linker) InstantiateCompiled(ctx context.Context, cm *CompiledModule) (*Instance, error) {
+	return l.config().InstantiateCompiled(ctx, cm, l.defs)
+}
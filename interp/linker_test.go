@@ -0,0 +1,98 @@
+package interp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLinker(t *testing.T) {
+	ctx := context.Background()
+	var l Linker
+	logged := NewGlobal(Int32(0), true)
+	if err := l.Define("host", "logged", logged); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Define("host", "log", NewHostFunc(FuncType{Params: []ValueType{I32}}, func(_ context.Context, args []Value) ([]Value, error) {
+		return nil, logged.Set(args[0])
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	lib, err := l.Instantiate(ctx, parse(t, `(module
+		(import "host" "log" (func $log (param i32)))
+		(memory (export "mem") 1)
+		(table (export "table") 2 anyfunc)
+		(global $count (export "count") (mut i32) (i32.const 0))
+		(func (export "peek") (result i32) (i32.load8_u (i32.const 7)))
+		(func (export "call") (param i32) (result i32)
+			(call_indirect (result i32) (get_local 0)))
+		(func (export "log") (param i32)
+			(set_global $count (i32.add (get_global $count) (i32.const 1)))
+			(call $log (get_local 0))))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Register("lib", lib); err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := l.Instantiate(ctx, parse(t, `(module
+		(import "lib" "mem" (memory 1))
+		(import "lib" "table" (table 1 anyfunc))
+		(import "lib" "log" (func $log (param i32)))
+		(import "lib" "count" (global $count (mut i32)))
+		(import "host" "logged" (global $logged (mut i32)))
+		(func $answer (result i32) (i32.const 42))
+		(elem (i32.const 1) $answer)
+		(data (i32.const 7) "\2a")
+		(func (export "run") (result i32)
+			(call $log (i32.const 5))
+			(call $log (get_global $count))
+			(get_global $logged)))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, app, []invokeTest{{"run", nil, []Value{Int32(1)}, nil}})
+
+	// The memory, table and global of lib are shared with app.
+	runInvokeTests(t, lib, []invokeTest{
+		{"peek", nil, []Value{Int32(42)}, nil},
+		{"call", []Value{Int32(1)}, []Value{Int32(42)}, nil},
+	})
+	if got := lib.Export("count").(*Global).Get(); got != Int32(2) {
+		t.Errorf("count = %v, want %v", got, Int32(2))
+	}
+	if l.Get("lib", "mem") != lib.Export("mem") || l.Get("lib", "none") != nil {
+		t.Errorf("Get does not return the registered exports")
+	}
+}
+
+func TestLinkerErrors(t *testing.T) {
+	ctx := context.Background()
+	l := &Linker{Config: &Config{Engine: TreeWalker}}
+	inst, err := l.Instantiate(ctx, parse(t, `(module (func (export "f")) (memory (export "m") 1))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Define("env", "m", NewMemory(Limits{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Define("env", "m", NewMemory(Limits{})); err == nil || err.Error() != `import "env" "m" is already defined` {
+		t.Errorf("Define twice: got error %v", err)
+	}
+	if err := l.Register("env", inst); err == nil {
+		t.Errorf("Register of a defined import succeeded")
+	}
+	if l.Get("env", "f") != nil {
+		t.Errorf("failed Register defined f")
+	}
+
+	_, err = l.Instantiate(ctx, parse(t, `(module (import "env" "g" (func)))`))
+	if err == nil || err.Error() != `import "env" "g": unknown import` {
+		t.Errorf("unknown import: got error %v", err)
+	}
+	_, err = l.Instantiate(ctx, parse(t, `(module (import "env" "m" (func)))`))
+	if err == nil || err.Error() != `import "env" "m": incompatible import type` {
+		t.Errorf("incompatible import: got error %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package interp
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// maxPages is the maximum size of a memory, in pages.
+const maxPages = 65536
+
+// Memory is a linear memory: an array of bytes whose size is a multiple
+// of the page size ast.PageSize, and which can grow.
+// Its contents are stored in little-endian byte order.
+type Memory struct {
+	data   []byte
+	max    uint32 // declared maximum size, in pages, if hasMax
+	hasMax bool
+	cap    uint32 // maximum size it can grow to, in pages
+
+	// A shared memory may be accessed by several goroutines at once. Its
+	// data is allocated at its cap, so that it never moves, and its size
+	// is that of the first pages of it, which grows atomically.
+	shared  bool
+	pages   uint32     // size, if shared
+	mu      sync.Mutex // held to grow a shared memory, or to wait or notify
+	waiters []*waiter  // of memory.atomic.wait, in order of arrival
+}
+
+// NewMemory returns a new memory of lim.Min pages of zeros, which can grow
+// up to lim.Max pages if lim.HasMax. The sizes must be at most 65536 pages.
+func NewMemory(lim Limits) *Memory { return newMemory(lim, false, maxPages) }
+
+// NewSharedMemory returns a new shared memory, like NewMemory, which
+// modules import as a shared memory. Unlike other memories, it can be
+// accessed by instances that execute in several goroutines. lim.HasMax
+// must be true: the memory is allocated at its maximum size up front.
+func NewSharedMemory(lim Limits) *Memory {
+	if !lim.HasMax {
+		panic("interp: shared memory without a maximum size")
+	}
+	return newMemory(lim, true, maxPages)
+}
+
+// newMemory returns a new memory of limits lim, which can grow up to
+// limit pages.
+func newMemory(lim Limits, shared bool, limit uint32) *Memory {
+	mem := &Memory{
+		max:    lim.Max,
+		hasMax: lim.HasMax,
+		cap:    limit,
+		shared: shared,
+	}
+	if lim.HasMax && lim.Max < limit {
+		mem.cap = lim.Max
+	}
+	if shared {
+		mem.data = make([]byte, uint64(mem.cap)*ast.PageSize)
+		mem.pages = lim.Min
+	} else {
+		mem.data = make([]byte, uint64(lim.Min)*ast.PageSize)
+	}
+	return mem
+}
+
+func (mem *Memory) limits() Limits {
+	return Limits{Min: mem.Size(), Max: mem.max, HasMax: mem.hasMax}
+}
+
+// Shared reports whether mem is a shared memory.
+func (mem *Memory) Shared() bool { return mem.shared }
+
+// Size returns the size of mem, in pages.
+func (mem *Memory) Size() uint32 {
+	return uint32(len(mem.bytes()) / ast.PageSize)
+}
+
+// Grow grows mem by delta pages of zeros, and returns its previous size
+// in pages. It fails, leaving mem unchanged, if the new size would exceed
+// the maximum size of mem or the cap on the memories of its instance.
+func (mem *Memory) Grow(delta uint32) (prev uint32, ok bool) {
+	if mem.shared {
+		mem.mu.Lock()
+		defer mem.mu.Unlock()
+	}
+	prev = mem.Size()
+	if uint64(prev)+uint64(delta) > uint64(mem.cap) {
+		return prev, false
+	}
+	switch {
+	case mem.shared:
+		atomic.StoreUint32(&mem.pages, prev+delta)
+	case delta > 0:
+		data := make([]byte, (uint64(prev)+uint64(delta))*ast.PageSize)
+		copy(data, mem.data)
+		mem.data = data
+	}
+	return prev, true
+}
+
+// setBytes sets the contents of mem to data, whose size is at most the
+// cap of mem.
+func (mem *Memory) setBytes(data []byte) {
+	if !mem.shared {
+		mem.data = data
+		return
+	}
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	old := mem.bytes()
+	copy(mem.data, data)
+	if len(old) > len(data) {
+		zero := old[len(data):]
+		for i := range zero {
+			zero[i] = 0
+		}
+	}
+	atomic.StoreUint32(&mem.pages, uint32(len(data)/ast.PageSize))
+}
+
+// Bytes returns the contents of mem, which remain valid until it grows,
+// unless it is shared.
+func (mem *Memory) Bytes() []byte { return mem.bytes() }
+
+// bytes returns the contents of mem.
+func (mem *Memory) bytes() []byte {
+	if mem.shared {
+		return mem.data[:uint64(atomic.LoadUint32(&mem.pages))*ast.PageSize]
+	}
+	return mem.data
+}
+
+// slice returns the n bytes at the address ea of mem,
+// or ok == false if they are out of bounds.
+func (mem *Memory) slice(ea, n uint64) (b []byte, ok bool) {
+	data := mem.bytes()
+	if ea+n > uint64(len(data)) {
+		return nil, false
+	}
+	return data[ea : ea+n], true
+}
+
+// Read reads len(p) bytes at addr into p.
+// Like the other accessors below, it returns ErrOutOfBounds if any of the
+// bytes accessed is out of bounds.
+func (mem *Memory) Read(addr uint32, p []byte) error {
+	b, ok := mem.slice(uint64(addr), uint64(len(p)))
+	if !ok {
+		return ErrOutOfBounds
+	}
+	copy(p, b)
+	return nil
+}
+
+// Write writes p at addr.
+func (mem *Memory) Write(addr uint32, p []byte) error {
+	b, ok := mem.slice(uint64(addr), uint64(len(p)))
+	if !ok {
+		return ErrOutOfBounds
+	}
+	copy(b, p)
+	return nil
+}
+
+// LoadUint8 returns the uint8 at addr.
+func (mem *Memory) LoadUint8(addr uint32) (uint8, error) {
+	b, ok := mem.slice(uint64(addr), 1)
+	if !ok {
+		return 0, ErrOutOfBounds
+	}
+	return b[0], nil
+}
+
+// LoadUint16 returns the uint16 at addr.
+func (mem *Memory) LoadUint16(addr uint32) (uint16, error) {
+	b, ok := mem.slice(uint64(addr), 2)
+	if !ok {
+		return 0, ErrOutOfBounds
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+// LoadUint32 returns the uint32 at addr.
+func (mem *Memory) LoadUint32(addr uint32) (uint32, error) {
+	b, ok := mem.slice(uint64(addr), 4)
+	if !ok {
+		return 0, ErrOutOfBounds
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// LoadUint64 returns the uint64 at addr.
+func (mem *Memory) LoadUint64(addr uint32) (uint64, error) {
+	b, ok := mem.slice(uint64(addr), 8)
+	if !ok {
+		return 0, ErrOutOfBounds
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// StoreUint8 stores v at addr.
+func (mem *Memory) StoreUint8(addr uint32, v uint8) error {
+	b, ok := mem.slice(uint64(addr), 1)
+	if !ok {
+		return ErrOutOfBounds
+	}
+	b[0] = v
+	return nil
+}
+
+// StoreUint16 stores v at addr.
+func (mem *Memory) StoreUint16(addr uint32, v uint16) error {
+	b, ok := mem.slice(uint64(addr), 2)
+	if !ok {
+		return ErrOutOfBounds
+	}
+	binary.LittleEndian.PutUint16(b, v)
+	return nil
+}
+
+// StoreUint32 stores v at addr.
+func (mem *Memory) StoreUint32(addr uint32, v uint32) error {
+	b, ok := mem.slice(uint64(addr), 4)
+	if !ok {
+		return ErrOutOfBounds
+	}
+	binary.LittleEndian.PutUint32(b, v)
+	return nil
+}
+
+// StoreUint64 stores v at addr.
+func (mem *Memory) StoreUint64(addr uint32, v uint64) error {
+	b, ok := mem.slice(uint64(addr), 8)
+	if !ok {
+		return ErrOutOfBounds
+	}
+	binary.LittleEndian.PutUint64(b, v)
+	return nil
+}
+
+// load executes the load instruction in at the effective address ea.
+func (mem *Memory) load(in *ast.Instruction, ea uint64) uint64 {
+	b, ok := mem.slice(ea, uint64(in.Width/8))
+	if !ok {
+		trap(ErrOutOfBounds)
+	}
+	signed := in.Sign == ast.S
+	var v uint64
+	switch in.Width {
+	case 8:
+		v = uint64(b[0])
+		if signed {
+			v = uint64(int8(b[0]))
+		}
+	case 16:
+		u := binary.LittleEndian.Uint16(b)
+		v = uint64(u)
+		if signed {
+			v = uint64(int16(u))
+		}
+	case 32:
+		u := binary.LittleEndian.Uint32(b)
+		v = uint64(u)
+		if signed {
+			v = uint64(int32(u))
+		}
+	case 64:
+		v = binary.LittleEndian.Uint64(b)
+	}
+	if in.Type == ast.I32 {
+		v = uint64(uint32(v))
+	}
+	return v
+}
+
+// store executes the store instruction in of v at the effective address ea.
+func (mem *Memory) store(in *ast.Instruction, ea, v uint64) {
+	b, ok := mem.slice(ea, uint64(in.Width/8))
+	if !ok {
+		trap(ErrOutOfBounds)
+	}
+	switch in.Width {
+	case 8:
+		b[0] = byte(v)
+	case 16:
+		binary.LittleEndian.PutUint16(b, uint16(v))
+	case 32:
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	case 64:
+		binary.LittleEndian.PutUint64(b, v)
+	}
+}
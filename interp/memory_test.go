@@ -0,0 +1,189 @@
+package interp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sprt/wasm/ast"
+)
+
+const memoryModule = `(module
+	(memory (export "mem") 1 3)
+	(data (i32.const 0) "\01\02\03\04\05\06\07\08")
+	(data (i32.const 65534) "\ff\7f")
+	(func (export "i32.load") (param i32) (result i32) (i32.load (get_local 0)))
+	(func (export "i32.load8_s") (param i32) (result i32) (i32.load8_s (get_local 0)))
+	(func (export "i32.load16_u") (param i32) (result i32) (i32.load16_u offset=1 (get_local 0)))
+	(func (export "i64.load") (param i32) (result i64) (i64.load (get_local 0)))
+	(func (export "i64.load32_s") (param i32) (result i64) (i64.load32_s (get_local 0)))
+	(func (export "i64.store16") (param i32 i64) (i64.store16 (get_local 0) (get_local 1)))
+	(func (export "f64.store") (param i32 f64) (f64.store offset=8 (get_local 0) (get_local 1)))
+	(func (export "size") (result i32) (current_memory))
+	(func (export "grow") (param i32) (result i32) (grow_memory (get_local 0)))
+)`
+
+func TestMemory(t *testing.T) {
+	inst := instantiate(t, memoryModule, nil)
+	runInvokeTests(t, inst, []invokeTest{
+		{"i32.load", []Value{Int32(0)}, []Value{Int32(0x04030201)}, nil},
+		{"i32.load", []Value{Int32(65533)}, nil, ErrOutOfBounds},
+		{"i32.load", []Value{Int32(-1)}, nil, ErrOutOfBounds},
+		{"i32.load8_s", []Value{Int32(65534)}, []Value{Int32(-1)}, nil},
+		{"i32.load16_u", []Value{Int32(65533)}, []Value{Int32(0x7fff)}, nil},
+		{"i32.load16_u", []Value{Int32(65534)}, nil, ErrOutOfBounds},
+		{"i64.load", []Value{Int32(0)}, []Value{Int64(0x0807060504030201)}, nil},
+		{"i64.load32_s", []Value{Int32(65532)}, []Value{Int64(0x7fff0000)}, nil},
+		{"i64.store16", []Value{Int32(2), Int64(-1)}, nil, nil},
+		{"i64.load", []Value{Int32(0)}, []Value{Int64(0x08070605ffff0201)}, nil},
+		{"f64.store", []Value{Int32(65528), Float64(1)}, nil, ErrOutOfBounds},
+		{"size", nil, []Value{Int32(1)}, nil},
+		{"grow", []Value{Int32(1)}, []Value{Int32(1)}, nil},
+		{"i32.load", []Value{Int32(65536)}, []Value{Int32(0)}, nil},
+		{"grow", []Value{Int32(2)}, []Value{Int32(-1)}, nil},
+		{"grow", []Value{Int32(0)}, []Value{Int32(2)}, nil},
+		{"size", nil, []Value{Int32(2)}, nil},
+	})
+
+	mem := inst.Export("mem").(*Memory)
+	if v, err := mem.LoadUint16(65534); err != nil || v != 0x7fff {
+		t.Errorf("LoadUint16(65534) = %#x, %v, want 0x7fff", v, err)
+	}
+	if err := mem.StoreUint32(2*65536-2, 0); !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("StoreUint32 out of bounds: got error %v, want %v", err, ErrOutOfBounds)
+	}
+	if err := mem.Write(100, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 5)
+	if err := mem.Read(100, p); err != nil || !bytes.Equal(p, []byte("hello")) {
+		t.Errorf("Read = %q, %v, want %q", p, err, "hello")
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	m := parse(t, `(module
+		(memory 2)
+		(func (export "grow") (param i32) (result i32) (grow_memory (get_local 0))))`)
+	cfg := &Config{MaxMemoryPages: 4}
+	inst, err := cfg.Instantiate(context.Background(), m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"grow", []Value{Int32(3)}, []Value{Int32(-1)}, nil},
+		{"grow", []Value{Int32(2)}, []Value{Int32(2)}, nil},
+		{"grow", []Value{Int32(1)}, []Value{Int32(-1)}, nil},
+	})
+
+	cfg.MaxMemoryPages = 1
+	if _, err := cfg.Instantiate(context.Background(), m, nil); err == nil || err.Error() != "memory size of 2 pages exceeds the limit of 1" {
+		t.Errorf("got error %v, want memory size limit exceeded", err)
+	}
+}
+
+func TestImportMemory(t *testing.T) {
+	mem := NewMemory(Limits{Min: 1, Max: 2, HasMax: true})
+	instantiate(t, `(module
+		(import "env" "mem" (memory 1 2))
+		(data (i32.const 10) "shared"))`,
+		Imports{"env": {"mem": mem}})
+	inst := instantiate(t, `(module
+		(import "env" "mem" (memory 1))
+		(func (export "load") (param i32) (result i32) (i32.load8_u (get_local 0))))`,
+		Imports{"env": {"mem": mem}})
+	runInvokeTests(t, inst, []invokeTest{
+		{"load", []Value{Int32(10)}, []Value{Int32('s')}, nil},
+	})
+	if !bytes.HasPrefix(mem.Bytes()[10:], []byte("shared")) {
+		t.Errorf("memory does not hold the data segment")
+	}
+}
+
+const bulkMemoryModule = `(module
+	(memory (export "mem") 1)
+	(data (i32.const 0) "\01\02\03\04\05")
+	(data $hello "hello")
+	(func (export "copy") (param i32 i32 i32)
+		(memory.copy (get_local 0) (get_local 1) (get_local 2)))
+	(func (export "fill") (param i32 i32 i32)
+		(memory.fill (get_local 0) (get_local 1) (get_local 2)))
+	(func (export "init") (param i32 i32 i32)
+		(memory.init $hello (get_local 0) (get_local 1) (get_local 2)))
+	(func (export "init_active") (param i32)
+		(memory.init 0 (get_local 0) (i32.const 0) (i32.const 1)))
+	(func (export "drop") data.drop $hello)
+	(func (export "load") (param i32) (result i64) (i64.load (get_local 0)))
+)`
+
+func TestBulkMemory(t *testing.T) {
+	m := parse(t, bulkMemoryModule)
+	if _, err := Instantiate(context.Background(), m, nil); err == nil {
+		t.Fatal("Instantiate without the bulk-memory feature succeeded")
+	}
+	c := &Config{Features: ast.BulkMemory}
+	inst, err := c.Instantiate(context.Background(), m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		// Overlapping copies, forward and backward.
+		{"copy", []Value{Int32(1), Int32(0), Int32(4)}, nil, nil},
+		{"load", []Value{Int32(0)}, []Value{Int64(0x0403020101)}, nil},
+		{"copy", []Value{Int32(0), Int32(1), Int32(5)}, nil, nil},
+		{"load", []Value{Int32(0)}, []Value{Int64(0x04030201)}, nil},
+		{"fill", []Value{Int32(2), Int32(0x1ff), Int32(2)}, nil, nil},
+		{"load", []Value{Int32(0)}, []Value{Int64(0xffff0201)}, nil},
+		{"init", []Value{Int32(65533), Int32(2), Int32(3)}, nil, nil},
+		{"load", []Value{Int32(65528)}, []Value{Int64(0x6f6c6c0000000000)}, nil},
+
+		// Out of bounds accesses trap without writing anything, but
+		// empty ones do not trap at the ends.
+		{"copy", []Value{Int32(65530), Int32(0), Int32(7)}, nil, ErrOutOfBounds},
+		{"copy", []Value{Int32(0), Int32(65530), Int32(7)}, nil, ErrOutOfBounds},
+		{"fill", []Value{Int32(65530), Int32(0), Int32(-1)}, nil, ErrOutOfBounds},
+		{"init", []Value{Int32(0), Int32(1), Int32(5)}, nil, ErrOutOfBounds},
+		{"load", []Value{Int32(0)}, []Value{Int64(0xffff0201)}, nil},
+		{"load", []Value{Int32(65528)}, []Value{Int64(0x6f6c6c0000000000)}, nil},
+		{"copy", []Value{Int32(65536), Int32(65536), Int32(0)}, nil, nil},
+		{"fill", []Value{Int32(65536), Int32(0), Int32(0)}, nil, nil},
+		{"init", []Value{Int32(65536), Int32(5), Int32(0)}, nil, nil},
+		{"copy", []Value{Int32(65537), Int32(0), Int32(0)}, nil, ErrOutOfBounds},
+		{"init", []Value{Int32(0), Int32(6), Int32(0)}, nil, ErrOutOfBounds},
+
+		// Active segments are dropped on instantiation, and dropped
+		// segments are empty.
+		{"init_active", []Value{Int32(0)}, nil, ErrOutOfBounds},
+		{"drop", nil, nil, nil},
+		{"drop", nil, nil, nil},
+		{"init", []Value{Int32(0), Int32(0), Int32(0)}, nil, nil},
+		{"init", []Value{Int32(0), Int32(0), Int32(1)}, nil, ErrOutOfBounds},
+	})
+}
+
+func TestBulkMemoryInstantiate(t *testing.T) {
+	m := parse(t, `(module
+		(memory (import "env" "mem") 1)
+		(data (i32.const 0) "a")
+		(data (i32.const 65536) "b")
+		(data (i32.const 1) "c"))`)
+	mem := NewMemory(Limits{Min: 1})
+	imports := Imports{"env": {"mem": mem}}
+	if _, err := Instantiate(context.Background(), m, imports); err == nil {
+		t.Fatal("Instantiate succeeded")
+	}
+	if mem.Bytes()[0] != 0 {
+		t.Errorf("without the bulk-memory feature, a segment was written")
+	}
+
+	// With it, the segments are written in order, up to the one that does
+	// not fit.
+	c := &Config{Features: ast.BulkMemory}
+	if _, err := c.Instantiate(context.Background(), m, imports); err == nil || err.Error() != "data segment does not fit" {
+		t.Fatalf("got error %v, want data segment does not fit", err)
+	}
+	if b := mem.Bytes(); b[0] != 'a' || b[1] != 0 {
+		t.Errorf("memory starts with %q, want %q", b[:2], "a\x00")
+	}
+}
@@ -0,0 +1,528 @@
+package interp
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// numeric executes the numeric instruction in, whose operands are on the
+// stack.
+func (m *machine) numeric(in *ast.Instruction) {
+	if in.From != 0 || in.Op == ast.EXTEND {
+		m.push(convert(in, m.pop()))
+		return
+	}
+	if isUnary(in.Op) {
+		x := m.pop()
+		switch in.Type {
+		case ast.I32:
+			m.push(i32Unop(in.Op, uint32(x)))
+		case ast.I64:
+			m.push(i64Unop(in.Op, x))
+		case ast.F32:
+			m.push(f32Unop(in.Op, uint32(x)))
+		case ast.F64:
+			m.push(f64Unop(in.Op, x))
+		}
+		return
+	}
+	y, x := m.pop(), m.pop()
+	switch in.Type {
+	case ast.I32:
+		m.push(i32Binop(in.Op, in.Sign, uint32(x), uint32(y)))
+	case ast.I64:
+		m.push(i64Binop(in.Op, in.Sign, x, y))
+	case ast.F32:
+		m.push(f32Binop(in.Op, uint32(x), uint32(y)))
+	case ast.F64:
+		m.push(f64Binop(in.Op, x, y))
+	}
+}
+
+func isUnary(op ast.TokenType) bool {
+	switch op {
+	case ast.ABS, ast.CEIL, ast.CLZ, ast.CTZ, ast.EQZ, ast.FLOOR, ast.NEAREST,
+		ast.NEG, ast.POPCNT, ast.SQRT, ast.TRUNC, ast.EXTEND:
+		return true
+	}
+	return false
+}
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func i32Unop(op ast.TokenType, x uint32) uint64 {
+	switch op {
+	case ast.CLZ:
+		return uint64(bits.LeadingZeros32(x))
+	case ast.CTZ:
+		return uint64(bits.TrailingZeros32(x))
+	case ast.POPCNT:
+		return uint64(bits.OnesCount32(x))
+	case ast.EQZ:
+		return b2u(x == 0)
+	}
+	panic(fmt.Sprintf("interp: unknown operator i32.%s", op))
+}
+
+func i64Unop(op ast.TokenType, x uint64) uint64 {
+	switch op {
+	case ast.CLZ:
+		return uint64(bits.LeadingZeros64(x))
+	case ast.CTZ:
+		return uint64(bits.TrailingZeros64(x))
+	case ast.POPCNT:
+		return uint64(bits.OnesCount64(x))
+	case ast.EQZ:
+		return b2u(x == 0)
+	}
+	panic(fmt.Sprintf("interp: unknown operator i64.%s", op))
+}
+
+func i32Binop(op, sign ast.TokenType, x, y uint32) uint64 {
+	signed := sign == ast.S
+	switch op {
+	case ast.ADD:
+		return uint64(x + y)
+	case ast.SUB:
+		return uint64(x - y)
+	case ast.MUL:
+		return uint64(x * y)
+	case ast.DIV:
+		if y == 0 {
+			trap(ErrIntegerDivideByZero)
+		}
+		if !signed {
+			return uint64(x / y)
+		}
+		if int32(x) == math.MinInt32 && int32(y) == -1 {
+			trap(ErrIntegerOverflow)
+		}
+		return uint64(uint32(int32(x) / int32(y)))
+	case ast.REM:
+		if y == 0 {
+			trap(ErrIntegerDivideByZero)
+		}
+		if !signed {
+			return uint64(x % y)
+		}
+		if int32(y) == -1 {
+			return 0
+		}
+		return uint64(uint32(int32(x) % int32(y)))
+	case ast.AND:
+		return uint64(x & y)
+	case ast.OR:
+		return uint64(x | y)
+	case ast.XOR:
+		return uint64(x ^ y)
+	case ast.SHL:
+		return uint64(x << (y & 31))
+	case ast.SHR:
+		if signed {
+			return uint64(uint32(int32(x) >> (y & 31)))
+		}
+		return uint64(x >> (y & 31))
+	case ast.ROTL:
+		return uint64(bits.RotateLeft32(x, int(y&31)))
+	case ast.ROTR:
+		return uint64(bits.RotateLeft32(x, -int(y&31)))
+	case ast.EQ:
+		return b2u(x == y)
+	case ast.NE:
+		return b2u(x != y)
+	case ast.LT:
+		if signed {
+			return b2u(int32(x) < int32(y))
+		}
+		return b2u(x < y)
+	case ast.LE:
+		if signed {
+			return b2u(int32(x) <= int32(y))
+		}
+		return b2u(x <= y)
+	case ast.GT:
+		if signed {
+			return b2u(int32(x) > int32(y))
+		}
+		return b2u(x > y)
+	case ast.GE:
+		if signed {
+			return b2u(int32(x) >= int32(y))
+		}
+		return b2u(x >= y)
+	}
+	panic(fmt.Sprintf("interp: unknown operator i32.%s", op))
+}
+
+func i64Binop(op, sign ast.TokenType, x, y uint64) uint64 {
+	signed := sign == ast.S
+	switch op {
+	case ast.ADD:
+		return x + y
+	case ast.SUB:
+		return x - y
+	case ast.MUL:
+		return x * y
+	case ast.DIV:
+		if y == 0 {
+			trap(ErrIntegerDivideByZero)
+		}
+		if !signed {
+			return x / y
+		}
+		if int64(x) == math.MinInt64 && int64(y) == -1 {
+			trap(ErrIntegerOverflow)
+		}
+		return uint64(int64(x) / int64(y))
+	case ast.REM:
+		if y == 0 {
+			trap(ErrIntegerDivideByZero)
+		}
+		if !signed {
+			return x % y
+		}
+		if int64(y) == -1 {
+			return 0
+		}
+		return uint64(int64(x) % int64(y))
+	case ast.AND:
+		return x & y
+	case ast.OR:
+		return x | y
+	case ast.XOR:
+		return x ^ y
+	case ast.SHL:
+		return x << (y & 63)
+	case ast.SHR:
+		if signed {
+			return uint64(int64(x) >> (y & 63))
+		}
+		return x >> (y & 63)
+	case ast.ROTL:
+		return bits.RotateLeft64(x, int(y&63))
+	case ast.ROTR:
+		return bits.RotateLeft64(x, -int(y&63))
+	case ast.EQ:
+		return b2u(x == y)
+	case ast.NE:
+		return b2u(x != y)
+	case ast.LT:
+		if signed {
+			return b2u(int64(x) < int64(y))
+		}
+		return b2u(x < y)
+	case ast.LE:
+		if signed {
+			return b2u(int64(x) <= int64(y))
+		}
+		return b2u(x <= y)
+	case ast.GT:
+		if signed {
+			return b2u(int64(x) > int64(y))
+		}
+		return b2u(x > y)
+	case ast.GE:
+		if signed {
+			return b2u(int64(x) >= int64(y))
+		}
+		return b2u(x >= y)
+	}
+	panic(fmt.Sprintf("interp: unknown operator i64.%s", op))
+}
+
+const (
+	f32SignBit = 1 << 31
+	f64SignBit = 1 << 63
+)
+
+func f32Unop(op ast.TokenType, x uint32) uint64 {
+	// abs and neg only affect the sign bit, even of a NaN.
+	switch op {
+	case ast.ABS:
+		return uint64(x &^ f32SignBit)
+	case ast.NEG:
+		return uint64(x ^ f32SignBit)
+	}
+	f := float64(math.Float32frombits(x))
+	switch op {
+	case ast.SQRT:
+		f = math.Sqrt(f)
+	case ast.CEIL:
+		f = math.Ceil(f)
+	case ast.FLOOR:
+		f = math.Floor(f)
+	case ast.TRUNC:
+		f = math.Trunc(f)
+	case ast.NEAREST:
+		f = math.RoundToEven(f)
+	default:
+		panic(fmt.Sprintf("interp: unknown operator f32.%s", op))
+	}
+	// The result of these operations on a float32 is exactly
+	// representable, except that of sqrt, which is correctly rounded.
+	return uint64(math.Float32bits(float32(f)))
+}
+
+func f64Unop(op ast.TokenType, x uint64) uint64 {
+	switch op {
+	case ast.ABS:
+		return x &^ f64SignBit
+	case ast.NEG:
+		return x ^ f64SignBit
+	}
+	f := math.Float64frombits(x)
+	switch op {
+	case ast.SQRT:
+		f = math.Sqrt(f)
+	case ast.CEIL:
+		f = math.Ceil(f)
+	case ast.FLOOR:
+		f = math.Floor(f)
+	case ast.TRUNC:
+		f = math.Trunc(f)
+	case ast.NEAREST:
+		f = math.RoundToEven(f)
+	default:
+		panic(fmt.Sprintf("interp: unknown operator f64.%s", op))
+	}
+	return math.Float64bits(f)
+}
+
+func f32Binop(op ast.TokenType, xb, yb uint32) uint64 {
+	if op == ast.COPYSIGN {
+		return uint64(xb&^f32SignBit | yb&f32SignBit)
+	}
+	x, y := math.Float32frombits(xb), math.Float32frombits(yb)
+	var z float32
+	switch op {
+	case ast.ADD:
+		z = x + y
+	case ast.SUB:
+		z = x - y
+	case ast.MUL:
+		z = x * y
+	case ast.DIV:
+		z = x / y
+	case ast.MIN:
+		z = float32(fmin(float64(x), float64(y)))
+	case ast.MAX:
+		z = float32(fmax(float64(x), float64(y)))
+	case ast.EQ:
+		return b2u(x == y)
+	case ast.NE:
+		return b2u(x != y)
+	case ast.LT:
+		return b2u(x < y)
+	case ast.LE:
+		return b2u(x <= y)
+	case ast.GT:
+		return b2u(x > y)
+	case ast.GE:
+		return b2u(x >= y)
+	default:
+		panic(fmt.Sprintf("interp: unknown operator f32.%s", op))
+	}
+	return uint64(math.Float32bits(z))
+}
+
+func f64Binop(op ast.TokenType, xb, yb uint64) uint64 {
+	if op == ast.COPYSIGN {
+		return xb&^f64SignBit | yb&f64SignBit
+	}
+	x, y := math.Float64frombits(xb), math.Float64frombits(yb)
+	var z float64
+	switch op {
+	case ast.ADD:
+		z = x + y
+	case ast.SUB:
+		z = x - y
+	case ast.MUL:
+		z = x * y
+	case ast.DIV:
+		z = x / y
+	case ast.MIN:
+		z = fmin(x, y)
+	case ast.MAX:
+		z = fmax(x, y)
+	case ast.EQ:
+		return b2u(x == y)
+	case ast.NE:
+		return b2u(x != y)
+	case ast.LT:
+		return b2u(x < y)
+	case ast.LE:
+		return b2u(x <= y)
+	case ast.GT:
+		return b2u(x > y)
+	case ast.GE:
+		return b2u(x >= y)
+	default:
+		panic(fmt.Sprintf("interp: unknown operator f64.%s", op))
+	}
+	return math.Float64bits(z)
+}
+
+// fmin and fmax return a NaN if either operand is a NaN,
+// and order -0 below +0.
+func fmin(x, y float64) float64 {
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return x + y
+	}
+	return math.Min(x, y)
+}
+
+func fmax(x, y float64) float64 {
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return x + y
+	}
+	return math.Max(x, y)
+}
+
+// convert returns the result of the conversion in of x.
+func convert(in *ast.Instruction, x uint64) uint64 {
+	signed := in.Sign == ast.S
+	switch in.Op {
+	case ast.WRAP:
+		return uint64(uint32(x))
+	case ast.EXTEND:
+		if in.From == 0 { // extend8_s, extend16_s, extend32_s
+			shift := uint(64 - in.Width)
+			x = uint64(int64(x<<shift) >> shift)
+			if in.Type == ast.I32 {
+				x = uint64(uint32(x))
+			}
+			return x
+		}
+		if signed {
+			return uint64(int64(int32(x)))
+		}
+		return uint64(uint32(x))
+	case ast.REINTERPRET:
+		return x
+	case ast.PROMOTE:
+		return math.Float64bits(float64(math.Float32frombits(uint32(x))))
+	case ast.DEMOTE:
+		return uint64(math.Float32bits(float32(math.Float64frombits(x))))
+	case ast.TRUNC:
+		f := math.Float64frombits(x)
+		if in.From == ast.F32 {
+			f = float64(math.Float32frombits(uint32(x)))
+		}
+		return trunc(f, in.Type, signed)
+	case ast.TRUNC_SAT:
+		f := math.Float64frombits(x)
+		if in.From == ast.F32 {
+			f = float64(math.Float32frombits(uint32(x)))
+		}
+		return truncSat(f, in.Type, signed)
+	case ast.CONVERT:
+		return convertInt(x, in.From, in.Type, signed)
+	}
+	panic(fmt.Sprintf("interp: unknown conversion %s", in.Op))
+}
+
+// trunc returns f truncated to an integer of type t, trapping if it is
+// a NaN or out of range.
+func trunc(f float64, t ast.TokenType, signed bool) uint64 {
+	if math.IsNaN(f) {
+		trap(ErrInvalidConversion)
+	}
+	var ok bool
+	switch {
+	case t == ast.I32 && signed:
+		ok = f > math.MinInt32-1 && f < math.MaxInt32+1
+	case t == ast.I32:
+		ok = f > -1 && f < math.MaxUint32+1
+	case signed:
+		ok = f >= math.MinInt64 && f < math.MaxInt64+1
+	default:
+		ok = f > -1 && f < math.MaxUint64+1
+	}
+	if !ok {
+		trap(ErrIntegerOverflow)
+	}
+	switch {
+	case t == ast.I32 && signed:
+		return uint64(uint32(int32(f)))
+	case t == ast.I32:
+		return uint64(uint32(f))
+	case signed:
+		return uint64(int64(f))
+	}
+	return uint64(f)
+}
+
+// truncSat returns f truncated to an integer of type t, saturating at its
+// bounds: NaN is 0, and values out of range are its minimum or maximum.
+func truncSat(f float64, t ast.TokenType, signed bool) uint64 {
+	if math.IsNaN(f) {
+		return 0
+	}
+	switch {
+	case t == ast.I32 && signed:
+		if f <= math.MinInt32-1 {
+			return 1 << 31
+		}
+		if f >= math.MaxInt32+1 {
+			return math.MaxInt32
+		}
+	case t == ast.I32:
+		if f <= -1 {
+			return 0
+		}
+		if f >= math.MaxUint32+1 {
+			return math.MaxUint32
+		}
+	case signed:
+		if f < math.MinInt64 {
+			return 1 << 63
+		}
+		if f >= math.MaxInt64+1 {
+			return math.MaxInt64
+		}
+	default:
+		if f <= -1 {
+			return 0
+		}
+		if f >= math.MaxUint64+1 {
+			return math.MaxUint64
+		}
+	}
+	return trunc(f, t, signed)
+}
+
+// convertInt returns the integer x of type from converted to a float of
+// type to.
+func convertInt(x uint64, from, to ast.TokenType, signed bool) uint64 {
+	var i int64
+	var u uint64
+	switch {
+	case from == ast.I32 && signed:
+		i = int64(int32(x))
+	case from == ast.I32:
+		i = int64(uint32(x))
+	case signed:
+		i = int64(x)
+	default:
+		u = x
+	}
+	unsigned64 := from == ast.I64 && !signed
+	if to == ast.F32 {
+		if unsigned64 {
+			return uint64(math.Float32bits(float32(u)))
+		}
+		return uint64(math.Float32bits(float32(i)))
+	}
+	if unsigned64 {
+		return math.Float64bits(float64(u))
+	}
+	return math.Float64bits(float64(i))
+}
@@ -0,0 +1,137 @@
+package interp
+
+import "github.com/sprt/wasm/ast"
+
+// References are held on the stack and in the locals of a machine as
+// handles: zero for null, or one plus the index of the referent, a *Func
+// or an *extern, in the refs of the machine. A referent has a single
+// handle, so the refs grow with the number of distinct referents of the
+// call, not with the number of references made. Globals and tables, which
+// outlive the call, hold the referents themselves.
+
+// refBits returns the handle of the referent r, or zero if r is nil.
+func (m *machine) refBits(r interface{}) uint64 {
+	if r == nil {
+		return 0
+	}
+	if h, ok := m.refIDs[r]; ok {
+		return h
+	}
+	if m.refIDs == nil {
+		m.refIDs = make(map[interface{}]uint64)
+	}
+	m.refs = append(m.refs, r)
+	h := uint64(len(m.refs))
+	m.refIDs[r] = h
+	return h
+}
+
+// ref returns the referent of the handle h, or nil if it is null.
+func (m *machine) ref(h uint64) interface{} {
+	if h == 0 {
+		return nil
+	}
+	return m.refs[h-1]
+}
+
+// pushValue pushes v onto the stack of m.
+func (m *machine) pushValue(v Value) {
+	switch {
+	case v.typ.isRef():
+		m.push(m.refBits(v.ref))
+	case v.typ == V128:
+		m.push(v.bits)
+		m.push(v.hi)
+	default:
+		m.push(v.bits)
+	}
+}
+
+// value returns the value of type t held by m in the slots beginning
+// with slots[0].
+func (m *machine) value(t ValueType, slots []uint64) Value {
+	switch {
+	case t.isRef():
+		return Value{typ: t, ref: m.ref(slots[0])}
+	case t == V128:
+		return Value{typ: t, bits: slots[0], hi: slots[1]}
+	}
+	return Value{typ: t, bits: slots[0]}
+}
+
+// values returns the values of the given types held by m in slots.
+func (m *machine) values(types []ValueType, slots []uint64) []Value {
+	vs := make([]Value, len(types))
+	for i, t := range types {
+		vs[i] = m.value(t, slots)
+		slots = slots[t.slots():]
+	}
+	return vs
+}
+
+// pushGlobal pushes the value of g onto the stack of m.
+func (m *machine) pushGlobal(g *Global) {
+	m.pushValue(g.Get())
+}
+
+// popGlobal pops the value of g from the stack of m.
+func (m *machine) popGlobal(g *Global) {
+	switch {
+	case g.typ.isRef():
+		g.ref = m.ref(m.pop())
+	case g.typ == V128:
+		g.hi = m.pop()
+		g.bits = m.pop()
+	default:
+		g.bits = m.pop()
+	}
+}
+
+// reference executes the reference or table instruction in of inst,
+// whose operands are on the stack.
+func (m *machine) reference(inst *Instance, in *ast.Instruction) {
+	switch in.Op {
+	case ast.REF_NULL:
+		m.push(0)
+	case ast.REF_IS_NULL:
+		m.push(b2u(m.pop() == 0))
+	case ast.REF_FUNC:
+		m.push(m.refBits(inst.funcs[in.Var.Index]))
+	case ast.TABLE_GET:
+		elems := inst.table(in.TableVar).elems
+		i := uint64(uint32(m.pop()))
+		if i >= uint64(len(elems)) {
+			trap(ErrTableOutOfBounds)
+		}
+		m.push(m.refBits(elems[i]))
+	case ast.TABLE_SET:
+		elems := inst.table(in.TableVar).elems
+		r := m.ref(m.pop())
+		i := uint64(uint32(m.pop()))
+		if i >= uint64(len(elems)) {
+			trap(ErrTableOutOfBounds)
+		}
+		elems[i] = r
+	case ast.TABLE_SIZE:
+		m.push(uint64(len(inst.table(in.TableVar).elems)))
+	case ast.TABLE_GROW:
+		n := uint32(m.pop())
+		r := m.ref(m.pop())
+		prev, ok := inst.table(in.TableVar).grow(n, r)
+		if !ok {
+			prev = ^uint32(0) // -1
+		}
+		m.push(uint64(prev))
+	case ast.TABLE_FILL:
+		elems := inst.table(in.TableVar).elems
+		n := uint64(uint32(m.pop()))
+		r := m.ref(m.pop())
+		i := uint64(uint32(m.pop()))
+		if i+n > uint64(len(elems)) {
+			trap(ErrTableOutOfBounds)
+		}
+		for j := range elems[i : i+n] {
+			elems[i+uint64(j)] = r
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package interp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/sprt/wasm/ast"
+)
+
+const refModule = `(module
+	(type $i32 (func (result i32)))
+	(import "env" "id" (func $id (param externref) (result externref)))
+	(func $one (type $i32) (i32.const 1))
+	(func $two (type $i32) (i32.const 2))
+	(table $fs (export "funcs") 2 3 funcref)
+	(table $xs (export "externs") 1 externref)
+	(elem $fs (i32.const 0) $one)
+	(elem declare func $two)
+	(global $x (export "x") (mut externref) (ref.null extern))
+	(global $f (mut funcref) (ref.func $two))
+	(func (export "id") (param externref) (result externref)
+		(call $id (get_local 0)))
+	(func (export "is_null") (param externref) (result i32)
+		(ref.is_null (get_local 0)))
+	(func (export "set_x") (param externref) (set_global $x (get_local 0)))
+	(func (export "get_x") (result externref) (get_global $x))
+	(func (export "call") (param i32) (result i32)
+		(call_indirect $fs (type $i32) (get_local 0)))
+	(func (export "store_f") (param i32) (table.set $fs (get_local 0) (get_global $f)))
+	(func (export "get") (param i32) (result externref) (table.get $xs (get_local 0)))
+	(func (export "set") (param i32 externref) (table.set $xs (get_local 0) (get_local 1)))
+	(func (export "size") (result i32) (table.size $xs))
+	(func (export "grow") (param externref i32) (result i32)
+		(table.grow $xs (get_local 0) (get_local 1)))
+	(func (export "grow_funcs") (param i32) (result i32)
+		(table.grow $fs (ref.func $two) (get_local 0)))
+	(func (export "fill") (param i32 externref i32)
+		(table.fill $xs (get_local 0) (get_local 1) (get_local 2)))
+	(func (export "pick") (param externref externref i32) (result externref)
+		(select (result externref) (get_local 0) (get_local 1) (get_local 2)))
+)`
+
+func TestRefTypes(t *testing.T) {
+	id := NewHostFunc(FuncType{Params: []ValueType{ExternRef}, Results: []ValueType{ExternRef}},
+		func(_ context.Context, args []Value) ([]Value, error) { return args, nil })
+	c := &Config{Features: ast.ReferenceTypes}
+	inst, err := c.Instantiate(context.Background(), parse(t, refModule), Imports{"env": {"id": id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type host struct{ name string }
+	a, b := &host{"a"}, &host{"b"}
+	null := RefNull(ExternRef)
+	runInvokeTests(t, inst, []invokeTest{
+		{"id", []Value{RefExtern(a)}, []Value{RefExtern(a)}, nil},
+		{"id", []Value{null}, []Value{null}, nil},
+		{"is_null", []Value{null}, []Value{Int32(1)}, nil},
+		{"is_null", []Value{RefExtern(a)}, []Value{Int32(0)}, nil},
+		{"set_x", []Value{RefExtern(b)}, nil, nil},
+		{"get_x", nil, []Value{RefExtern(b)}, nil},
+		{"pick", []Value{RefExtern(a), RefExtern(b), Int32(1)}, []Value{RefExtern(a)}, nil},
+		{"pick", []Value{RefExtern(a), RefExtern(b), Int32(0)}, []Value{RefExtern(b)}, nil},
+
+		{"call", []Value{Int32(0)}, []Value{Int32(1)}, nil},
+		{"call", []Value{Int32(1)}, nil, ErrUninitializedElement},
+		{"store_f", []Value{Int32(1)}, nil, nil},
+		{"call", []Value{Int32(1)}, []Value{Int32(2)}, nil},
+		{"store_f", []Value{Int32(2)}, nil, ErrTableOutOfBounds},
+		{"grow_funcs", []Value{Int32(2)}, []Value{Int32(-1)}, nil},
+		{"grow_funcs", []Value{Int32(1)}, []Value{Int32(2)}, nil},
+		{"call", []Value{Int32(2)}, []Value{Int32(2)}, nil},
+
+		{"get", []Value{Int32(0)}, []Value{null}, nil},
+		{"set", []Value{Int32(0), RefExtern(a)}, nil, nil},
+		{"get", []Value{Int32(0)}, []Value{RefExtern(a)}, nil},
+		{"set", []Value{Int32(1), RefExtern(a)}, nil, ErrTableOutOfBounds},
+		{"get", []Value{Int32(-1)}, nil, ErrTableOutOfBounds},
+		{"grow", []Value{RefExtern(b), Int32(2)}, []Value{Int32(1)}, nil},
+		{"size", nil, []Value{Int32(3)}, nil},
+		{"get", []Value{Int32(2)}, []Value{RefExtern(b)}, nil},
+		{"fill", []Value{Int32(1), null, Int32(3)}, nil, ErrTableOutOfBounds},
+		{"get", []Value{Int32(1)}, []Value{RefExtern(b)}, nil},
+		{"fill", []Value{Int32(1), null, Int32(2)}, nil, nil},
+		{"get", []Value{Int32(2)}, []Value{null}, nil},
+		{"get", []Value{Int32(0)}, []Value{RefExtern(a)}, nil},
+		{"grow", []Value{null, Int32(-1)}, []Value{Int32(-1)}, nil},
+	})
+
+	// The host sees the values that it passed in, and can pass them in
+	// through globals and tables too.
+	x := inst.Export("x").(*Global)
+	if got := x.Get().Extern(); got != b {
+		t.Errorf("x = %v, want %v", got, b)
+	}
+	if err := x.Set(RefExtern(a)); err != nil {
+		t.Fatal(err)
+	}
+	externs := inst.Export("externs").(*Table)
+	if got := externs.Ref(0).Extern(); got != a {
+		t.Errorf("externs[0] = %v, want %v", got, a)
+	}
+	if err := externs.SetRef(1, RefFunc(nil)); err == nil {
+		t.Error("SetRef of a funcref in a table of externref succeeded")
+	}
+	if err := externs.SetRef(1, RefExtern(b)); err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"get_x", nil, []Value{RefExtern(a)}, nil},
+		{"get", []Value{Int32(1)}, []Value{RefExtern(b)}, nil},
+	})
+	if f := inst.Export("funcs").(*Table).Ref(1).Func(); f == nil {
+		t.Error("funcs[1] is null")
+	}
+
+	// Values of the host cannot be saved in snapshots.
+	if err := inst.Snapshot(new(bytes.Buffer)); err == nil {
+		t.Error("Snapshot of an instance holding externrefs succeeded")
+	}
+}
+
+func TestRefTypesImportTable(t *testing.T) {
+	m := parse(t, `(module (import "env" "t" (table 1 externref)))`)
+	c := &Config{Features: ast.ReferenceTypes}
+	_, err := c.Instantiate(context.Background(), m, Imports{"env": {"t": NewTable(Limits{Min: 1})}})
+	if err == nil || err.Error() != `import "env" "t": incompatible import type` {
+		t.Errorf("got error %v, want incompatible import type", err)
+	}
+	if _, err := c.Instantiate(context.Background(), m, Imports{"env": {"t": NewTableOf(ExternRef, Limits{Min: 1})}}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,359 @@
+package interp
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// run executes the compiled body of the function of f, whose arguments
+// are on the stack above base. Its locals are held in m.locals, and it
+// leaves its results on the stack, possibly above other values.
+func (m *machine) run(f *frame, base int) {
+	fn := f.fn
+	inst := fn.inst
+	code := fn.compiled.code
+
+	lb := len(m.locals)
+	m.locals = append(m.locals, m.stack[base:]...)
+	for i := typeSlots(fn.typ.Params); i < fn.nlocals; i++ {
+		m.locals = append(m.locals, 0)
+	}
+	locals := m.locals[lb:]
+	stack := m.stack[:base]
+
+	for pc := 0; ; {
+		o := &code[pc]
+		f.pc = pc
+		pc++
+		if inst.metered && o.cost != 0 {
+			if inst.fuel < uint64(o.cost) {
+				inst.fuel = 0
+				trap(ErrOutOfFuel)
+			}
+			inst.fuel -= uint64(o.cost)
+		}
+		n := len(stack) - 1 // top of the stack
+
+		switch o.code {
+		case opNop:
+		case opUnreachable:
+			trap(ErrUnreachable)
+		case opBrIf:
+			c := stack[n]
+			stack = stack[:n]
+			if uint32(c) == 0 {
+				break
+			}
+			fallthrough
+		case opBr:
+			stack = unwind(stack, base+int(o.height), int(o.arity))
+			if int(o.a) < pc {
+				m.checkDone()
+			}
+			pc = int(o.a)
+		case opBrUnless:
+			c := stack[n]
+			stack = stack[:n]
+			if uint32(c) == 0 {
+				pc = int(o.a)
+			}
+		case opBrTable:
+			table := fn.compiled.tables[o.a]
+			br := &table[len(table)-1]
+			if i := uint32(stack[n]); uint64(i) < uint64(len(table)-1) {
+				br = &table[i]
+			}
+			stack = unwind(stack[:n], base+int(br.height), int(br.arity))
+			if int(br.pc) < pc {
+				m.checkDone()
+			}
+			pc = int(br.pc)
+		case opReturn:
+			m.stack = stack
+			m.locals = m.locals[:lb]
+			return
+		case opCall, opCallIndirect, opReturnCall, opReturnCallIndirect:
+			var callee *Func
+			if o.code == opCall || o.code == opReturnCall {
+				callee = inst.funcs[o.a]
+			} else {
+				callee = inst.tables[o.imm].function(uint32(stack[n]))
+				stack = stack[:n]
+				if !callee.typ.equal(fn.compiled.sigs[o.a]) {
+					trap(ErrIndirectCallTypeMismatch)
+				}
+			}
+			m.stack = stack
+			if o.code == opReturnCall || o.code == opReturnCallIndirect {
+				f.tail = callee
+				m.locals = m.locals[:lb]
+				return
+			}
+			m.call(callee)
+			stack = m.stack
+			locals = m.locals[lb:]
+		case opDrop:
+			stack = stack[:n]
+		case opSelect:
+			if uint32(stack[n]) == 0 {
+				stack[n-2] = stack[n-1]
+			}
+			stack = stack[:n-1]
+		case opGetLocal:
+			stack = append(stack, locals[o.a])
+		case opSetLocal:
+			locals[o.a] = stack[n]
+			stack = stack[:n]
+		case opTeeLocal:
+			locals[o.a] = stack[n]
+		case opGetGlobal:
+			stack = append(stack, inst.globals[o.a].bits)
+		case opSetGlobal:
+			inst.globals[o.a].bits = stack[n]
+			stack = stack[:n]
+		case opGetGlobalRef:
+			stack = append(stack, m.refBits(inst.globals[o.a].ref))
+		case opSetGlobalRef:
+			inst.globals[o.a].ref = m.ref(stack[n])
+			stack = stack[:n]
+		case opConst:
+			stack = append(stack, o.imm)
+		case opCurrentMemory:
+			stack = append(stack, uint64(inst.memories[0].Size()))
+		case opGrowMemory:
+			prev, ok := inst.memories[0].Grow(uint32(stack[n]))
+			if !ok {
+				prev = ^uint32(0) // -1
+			}
+			stack[n] = uint64(prev)
+		case opBulk:
+			m.stack = stack
+			m.bulk(inst, fn.compiled.srcs[f.pc].(*ast.Instruction))
+			stack = m.stack
+		case opRef:
+			m.stack = stack
+			m.reference(inst, fn.compiled.srcs[f.pc].(*ast.Instruction))
+			stack = m.stack
+		case opVector:
+			m.stack = stack
+			m.vector(inst, fn.compiled.srcs[f.pc].(*ast.Instruction))
+			stack = m.stack
+		case opAtomic:
+			m.stack = stack
+			m.atomic(inst, fn.compiled.srcs[f.pc].(*ast.Instruction))
+			stack = m.stack
+
+		case opDrop128:
+			stack = stack[:n-1]
+		case opSelect128:
+			if uint32(stack[n]) == 0 {
+				stack[n-4], stack[n-3] = stack[n-2], stack[n-1]
+			}
+			stack = stack[:n-2]
+		case opGetLocal128:
+			stack = append(stack, locals[o.a], locals[o.a+1])
+		case opSetLocal128:
+			locals[o.a], locals[o.a+1] = stack[n-1], stack[n]
+			stack = stack[:n-1]
+		case opTeeLocal128:
+			locals[o.a], locals[o.a+1] = stack[n-1], stack[n]
+		case opGetGlobal128:
+			g := inst.globals[o.a]
+			stack = append(stack, g.bits, g.hi)
+		case opSetGlobal128:
+			g := inst.globals[o.a]
+			g.bits, g.hi = stack[n-1], stack[n]
+			stack = stack[:n-1]
+
+		// The bounds check of an access covers its offset and width at once.
+		case opLoad8U:
+			stack[n] = uint64(access(inst, stack[n], o.a, 1)[0])
+		case opLoad8S32:
+			stack[n] = uint64(uint32(int8(access(inst, stack[n], o.a, 1)[0])))
+		case opLoad8S64:
+			stack[n] = uint64(int8(access(inst, stack[n], o.a, 1)[0]))
+		case opLoad16U:
+			stack[n] = uint64(binary.LittleEndian.Uint16(access(inst, stack[n], o.a, 2)))
+		case opLoad16S32:
+			stack[n] = uint64(uint32(int16(binary.LittleEndian.Uint16(access(inst, stack[n], o.a, 2)))))
+		case opLoad16S64:
+			stack[n] = uint64(int16(binary.LittleEndian.Uint16(access(inst, stack[n], o.a, 2))))
+		case opLoad32U:
+			stack[n] = uint64(binary.LittleEndian.Uint32(access(inst, stack[n], o.a, 4)))
+		case opLoad32S64:
+			stack[n] = uint64(int32(binary.LittleEndian.Uint32(access(inst, stack[n], o.a, 4))))
+		case opLoad64:
+			stack[n] = binary.LittleEndian.Uint64(access(inst, stack[n], o.a, 8))
+		case opStore8:
+			access(inst, stack[n-1], o.a, 1)[0] = byte(stack[n])
+			stack = stack[:n-1]
+		case opStore16:
+			binary.LittleEndian.PutUint16(access(inst, stack[n-1], o.a, 2), uint16(stack[n]))
+			stack = stack[:n-1]
+		case opStore32:
+			binary.LittleEndian.PutUint32(access(inst, stack[n-1], o.a, 4), uint32(stack[n]))
+			stack = stack[:n-1]
+		case opStore64:
+			binary.LittleEndian.PutUint64(access(inst, stack[n-1], o.a, 8), stack[n])
+			stack = stack[:n-1]
+
+		case opNumeric:
+			m.stack = stack
+			m.numeric(fn.compiled.srcs[f.pc].(*ast.Instruction))
+			stack = m.stack
+
+		case opI32Eqz:
+			stack[n] = b2u(uint32(stack[n]) == 0)
+		case opI32Add:
+			stack[n-1] = uint64(uint32(stack[n-1]) + uint32(stack[n]))
+			stack = stack[:n]
+		case opI32Sub:
+			stack[n-1] = uint64(uint32(stack[n-1]) - uint32(stack[n]))
+			stack = stack[:n]
+		case opI32Mul:
+			stack[n-1] = uint64(uint32(stack[n-1]) * uint32(stack[n]))
+			stack = stack[:n]
+		case opI32And:
+			stack[n-1] &= stack[n]
+			stack = stack[:n]
+		case opI32Or:
+			stack[n-1] |= stack[n]
+			stack = stack[:n]
+		case opI32Xor:
+			stack[n-1] ^= stack[n]
+			stack = stack[:n]
+		case opI32Shl:
+			stack[n-1] = uint64(uint32(stack[n-1]) << (stack[n] & 31))
+			stack = stack[:n]
+		case opI32ShrS:
+			stack[n-1] = uint64(uint32(int32(stack[n-1]) >> (stack[n] & 31)))
+			stack = stack[:n]
+		case opI32ShrU:
+			stack[n-1] = uint64(uint32(stack[n-1]) >> (stack[n] & 31))
+			stack = stack[:n]
+		case opI32Eq:
+			stack[n-1] = b2u(uint32(stack[n-1]) == uint32(stack[n]))
+			stack = stack[:n]
+		case opI32Ne:
+			stack[n-1] = b2u(uint32(stack[n-1]) != uint32(stack[n]))
+			stack = stack[:n]
+		case opI32LtS:
+			stack[n-1] = b2u(int32(stack[n-1]) < int32(stack[n]))
+			stack = stack[:n]
+		case opI32LtU:
+			stack[n-1] = b2u(uint32(stack[n-1]) < uint32(stack[n]))
+			stack = stack[:n]
+		case opI32GtS:
+			stack[n-1] = b2u(int32(stack[n-1]) > int32(stack[n]))
+			stack = stack[:n]
+		case opI32GtU:
+			stack[n-1] = b2u(uint32(stack[n-1]) > uint32(stack[n]))
+			stack = stack[:n]
+		case opI32LeS:
+			stack[n-1] = b2u(int32(stack[n-1]) <= int32(stack[n]))
+			stack = stack[:n]
+		case opI32LeU:
+			stack[n-1] = b2u(uint32(stack[n-1]) <= uint32(stack[n]))
+			stack = stack[:n]
+		case opI32GeS:
+			stack[n-1] = b2u(int32(stack[n-1]) >= int32(stack[n]))
+			stack = stack[:n]
+		case opI32GeU:
+			stack[n-1] = b2u(uint32(stack[n-1]) >= uint32(stack[n]))
+			stack = stack[:n]
+
+		case opI64Eqz:
+			stack[n] = b2u(stack[n] == 0)
+		case opI64Add:
+			stack[n-1] += stack[n]
+			stack = stack[:n]
+		case opI64Sub:
+			stack[n-1] -= stack[n]
+			stack = stack[:n]
+		case opI64Mul:
+			stack[n-1] *= stack[n]
+			stack = stack[:n]
+		case opI64And:
+			stack[n-1] &= stack[n]
+			stack = stack[:n]
+		case opI64Or:
+			stack[n-1] |= stack[n]
+			stack = stack[:n]
+		case opI64Xor:
+			stack[n-1] ^= stack[n]
+			stack = stack[:n]
+		case opI64Shl:
+			stack[n-1] <<= stack[n] & 63
+			stack = stack[:n]
+		case opI64ShrS:
+			stack[n-1] = uint64(int64(stack[n-1]) >> (stack[n] & 63))
+			stack = stack[:n]
+		case opI64ShrU:
+			stack[n-1] >>= stack[n] & 63
+			stack = stack[:n]
+		case opI64Eq:
+			stack[n-1] = b2u(stack[n-1] == stack[n])
+			stack = stack[:n]
+		case opI64Ne:
+			stack[n-1] = b2u(stack[n-1] != stack[n])
+			stack = stack[:n]
+		case opI64LtS:
+			stack[n-1] = b2u(int64(stack[n-1]) < int64(stack[n]))
+			stack = stack[:n]
+		case opI64LtU:
+			stack[n-1] = b2u(stack[n-1] < stack[n])
+			stack = stack[:n]
+		case opI64GtS:
+			stack[n-1] = b2u(int64(stack[n-1]) > int64(stack[n]))
+			stack = stack[:n]
+		case opI64GtU:
+			stack[n-1] = b2u(stack[n-1] > stack[n])
+			stack = stack[:n]
+		case opI64LeS:
+			stack[n-1] = b2u(int64(stack[n-1]) <= int64(stack[n]))
+			stack = stack[:n]
+		case opI64LeU:
+			stack[n-1] = b2u(stack[n-1] <= stack[n])
+			stack = stack[:n]
+		case opI64GeS:
+			stack[n-1] = b2u(int64(stack[n-1]) >= int64(stack[n]))
+			stack = stack[:n]
+		case opI64GeU:
+			stack[n-1] = b2u(stack[n-1] >= stack[n])
+			stack = stack[:n]
+
+		case opF64Add:
+			stack[n-1] = math.Float64bits(math.Float64frombits(stack[n-1]) + math.Float64frombits(stack[n]))
+			stack = stack[:n]
+		case opF64Sub:
+			stack[n-1] = math.Float64bits(math.Float64frombits(stack[n-1]) - math.Float64frombits(stack[n]))
+			stack = stack[:n]
+		case opF64Mul:
+			stack[n-1] = math.Float64bits(math.Float64frombits(stack[n-1]) * math.Float64frombits(stack[n]))
+			stack = stack[:n]
+		case opF64Div:
+			stack[n-1] = math.Float64bits(math.Float64frombits(stack[n-1]) / math.Float64frombits(stack[n]))
+			stack = stack[:n]
+		case opF64Lt:
+			stack[n-1] = b2u(math.Float64frombits(stack[n-1]) < math.Float64frombits(stack[n]))
+			stack = stack[:n]
+		case opF64Gt:
+			stack[n-1] = b2u(math.Float64frombits(stack[n-1]) > math.Float64frombits(stack[n]))
+			stack = stack[:n]
+		}
+	}
+}
+
+// access returns the n bytes of the memory of inst at the effective
+// address of a memory access of offset off to address addr, or traps if
+// they are out of bounds.
+func access(inst *Instance, addr uint64, off uint32, n uint64) []byte {
+	data := inst.memories[0].bytes()
+	ea := uint64(uint32(addr)) + uint64(off)
+	if ea+n > uint64(len(data)) {
+		trap(ErrOutOfBounds)
+	}
+	return data[ea : ea+n]
+}
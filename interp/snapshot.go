@@ -0,0 +1,429 @@
+package interp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// Snapshots are encoded as:
+//
+//	magic    "WASMSNAP"
+//	version  uint32
+//	fuel     metered byte, fuel uint64
+//	globals  count uvarint, then for each: type byte, bits uint64, which
+//	         for a reference are 0 if it is null, or 1 + the index of its
+//	         function, and for a v128 are its low bits, followed by its
+//	         high bits uint64
+//	memories count uvarint, then for each: size uint32 in pages, then for
+//	         each page: 0 if it is all zeros, or 1 and its contents
+//	tables   count uvarint, then for each: length uvarint, then for each
+//	         element: 0 if it is null, or 1 + the index of its function
+//	dropped  count uvarint of the data segments, then for each: 1 if it
+//	         was dropped, or 0; then the same for the element segments
+//	checksum uint32, the CRC-32 (Castagnoli) of all the above
+//
+// Fixed-size integers are little-endian.
+const (
+	snapshotMagic   = "WASMSNAP"
+	snapshotVersion = 2
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrInstanceBusy is returned by Snapshot and Restore when a function of the
+// instance is being executed, since the state of its calls is not saved.
+var ErrInstanceBusy = errors.New("instance is executing a function")
+
+// Snapshot writes to w the state of inst: the contents of its memories,
+// the values of its globals, the elements of its tables, which of its
+// segments were dropped and its fuel,
+// including the memories, globals and tables that it imports. A
+// snapshot is taken between calls, when inst is quiescent: it fails
+// with ErrInstanceBusy if a function of inst is being executed, as by a
+// host function that it called. A shared memory is saved as it is while
+// Snapshot reads it, which instances executing concurrently may change.
+//
+// The references held by globals and tables must be null or reference
+// functions of inst, defined or imported: values of the host cannot be
+// saved.
+func (inst *Instance) Snapshot(w io.Writer) error {
+	if inst.active > 0 {
+		return ErrInstanceBusy
+	}
+	funcs := make(map[*Func]int, len(inst.funcs))
+	for i, f := range inst.funcs {
+		if _, ok := funcs[f]; !ok {
+			funcs[f] = i
+		}
+	}
+	// ref returns the encoding of the referent r, or ok == false if it
+	// cannot be encoded.
+	ref := func(r interface{}) (bits uint64, ok bool) {
+		if r == nil {
+			return 0, true
+		}
+		f, _ := r.(*Func)
+		i, ok := funcs[f]
+		return uint64(i) + 1, ok
+	}
+	for i, g := range inst.globals {
+		if _, ok := ref(g.ref); !ok {
+			return fmt.Errorf("snapshot: global %d is not a function of the instance", i)
+		}
+	}
+	for i, t := range inst.tables {
+		for j, r := range t.elems {
+			if _, ok := ref(r); !ok {
+				return fmt.Errorf("snapshot: element %d of table %d is not a function of the instance", j, i)
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	e := &encoder{w: bw, h: crc32.New(castagnoli)}
+	e.write([]byte(snapshotMagic))
+	e.uint32(snapshotVersion)
+
+	if inst.metered {
+		e.write([]byte{1})
+	} else {
+		e.write([]byte{0})
+	}
+	e.uint64(inst.fuel)
+
+	e.uvarint(uint64(len(inst.globals)))
+	for _, g := range inst.globals {
+		e.write([]byte{byte(g.typ)})
+		if g.typ.isRef() {
+			bits, _ := ref(g.ref)
+			e.uint64(bits)
+			continue
+		}
+		e.uint64(g.bits)
+		if g.typ == V128 {
+			e.uint64(g.hi)
+		}
+	}
+
+	e.uvarint(uint64(len(inst.memories)))
+	for _, mem := range inst.memories {
+		data := mem.bytes()
+		e.uint32(uint32(len(data) / ast.PageSize))
+		for p := 0; p < len(data); p += ast.PageSize {
+			page := data[p : p+ast.PageSize]
+			if isZero(page) {
+				e.write([]byte{0})
+				continue
+			}
+			e.write([]byte{1})
+			e.write(page)
+		}
+	}
+
+	e.uvarint(uint64(len(inst.tables)))
+	for _, t := range inst.tables {
+		e.uvarint(uint64(len(t.elems)))
+		for _, r := range t.elems {
+			bits, _ := ref(r)
+			e.uvarint(bits)
+		}
+	}
+
+	for _, dropped := range [][]bool{inst.droppedData, inst.droppedElems} {
+		e.uvarint(uint64(len(dropped)))
+		for _, d := range dropped {
+			if d {
+				e.write([]byte{1})
+			} else {
+				e.write([]byte{0})
+			}
+		}
+	}
+
+	e.uint32(e.h.Sum32())
+	if e.err != nil {
+		return e.err
+	}
+	return bw.Flush()
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Restore sets the state of inst to the snapshot read from r, written by
+// Snapshot from an instance of the same module. The memories grow or
+// shrink to their size in the snapshot. Like Snapshot, it fails with
+// ErrInstanceBusy if a function of inst is being executed.
+//
+// Restore checks the snapshot before changing inst, which it leaves
+// unchanged if the snapshot is invalid, corrupted, or does not fit it:
+// if its globals or the number of its memories and tables differ, if it
+// was taken with fuel metering and inst is not metered, or the reverse,
+// or if the size of a memory or table is not within its limits.
+func (inst *Instance) Restore(r io.Reader) error {
+	if inst.active > 0 {
+		return ErrInstanceBusy
+	}
+	s, err := inst.readSnapshot(r)
+	if err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+	inst.fuel = s.fuel
+	for i, g := range inst.globals {
+		g.bits, g.hi, g.ref = s.globals[i], s.globalHighs[i], s.globalRefs[i]
+	}
+	for i, mem := range inst.memories {
+		mem.setBytes(s.memories[i])
+	}
+	for i, t := range inst.tables {
+		t.elems = s.tables[i]
+	}
+	inst.droppedData, inst.droppedElems = s.droppedData, s.droppedElems
+	return nil
+}
+
+// snapshot is the state of an instance read by Restore.
+type snapshot struct {
+	fuel     uint64
+	globals  []uint64
+	memories [][]byte
+	tables   [][]interface{}
+
+	globalRefs  []interface{} // the referents of the globals
+	globalHighs []uint64      // the high bits of the globals of type v128
+
+	droppedData, droppedElems []bool
+}
+
+// readSnapshot reads a snapshot of an instance of the module of inst.
+func (inst *Instance) readSnapshot(r io.Reader) (*snapshot, error) {
+	d := &decoder{r: bufio.NewReader(r), h: crc32.New(castagnoli)}
+	magic := make([]byte, len(snapshotMagic))
+	if d.read(magic); d.err == nil && string(magic) != snapshotMagic {
+		return nil, errors.New("not a snapshot")
+	}
+	if v := d.uint32(); d.err == nil && v != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+
+	if metered := d.byte() != 0; d.err == nil && metered != inst.metered {
+		return nil, fmt.Errorf("snapshot has fuel metering %v, want %v", metered, inst.metered)
+	}
+	s := new(snapshot)
+	s.fuel = d.uint64()
+
+	if n := d.uvarint(); d.err == nil && n != uint64(len(inst.globals)) {
+		return nil, fmt.Errorf("snapshot has %d globals, want %d", n, len(inst.globals))
+	}
+	for i, g := range inst.globals {
+		if typ := ValueType(d.byte()); d.err == nil && typ != g.typ {
+			return nil, fmt.Errorf("global %d: type mismatch: got %s, want %s", i, typ, g.typ)
+		}
+		bits := d.uint64()
+		var r interface{}
+		if g.typ.isRef() && d.err == nil {
+			if bits > uint64(len(inst.funcs)) || bits > 0 && g.typ != FuncRef {
+				return nil, fmt.Errorf("global %d: invalid reference %d", i, bits)
+			}
+			if bits > 0 {
+				r = inst.funcs[bits-1]
+			}
+			bits = 0
+		}
+		var hi uint64
+		if g.typ == V128 {
+			hi = d.uint64()
+		}
+		s.globals = append(s.globals, bits)
+		s.globalRefs = append(s.globalRefs, r)
+		s.globalHighs = append(s.globalHighs, hi)
+	}
+
+	if n := d.uvarint(); d.err == nil && n != uint64(len(inst.memories)) {
+		return nil, fmt.Errorf("snapshot has %d memories, want %d", n, len(inst.memories))
+	}
+	// The memories are allocated once the checksum is verified: until
+	// then, only their pages that are not all zeros are, as they are read.
+	sizes := make([]uint32, len(inst.memories))
+	var pages []snapshotPage
+	for i, mem := range inst.memories {
+		sizes[i] = d.uint32()
+		if d.err == nil && sizes[i] > mem.cap {
+			return nil, fmt.Errorf("memory %d: size of %d pages exceeds the maximum of %d", i, sizes[i], mem.cap)
+		}
+		if min := inst.module.Memories[i].Limits.Min; d.err == nil && sizes[i] < min {
+			return nil, fmt.Errorf("memory %d: size of %d pages is below the minimum of %d", i, sizes[i], min)
+		}
+		for p := uint32(0); p < sizes[i] && d.err == nil; p++ {
+			if d.byte() != 0 {
+				data := make([]byte, ast.PageSize)
+				d.read(data)
+				pages = append(pages, snapshotPage{i, p, data})
+			}
+		}
+	}
+
+	if n := d.uvarint(); d.err == nil && n != uint64(len(inst.tables)) {
+		return nil, fmt.Errorf("snapshot has %d tables, want %d", n, len(inst.tables))
+	}
+	for i, t := range inst.tables {
+		n := d.uvarint()
+		if d.err == nil && (n > 1<<32-1 || t.hasMax && n > uint64(t.max)) {
+			return nil, fmt.Errorf("table %d: length of %d elements exceeds its maximum", i, n)
+		}
+		if min := inst.module.Tables[i].Limits.Min; d.err == nil && n < uint64(min) {
+			return nil, fmt.Errorf("table %d: length of %d elements is below the minimum of %d", i, n, min)
+		}
+		var elems []interface{}
+		for j := uint64(0); j < n && d.err == nil; j++ {
+			var r interface{}
+			if k := d.uvarint(); k > uint64(len(inst.funcs)) {
+				return nil, fmt.Errorf("table %d: element %d: function index %d out of range", i, j, k-1)
+			} else if k > 0 && t.typ != FuncRef {
+				return nil, fmt.Errorf("table %d: element %d: function in a table of %s", i, j, t.typ)
+			} else if k > 0 {
+				r = inst.funcs[k-1]
+			}
+			elems = append(elems, r)
+		}
+		s.tables = append(s.tables, elems)
+	}
+
+	s.droppedData = d.dropped("data", len(inst.droppedData))
+	s.droppedElems = d.dropped("element", len(inst.droppedElems))
+
+	sum := d.h.Sum32()
+	if got := d.uint32(); d.err == nil && got != sum {
+		return nil, errors.New("snapshot checksum mismatch")
+	}
+	if d.err == io.EOF {
+		d.err = io.ErrUnexpectedEOF
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	for _, size := range sizes {
+		s.memories = append(s.memories, make([]byte, uint64(size)*ast.PageSize))
+	}
+	for _, p := range pages {
+		copy(s.memories[p.memory][uint64(p.index)*ast.PageSize:], p.data)
+	}
+	return s, nil
+}
+
+// snapshotPage is a page of a memory in a snapshot, which is not all
+// zeros.
+type snapshotPage struct {
+	memory int
+	index  uint32
+	data   []byte
+}
+
+// encoder writes a snapshot, computing its checksum. Its first error is
+// saved in err, and subsequent writes are ignored.
+type encoder struct {
+	w   io.Writer
+	h   hash.Hash32
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err != nil {
+		return
+	}
+	e.h.Write(b)
+	_, e.err = e.w.Write(b)
+}
+
+func (e *encoder) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(e.buf[:], v)
+	e.write(e.buf[:4])
+}
+
+func (e *encoder) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(e.buf[:], v)
+	e.write(e.buf[:8])
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.write(e.buf[:binary.PutUvarint(e.buf[:], v)])
+}
+
+// decoder reads a snapshot, computing its checksum. Its first error is
+// saved in err, and subsequent reads return zeros.
+type decoder struct {
+	r   *bufio.Reader
+	h   hash.Hash32
+	err error
+	buf [8]byte
+}
+
+func (d *decoder) read(b []byte) {
+	if d.err != nil {
+		for i := range b {
+			b[i] = 0
+		}
+		return
+	}
+	_, d.err = io.ReadFull(d.r, b)
+	d.h.Write(b)
+}
+
+func (d *decoder) byte() byte {
+	d.read(d.buf[:1])
+	return d.buf[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	d.read(d.buf[:4])
+	return binary.LittleEndian.Uint32(d.buf[:4])
+}
+
+func (d *decoder) uint64() uint64 {
+	d.read(d.buf[:8])
+	return binary.LittleEndian.Uint64(d.buf[:8])
+}
+
+// dropped reads the flags of the n segments of kind that were dropped.
+func (d *decoder) dropped(kind string, n int) []bool {
+	if m := d.uvarint(); d.err == nil && m != uint64(n) {
+		d.err = fmt.Errorf("snapshot has %d %s segments, want %d", m, kind, n)
+		return nil
+	}
+	dropped := make([]bool, n)
+	for i := range dropped {
+		dropped[i] = d.byte() != 0
+	}
+	return dropped
+}
+
+func (d *decoder) uvarint() uint64 {
+	var v uint64
+	for shift := 0; shift < 64; shift += 7 {
+		b := d.byte()
+		if d.err != nil {
+			return 0
+		}
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v
+		}
+	}
+	d.err = errors.New("invalid varint")
+	return 0
+}
@@ -0,0 +1,242 @@
+package interp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const snapshotModule = `(module
+	(import "env" "check" (func $check))
+	(memory 1 4)
+	(table 2 anyfunc)
+	(global $n (mut i32) (i32.const 0))
+	(func $one (result i32) (i32.const 1))
+	(func $two (result i32) (i32.const 2))
+	(elem (i32.const 0) $one)
+	(func (export "step") (result i32)
+		(set_global $n (i32.add (get_global $n) (i32.const 1)))
+		(i32.store (i32.mul (get_global $n) (i32.const 4)) (get_global $n))
+		(drop (grow_memory (i32.const 1)))
+		(get_global $n))
+	(func (export "load") (param i32) (result i32)
+		(i32.load (i32.mul (get_local 0) (i32.const 4))))
+	(func (export "size") (result i32) (current_memory))
+	(func (export "elem") (param i32) (result i32)
+		(call_indirect (result i32) (get_local 0)))
+	(func (export "check") (call $check)))`
+
+func snapshotImports(check HostFunc) Imports {
+	if check == nil {
+		check = func(context.Context, []Value) ([]Value, error) { return nil, nil }
+	}
+	return Imports{"env": {"check": NewHostFunc(FuncType{}, check)}}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	inst := instantiate(t, snapshotModule, snapshotImports(nil))
+	runInvokeTests(t, inst, []invokeTest{
+		{"step", nil, []Value{Int32(1)}, nil},
+		{"step", nil, []Value{Int32(2)}, nil},
+	})
+	inst.tables[0].Set(1, inst.funcs[2]) // $two
+
+	var snap bytes.Buffer
+	if err := inst.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(snap.Bytes(), []byte("WASMSNAP")) {
+		t.Fatalf("snapshot starts with %q", snap.Bytes()[:8])
+	}
+	if snap.Len() > 2*65536 {
+		t.Errorf("snapshot of 3 pages with 1 non-zero page has %d bytes", snap.Len())
+	}
+
+	// Change the state, and restore it.
+	runInvokeTests(t, inst, []invokeTest{
+		{"step", nil, []Value{Int32(3)}, nil},
+	})
+	inst.tables[0].Set(0, nil)
+	if err := inst.Restore(bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	want := []invokeTest{
+		{"size", nil, []Value{Int32(3)}, nil},
+		{"load", []Value{Int32(2)}, []Value{Int32(2)}, nil},
+		{"load", []Value{Int32(3)}, []Value{Int32(0)}, nil},
+		{"elem", []Value{Int32(0)}, []Value{Int32(1)}, nil},
+		{"elem", []Value{Int32(1)}, []Value{Int32(2)}, nil},
+		{"step", nil, []Value{Int32(3)}, nil},
+	}
+	runInvokeTests(t, inst, want)
+
+	// Restore it in another instance of the module.
+	other := instantiate(t, snapshotModule, snapshotImports(nil))
+	if err := other.Restore(bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, other, want)
+}
+
+func TestSnapshotFuel(t *testing.T) {
+	c := &Config{FuelMetering: true, Fuel: 100}
+	inst, err := c.Instantiate(context.Background(), parse(t, snapshotModule), snapshotImports(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap bytes.Buffer
+	if err := inst.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{{"step", nil, []Value{Int32(1)}, nil}})
+	if err := inst.Restore(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if fuel, metered := inst.Fuel(); fuel != 100 || !metered {
+		t.Errorf("Fuel() = %d, %v after Restore, want 100, true", fuel, metered)
+	}
+
+	// A snapshot of an instance without metering does not turn it off.
+	var unmetered bytes.Buffer
+	if err := instantiate(t, snapshotModule, snapshotImports(nil)).Snapshot(&unmetered); err != nil {
+		t.Fatal(err)
+	}
+	want := "restore: snapshot has fuel metering false, want true"
+	if err := inst.Restore(&unmetered); err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+	if fuel, metered := inst.Fuel(); fuel != 100 || !metered {
+		t.Errorf("Fuel() = %d, %v after failed Restore, want 100, true", fuel, metered)
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	inst := instantiate(t, snapshotModule, snapshotImports(nil))
+	runInvokeTests(t, inst, []invokeTest{{"step", nil, []Value{Int32(1)}, nil}})
+	var buf bytes.Buffer
+	if err := inst.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap := buf.Bytes()
+	runInvokeTests(t, inst, []invokeTest{{"step", nil, []Value{Int32(2)}, nil}})
+
+	corrupt := append([]byte(nil), snap...)
+	corrupt[len(corrupt)/2] ^= 1
+	badVersion := append([]byte(nil), snap...)
+	badVersion[8] = 3
+	snapshotOf := func(src string) []byte {
+		var buf bytes.Buffer
+		if err := instantiate(t, src, nil).Snapshot(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	otherSnap := snapshotOf(`(module (global (mut i32) (i32.const 0)))`)
+	// Like snapshotModule, below its minimum sizes of 1 page and 2 elements
+	const segment = `(global (mut i32) (i32.const 0)) (func $f) (elem (i32.const 0) $f)`
+	smallMemory := snapshotOf(`(module (memory 0) (table 2 anyfunc) ` + segment + `)`)
+	smallTable := snapshotOf(`(module (memory 1) (table 1 anyfunc) ` + segment + `)`)
+
+	tests := []struct {
+		name string
+		snap []byte
+		err  string
+	}{
+		{"empty", nil, "restore: unexpected EOF"},
+		{"truncated", snap[:len(snap)-1], "restore: unexpected EOF"},
+		{"corrupt", corrupt, "restore: snapshot checksum mismatch"},
+		{"not a snapshot", []byte("(module)\x00\x00\x00\x00"), "restore: not a snapshot"},
+		{"version", badVersion, "restore: unsupported snapshot version 3"},
+		{"other module", otherSnap, "restore: snapshot has 0 memories, want 1"},
+		{"small memory", smallMemory, "restore: memory 0: size of 0 pages is below the minimum of 1"},
+		{"small table", smallTable, "restore: table 0: length of 1 elements is below the minimum of 2"},
+	}
+	for _, tt := range tests {
+		err := inst.Restore(bytes.NewReader(tt.snap))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	// The instance is unchanged.
+	runInvokeTests(t, inst, []invokeTest{
+		{"size", nil, []Value{Int32(3)}, nil},
+		{"step", nil, []Value{Int32(3)}, nil},
+	})
+}
+
+// TestRestoreCorruptSize restores a snapshot whose memory is 65536 pages
+// of zeros, which fails the checksum, without allocating them.
+func TestRestoreCorruptSize(t *testing.T) {
+	inst := instantiate(t, `(module (memory 1))`, nil)
+	var buf bytes.Buffer
+	if err := inst.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// The size of the memory follows the header, fuel, and the counts of
+	// globals and memories.
+	const sizeOffset = 8 + 4 + 1 + 8 + 1 + 1
+	snap := buf.Bytes()
+	if got := binary.LittleEndian.Uint32(snap[sizeOffset:]); got != 1 {
+		t.Fatalf("size in snapshot = %d, want 1", got)
+	}
+	corrupt := append([]byte(nil), snap[:sizeOffset+4]...)
+	binary.LittleEndian.PutUint32(corrupt[sizeOffset:], 65536)
+	corrupt = append(corrupt, make([]byte, 65535)...)
+	corrupt = append(corrupt, snap[sizeOffset+4:]...)
+
+	for _, tt := range []struct {
+		name string
+		snap []byte
+		err  string
+	}{
+		{"corrupt", corrupt, "restore: snapshot checksum mismatch"},
+		{"truncated", corrupt[:len(corrupt)/2], "restore: unexpected EOF"},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := inst.Restore(bytes.NewReader(tt.snap))
+		runtime.ReadMemStats(&after)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", tt.name, n)
+		}
+	}
+	if size := inst.memories[0].Size(); size != 1 {
+		t.Errorf("size = %d after failed Restore, want 1", size)
+	}
+}
+
+func TestSnapshotBusy(t *testing.T) {
+	var inst *Instance
+	var snapErr, restoreErr error
+	inst = instantiate(t, snapshotModule, snapshotImports(func(ctx context.Context, _ []Value) ([]Value, error) {
+		snapErr = inst.Snapshot(new(bytes.Buffer))
+		restoreErr = inst.Restore(strings.NewReader(""))
+		return nil, errors.New("failed")
+	}))
+	if _, err := inst.Invoke(context.Background(), "check"); err == nil {
+		t.Fatal("check did not trap")
+	}
+	if snapErr != ErrInstanceBusy || restoreErr != ErrInstanceBusy {
+		t.Errorf("during a call: Snapshot: %v, Restore: %v; want %v", snapErr, restoreErr, ErrInstanceBusy)
+	}
+	// The trap ended the call.
+	if err := inst.Snapshot(new(bytes.Buffer)); err != nil {
+		t.Errorf("after the call: Snapshot: %v", err)
+	}
+}
+
+func TestSnapshotForeignElement(t *testing.T) {
+	inst := instantiate(t, snapshotModule, snapshotImports(nil))
+	inst.tables[0].Set(1, NewHostFunc(FuncType{Results: []ValueType{I32}}, nil))
+	err := inst.Snapshot(new(bytes.Buffer))
+	if err == nil || err.Error() != "snapshot: element 1 of table 0 is not a function of the instance" {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package interp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sprt/wasm/ast"
+)
+
+const recursionModule = `(module
+	(func $inf (export "inf") (call $inf))
+	(func $count (export "count") (param i32) (result i32)
+		(if (result i32) (i32.eqz (get_local 0))
+			(then (i32.const 0))
+			(else (i32.add (i32.const 1) (call $count (i32.sub (get_local 0) (i32.const 1)))))))
+	(func $big (export "big") (param i32) (local f64 f64 f64 f64 f64 f64 f64 f64 f64 f64)
+		(if (get_local 0) (then (call $big (i32.sub (get_local 0) (i32.const 1)))))))`
+
+func TestCallStackExhausted(t *testing.T) {
+	inst := instantiate(t, recursionModule, nil)
+	runInvokeTests(t, inst, []invokeTest{
+		{"inf", nil, nil, ErrCallStackExhausted},
+		{"count", []Value{Int32(DefaultMaxCallDepth - 1)}, []Value{Int32(DefaultMaxCallDepth - 1)}, nil},
+		{"count", []Value{Int32(DefaultMaxCallDepth)}, nil, ErrCallStackExhausted},
+	})
+
+	cfg := &Config{MaxCallDepth: 10, MaxStackValues: 50}
+	inst, err := cfg.Instantiate(context.Background(), parse(t, recursionModule), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"count", []Value{Int32(9)}, []Value{Int32(9)}, nil},
+		{"count", []Value{Int32(10)}, nil, ErrCallStackExhausted},
+		// Each call of big holds 11 locals, and an operand while calling.
+		{"big", []Value{Int32(3)}, nil, nil},
+		{"big", []Value{Int32(4)}, nil, ErrCallStackExhausted},
+	})
+}
+
+func TestCallStackExhaustedReentrant(t *testing.T) {
+	var inst *Instance
+	calls := 0
+	reenter := NewHostFunc(FuncType{}, func(ctx context.Context, _ []Value) ([]Value, error) {
+		calls++
+		_, err := inst.Invoke(ctx, "run")
+		return nil, err
+	})
+	cfg := &Config{MaxCallDepth: 100}
+	var err error
+	inst, err = cfg.Instantiate(context.Background(), parse(t, `(module
+		(import "env" "reenter" (func $reenter))
+		(func (export "run") (call $reenter)))`),
+		Imports{"env": {"reenter": reenter}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inst.Invoke(context.Background(), "run"); !errors.Is(err, ErrCallStackExhausted) {
+		t.Errorf("got error %v, want %v", err, ErrCallStackExhausted)
+	}
+	if calls != 100 {
+		t.Errorf("host function called %d times, want 100", calls)
+	}
+}
+
+const tailCallModule = `(module
+	(import "env" "double" (func $double (param i64) (result i64)))
+	(type $pred (func (param i64) (result i32)))
+	(table 2 funcref)
+	(elem (i32.const 0) $even $odd)
+	(func $even (export "even") (param i64) (result i32)
+		(if (result i32) (i64.eqz (get_local 0))
+			(then (i32.const 1))
+			(else (return_call $odd (i64.sub (get_local 0) (i64.const 1))))))
+	(func $odd (export "odd") (param i64) (result i32) (local i64 i64 i64)
+		(if (result i32) (i64.eqz (get_local 0))
+			(then (i32.const 0))
+			(else (return_call_indirect (type $pred) (i64.sub (get_local 0) (i64.const 1)) (i32.const 0)))))
+	(func (export "double") (param i64) (result i64)
+		(return_call $double (get_local 0)))
+	(func (export "bad") (param i32) (result i32)
+		(return_call_indirect (type $pred) (i64.const 1) (get_local 0)))
+)`
+
+func TestTailCall(t *testing.T) {
+	double := NewHostFunc(FuncType{Params: []ValueType{I64}, Results: []ValueType{I64}},
+		func(_ context.Context, args []Value) ([]Value, error) {
+			return []Value{Int64(2 * args[0].Int64())}, nil
+		})
+	cfg := &Config{Features: ast.TailCall, MaxCallDepth: 10, MaxStackValues: 50}
+	inst, err := cfg.Instantiate(context.Background(), parse(t, tailCallModule), Imports{"env": {"double": double}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tail calls run in the frame of their caller, so the depth of the
+	// recursion is not limited by that of the call stack.
+	runInvokeTests(t, inst, []invokeTest{
+		{"even", []Value{Int64(1000000)}, []Value{Int32(1)}, nil},
+		{"odd", []Value{Int64(1000001)}, []Value{Int32(1)}, nil},
+		{"even", []Value{Int64(7)}, []Value{Int32(0)}, nil},
+		{"double", []Value{Int64(21)}, []Value{Int64(42)}, nil},
+		{"bad", []Value{Int32(1)}, []Value{Int32(1)}, nil},
+		{"bad", []Value{Int32(2)}, nil, ErrUndefinedElement},
+	})
+	// The trap left no call of the instance active.
+	if err := inst.Snapshot(new(bytes.Buffer)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,67 @@
+package interp
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const startModule = `(module
+	(memory 1)
+	(data (i32.const 0) "\01")
+	(func $main (i32.store8 (i32.const 0) (i32.const 2)))
+	(start $main))`
+
+func TestStart(t *testing.T) {
+	inst := instantiate(t, startModule, nil)
+	if b := inst.Memory().Bytes()[0]; b != 2 {
+		t.Errorf("memory[0] = %d after start, want 2", b)
+	}
+
+	_, err := Instantiate(context.Background(), parse(t, `(module (func unreachable) (start 0))`), nil)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("trapping start function: got error %v, want trap %v", err, ErrUnreachable)
+	}
+}
+
+func TestStartHooks(t *testing.T) {
+	var events []string
+	logMemory := func(when string) func(*Instance) error {
+		return func(inst *Instance) error {
+			events = append(events, when+":"+string('0'+inst.Memory().Bytes()[0]))
+			return nil
+		}
+	}
+	m := parse(t, startModule)
+
+	cfg := &Config{PreStart: logMemory("pre"), PostStart: logMemory("post")}
+	if _, err := cfg.Instantiate(context.Background(), m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pre:1", "post:2"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+
+	events = nil
+	cfg.SkipStart = true
+	inst, err := cfg.Instantiate(context.Background(), m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pre:1", "post:1"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+	if _, err := inst.StartFunc().Call(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b := inst.Memory().Bytes()[0]; b != 2 {
+		t.Errorf("memory[0] = %d after deferred start, want 2", b)
+	}
+
+	errStop := errors.New("stop")
+	cfg = &Config{PreStart: func(*Instance) error { return errStop }}
+	if _, err := cfg.Instantiate(context.Background(), m, nil); err != errStop {
+		t.Errorf("failing PreStart: got error %v, want %v", err, errStop)
+	}
+}
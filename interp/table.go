@@ -0,0 +1,141 @@
+package interp
+
+import (
+	"fmt"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// Limits is the size range of a table, in elements, or of a memory,
+// in pages.
+type Limits struct {
+	Min    uint32
+	Max    uint32 // if HasMax
+	HasMax bool
+}
+
+func limits(lim *ast.Limits) Limits {
+	return Limits{Min: lim.Min, Max: lim.Max, HasMax: lim.HasMax}
+}
+
+// matches reports whether an entity of limits l can be imported
+// where limits want are expected.
+func (l Limits) matches(want Limits) bool {
+	if l.Min < want.Min {
+		return false
+	}
+	return !want.HasMax || l.HasMax && l.Max <= want.Max
+}
+
+// maxTableLen is the maximum number of elements of a table, beyond which
+// table.grow fails.
+const maxTableLen = 10000000
+
+// Table is a table of references, to functions or to values of the host,
+// whose elements may be null.
+type Table struct {
+	typ    ValueType     // of its elements: FuncRef or ExternRef
+	elems  []interface{} // referents, as in Value
+	max    uint32
+	hasMax bool
+}
+
+// NewTable returns a new table of lim.Min null references to functions.
+func NewTable(lim Limits) *Table { return NewTableOf(FuncRef, lim) }
+
+// NewTableOf returns a new table of lim.Min null references of type typ,
+// which must be a reference type.
+func NewTableOf(typ ValueType, lim Limits) *Table {
+	if !typ.isRef() {
+		panic(fmt.Sprintf("interp: not a reference type: %s", typ))
+	}
+	return &Table{
+		typ:    typ,
+		elems:  make([]interface{}, lim.Min),
+		max:    lim.Max,
+		hasMax: lim.HasMax,
+	}
+}
+
+func (t *Table) limits() Limits {
+	return Limits{Min: uint32(len(t.elems)), Max: t.max, HasMax: t.hasMax}
+}
+
+// Type returns the type of the elements of t.
+func (t *Table) Type() ValueType { return t.typ }
+
+// Len returns the number of elements of t.
+func (t *Table) Len() int { return len(t.elems) }
+
+// Get returns the function referenced by the element i of t, which must
+// be less than t.Len(), or nil if it is null or t is not a table of
+// functions.
+func (t *Table) Get(i int) *Func {
+	f, _ := t.elems[i].(*Func)
+	return f
+}
+
+// Set sets the element i of t, which must be a table of functions and i
+// less than t.Len(), to a reference to f, which is null if f is nil.
+func (t *Table) Set(i int, f *Func) {
+	if t.typ != FuncRef {
+		panic(fmt.Sprintf("interp: Set of a table of %s", t.typ))
+	}
+	if f == nil {
+		t.elems[i] = nil
+		return
+	}
+	t.elems[i] = f
+}
+
+// Ref returns the element i of t, which must be less than t.Len().
+func (t *Table) Ref(i int) Value { return Value{typ: t.typ, ref: t.elems[i]} }
+
+// SetRef sets the element i of t, which must be less than t.Len(), to v,
+// which must be of the type of the elements of t.
+func (t *Table) SetRef(i int, v Value) error {
+	if v.typ != t.typ {
+		return fmt.Errorf("type mismatch: got %s, want %s", v.typ, t.typ)
+	}
+	t.elems[i] = v.ref
+	return nil
+}
+
+// grow grows t by delta elements set to the referent r, and returns its
+// previous size. It fails, leaving t unchanged, if the new size would
+// exceed the maximum size of t or maxTableLen.
+func (t *Table) grow(delta uint32, r interface{}) (prev uint32, ok bool) {
+	prev = uint32(len(t.elems))
+	n := uint64(prev) + uint64(delta)
+	if n > maxTableLen || t.hasMax && n > uint64(t.max) {
+		return prev, false
+	}
+	elems := make([]interface{}, n)
+	copy(elems, t.elems)
+	for i := prev; uint64(i) < n; i++ {
+		elems[i] = r
+	}
+	t.elems = elems
+	return prev, true
+}
+
+// function returns the function referenced by the element i of t, the
+// callee of call_indirect, or traps if it is out of bounds or null.
+func (t *Table) function(i uint32) *Func {
+	if uint64(i) >= uint64(len(t.elems)) {
+		trap(ErrUndefinedElement)
+	}
+	fn, _ := t.elems[i].(*Func)
+	if fn == nil {
+		trap(ErrUninitializedElement)
+	}
+	return fn
+}
+
+// table returns the table x of inst, or its first table if x is nil.
+func (inst *Instance) table(x *ast.Variable) *Table {
+	if x == nil {
+		return inst.tables[0]
+	}
+	return inst.tables[x.Index]
+}
@@ -0,0 +1,138 @@
+package interp
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sprt/wasm/ast"
+)
+
+const tableModule = `(module
+	(type $i32 (func (result i32)))
+	(type $i64 (func (result i64)))
+	(func $one (type $i32) (i32.const 1))
+	(func $two (result i32) (i32.const 2))
+	(func $big (type $i64) (i64.const 3))
+	(table (export "table") 5 anyfunc)
+	(elem (i32.const 0) $one $two $big)
+	(func (export "call") (param i32) (result i32)
+		(call_indirect (type $i32) (get_local 0)))
+	(func (export "call64") (param i32) (result i64)
+		(call_indirect (result i64) (get_local 0)))
+)`
+
+func TestCallIndirect(t *testing.T) {
+	inst := instantiate(t, tableModule, nil)
+	runInvokeTests(t, inst, []invokeTest{
+		{"call", []Value{Int32(0)}, []Value{Int32(1)}, nil},
+		{"call", []Value{Int32(1)}, []Value{Int32(2)}, nil},
+		{"call64", []Value{Int32(2)}, []Value{Int64(3)}, nil},
+		{"call", []Value{Int32(2)}, nil, ErrIndirectCallTypeMismatch},
+		{"call64", []Value{Int32(0)}, nil, ErrIndirectCallTypeMismatch},
+		{"call", []Value{Int32(3)}, nil, ErrUninitializedElement},
+		{"call", []Value{Int32(5)}, nil, ErrUndefinedElement},
+		{"call", []Value{Int32(-1)}, nil, ErrUndefinedElement},
+	})
+
+	// Functions set in the table from outside are called too.
+	table := inst.Export("table").(*Table)
+	table.Set(4, NewHostFunc(FuncType{Results: []ValueType{I32}}, func(context.Context, []Value) ([]Value, error) {
+		return []Value{Int32(42)}, nil
+	}))
+	runInvokeTests(t, inst, []invokeTest{
+		{"call", []Value{Int32(4)}, []Value{Int32(42)}, nil},
+	})
+}
+
+func TestImportTable(t *testing.T) {
+	table := NewTable(Limits{Min: 2, Max: 10, HasMax: true})
+	instantiate(t, `(module
+		(import "env" "table" (table 1 10 anyfunc))
+		(func $f (result i32) (i32.const 7))
+		(elem (i32.const 1) $f))`,
+		Imports{"env": {"table": table}})
+	inst := instantiate(t, `(module
+		(import "env" "table" (table 2 anyfunc))
+		(func (export "call") (param i32) (result i32)
+			(call_indirect (result i32) (get_local 0))))`,
+		Imports{"env": {"table": table}})
+	runInvokeTests(t, inst, []invokeTest{
+		{"call", []Value{Int32(1)}, []Value{Int32(7)}, nil},
+		{"call", []Value{Int32(0)}, nil, ErrUninitializedElement},
+	})
+}
+
+func TestInstantiateErrors(t *testing.T) {
+	table := NewTable(Limits{Min: 1})
+	for _, tt := range []struct {
+		src     string
+		imports Imports
+		err     string
+	}{
+		{`(module (import "env" "f" (func)))`, nil, `import "env" "f": unknown import`},
+		{`(module (import "env" "f" (func)))`, Imports{"env": {"f": table}},
+			`import "env" "f": incompatible import type`},
+		{`(module (import "env" "f" (func (param i32))))`,
+			Imports{"env": {"f": NewHostFunc(FuncType{}, nil)}},
+			`import "env" "f": incompatible import type`},
+		{`(module (import "env" "t" (table 2 anyfunc)))`, Imports{"env": {"t": table}},
+			`import "env" "t": incompatible import type`},
+		{`(module (import "env" "t" (table 1 5 anyfunc)))`, Imports{"env": {"t": table}},
+			`import "env" "t": incompatible import type`},
+		{`(module (table 1 anyfunc) (func) (elem (i32.const 1) 0))`, nil, "elements segment does not fit"},
+		{`(module (memory 0) (data (i32.const 0) "a"))`, nil, "data segment does not fit"},
+		{`(module (memory 1) (table 0 anyfunc) (func) (data (i32.const 0) "a") (elem (i32.const 0) 0))`,
+			nil, "elements segment does not fit"},
+		{`(module (import "env" "m" (memory 2)))`, Imports{"env": {"m": NewMemory(Limits{Min: 1})}},
+			`import "env" "m": incompatible import type`},
+		{`(module (func (result i32)))`, nil, "func 0: type mismatch: expected i32, found nothing"},
+	} {
+		m, err := ast.Parse(strings.NewReader(tt.src))
+		if err != nil {
+			t.Errorf("%s: Parse: %v", tt.src, err)
+			continue
+		}
+		_, err = Instantiate(context.Background(), m, tt.imports)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+const bulkTableModule = `(module
+	(type $i32 (func (result i32)))
+	(func $one (type $i32) (i32.const 1))
+	(func $two (type $i32) (i32.const 2))
+	(table 4 anyfunc)
+	(elem (i32.const 0) $one)
+	(elem $fs func $one $two)
+	(func (export "call") (param i32) (result i32)
+		(call_indirect (type $i32) (get_local 0)))
+	(func (export "copy") (param i32 i32 i32)
+		(table.copy (get_local 0) (get_local 1) (get_local 2)))
+	(func (export "init") (param i32 i32 i32)
+		(table.init $fs (get_local 0) (get_local 1) (get_local 2)))
+	(func (export "drop") elem.drop $fs)
+)`
+
+func TestBulkTable(t *testing.T) {
+	c := &Config{Features: ast.BulkMemory}
+	inst, err := c.Instantiate(context.Background(), parse(t, bulkTableModule), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runInvokeTests(t, inst, []invokeTest{
+		{"init", []Value{Int32(2), Int32(0), Int32(2)}, nil, nil},
+		{"call", []Value{Int32(2)}, []Value{Int32(1)}, nil},
+		{"call", []Value{Int32(3)}, []Value{Int32(2)}, nil},
+		{"copy", []Value{Int32(0), Int32(2), Int32(2)}, nil, nil},
+		{"call", []Value{Int32(1)}, []Value{Int32(2)}, nil},
+		{"copy", []Value{Int32(1), Int32(0), Int32(4)}, nil, ErrTableOutOfBounds},
+		{"init", []Value{Int32(3), Int32(0), Int32(2)}, nil, ErrTableOutOfBounds},
+		{"call", []Value{Int32(3)}, []Value{Int32(2)}, nil},
+		{"init", []Value{Int32(4), Int32(2), Int32(0)}, nil, nil},
+		{"drop", nil, nil, nil},
+		{"init", []Value{Int32(0), Int32(0), Int32(1)}, nil, ErrTableOutOfBounds},
+	})
+}
@@ -0,0 +1,174 @@
+package interp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// Errors wrapped by a Trap, describing its cause.
+var (
+	ErrUnreachable              = errors.New("unreachable executed")
+	ErrIntegerDivideByZero      = errors.New("integer divide by zero")
+	ErrIntegerOverflow          = errors.New("integer overflow")
+	ErrInvalidConversion        = errors.New("invalid conversion to integer")
+	ErrOutOfBounds              = errors.New("out of bounds memory access")
+	ErrTableOutOfBounds         = errors.New("out of bounds table access")
+	ErrUndefinedElement         = errors.New("undefined element")
+	ErrUninitializedElement     = errors.New("uninitialized element")
+	ErrIndirectCallTypeMismatch = errors.New("indirect call type mismatch")
+	ErrOutOfFuel                = errors.New("out of fuel")
+	ErrCallStackExhausted       = errors.New("call stack exhausted")
+	ErrUnalignedAtomic          = errors.New("unaligned atomic")
+	ErrExpectedSharedMemory     = errors.New("expected shared memory")
+)
+
+// Trap is the error returned when the execution of a function traps,
+// aborting the call.
+// Err is one of the errors above, or the error returned by a host function.
+type Trap struct {
+	Err error
+
+	// Frames is the backtrace of the trap: the functions of module
+	// instances that were executing, innermost first.
+	Frames []Frame
+}
+
+func (t *Trap) Error() string {
+	return "trap: " + t.Err.Error()
+}
+
+// Format implements fmt.Formatter. The %+v verb prints the error followed
+// by its backtrace, in the manner of a Go panic:
+//
+//	trap: integer divide by zero
+//
+//	wasm backtrace:
+//	$div(func 2)
+//		line 7 +0x3
+//	func 0
+//		+0x1
+//
+// Each frame is the function, by name if it has one, and its index in its
+// module, then the line of the executing instruction in the text it was
+// parsed from, if known, and its offset in the function body.
+// Other verbs print the error only.
+func (t *Trap) Format(s fmt.State, verb rune) {
+	io.WriteString(s, t.Error())
+	if verb != 'v' || !s.Flag('+') {
+		return
+	}
+	io.WriteString(s, "\n\nwasm backtrace:")
+	for _, f := range t.Frames {
+		if f.FuncName != "" {
+			fmt.Fprintf(s, "\n$%s(func %d)\n\t", f.FuncName, f.FuncIndex)
+		} else {
+			fmt.Fprintf(s, "\nfunc %d\n\t", f.FuncIndex)
+		}
+		if f.Line != 0 {
+			fmt.Fprintf(s, "line %d ", f.Line)
+		}
+		fmt.Fprintf(s, "+%#x", f.Offset)
+	}
+}
+
+func (t *Trap) Unwrap() error { return t.Err }
+
+// trap aborts the current call with a Trap wrapping err.
+// It is recovered by Func.Call.
+func trap(err error) {
+	panic(&Trap{Err: err})
+}
+
+// Frame is a frame of the backtrace of a trap.
+type Frame struct {
+	FuncIndex int    // index of the function in its module
+	FuncName  string // without the $; empty if the function has no name
+
+	// Offset is the index of the executing instruction among the
+	// instructions of the function body, counted in execution order,
+	// that is in their unfolded form, from 0.
+	Offset int
+	Line   int // of the instruction in the text format, zero if unknown
+}
+
+// backtrace returns the frames of m, innermost first.
+func (m *machine) backtrace() []Frame {
+	frames := make([]Frame, len(m.frames))
+	for i, f := range m.frames {
+		fr := Frame{
+			FuncIndex: f.fn.index,
+			FuncName:  f.fn.code.Name,
+		}
+		instr := f.instr
+		if f.fn.compiled != nil {
+			instr = f.fn.compiled.srcs[f.pc]
+		}
+		fr.Offset, _ = instrOffset(f.fn.code.Body, instr, 0)
+		switch in := instr.(type) {
+		case *ast.Instruction:
+			fr.Line = in.Line
+		case *ast.Block:
+			fr.Line = in.Line
+		case *ast.Loop:
+			fr.Line = in.Line
+		case *ast.If:
+			fr.Line = in.Line
+		}
+		frames[len(frames)-1-i] = fr
+	}
+	return frames
+}
+
+// instrOffset returns the offset of target in body, which starts at offset
+// n, and whether it was found; if not, it returns the offset following body.
+func instrOffset(body []ast.Instr, target ast.Instr, n int) (int, bool) {
+	found := false
+	for _, in := range body {
+		switch in := in.(type) {
+		case *ast.Instruction:
+			if n, found = instrOffset(in.Operands, target, n); found {
+				return n, true
+			}
+		case *ast.Block:
+			if in == target {
+				return n, true
+			}
+			if n, found = instrOffset(in.Body, target, n+1); found {
+				return n, true
+			}
+		case *ast.Loop:
+			if in == target {
+				return n, true
+			}
+			if n, found = instrOffset(in.Body, target, n+1); found {
+				return n, true
+			}
+		case *ast.If:
+			if n, found = instrOffset(in.Cond, target, n); found {
+				return n, true
+			}
+			if in == target {
+				return n, true
+			}
+			if n, found = instrOffset(in.Then, target, n+1); found {
+				return n, true
+			}
+			if in.Else != nil {
+				n++ // else
+			}
+			if n, found = instrOffset(in.Else, target, n); found {
+				return n, true
+			}
+			n++ // end
+			continue
+		}
+		if in == target {
+			return n, true
+		}
+		n++ // the instruction, or the end of the block
+	}
+	return n, false
+}
@@ -0,0 +1,71 @@
+package interp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTrapBacktrace(t *testing.T) {
+	inst := instantiate(t, `(module
+		(func $div (param i32) (result i32)
+			(i32.div_u (i32.const 1) (get_local 0)))
+		(func (export "run") (param i32) (result i32)
+			nop
+			(block (result i32)
+				get_local 0
+				call $div)))`, nil)
+	_, err := inst.Invoke(context.Background(), "run", Int32(0))
+	var trap *Trap
+	if !errors.As(err, &trap) {
+		t.Fatalf("got error %v, want a trap", err)
+	}
+	want := []Frame{
+		{FuncIndex: 0, FuncName: "div", Offset: 2, Line: 3},
+		{FuncIndex: 1, Offset: 3, Line: 8},
+	}
+	if !reflect.DeepEqual(trap.Frames, want) {
+		t.Errorf("got frames %+v, want %+v", trap.Frames, want)
+	}
+
+	const wantTrace = `trap: integer divide by zero
+
+wasm backtrace:
+$div(func 0)
+	line 3 +0x2
+func 1
+	line 8 +0x3`
+	if s := fmt.Sprintf("%+v", err); s != wantTrace {
+		t.Errorf("got trace:\n%s\nwant:\n%s", s, wantTrace)
+	}
+	if s := fmt.Sprint(err); s != "trap: integer divide by zero" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestTrapBacktraceReentrant(t *testing.T) {
+	var inst *Instance
+	reenter := NewHostFunc(FuncType{}, func(ctx context.Context, _ []Value) ([]Value, error) {
+		_, err := inst.Invoke(ctx, "inner")
+		return nil, err
+	})
+	inst = instantiate(t, `(module
+		(import "env" "reenter" (func $reenter))
+		(func $inner (export "inner") unreachable)
+		(func $outer (export "outer") (call $reenter)))`,
+		Imports{"env": {"reenter": reenter}})
+	_, err := inst.Invoke(context.Background(), "outer")
+	var trap *Trap
+	if !errors.As(err, &trap) || trap.Err != ErrUnreachable {
+		t.Fatalf("got error %v, want trap %v", err, ErrUnreachable)
+	}
+	want := []Frame{
+		{FuncIndex: 1, FuncName: "inner", Offset: 0, Line: 3},
+		{FuncIndex: 2, FuncName: "outer", Offset: 0, Line: 4},
+	}
+	if !reflect.DeepEqual(trap.Frames, want) {
+		t.Errorf("got frames %+v, want %+v", trap.Frames, want)
+	}
+}
@@ -0,0 +1,261 @@
+package interp
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// ValueType is the type of a value.
+type ValueType byte
+
+const (
+	I32 ValueType = iota + 1
+	I64
+	F32
+	F64
+	FuncRef   // reference to a function
+	ExternRef // reference to a value of the host
+	V128      // 128-bit vector
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case I32:
+		return "i32"
+	case I64:
+		return "i64"
+	case F32:
+		return "f32"
+	case F64:
+		return "f64"
+	case FuncRef:
+		return "funcref"
+	case ExternRef:
+		return "externref"
+	case V128:
+		return "v128"
+	}
+	return fmt.Sprintf("ValueType(%d)", t)
+}
+
+// isRef reports whether t is a reference type.
+func (t ValueType) isRef() bool { return t == FuncRef || t == ExternRef }
+
+// slots returns the number of slots that a value of type t takes on the
+// stack and in the locals of a machine: two for a V128, its low then high
+// 64 bits, and one for the other types.
+func (t ValueType) slots() int {
+	if t == V128 {
+		return 2
+	}
+	return 1
+}
+
+// typeSlots returns the number of slots taken by values of the given types.
+func typeSlots(types []ValueType) int {
+	n := len(types)
+	for _, t := range types {
+		if t == V128 {
+			n++
+		}
+	}
+	return n
+}
+
+// tokenSlots is like typeSlots for value type tokens, zero counting as an
+// unknown type of one slot.
+func tokenSlots(types ...ast.TokenType) int {
+	n := len(types)
+	for _, t := range types {
+		if t == ast.V128 {
+			n++
+		}
+	}
+	return n
+}
+
+// valueType returns the ValueType of the value type token t.
+func valueType(t ast.TokenType) ValueType {
+	switch t {
+	case ast.I32:
+		return I32
+	case ast.I64:
+		return I64
+	case ast.F32:
+		return F32
+	case ast.F64:
+		return F64
+	case ast.FUNCREF:
+		return FuncRef
+	case ast.EXTERNREF:
+		return ExternRef
+	case ast.V128:
+		return V128
+	}
+	panic(fmt.Sprintf("interp: not a value type: %s", t))
+}
+
+func valueTypes(types []ast.TokenType) []ValueType {
+	vts := make([]ValueType, len(types))
+	for i, t := range types {
+		vts[i] = valueType(t)
+	}
+	return vts
+}
+
+// Value is a value of one of the value types.
+// The zero Value is invalid.
+type Value struct {
+	typ  ValueType
+	bits uint64      // the bits of a 32-bit value are zero-extended
+	hi   uint64      // of a V128: its high 64 bits, bits holding the low ones
+	ref  interface{} // of a reference: nil if null, or a *Func or *extern
+}
+
+// extern is the referent of a non-null ExternRef: a value of the host,
+// boxed so that references can be compared.
+type extern struct {
+	v interface{}
+}
+
+func Int32(v int32) Value     { return Value{typ: I32, bits: uint64(uint32(v))} }
+func Int64(v int64) Value     { return Value{typ: I64, bits: uint64(v)} }
+func Float32(v float32) Value { return Value{typ: F32, bits: uint64(math.Float32bits(v))} }
+func Float64(v float64) Value { return Value{typ: F64, bits: math.Float64bits(v)} }
+
+// Vector128 returns the V128 of the given low and high 64 bits, whose
+// lanes are little-endian: the first lane is in the low bits of lo.
+func Vector128(lo, hi uint64) Value { return Value{typ: V128, bits: lo, hi: hi} }
+
+// RefNull returns the null reference of type t, which must be a reference
+// type.
+func RefNull(t ValueType) Value {
+	if !t.isRef() {
+		panic(fmt.Sprintf("interp: not a reference type: %s", t))
+	}
+	return Value{typ: t}
+}
+
+// RefFunc returns a reference to f, which is null if f is nil.
+func RefFunc(f *Func) Value {
+	if f == nil {
+		return Value{typ: FuncRef}
+	}
+	return Value{typ: FuncRef, ref: f}
+}
+
+// RefExtern returns a reference to the value v of the host, which is
+// null if v is nil. Modules cannot inspect v: they can only pass it to
+// functions, and hold it in globals and tables.
+func RefExtern(v interface{}) Value {
+	if v == nil {
+		return Value{typ: ExternRef}
+	}
+	return Value{typ: ExternRef, ref: &extern{v}}
+}
+
+// ValueOf returns the value of type t with the given bits, which for a
+// 32-bit type are truncated to their low 32 bits, and for a reference
+// type ignored: the value is the null reference. A V128 gets them as its
+// low 64 bits, and zero high bits.
+// It is the inverse of Bits, and preserves the payload of a NaN.
+func ValueOf(t ValueType, bits uint64) Value {
+	switch {
+	case t == I32 || t == F32:
+		bits = uint64(uint32(bits))
+	case t.isRef():
+		bits = 0
+	}
+	return Value{typ: t, bits: bits}
+}
+
+// Type returns the type of v.
+func (v Value) Type() ValueType { return v.typ }
+
+// Bits returns the bits of v, zero-extended if it is a 32-bit value, the
+// low 64 bits if it is a V128, or zero if it is a reference.
+func (v Value) Bits() uint64 { return v.bits }
+
+// IsNull reports whether v is a null reference.
+func (v Value) IsNull() bool { return v.typ.isRef() && v.ref == nil }
+
+// Func returns the function referenced by v, which must be of type
+// FuncRef, or nil if it is null.
+func (v Value) Func() *Func {
+	v.mustBe(FuncRef)
+	f, _ := v.ref.(*Func)
+	return f
+}
+
+// Extern returns the value of the host referenced by v, which must be of
+// type ExternRef, or nil if it is null.
+func (v Value) Extern() interface{} {
+	v.mustBe(ExternRef)
+	if v.ref == nil {
+		return nil
+	}
+	return v.ref.(*extern).v
+}
+
+// Int32 returns the value of v, which must be of type I32.
+func (v Value) Int32() int32 {
+	v.mustBe(I32)
+	return int32(v.bits)
+}
+
+// Int64 returns the value of v, which must be of type I64.
+func (v Value) Int64() int64 {
+	v.mustBe(I64)
+	return int64(v.bits)
+}
+
+// Float32 returns the value of v, which must be of type F32.
+func (v Value) Float32() float32 {
+	v.mustBe(F32)
+	return math.Float32frombits(uint32(v.bits))
+}
+
+// Float64 returns the value of v, which must be of type F64.
+func (v Value) Float64() float64 {
+	v.mustBe(F64)
+	return math.Float64frombits(v.bits)
+}
+
+// Vector128 returns the low and high 64 bits of v, which must be of type
+// V128.
+func (v Value) Vector128() (lo, hi uint64) {
+	v.mustBe(V128)
+	return v.bits, v.hi
+}
+
+func (v Value) mustBe(t ValueType) {
+	if v.typ != t {
+		panic(fmt.Sprintf("interp: %s value used as %s", v.typ, t))
+	}
+}
+
+func (v Value) String() string {
+	switch v.typ {
+	case I32:
+		return fmt.Sprintf("i32:%d", v.Int32())
+	case I64:
+		return fmt.Sprintf("i64:%d", v.Int64())
+	case F32:
+		return fmt.Sprintf("f32:%v", v.Float32())
+	case F64:
+		return fmt.Sprintf("f64:%v", v.Float64())
+	case V128:
+		return fmt.Sprintf("v128:0x%016x%016x", v.hi, v.bits)
+	case FuncRef, ExternRef:
+		if v.ref == nil {
+			return v.typ.String() + ":null"
+		}
+		if v.typ == FuncRef {
+			return fmt.Sprintf("funcref:%p", v.ref)
+		}
+		return fmt.Sprintf("externref:%v", v.Extern())
+	}
+	return "invalid value"
+}
@@ -0,0 +1,501 @@
+package interp
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// v128 is a 128-bit vector: its low then high 64 bits, whose lanes are
+// little-endian, the first lane in the low bits. It is held on the stack
+// and in the locals of a machine in two slots, in that order.
+type v128 [2]uint64
+
+func (m *machine) pushVector(v v128) { m.stack = append(m.stack, v[0], v[1]) }
+
+func (m *machine) popVector() v128 {
+	n := len(m.stack)
+	v := v128{m.stack[n-2], m.stack[n-1]}
+	m.stack = m.stack[:n-2]
+	return v
+}
+
+// lane returns the lane i of v, of w bits, zero-extended.
+func (v v128) lane(w, i uint) uint64 {
+	b := w * i
+	x := v[b/64] >> (b % 64)
+	if w < 64 {
+		x &= 1<<w - 1
+	}
+	return x
+}
+
+// setLane sets the lane i of v, of w bits, to the low w bits of x.
+func (v *v128) setLane(w, i uint, x uint64) {
+	b := w * i
+	mask := ^uint64(0)
+	if w < 64 {
+		mask = 1<<w - 1
+	}
+	v[b/64] = v[b/64]&^(mask<<(b%64)) | (x&mask)<<(b%64)
+}
+
+// sext returns the w-bit integer x sign-extended.
+func sext(x uint64, w uint) int64 {
+	return int64(x<<(64-w)) >> (64 - w)
+}
+
+// laneWidth returns the width in bits of the lanes of the vectors of
+// shape t.
+func laneWidth(t ast.TokenType) uint { return 128 / uint(t.Lanes()) }
+
+// vector executes the vector instruction in of inst, whose operands are
+// on the stack.
+func (m *machine) vector(inst *Instance, in *ast.Instruction) {
+	signed := in.Sign == ast.S
+	switch in.Op {
+	case ast.CONST:
+		m.pushVector(v128(in.Vector))
+		return
+	case ast.LOAD, ast.LOAD_SPLAT, ast.LOAD_ZERO:
+		m.pushVector(load(inst, in, m.pop()))
+		return
+	case ast.LOAD_LANE:
+		v := m.popVector()
+		w := uint(in.Width)
+		v.setLane(w, uint(in.Lane), le(access(inst, m.pop(), in.Offset, uint64(w/8))))
+		m.pushVector(v)
+		return
+	case ast.STORE:
+		v := m.popVector()
+		b := access(inst, m.pop(), in.Offset, 16)
+		putLE(b[:8], v[0])
+		putLE(b[8:], v[1])
+		return
+	case ast.STORE_LANE:
+		v := m.popVector()
+		w := uint(in.Width)
+		putLE(access(inst, m.pop(), in.Offset, uint64(w/8)), v.lane(w, uint(in.Lane)))
+		return
+	case ast.SPLAT:
+		x := m.pop()
+		var v v128
+		w := laneWidth(in.Type)
+		for i := uint(0); i < 128/w; i++ {
+			v.setLane(w, i, x)
+		}
+		m.pushVector(v)
+		return
+	case ast.EXTRACT_LANE:
+		v := m.popVector()
+		w := laneWidth(in.Type)
+		x := v.lane(w, uint(in.Lane))
+		if signed {
+			x = uint64(uint32(sext(x, w)))
+		}
+		m.push(x)
+		return
+	case ast.REPLACE_LANE:
+		x := m.pop()
+		v := m.popVector()
+		v.setLane(laneWidth(in.Type), uint(in.Lane), x)
+		m.pushVector(v)
+		return
+	case ast.SHL, ast.SHR:
+		n := m.pop()
+		m.pushVector(shift(in, m.popVector(), n))
+		return
+	case ast.BITSELECT:
+		c, y, x := m.popVector(), m.popVector(), m.popVector()
+		m.pushVector(v128{x[0]&c[0] | y[0]&^c[0], x[1]&c[1] | y[1]&^c[1]})
+		return
+	case ast.ANY_TRUE, ast.ALL_TRUE, ast.BITMASK:
+		m.push(test(in, m.popVector()))
+		return
+	}
+	if params, _, _ := in.VectorType(); len(params) == 1 {
+		m.pushVector(vectorUnop(in, m.popVector()))
+		return
+	}
+	y, x := m.popVector(), m.popVector()
+	m.pushVector(vectorBinop(in, x, y))
+}
+
+// load returns the vector loaded by in, a load other than
+// v128.load*_lane, from the address addr of the memory of inst.
+func load(inst *Instance, in *ast.Instruction, addr uint64) (v v128) {
+	if in.Op == ast.LOAD && in.Sign == 0 {
+		b := access(inst, addr, in.Offset, 16)
+		return v128{le(b[:8]), le(b[8:])}
+	}
+	w := uint(in.Width)
+	switch in.Op {
+	case ast.LOAD: // extending, as v128.load8x8_s
+		b := access(inst, addr, in.Offset, 8)
+		for i := uint(0); i < 64/w; i++ {
+			x := le(b[i*w/8 : (i+1)*w/8])
+			if in.Sign == ast.S {
+				x = uint64(sext(x, w))
+			}
+			v.setLane(2*w, i, x)
+		}
+	case ast.LOAD_SPLAT:
+		x := le(access(inst, addr, in.Offset, uint64(w/8)))
+		for i := uint(0); i < 128/w; i++ {
+			v.setLane(w, i, x)
+		}
+	case ast.LOAD_ZERO:
+		v[0] = le(access(inst, addr, in.Offset, uint64(w/8)))
+	}
+	return v
+}
+
+// le returns the little-endian integer of at most 8 bytes b.
+func le(b []byte) uint64 {
+	var x uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		x = x<<8 | uint64(b[i])
+	}
+	return x
+}
+
+// putLE stores the low len(b) bytes of x in b, in little-endian order.
+func putLE(b []byte, x uint64) {
+	for i := range b {
+		b[i] = byte(x)
+		x >>= 8
+	}
+}
+
+// shift returns the lanes of v shifted by in, a shl or shr, by n modulo
+// their width.
+func shift(in *ast.Instruction, v v128, n uint64) (r v128) {
+	w := laneWidth(in.Type)
+	n %= uint64(w)
+	for i := uint(0); i < 128/w; i++ {
+		x := v.lane(w, i)
+		switch {
+		case in.Op == ast.SHL:
+			x <<= n
+		case in.Sign == ast.S:
+			x = uint64(sext(x, w) >> n)
+		default:
+			x >>= n
+		}
+		r.setLane(w, i, x)
+	}
+	return r
+}
+
+// test returns the i32 result of in, v128.any_true or the all_true or
+// bitmask of a shape, on v.
+func test(in *ast.Instruction, v v128) uint64 {
+	if in.Op == ast.ANY_TRUE {
+		return b2u(v[0]|v[1] != 0)
+	}
+	w := laneWidth(in.Type)
+	var r uint64
+	for i := uint(0); i < 128/w; i++ {
+		x := v.lane(w, i)
+		if in.Op == ast.ALL_TRUE && x == 0 {
+			return 0
+		}
+		r |= x >> (w - 1) << i
+	}
+	if in.Op == ast.ALL_TRUE {
+		return 1
+	}
+	return r
+}
+
+// vectorUnop returns the result of the vector instruction in, which takes
+// a single vector, on v.
+func vectorUnop(in *ast.Instruction, v v128) (r v128) {
+	t, from := in.Type, in.From
+	signed := in.Sign == ast.S
+	if t == ast.V128 { // v128.not
+		return v128{^v[0], ^v[1]}
+	}
+	w := laneWidth(t)
+	n := 128 / w
+	switch in.Op {
+	case ast.EXTEND_LOW, ast.EXTEND_HIGH:
+		base := uint(0)
+		if in.Op == ast.EXTEND_HIGH {
+			base = n
+		}
+		for i := uint(0); i < n; i++ {
+			r.setLane(w, i, extendLane(v, w/2, base+i, signed))
+		}
+		return r
+	case ast.EXTADD_PAIRWISE:
+		for i := uint(0); i < n; i++ {
+			r.setLane(w, i, extendLane(v, w/2, 2*i, signed)+extendLane(v, w/2, 2*i+1, signed))
+		}
+		return r
+	case ast.CONVERT:
+		for i := uint(0); i < n; i++ {
+			r.setLane(w, i, convertInt(v.lane(32, i), ast.I32, ast.F32, signed))
+		}
+		return r
+	case ast.CONVERT_LOW:
+		for i := uint(0); i < 2; i++ {
+			r.setLane(64, i, convertInt(v.lane(32, i), ast.I32, ast.F64, signed))
+		}
+		return r
+	case ast.PROMOTE_LOW:
+		for i := uint(0); i < 2; i++ {
+			r.setLane(64, i, math.Float64bits(float64(math.Float32frombits(uint32(v.lane(32, i))))))
+		}
+		return r
+	case ast.DEMOTE: // f32x4.demote_f64x2_zero
+		for i := uint(0); i < 2; i++ {
+			r.setLane(32, i, uint64(math.Float32bits(float32(math.Float64frombits(v.lane(64, i))))))
+		}
+		return r
+	case ast.TRUNC_SAT:
+		if from == ast.F64X2 { // i32x4.trunc_sat_f64x2_*_zero
+			for i := uint(0); i < 2; i++ {
+				r.setLane(32, i, truncSat(math.Float64frombits(v.lane(64, i)), ast.I32, signed))
+			}
+			return r
+		}
+		for i := uint(0); i < n; i++ {
+			r.setLane(32, i, truncSat(float64(math.Float32frombits(uint32(v.lane(32, i)))), ast.I32, signed))
+		}
+		return r
+	}
+	for i := uint(0); i < n; i++ {
+		x := v.lane(w, i)
+		switch t {
+		case ast.F32X4:
+			x = f32Unop(in.Op, uint32(x))
+		case ast.F64X2:
+			x = f64Unop(in.Op, x)
+		default:
+			x = intLaneUnop(in.Op, w, x)
+		}
+		r.setLane(w, i, x)
+	}
+	return r
+}
+
+// extendLane returns the lane i of v, of w bits, extended to 2w bits.
+func extendLane(v v128, w, i uint, signed bool) uint64 {
+	x := v.lane(w, i)
+	if signed {
+		return uint64(sext(x, w))
+	}
+	return x
+}
+
+func intLaneUnop(op ast.TokenType, w uint, x uint64) uint64 {
+	switch op {
+	case ast.ABS:
+		if sext(x, w) < 0 {
+			return -x
+		}
+		return x
+	case ast.NEG:
+		return -x
+	case ast.POPCNT:
+		return uint64(bits.OnesCount64(x))
+	}
+	panic(fmt.Sprintf("interp: unknown vector operator %s", op))
+}
+
+// vectorBinop returns the result of the vector instruction in, which takes
+// two vectors, on x and y.
+func vectorBinop(in *ast.Instruction, x, y v128) (r v128) {
+	t := in.Type
+	signed := in.Sign == ast.S
+	switch in.Op {
+	case ast.AND:
+		return v128{x[0] & y[0], x[1] & y[1]}
+	case ast.ANDNOT:
+		return v128{x[0] &^ y[0], x[1] &^ y[1]}
+	case ast.OR:
+		return v128{x[0] | y[0], x[1] | y[1]}
+	case ast.XOR:
+		return v128{x[0] ^ y[0], x[1] ^ y[1]}
+	case ast.SHUFFLE:
+		indices := v128(in.Vector)
+		for i := uint(0); i < 16; i++ {
+			j := uint(indices.lane(8, i))
+			if j < 16 {
+				r.setLane(8, i, x.lane(8, j))
+			} else {
+				r.setLane(8, i, y.lane(8, j-16))
+			}
+		}
+		return r
+	case ast.SWIZZLE:
+		for i := uint(0); i < 16; i++ {
+			if j := uint(y.lane(8, i)); j < 16 {
+				r.setLane(8, i, x.lane(8, j))
+			}
+		}
+		return r
+	}
+	w := laneWidth(t)
+	n := 128 / w
+	switch in.Op {
+	case ast.NARROW:
+		// The lanes of x, then those of y, saturated.
+		for i := uint(0); i < n; i++ {
+			v, j := x, i
+			if i >= n/2 {
+				v, j = y, i-n/2
+			}
+			r.setLane(w, i, saturate(sext(v.lane(2*w, j), 2*w), w, signed))
+		}
+		return r
+	case ast.EXTMUL_LOW, ast.EXTMUL_HIGH:
+		base := uint(0)
+		if in.Op == ast.EXTMUL_HIGH {
+			base = n
+		}
+		for i := uint(0); i < n; i++ {
+			r.setLane(w, i, extendLane(x, w/2, base+i, signed)*extendLane(y, w/2, base+i, signed))
+		}
+		return r
+	case ast.DOT_PRODUCT: // i32x4.dot_i16x8_s
+		for i := uint(0); i < n; i++ {
+			r.setLane(32, i, extendLane(x, 16, 2*i, true)*extendLane(y, 16, 2*i, true)+
+				extendLane(x, 16, 2*i+1, true)*extendLane(y, 16, 2*i+1, true))
+		}
+		return r
+	}
+	for i := uint(0); i < n; i++ {
+		a, b := x.lane(w, i), y.lane(w, i)
+		var z uint64
+		switch t {
+		case ast.F32X4:
+			z = f32LaneBinop(in.Op, uint32(a), uint32(b))
+		case ast.F64X2:
+			z = f64LaneBinop(in.Op, a, b)
+		default:
+			z = intLaneBinop(in.Op, in.Sign, w, a, b)
+		}
+		r.setLane(w, i, z)
+	}
+	return r
+}
+
+// saturate returns x saturated to the range of the w-bit integers, signed
+// or not.
+func saturate(x int64, w uint, signed bool) uint64 {
+	lo, hi := int64(0), int64(1)<<w-1
+	if signed {
+		lo, hi = -1<<(w-1), 1<<(w-1)-1
+	}
+	if x < lo {
+		return uint64(lo)
+	}
+	if x > hi {
+		return uint64(hi)
+	}
+	return uint64(x)
+}
+
+// mask returns a lane of all ones if b, or of zeros.
+func mask(b bool) uint64 {
+	if b {
+		return ^uint64(0)
+	}
+	return 0
+}
+
+// intLaneBinop returns the result of the binary operator op of sign sign
+// on the w-bit lanes x and y, zero-extended. Comparisons yield a mask.
+func intLaneBinop(op, sign ast.TokenType, w uint, x, y uint64) uint64 {
+	signed := sign == ast.S
+	sx, sy := sext(x, w), sext(y, w)
+	switch op {
+	case ast.ADD:
+		return x + y
+	case ast.SUB:
+		return x - y
+	case ast.MUL:
+		return x * y
+	case ast.ADD_SAT:
+		if signed {
+			return saturate(sx+sy, w, true)
+		}
+		return saturate(int64(x+y), w, false)
+	case ast.SUB_SAT:
+		if signed {
+			return saturate(sx-sy, w, true)
+		}
+		return saturate(int64(x-y), w, false)
+	case ast.MIN:
+		if signed && sx < sy || !signed && x < y {
+			return x
+		}
+		return y
+	case ast.MAX:
+		if signed && sx > sy || !signed && x > y {
+			return x
+		}
+		return y
+	case ast.AVGR:
+		return (x + y + 1) / 2
+	case ast.Q15MULR_SAT:
+		return saturate((sx*sy+0x4000)>>15, w, true)
+	case ast.EQ:
+		return mask(x == y)
+	case ast.NE:
+		return mask(x != y)
+	case ast.LT:
+		return mask(signed && sx < sy || !signed && x < y)
+	case ast.GT:
+		return mask(signed && sx > sy || !signed && x > y)
+	case ast.LE:
+		return mask(signed && sx <= sy || !signed && x <= y)
+	case ast.GE:
+		return mask(signed && sx >= sy || !signed && x >= y)
+	}
+	panic(fmt.Sprintf("interp: unknown vector operator %s", op))
+}
+
+// f32LaneBinop and f64LaneBinop are like f32Binop and f64Binop, but
+// comparisons yield a mask, and they also implement pmin and pmax.
+func f32LaneBinop(op ast.TokenType, x, y uint32) uint64 {
+	a, b := math.Float32frombits(x), math.Float32frombits(y)
+	switch op {
+	case ast.PMIN:
+		if b < a {
+			return uint64(y)
+		}
+		return uint64(x)
+	case ast.PMAX:
+		if a < b {
+			return uint64(y)
+		}
+		return uint64(x)
+	case ast.EQ, ast.NE, ast.LT, ast.GT, ast.LE, ast.GE:
+		return mask(f32Binop(op, x, y) != 0)
+	}
+	return f32Binop(op, x, y)
+}
+
+func f64LaneBinop(op ast.TokenType, x, y uint64) uint64 {
+	a, b := math.Float64frombits(x), math.Float64frombits(y)
+	switch op {
+	case ast.PMIN:
+		if b < a {
+			return y
+		}
+		return x
+	case ast.PMAX:
+		if a < b {
+			return y
+		}
+		return x
+	case ast.EQ, ast.NE, ast.LT, ast.GT, ast.LE, ast.GE:
+		return mask(f64Binop(op, x, y) != 0)
+	}
+	return f64Binop(op, x, y)
+}
@@ -0,0 +1,134 @@
+package interp
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+
+	"github.com/sprt/wasm/ast"
+)
+
+const vectorModule = `(module
+	(import "env" "swap" (func $swap (param v128) (result v128)))
+	(memory 1)
+	(data (i32.const 0) "\01\02\03\04\05\06\07\08\09\0a\0b\0c\0d\0e\0f\10\ff\fe")
+	(global $g (export "g") (mut v128) (v128.const i64x2 0 0))
+	(func (export "i32x4.add") (param v128 v128) (result v128) (i32x4.add (get_local 0) (get_local 1)))
+	(func (export "i8x16.add_sat_s") (param v128 v128) (result v128) (i8x16.add_sat_s (get_local 0) (get_local 1)))
+	(func (export "i16x8.mul") (param v128 v128) (result v128) (i16x8.mul (get_local 0) (get_local 1)))
+	(func (export "i32x4.lt_s") (param v128 v128) (result v128) (i32x4.lt_s (get_local 0) (get_local 1)))
+	(func (export "f32x4.mul") (param v128 v128) (result v128) (f32x4.mul (get_local 0) (get_local 1)))
+	(func (export "f64x2.pmin") (param v128 v128) (result v128) (f64x2.pmin (get_local 0) (get_local 1)))
+	(func (export "extract") (param v128) (result i32) (i8x16.extract_lane_s 1 (get_local 0)))
+	(func (export "replace") (param v128 i64) (result v128) (i64x2.replace_lane 1 (get_local 0) (get_local 1)))
+	(func (export "splat") (param i32) (result v128) (i16x8.splat (get_local 0)))
+	(func (export "shuffle") (param v128 v128) (result v128)
+		(i8x16.shuffle 16 17 18 19 0 1 2 3 20 21 22 23 4 5 6 7 (get_local 0) (get_local 1)))
+	(func (export "swizzle") (param v128 v128) (result v128) (i8x16.swizzle (get_local 0) (get_local 1)))
+	(func (export "shr_s") (param v128 i32) (result v128) (i32x4.shr_s (get_local 0) (get_local 1)))
+	(func (export "bitmask") (param v128) (result i32) (i8x16.bitmask (get_local 0)))
+	(func (export "all_true") (param v128) (result i32) (i32x4.all_true (get_local 0)))
+	(func (export "narrow") (param v128 v128) (result v128) (i8x16.narrow_i16x8_u (get_local 0) (get_local 1)))
+	(func (export "extmul") (param v128 v128) (result v128) (i32x4.extmul_low_i16x8_s (get_local 0) (get_local 1)))
+	(func (export "dot") (param v128 v128) (result v128) (i32x4.dot_i16x8_s (get_local 0) (get_local 1)))
+	(func (export "trunc_sat") (param v128) (result v128) (i32x4.trunc_sat_f64x2_s_zero (get_local 0)))
+	(func (export "load") (param i32) (result v128) (v128.load (get_local 0)))
+	(func (export "load8x8_s") (param i32) (result v128) (v128.load8x8_s offset=10 (get_local 0)))
+	(func (export "load32_splat") (param i32) (result v128) (v128.load32_splat (get_local 0)))
+	(func (export "load16_lane") (param i32 v128) (result v128) (v128.load16_lane 7 (get_local 0) (get_local 1)))
+	(func (export "store") (param i32 v128) (v128.store (get_local 0) (get_local 1)))
+	(func (export "store8_lane") (param i32 v128) (v128.store8_lane 15 (get_local 0) (get_local 1)))
+	(func (export "mixed") (param $c i32) (param $v v128) (param $x i64) (result i64)
+		(local $w v128) (local $y i64)
+		(set_local $y (i64.const 7))
+		(set_local $w (i64x2.splat (get_local $x)))
+		(set_global $g (i64x2.add (get_local $v) (get_local $w)))
+		(drop (tee_local $w (call $swap (get_global $g))))
+		(i64.add (get_local $y)
+			(i64x2.extract_lane 0
+				(select (get_local $w) (block (result v128) (get_global $g)) (get_local $c)))))
+)`
+
+func i32x4(a, b, c, d uint32) Value {
+	return Vector128(uint64(b)<<32|uint64(a), uint64(d)<<32|uint64(c))
+}
+
+func f32x4(a, b, c, d float32) Value {
+	return i32x4(math.Float32bits(a), math.Float32bits(b), math.Float32bits(c), math.Float32bits(d))
+}
+
+func f64x2(a, b float64) Value {
+	return Vector128(math.Float64bits(a), math.Float64bits(b))
+}
+
+func TestVector(t *testing.T) {
+	swap := NewHostFunc(FuncType{Params: []ValueType{V128}, Results: []ValueType{V128}},
+		func(_ context.Context, args []Value) ([]Value, error) {
+			lo, hi := args[0].Vector128()
+			return []Value{Vector128(hi, lo)}, nil
+		})
+	c := &Config{Features: ast.SIMD}
+	inst, err := c.Instantiate(context.Background(), parse(t, vectorModule), Imports{"env": {"swap": swap}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nan := math.NaN()
+	runInvokeTests(t, inst, []invokeTest{
+		{"i32x4.add", []Value{i32x4(1, 2, 3, 0xffffffff), i32x4(10, 20, 30, 1)}, []Value{i32x4(11, 22, 33, 0)}, nil},
+		{"i8x16.add_sat_s", []Value{Vector128(0x107f80, 0), Vector128(0x2001ff, 0)}, []Value{Vector128(0x307f80, 0)}, nil},
+		{"i16x8.mul", []Value{Vector128(0xffff0100, 0), Vector128(0x00030100, 0)}, []Value{Vector128(0xfffd0000, 0)}, nil},
+		{"i32x4.lt_s", []Value{i32x4(1, 0xffffffff, 5, 0), i32x4(2, 0, 5, 0x80000000)},
+			[]Value{i32x4(0xffffffff, 0xffffffff, 0, 0)}, nil},
+		{"f32x4.mul", []Value{f32x4(1.5, 2, -3, 0.5), f32x4(2, 2, 2, 4)}, []Value{f32x4(3, 4, -6, 2)}, nil},
+		{"f64x2.pmin", []Value{f64x2(1, nan), f64x2(0.5, 2)}, []Value{f64x2(0.5, nan)}, nil},
+		{"extract", []Value{Vector128(0xff00, 0)}, []Value{Int32(-1)}, nil},
+		{"replace", []Value{Vector128(1, 2), Int64(9)}, []Value{Vector128(1, 9)}, nil},
+		{"splat", []Value{Int32(0x12345)}, []Value{Vector128(0x2345234523452345, 0x2345234523452345)}, nil},
+		{"shuffle", []Value{i32x4(1, 2, 3, 4), i32x4(5, 6, 7, 8)}, []Value{i32x4(5, 1, 6, 2)}, nil},
+		{"swizzle", []Value{Vector128(0x0807060504030201, 0x100f0e0d0c0b0a09), Vector128(0xff10000f, 0x0101010101010101)},
+			[]Value{Vector128(0x0101010100000110, 0x0202020202020202)}, nil},
+		{"shr_s", []Value{i32x4(0x80000000, 16, 0xfffffff0, 1), Int32(33)}, []Value{i32x4(0xc0000000, 8, 0xfffffff8, 0)}, nil},
+		{"bitmask", []Value{Vector128(0x80000000000000ff, 0x8000000000000000)}, []Value{Int32(0x8081)}, nil},
+		{"all_true", []Value{i32x4(1, 2, 3, 4)}, []Value{Int32(1)}, nil},
+		{"all_true", []Value{i32x4(1, 0, 3, 4)}, []Value{Int32(0)}, nil},
+		{"narrow", []Value{Vector128(0x7fff00ff012cffff, 0), Vector128(1, 0)}, []Value{Vector128(0xffffff00, 1)}, nil},
+		{"extmul", []Value{Vector128(0x000700640003fffe, 0), Vector128(0x000003e8fffc0003, 0)},
+			[]Value{i32x4(0xfffffffa, 0xfffffff4, 100000, 0)}, nil},
+		{"dot", []Value{Vector128(0x0004000300020001, 0), Vector128(0x0008000700060005, 0)}, []Value{i32x4(17, 53, 0, 0)}, nil},
+		{"trunc_sat", []Value{f64x2(-1.5, 1e10)}, []Value{i32x4(0xffffffff, 0x7fffffff, 0, 0)}, nil},
+
+		{"load", []Value{Int32(0)}, []Value{Vector128(0x0807060504030201, 0x100f0e0d0c0b0a09)}, nil},
+		{"load8x8_s", []Value{Int32(0)}, []Value{Vector128(0x000e000d000c000b, 0xfffeffff0010000f)}, nil},
+		{"load32_splat", []Value{Int32(4)}, []Value{Vector128(0x0807060508070605, 0x0807060508070605)}, nil},
+		{"load16_lane", []Value{Int32(16), Vector128(0, 0)}, []Value{Vector128(0, 0xfeff000000000000)}, nil},
+		{"store", []Value{Int32(32), Vector128(1, 2)}, nil, nil},
+		{"load", []Value{Int32(32)}, []Value{Vector128(1, 2)}, nil},
+		{"store8_lane", []Value{Int32(64), Vector128(0, 0xab00000000000000)}, nil, nil},
+		{"load", []Value{Int32(64)}, []Value{Vector128(0xab, 0)}, nil},
+		{"load", []Value{Int32(65521)}, nil, ErrOutOfBounds},
+		{"load16_lane", []Value{Int32(65535), Vector128(0, 0)}, nil, ErrOutOfBounds},
+		{"store", []Value{Int32(-1), Vector128(0, 0)}, nil, ErrOutOfBounds},
+
+		{"mixed", []Value{Int32(1), Vector128(1, 2), Int64(10)}, []Value{Int64(19)}, nil},
+		{"mixed", []Value{Int32(0), Vector128(1, 2), Int64(10)}, []Value{Int64(18)}, nil},
+	})
+
+	g := inst.Export("g").(*Global)
+	if lo, hi := g.Get().Vector128(); lo != 11 || hi != 12 {
+		t.Errorf("g = %#x %#x, want 11 12", lo, hi)
+	}
+	var snap bytes.Buffer
+	if err := inst.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Set(Vector128(3, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Restore(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := g.Get(), Vector128(11, 12); got != want {
+		t.Errorf("restored g = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,626 @@
+package wasm2go
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// function generates the method fI implementing the function fn of
+// index i.
+func (g *generator) function(i int, fn *ast.Func) {
+	sig := g.m.Signature(fn.Signature)
+	types := sig.ParamTypes()
+	if fn.Name != "" {
+		g.printf("// f%d is %s.\n", i, fn.Name)
+	}
+	if fn.Import != nil {
+		g.printf("func (m *Module) f%d(%s) %s {\n", i, params("x", types), results(sig.Results))
+		call := fmt.Sprintf("m.imports.%s(%s)", g.funcImports[i], args("x", len(types)))
+		if len(sig.Results) == 0 {
+			g.printf("imported(%s)\n}\n\n", call)
+			return
+		}
+		g.printf("%s, err := %s\nimported(err)\nreturn %s\n}\n\n", args("r", len(sig.Results)), call, args("r", len(sig.Results)))
+		return
+	}
+
+	f := &funcGen{g: g, results: sig.Results}
+	for j, t := range types {
+		f.vars = append(f.vars, &variable{name: fmt.Sprintf("l%d", j), typ: t, used: true})
+	}
+	for _, l := range fn.Locals {
+		v := &variable{name: fmt.Sprintf("l%d", len(f.vars)), typ: l.Type}
+		f.vars = append(f.vars, v)
+		f.lines = append(f.lines, line{kind: declLine, v: v})
+	}
+	f.body(fn.Body)
+	if !f.dead {
+		f.ret()
+	}
+
+	g.printf("func (m *Module) f%d(%s) %s {\nm.enter()\n", i, params("l", types), results(sig.Results))
+	for _, l := range f.lines {
+		switch l.kind {
+		case stmtLine:
+			g.printf("%s\n", l.text)
+		case defLine:
+			if l.v.used {
+				g.printf("%s := %s\n", l.v.name, l.text)
+			} else {
+				g.printf("_ = %s\n", l.text)
+			}
+		case declLine:
+			if l.v.used {
+				g.printf("var %s %s\n", l.v.name, goType(l.v.typ))
+			}
+		case assignLine:
+			if l.v.used {
+				g.printf("%s = %s\n", l.v.name, l.text)
+			} else {
+				g.printf("_ = %s\n", l.text)
+			}
+		case labelLine:
+			if l.label.used {
+				g.printf("%s:\n", l.label.name)
+			}
+		}
+	}
+	g.printf("}\n\n")
+}
+
+// funcGen translates the body of a function.
+//
+// Every value pushed on the operand stack is held by a Go variable, or is
+// a constant, so that the side effects of instructions keep their order.
+// As it is only known at the end of the body whether variables and
+// labels are used, which Go requires, the body is first translated to
+// lines, which are rendered afterwards.
+type funcGen struct {
+	g       *generator
+	results []ast.TokenType
+
+	vars   []*variable // locals, parameters first
+	lines  []line
+	stack  []value
+	labels []*label // innermost last
+	dead   bool     // whether the current instruction is unreachable
+
+	ntemps, nlabels int
+}
+
+// variable is a Go variable of the function.
+type variable struct {
+	name string
+	typ  ast.TokenType
+	used bool // whether it is read
+}
+
+// value is a value on the operand stack.
+type value struct {
+	expr string
+	typ  ast.TokenType
+	v    *variable // read by expr, nil if expr is a constant
+
+	// v is a local, which may be set before the value is used
+	local bool
+}
+
+type lineKind int
+
+const (
+	stmtLine   lineKind = iota // text
+	defLine                    // v := text, or _ = text if v is unused
+	declLine                   // var v T, if v is used
+	assignLine                 // v = text, or _ = text if v is unused
+	labelLine                  // label:, if label is used
+)
+
+type line struct {
+	kind  lineKind
+	text  string
+	v     *variable
+	label *label
+}
+
+// label is the label of a block, loop or if.
+type label struct {
+	name    string
+	loop    bool
+	height  int         // of the stack on entry
+	results []*variable // assigned the results at the end
+	used    bool        // whether a branch targets it
+	reached bool        // whether its end is reachable without branching
+}
+
+func (f *funcGen) stmt(format string, args ...interface{}) {
+	f.lines = append(f.lines, line{kind: stmtLine, text: fmt.Sprintf(format, args...)})
+}
+
+func (f *funcGen) temp(t ast.TokenType) *variable {
+	v := &variable{name: fmt.Sprintf("t%d", f.ntemps), typ: t}
+	f.ntemps++
+	return v
+}
+
+// define returns the value of expr, of type t, held by a new variable.
+func (f *funcGen) define(expr string, t ast.TokenType) value {
+	v := f.temp(t)
+	f.lines = append(f.lines, line{kind: defLine, text: expr, v: v})
+	return value{expr: v.name, typ: t, v: v}
+}
+
+// push pushes the value of expr, of type t, held by a new variable.
+func (f *funcGen) push(expr string, t ast.TokenType) {
+	f.stack = append(f.stack, f.define(expr, t))
+}
+
+func (f *funcGen) pop() value {
+	x := f.stack[len(f.stack)-1]
+	f.stack = f.stack[:len(f.stack)-1]
+	return x
+}
+
+// use returns the expression of x, marking its variable as used.
+func (f *funcGen) use(x value) string {
+	if x.v != nil {
+		x.v.used = true
+	}
+	return x.expr
+}
+
+// operands pops the n operands of a numeric instruction and returns their
+// expressions. Constant operands are first held by variables if they all
+// are, or if unsigned, when the instruction converts them to unsigned
+// types, since Go rejects constant expressions that overflow.
+func (f *funcGen) operands(n int, unsigned bool) []string {
+	xs := f.stack[len(f.stack)-n:]
+	constant := true
+	for _, x := range xs {
+		constant = constant && x.v == nil
+	}
+	constant = constant || unsigned
+	exprs := make([]string, n)
+	for i, x := range xs {
+		if constant {
+			x = f.define(x.expr, x.typ)
+		}
+		exprs[i] = f.use(x)
+	}
+	f.stack = f.stack[:len(f.stack)-n]
+	return exprs
+}
+
+// hold makes the values on the stack reading the local v, or any local if
+// v is nil, be held by variables of their own.
+func (f *funcGen) hold(v *variable) {
+	for i, x := range f.stack {
+		if x.local && (v == nil || x.v == v) {
+			f.stack[i] = f.define(f.use(x), x.typ)
+		}
+	}
+}
+
+func (f *funcGen) assign(v *variable, expr string) {
+	f.lines = append(f.lines, line{kind: assignLine, text: expr, v: v})
+}
+
+func (f *funcGen) body(body []ast.Instr) {
+	for _, in := range body {
+		if f.dead {
+			return
+		}
+		f.instr(in)
+	}
+}
+
+func (f *funcGen) instr(in ast.Instr) {
+	switch in := in.(type) {
+	case *ast.Instruction:
+		f.body(in.Operands)
+		if !f.dead {
+			f.plainInstr(in)
+		}
+	case *ast.Block:
+		l := f.enter(in.Type, false)
+		f.stmt("{")
+		f.body(in.Body)
+		f.end(l)
+	case *ast.Loop:
+		l := f.enter(in.Type, true)
+		f.lines = append(f.lines, line{kind: labelLine, label: l})
+		f.stmt("{")
+		f.body(in.Body)
+		f.end(l)
+	case *ast.If:
+		f.body(in.Cond)
+		if f.dead {
+			return
+		}
+		c := f.use(f.pop())
+		l := f.enter(in.Type, false)
+		f.stmt("if %s != 0 {", c)
+		f.body(in.Then)
+		if in.Else == nil {
+			l.reached = true
+		} else {
+			f.fallthru(l)
+			f.dead = false
+			f.stmt("} else {")
+			f.body(in.Else)
+		}
+		f.end(l)
+	}
+}
+
+// enter enters a block, loop or if of type typ.
+func (f *funcGen) enter(typ *ast.FuncSig, loop bool) *label {
+	// The values below the block may be used after it, where the
+	// variables declared in it are out of scope.
+	f.hold(nil)
+	l := &label{name: fmt.Sprintf("L%d", f.nlabels), loop: loop, height: len(f.stack)}
+	f.nlabels++
+	for _, t := range f.g.m.Signature(typ).Results {
+		v := f.temp(t)
+		l.results = append(l.results, v)
+		f.lines = append(f.lines, line{kind: declLine, v: v})
+	}
+	f.labels = append(f.labels, l)
+	return l
+}
+
+// fallthru assigns the results of l at the end of its body, or of the
+// then branch of an if.
+func (f *funcGen) fallthru(l *label) {
+	if !f.dead {
+		l.reached = true
+		xs := f.stack[len(f.stack)-len(l.results):]
+		for i, v := range l.results {
+			f.assign(v, f.use(xs[i]))
+		}
+	}
+	f.stack = f.stack[:l.height]
+}
+
+// end ends the block, loop or if of label l.
+func (f *funcGen) end(l *label) {
+	f.fallthru(l)
+	f.stmt("}")
+	f.labels = f.labels[:len(f.labels)-1]
+	if !l.loop {
+		f.lines = append(f.lines, line{kind: labelLine, label: l})
+	}
+	f.dead = !l.reached && !(l.used && !l.loop)
+	for _, v := range l.results {
+		f.stack = append(f.stack, value{expr: v.name, typ: v.typ, v: v})
+	}
+}
+
+// branch branches to the label of the given depth, leaving the stack
+// unchanged.
+func (f *funcGen) branch(depth int) {
+	if depth == len(f.labels) {
+		f.ret()
+		return
+	}
+	l := f.labels[len(f.labels)-1-depth]
+	l.used = true
+	if !l.loop {
+		xs := f.stack[len(f.stack)-len(l.results):]
+		for i, v := range l.results {
+			f.assign(v, f.use(xs[i]))
+		}
+	}
+	f.stmt("goto %s", l.name)
+}
+
+// ret returns from the function, leaving the stack unchanged.
+func (f *funcGen) ret() {
+	xs := f.stack[len(f.stack)-len(f.results):]
+	exprs := make([]string, len(xs))
+	for i, x := range xs {
+		exprs[i] = f.use(x)
+	}
+	f.stmt("m.depth--")
+	f.stmt("return %s", strings.Join(exprs, ", "))
+}
+
+// call calls the Go function fn with the n arguments on the stack,
+// preceded by args, pushing its results.
+func (f *funcGen) call(fn string, n int, results []ast.TokenType, args ...string) {
+	for _, x := range f.stack[len(f.stack)-n:] {
+		args = append(args, f.use(x))
+	}
+	f.stack = f.stack[:len(f.stack)-n]
+	expr := fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", "))
+	if len(results) == 0 {
+		f.stmt("%s", expr)
+		return
+	}
+	f.push(expr, results[0])
+}
+
+// plainInstr translates the plain instruction in, whose operands have
+// been translated.
+func (f *funcGen) plainInstr(in *ast.Instruction) {
+	m := f.g.m
+	switch in.Op {
+	case ast.UNREACHABLE:
+		f.stmt("panic(&Trap{ErrUnreachable})")
+		f.dead = true
+	case ast.NOP:
+	case ast.BR:
+		f.branch(in.Var.Index)
+		f.dead = true
+	case ast.BR_IF:
+		f.stmt("if %s != 0 {", f.use(f.pop()))
+		f.branch(in.Var.Index)
+		f.stmt("}")
+	case ast.BR_TABLE:
+		f.stmt("switch %s {", f.use(f.pop()))
+		for i, v := range in.Table {
+			f.stmt("case %d:", i)
+			f.branch(v.Index)
+		}
+		f.stmt("default:")
+		f.branch(in.Var.Index)
+		f.stmt("}")
+		f.dead = true
+	case ast.RETURN:
+		f.ret()
+		f.dead = true
+	case ast.CALL:
+		sig := m.Signature(m.Funcs[in.Var.Index].Signature)
+		f.call(fmt.Sprintf("m.f%d", in.Var.Index), len(sig.ParamTypes()), sig.Results)
+	case ast.CALL_INDIRECT:
+		sig := m.Signature(in.Sig)
+		i := f.use(f.pop())
+		f.call(fmt.Sprintf("m.callIndirect%d", f.g.dispatcherIndex(sig)), len(sig.ParamTypes()), sig.Results, i)
+	case ast.DROP:
+		f.pop()
+	case ast.SELECT:
+		c, y, x := f.pop(), f.pop(), f.pop()
+		f.push(fmt.Sprintf("sel(%s, %s, %s)", f.use(c), f.use(x), f.use(y)), x.typ)
+	case ast.GET_LOCAL:
+		v := f.vars[in.Var.Index]
+		f.stack = append(f.stack, value{expr: v.name, typ: v.typ, v: v, local: true})
+	case ast.SET_LOCAL, ast.TEE_LOCAL:
+		v := f.vars[in.Var.Index]
+		x := f.pop()
+		f.hold(v)
+		if x.v != v {
+			f.assign(v, f.use(x))
+		}
+		if in.Op == ast.TEE_LOCAL {
+			f.stack = append(f.stack, value{expr: v.name, typ: v.typ, v: v, local: true})
+		}
+	case ast.GET_GLOBAL:
+		f.push(fmt.Sprintf("m.g%d", in.Var.Index), m.Globals[in.Var.Index].Type)
+	case ast.SET_GLOBAL:
+		f.stmt("m.g%d = %s", in.Var.Index, f.use(f.pop()))
+	case ast.CONST:
+		f.stack = append(f.stack, value{expr: constant(in.Type, in.Value), typ: in.Type})
+	case ast.LOAD:
+		f.push(load(in, f.use(f.pop())), in.Type)
+	case ast.STORE:
+		x := f.operands(1, false)[0]
+		f.stmt("%s", store(in, f.use(f.pop()), x))
+	case ast.CURRENT_MEMORY:
+		f.push("int32(len(m.mem) / pageSize)", ast.I32)
+	case ast.GROW_MEMORY:
+		f.push(fmt.Sprintf("m.grow(%s)", f.use(f.pop())), ast.I32)
+	default:
+		f.numeric(in)
+	}
+}
+
+func load(in *ast.Instruction, addr string) string {
+	x := fmt.Sprintf("m.load%d(%s, %d)", in.Width, addr, in.Offset)
+	switch {
+	case in.Type == ast.F32:
+		return fmt.Sprintf("math.Float32frombits(%s)", x)
+	case in.Type == ast.F64:
+		return fmt.Sprintf("math.Float64frombits(%s)", x)
+	case in.Sign == ast.S:
+		return fmt.Sprintf("%s(int%d(%s))", goType(in.Type), in.Width, x)
+	}
+	return fmt.Sprintf("%s(%s)", goType(in.Type), x)
+}
+
+func store(in *ast.Instruction, addr, x string) string {
+	switch in.Type {
+	case ast.F32:
+		x = fmt.Sprintf("math.Float32bits(%s)", x)
+	case ast.F64:
+		x = fmt.Sprintf("math.Float64bits(%s)", x)
+	default:
+		x = fmt.Sprintf("uint%d(%s)", in.Width, x)
+	}
+	return fmt.Sprintf("m.store%d(%s, %d, %s)", in.Width, addr, in.Offset, x)
+}
+
+// operators maps operators to the Go operators implementing them.
+var operators = map[ast.TokenType]string{
+	ast.ADD: "+", ast.SUB: "-", ast.MUL: "*", ast.DIV: "/",
+	ast.AND: "&", ast.OR: "|", ast.XOR: "^",
+	ast.EQ: "==", ast.NE: "!=", ast.LT: "<", ast.LE: "<=", ast.GT: ">", ast.GE: ">=",
+}
+
+// rounding maps the float operators implemented with package math to
+// their functions.
+var rounding = map[ast.TokenType]string{
+	ast.SQRT: "Sqrt", ast.CEIL: "Ceil", ast.FLOOR: "Floor", ast.TRUNC: "Trunc", ast.NEAREST: "RoundToEven",
+}
+
+func isUnary(op ast.TokenType) bool {
+	switch op {
+	case ast.ABS, ast.CEIL, ast.CLZ, ast.CTZ, ast.EQZ, ast.FLOOR, ast.NEAREST,
+		ast.NEG, ast.POPCNT, ast.SQRT, ast.TRUNC:
+		return true
+	}
+	return false
+}
+
+// unsignedOperands reports whether binop converts the operands of the
+// integer operator in to unsigned types.
+func unsignedOperands(in *ast.Instruction) bool {
+	if in.Type != ast.I32 && in.Type != ast.I64 {
+		return false
+	}
+	switch in.Op {
+	case ast.ROTL, ast.ROTR:
+		return true
+	case ast.SHR:
+		return in.Sign == ast.U
+	}
+	return isComparison(in.Op) && in.Sign == ast.U
+}
+
+func isComparison(op ast.TokenType) bool {
+	switch op {
+	case ast.EQ, ast.NE, ast.LT, ast.LE, ast.GT, ast.GE, ast.EQZ:
+		return true
+	}
+	return false
+}
+
+// numeric translates the numeric instruction in.
+func (f *funcGen) numeric(in *ast.Instruction) {
+	t := in.Type
+	if isComparison(in.Op) && in.From == 0 {
+		t = ast.I32
+	}
+	switch {
+	case in.From != 0:
+		f.push(convert(in, f.operands(1, false)[0]), t)
+	case isUnary(in.Op):
+		f.push(f.unop(in, f.operands(1, false)[0]), t)
+	default:
+		xs := f.operands(2, unsignedOperands(in))
+		f.push(f.binop(in, xs[0], xs[1]), t)
+	}
+}
+
+// typeName returns the name of the value type t, such as i32, which
+// prefixes the names of the runtime functions implementing its operators.
+func typeName(t ast.TokenType) string {
+	return strings.ToLower(t.String())
+}
+
+// intBits returns the size in bits of the integer type t.
+func intBits(t ast.TokenType) int {
+	if t == ast.I64 {
+		return 64
+	}
+	return 32
+}
+
+func (f *funcGen) unop(in *ast.Instruction, x string) string {
+	t := goType(in.Type)
+	switch in.Op {
+	case ast.EQZ:
+		return fmt.Sprintf("b2i(%s == 0)", x)
+	case ast.CLZ, ast.CTZ, ast.POPCNT:
+		f.g.usesBits = true
+		fn := map[ast.TokenType]string{ast.CLZ: "LeadingZeros", ast.CTZ: "TrailingZeros", ast.POPCNT: "OnesCount"}[in.Op]
+		n := intBits(in.Type)
+		return fmt.Sprintf("%s(bits.%s%d(uint%d(%s)))", t, fn, n, n, x)
+	case ast.ABS:
+		return fmt.Sprintf("%sAbs(%s)", typeName(in.Type), x)
+	case ast.NEG:
+		return fmt.Sprintf("%sNeg(%s)", typeName(in.Type), x)
+	}
+	if in.Type == ast.F32 {
+		return fmt.Sprintf("float32(math.%s(float64(%s)))", rounding[in.Op], x)
+	}
+	return fmt.Sprintf("math.%s(%s)", rounding[in.Op], x)
+}
+
+func (f *funcGen) binop(in *ast.Instruction, x, y string) string {
+	t := goType(in.Type)
+	if in.Type == ast.F32 || in.Type == ast.F64 {
+		switch in.Op {
+		case ast.MIN, ast.MAX:
+			fn := "fmin"
+			if in.Op == ast.MAX {
+				fn = "fmax"
+			}
+			if in.Type == ast.F32 {
+				return fmt.Sprintf("float32(%s(float64(%s), float64(%s)))", fn, x, y)
+			}
+			return fmt.Sprintf("%s(%s, %s)", fn, x, y)
+		case ast.COPYSIGN:
+			return fmt.Sprintf("%sCopysign(%s, %s)", typeName(in.Type), x, y)
+		}
+		if isComparison(in.Op) {
+			return fmt.Sprintf("b2i(%s %s %s)", x, operators[in.Op], y)
+		}
+		// The conversion prevents the fusion of operations.
+		return fmt.Sprintf("%s(%s %s %s)", t, x, operators[in.Op], y)
+	}
+
+	n := intBits(in.Type)
+	signed := in.Sign == ast.S
+	switch in.Op {
+	case ast.DIV, ast.REM:
+		fn := map[ast.TokenType]string{ast.DIV: "Div", ast.REM: "Rem"}[in.Op]
+		return fmt.Sprintf("%s%s%s(%s, %s)", typeName(in.Type), fn, strings.ToUpper(in.Sign.String()), x, y)
+	case ast.SHL:
+		return fmt.Sprintf("%s << (%s & %d)", x, y, n-1)
+	case ast.SHR:
+		if signed {
+			return fmt.Sprintf("%s >> (%s & %d)", x, y, n-1)
+		}
+		return fmt.Sprintf("%s(uint%d(%s) >> (%s & %d))", t, n, x, y, n-1)
+	case ast.ROTL, ast.ROTR:
+		f.g.usesBits = true
+		k := fmt.Sprintf("int(%s & %d)", y, n-1)
+		if in.Op == ast.ROTR {
+			k = "-" + k
+		}
+		return fmt.Sprintf("%s(bits.RotateLeft%d(uint%d(%s), %s))", t, n, n, x, k)
+	}
+	if !isComparison(in.Op) {
+		return fmt.Sprintf("%s %s %s", x, operators[in.Op], y)
+	}
+	if in.Sign == ast.U {
+		return fmt.Sprintf("b2i(uint%d(%s) %s uint%d(%s))", n, x, operators[in.Op], n, y)
+	}
+	return fmt.Sprintf("b2i(%s %s %s)", x, operators[in.Op], y)
+}
+
+// convert returns the conversion in of x.
+func convert(in *ast.Instruction, x string) string {
+	t := goType(in.Type)
+	signed := in.Sign == ast.S
+	switch in.Op {
+	case ast.WRAP, ast.PROMOTE, ast.DEMOTE:
+		return fmt.Sprintf("%s(%s)", t, x)
+	case ast.EXTEND:
+		if signed {
+			return fmt.Sprintf("int64(%s)", x)
+		}
+		return fmt.Sprintf("int64(uint32(%s))", x)
+	case ast.REINTERPRET:
+		switch in.Type {
+		case ast.I32:
+			return fmt.Sprintf("int32(math.Float32bits(%s))", x)
+		case ast.I64:
+			return fmt.Sprintf("int64(math.Float64bits(%s))", x)
+		case ast.F32:
+			return fmt.Sprintf("math.Float32frombits(uint32(%s))", x)
+		}
+		return fmt.Sprintf("math.Float64frombits(uint64(%s))", x)
+	case ast.TRUNC:
+		if in.From == ast.F32 {
+			x = fmt.Sprintf("float64(%s)", x)
+		}
+		return fmt.Sprintf("%sTrunc%s(%s)", typeName(in.Type), strings.ToUpper(in.Sign.String()), x)
+	}
+	// convert
+	if !signed {
+		x = fmt.Sprintf("uint%d(%s)", intBits(in.From), x)
+	}
+	return fmt.Sprintf("%s(%s)", t, x)
+}
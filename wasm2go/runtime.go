@@ -0,0 +1,270 @@
+package wasm2go
+
+// runtime is the code shared by the functions of every generated package.
+// Its traps and their messages are those of package interp.
+const runtime = `
+// Errors wrapped by a Trap, describing its cause.
+var (
+	ErrUnreachable              = errors.New("unreachable executed")
+	ErrIntegerDivideByZero      = errors.New("integer divide by zero")
+	ErrIntegerOverflow          = errors.New("integer overflow")
+	ErrInvalidConversion        = errors.New("invalid conversion to integer")
+	ErrOutOfBounds              = errors.New("out of bounds memory access")
+	ErrUndefinedElement         = errors.New("undefined element")
+	ErrUninitializedElement     = errors.New("uninitialized element")
+	ErrIndirectCallTypeMismatch = errors.New("indirect call type mismatch")
+	ErrCallStackExhausted       = errors.New("call stack exhausted")
+)
+
+// Trap is the error returned when the execution of a function traps,
+// aborting the call.
+// Err is one of the errors above, or the error returned by an import.
+type Trap struct {
+	Err error
+}
+
+func (t *Trap) Error() string {
+	return "trap: " + t.Err.Error()
+}
+
+func (t *Trap) Unwrap() error { return t.Err }
+
+// maxCallDepth is the maximum number of nested calls of functions.
+const maxCallDepth = 10000
+
+// catch recovers a trap into *err, restoring the call depth.
+func (m *Module) catch(err *error, depth int) {
+	if e := recover(); e != nil {
+		t, ok := e.(*Trap)
+		if !ok {
+			panic(e)
+		}
+		m.depth = depth
+		*err = t
+	}
+}
+
+func (m *Module) enter() {
+	if m.depth++; m.depth > maxCallDepth {
+		panic(&Trap{ErrCallStackExhausted})
+	}
+}
+
+// imported traps if err, returned by an import, is not nil.
+func imported(err error) {
+	if t, ok := err.(*Trap); ok {
+		panic(t)
+	}
+	if err != nil {
+		panic(&Trap{err})
+	}
+}
+
+// element returns the function index of the element i of the table.
+func (m *Module) element(i int32) int32 {
+	if uint64(uint32(i)) >= uint64(len(m.table)) {
+		panic(&Trap{ErrUndefinedElement})
+	}
+	f := m.table[uint32(i)]
+	if f < 0 {
+		panic(&Trap{ErrUninitializedElement})
+	}
+	return f
+}
+
+// access returns the n bytes of memory at the effective address of an
+// access of offset off to addr.
+func (m *Module) access(addr int32, off uint32, n uint64) []byte {
+	ea := uint64(uint32(addr)) + uint64(off)
+	if ea+n > uint64(len(m.mem)) {
+		panic(&Trap{ErrOutOfBounds})
+	}
+	return m.mem[ea : ea+n]
+}
+
+func (m *Module) load8(addr int32, off uint32) uint8 { return m.access(addr, off, 1)[0] }
+
+func (m *Module) load16(addr int32, off uint32) uint16 {
+	return binary.LittleEndian.Uint16(m.access(addr, off, 2))
+}
+
+func (m *Module) load32(addr int32, off uint32) uint32 {
+	return binary.LittleEndian.Uint32(m.access(addr, off, 4))
+}
+
+func (m *Module) load64(addr int32, off uint32) uint64 {
+	return binary.LittleEndian.Uint64(m.access(addr, off, 8))
+}
+
+func (m *Module) store8(addr int32, off uint32, v uint8) { m.access(addr, off, 1)[0] = v }
+
+func (m *Module) store16(addr int32, off uint32, v uint16) {
+	binary.LittleEndian.PutUint16(m.access(addr, off, 2), v)
+}
+
+func (m *Module) store32(addr int32, off uint32, v uint32) {
+	binary.LittleEndian.PutUint32(m.access(addr, off, 4), v)
+}
+
+func (m *Module) store64(addr int32, off uint32, v uint64) {
+	binary.LittleEndian.PutUint64(m.access(addr, off, 8), v)
+}
+
+// grow grows the memory by delta pages, returning its previous size,
+// or -1 if it cannot grow.
+func (m *Module) grow(delta int32) int32 {
+	size := uint64(len(m.mem)) / pageSize
+	if size+uint64(uint32(delta)) > m.maxPages {
+		return -1
+	}
+	m.mem = append(m.mem, make([]byte, uint64(uint32(delta))*pageSize)...)
+	return int32(size)
+}
+
+const pageSize = 65536
+
+func b2i(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sel[T any](c int32, x, y T) T {
+	if c != 0 {
+		return x
+	}
+	return y
+}
+
+func i32DivS(x, y int32) int32 {
+	if y == 0 {
+		panic(&Trap{ErrIntegerDivideByZero})
+	}
+	if x == math.MinInt32 && y == -1 {
+		panic(&Trap{ErrIntegerOverflow})
+	}
+	return x / y
+}
+
+func i32DivU(x, y int32) int32 {
+	if y == 0 {
+		panic(&Trap{ErrIntegerDivideByZero})
+	}
+	return int32(uint32(x) / uint32(y))
+}
+
+func i32RemS(x, y int32) int32 {
+	if y == 0 {
+		panic(&Trap{ErrIntegerDivideByZero})
+	}
+	if y == -1 {
+		return 0
+	}
+	return x % y
+}
+
+func i32RemU(x, y int32) int32 {
+	if y == 0 {
+		panic(&Trap{ErrIntegerDivideByZero})
+	}
+	return int32(uint32(x) % uint32(y))
+}
+
+func i64DivS(x, y int64) int64 {
+	if y == 0 {
+		panic(&Trap{ErrIntegerDivideByZero})
+	}
+	if x == math.MinInt64 && y == -1 {
+		panic(&Trap{ErrIntegerOverflow})
+	}
+	return x / y
+}
+
+func i64DivU(x, y int64) int64 {
+	if y == 0 {
+		panic(&Trap{ErrIntegerDivideByZero})
+	}
+	return int64(uint64(x) / uint64(y))
+}
+
+func i64RemS(x, y int64) int64 {
+	if y == 0 {
+		panic(&Trap{ErrIntegerDivideByZero})
+	}
+	if y == -1 {
+		return 0
+	}
+	return x % y
+}
+
+func i64RemU(x, y int64) int64 {
+	if y == 0 {
+		panic(&Trap{ErrIntegerDivideByZero})
+	}
+	return int64(uint64(x) % uint64(y))
+}
+
+// abs, neg and copysign only affect the sign bit, even of a NaN.
+
+func f32Abs(x float32) float32 { return math.Float32frombits(math.Float32bits(x) &^ (1 << 31)) }
+func f32Neg(x float32) float32 { return math.Float32frombits(math.Float32bits(x) ^ (1 << 31)) }
+
+func f32Copysign(x, y float32) float32 {
+	return math.Float32frombits(math.Float32bits(x)&^(1<<31) | math.Float32bits(y)&(1<<31))
+}
+
+func f64Abs(x float64) float64 { return math.Float64frombits(math.Float64bits(x) &^ (1 << 63)) }
+func f64Neg(x float64) float64 { return math.Float64frombits(math.Float64bits(x) ^ (1 << 63)) }
+
+func f64Copysign(x, y float64) float64 {
+	return math.Float64frombits(math.Float64bits(x)&^(1<<63) | math.Float64bits(y)&(1<<63))
+}
+
+// fmin and fmax return a NaN if either operand is a NaN,
+// and order -0 below +0.
+func fmin(x, y float64) float64 {
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return x + y
+	}
+	return math.Min(x, y)
+}
+
+func fmax(x, y float64) float64 {
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return x + y
+	}
+	return math.Max(x, y)
+}
+
+// checkTrunc traps if f, to be truncated to an integer, is a NaN or
+// out of range.
+func checkTrunc(f float64, inRange bool) {
+	if math.IsNaN(f) {
+		panic(&Trap{ErrInvalidConversion})
+	}
+	if !inRange {
+		panic(&Trap{ErrIntegerOverflow})
+	}
+}
+
+func i32TruncS(f float64) int32 {
+	checkTrunc(f, f > math.MinInt32-1 && f < math.MaxInt32+1)
+	return int32(f)
+}
+
+func i32TruncU(f float64) int32 {
+	checkTrunc(f, f > -1 && f < math.MaxUint32+1)
+	return int32(uint32(f))
+}
+
+func i64TruncS(f float64) int64 {
+	checkTrunc(f, f >= math.MinInt64 && f < math.MaxInt64+1)
+	return int64(f)
+}
+
+func i64TruncU(f float64) int64 {
+	checkTrunc(f, f > -1 && f < math.MaxUint64+1)
+	return int64(uint64(f))
+}
+`
@@ -0,0 +1,426 @@
+// Package wasm2go translates modules to Go source code, so that they can
+// be built into Go programs without an interpreter.
+//
+// The generated package defines a type Module, an instance of the
+// module created by New, whose exported functions, memories and globals
+// are methods, and an interface Imports, which the caller implements to
+// provide the imported functions and globals. Each function of the module
+// becomes a method of Module, and its linear memory a []byte. Traps are
+// panics, recovered by the exported methods and New into a *Trap error,
+// with the messages of package interp.
+//
+// Imported tables and memories are not supported, and exported tables are
+// not exposed.
+package wasm2go
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/sprt/wasm/ast"
+)
+
+// Generate validates m and writes the source code of a Go package named
+// pkg implementing it to w.
+func Generate(w io.Writer, m *ast.Module, pkg string) error {
+	if err := ast.Validate(m); err != nil {
+		return err
+	}
+	g := &generator{m: m, dispatchers: make(map[string]int)}
+	if err := g.module(pkg); err != nil {
+		return err
+	}
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("wasm2go: formatting generated code: %v", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// generator generates the package of a module.
+type generator struct {
+	m   *ast.Module
+	buf bytes.Buffer
+
+	// methods of Imports, by index of function or global ("" if defined)
+	funcImports, globalImports []string
+
+	// call_indirect dispatchers, by signature
+	dispatchers map[string]int
+	sigs        []*ast.FuncSig
+
+	usesBits bool // whether math/bits is used
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// goType returns the Go type of values of type t, or error if t is zero.
+func goType(t ast.TokenType) string {
+	switch t {
+	case 0:
+		return "error"
+	case ast.I32:
+		return "int32"
+	case ast.I64:
+		return "int64"
+	case ast.F32:
+		return "float32"
+	}
+	return "float64"
+}
+
+// goTypes returns the Go types of values of types types, separated by
+// commas.
+func goTypes(types []ast.TokenType) string {
+	s := make([]string, len(types))
+	for i, t := range types {
+		s[i] = goType(t)
+	}
+	return strings.Join(s, ", ")
+}
+
+// params returns the parameter list of a Go function taking values of
+// types types, named prefix0, prefix1, etc.
+func params(prefix string, types []ast.TokenType) string {
+	s := make([]string, len(types))
+	for i, t := range types {
+		s[i] = fmt.Sprintf("%s%d %s", prefix, i, goType(t))
+	}
+	return strings.Join(s, ", ")
+}
+
+// args returns the arguments prefix0, prefix1, etc. up to n.
+func args(prefix string, n int) string {
+	s := make([]string, n)
+	for i := range s {
+		s[i] = fmt.Sprintf("%s%d", prefix, i)
+	}
+	return strings.Join(s, ", ")
+}
+
+// results returns the result list of a Go function returning values of
+// types types.
+func results(types []ast.TokenType) string {
+	if len(types) > 1 {
+		return "(" + goTypes(types) + ")"
+	}
+	return goTypes(types)
+}
+
+// exportName returns an exported Go identifier for the name s, by
+// capitalizing its words, which are separated by non-alphanumeric
+// characters.
+func exportName(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if b.Len() == 0 && unicode.IsDigit(r) {
+			b.WriteByte('X')
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "X"
+	}
+	return b.String()
+}
+
+// names allocates distinct exported Go identifiers.
+type names map[string]bool
+
+func (n names) name(s string) string {
+	name := exportName(s)
+	for i := 2; n[name]; i++ {
+		name = fmt.Sprintf("%s%d", exportName(s), i)
+	}
+	n[name] = true
+	return name
+}
+
+func (g *generator) module(pkg string) error {
+	m := g.m
+	for _, t := range m.Tables {
+		if t.Import != nil {
+			return errors.New("wasm2go: imported tables are not supported")
+		}
+	}
+	for _, mem := range m.Memories {
+		if mem.Import != nil {
+			return errors.New("wasm2go: imported memories are not supported")
+		}
+	}
+
+	g.printf("// Code generated by wasm2go. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	g.printf("import (\n\"encoding/binary\"\n\"errors\"\n\"math\"\n@BITS@)\n\n")
+
+	// Imports
+	imports := make(names)
+	g.printf("// Imports provides the imports of the module.\ntype Imports interface {\n")
+	for _, fn := range m.Funcs {
+		name := ""
+		if fn.Import != nil {
+			name = imports.name(fn.Import.Module + " " + fn.Import.Name)
+			sig := m.Signature(fn.Signature)
+			g.printf("// %s is the function %q of module %q.\n", name, fn.Import.Name, fn.Import.Module)
+			g.printf("%s(%s) (%s)\n", name, params("x", sig.ParamTypes()), goTypes(append(sig.Results[:len(sig.Results):len(sig.Results)], 0)))
+		}
+		g.funcImports = append(g.funcImports, name)
+	}
+	for _, gl := range m.Globals {
+		name := ""
+		if gl.Import != nil {
+			if gl.Mutable {
+				return errors.New("wasm2go: imported mutable globals are not supported")
+			}
+			name = imports.name(gl.Import.Module + " " + gl.Import.Name)
+			g.printf("// %s returns the value of the global %q of module %q.\n", name, gl.Import.Name, gl.Import.Module)
+			g.printf("%s() %s\n", name, goType(gl.Type))
+		}
+		g.globalImports = append(g.globalImports, name)
+	}
+	g.printf("}\n\n")
+
+	// Module
+	g.printf("// Module is an instance of the module.\ntype Module struct {\n")
+	g.printf("imports Imports\nmem []byte\nmaxPages uint64\n")
+	g.printf("table []int32 // function indexes, -1 if uninitialized\n")
+	for i, gl := range m.Globals {
+		g.printf("g%d %s\n", i, goType(gl.Type))
+	}
+	g.printf("depth int // number of nested calls\n}\n\n")
+
+	if err := g.newFunc(); err != nil {
+		return err
+	}
+	g.exports()
+	for i, fn := range m.Funcs {
+		g.function(i, fn)
+	}
+	for i, sig := range g.sigs {
+		g.dispatcher(i, sig)
+	}
+	g.printf("%s", runtime)
+
+	src := g.buf.Bytes()
+	bits := ""
+	if g.usesBits {
+		bits = "\"math/bits\"\n"
+	}
+	g.buf.Reset()
+	g.buf.Write(bytes.Replace(src, []byte("@BITS@"), []byte(bits), 1))
+	return nil
+}
+
+// newFunc generates New, which initializes an instance.
+func (g *generator) newFunc() error {
+	m := g.m
+	g.printf(`// New returns a new instance of the module, whose imports are provided
+// by imports, and calls its start function, if any.
+func New(imports Imports) (_ *Module, err error) {
+	m := &Module{imports: imports, maxPages: 65536}
+	defer m.catch(&err, 0)
+`)
+	for i, gl := range m.Globals {
+		if gl.Import != nil {
+			g.printf("m.g%d = imports.%s()\n", i, g.globalImports[i])
+			continue
+		}
+		g.printf("m.g%d = %s\n", i, g.constExpr(gl.Init))
+	}
+	if len(m.Memories) > 0 {
+		lim := m.Memories[0].Limits
+		g.printf("m.mem = make([]byte, %d*pageSize)\n", lim.Min)
+		if lim.HasMax {
+			g.printf("m.maxPages = %d\n", lim.Max)
+		}
+	}
+	if len(m.Tables) > 0 {
+		g.printf("m.table = make([]int32, %d)\n", m.Tables[0].Limits.Min)
+		g.printf("for i := range m.table {\nm.table[i] = -1\n}\n")
+	}
+
+	// Check that every segment fits before initializing any, as
+	// package interp does.
+	for i, e := range m.Elems {
+		g.printf("elem%d := %s\n", i, g.offset(e.Offset))
+		g.printf("if elem%d+%d > uint64(len(m.table)) {\nreturn nil, errors.New(\"elements segment does not fit\")\n}\n", i, len(e.Funcs))
+	}
+	for i, d := range m.Data {
+		g.printf("data%d := %s\n", i, g.offset(d.Offset))
+		g.printf("if data%d+%d > uint64(len(m.mem)) {\nreturn nil, errors.New(\"data segment does not fit\")\n}\n", i, len(d.Data))
+	}
+	for i, e := range m.Elems {
+		funcs := make([]string, len(e.Funcs))
+		for j, v := range e.Funcs {
+			funcs[j] = strconv.Itoa(v.Index)
+		}
+		g.printf("copy(m.table[elem%d:], []int32{%s})\n", i, strings.Join(funcs, ", "))
+	}
+	for i, d := range m.Data {
+		g.printf("copy(m.mem[data%d:], %s)\n", i, strconv.Quote(string(d.Data)))
+	}
+	if m.Start != nil {
+		g.printf("m.f%d()\n", m.Start.Index)
+	}
+	g.printf("return m, nil\n}\n\n")
+	return nil
+}
+
+// constExpr returns a Go expression of the value of the constant
+// expression instrs.
+func (g *generator) constExpr(instrs []ast.Instr) string {
+	in := instrs[0].(*ast.Instruction)
+	if in.Op == ast.GET_GLOBAL {
+		return fmt.Sprintf("m.g%d", in.Var.Index)
+	}
+	return constant(in.Type, in.Value)
+}
+
+// offset returns a Go expression of type uint64 of the offset of a
+// segment, the constant expression instrs, a constant being written
+// unsigned since Go rejects the conversion of a negative one.
+func (g *generator) offset(instrs []ast.Instr) string {
+	if in := instrs[0].(*ast.Instruction); in.Op == ast.CONST {
+		return fmt.Sprintf("uint64(%d)", uint32(in.Value))
+	}
+	return fmt.Sprintf("uint64(uint32(%s))", g.constExpr(instrs))
+}
+
+// constant returns a Go expression of the value of type t whose bits are
+// bits.
+func constant(t ast.TokenType, bits uint64) string {
+	switch t {
+	case ast.I32:
+		return fmt.Sprintf("int32(%d)", int32(bits))
+	case ast.I64:
+		return fmt.Sprintf("int64(%d)", int64(bits))
+	case ast.F32:
+		f := math.Float32frombits(uint32(bits))
+		if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) || f == 0 && math.Signbit(float64(f)) {
+			return fmt.Sprintf("math.Float32frombits(%#x)", uint32(bits))
+		}
+		return fmt.Sprintf("float32(%s)", strconv.FormatFloat(float64(f), 'g', -1, 32))
+	}
+	f := math.Float64frombits(bits)
+	if math.IsNaN(f) || math.IsInf(f, 0) || f == 0 && math.Signbit(f) {
+		return fmt.Sprintf("math.Float64frombits(%#x)", bits)
+	}
+	return fmt.Sprintf("float64(%s)", strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// exports generates the methods of the exports.
+func (g *generator) exports() {
+	m := g.m
+	var exports []*ast.Export
+	for i, fn := range m.Funcs {
+		if fn.Export != nil {
+			exports = append(exports, &ast.Export{Name: fn.Export.Name, Kind: ast.FUNC, Var: &ast.Variable{Index: i}})
+		}
+	}
+	for i, mem := range m.Memories {
+		if mem.Export != nil {
+			exports = append(exports, &ast.Export{Name: mem.Export.Name, Kind: ast.MEMORY, Var: &ast.Variable{Index: i}})
+		}
+	}
+	for i, gl := range m.Globals {
+		if gl.Export != nil {
+			exports = append(exports, &ast.Export{Name: gl.Export.Name, Kind: ast.GLOBAL, Var: &ast.Variable{Index: i}})
+		}
+	}
+	exports = append(exports, m.Exports...)
+
+	methods := make(names)
+	for _, e := range exports {
+		name := methods.name(e.Name)
+		switch e.Kind {
+		case ast.FUNC:
+			sig := m.Signature(m.Funcs[e.Var.Index].Signature)
+			types := sig.ParamTypes()
+			g.printf("// %s calls the exported function %q.\n", name, e.Name)
+			g.printf("func (m *Module) %s(%s) (", name, params("x", types))
+			for i, t := range sig.Results {
+				g.printf("r%d %s, ", i, goType(t))
+			}
+			g.printf("err error) {\ndefer m.catch(&err, m.depth)\n")
+			if len(sig.Results) > 0 {
+				g.printf("%s = ", args("r", len(sig.Results)))
+			}
+			g.printf("m.f%d(%s)\n", e.Var.Index, args("x", len(types)))
+			g.printf("return\n}\n\n")
+		case ast.MEMORY:
+			g.printf("// %s returns the exported memory %q.\n", name, e.Name)
+			g.printf("func (m *Module) %s() []byte { return m.mem }\n\n", name)
+		case ast.GLOBAL:
+			gl := m.Globals[e.Var.Index]
+			g.printf("// %s returns the value of the exported global %q.\n", name, e.Name)
+			g.printf("func (m *Module) %s() %s { return m.g%d }\n\n", name, goType(gl.Type), e.Var.Index)
+			if gl.Mutable {
+				setter := methods.name("set " + e.Name)
+				g.printf("// %s sets the value of the exported global %q.\n", setter, e.Name)
+				g.printf("func (m *Module) %s(v %s) { m.g%d = v }\n\n", setter, goType(gl.Type), e.Var.Index)
+			}
+		}
+	}
+}
+
+// dispatcher generates the function called by call_indirect of
+// signature sig, which calls a function of the table.
+func (g *generator) dispatcher(i int, sig *ast.FuncSig) {
+	types := sig.ParamTypes()
+	g.printf("func (m *Module) callIndirect%d(i int32", i)
+	if len(types) > 0 {
+		g.printf(", %s", params("x", types))
+	}
+	g.printf(") %s {\nswitch m.element(i) {\n", results(sig.Results))
+	ret := ""
+	if len(sig.Results) > 0 {
+		ret = "return "
+	}
+	for j, fn := range g.m.Funcs {
+		if g.signature(fn.Signature) != g.signature(sig) {
+			continue
+		}
+		g.printf("case %d:\n%sm.f%d(%s)\n", j, ret, j, args("x", len(types)))
+		if ret == "" {
+			g.printf("return\n")
+		}
+	}
+	g.printf("}\npanic(&Trap{ErrIndirectCallTypeMismatch})\n}\n\n")
+}
+
+// signature returns a key identifying the resolved signature sig.
+func (g *generator) signature(sig *ast.FuncSig) string {
+	sig = g.m.Signature(sig)
+	return "(" + goTypes(sig.ParamTypes()) + ") (" + goTypes(sig.Results) + ")"
+}
+
+// dispatcherIndex returns the index of the call_indirect dispatcher of
+// signature sig.
+func (g *generator) dispatcherIndex(sig *ast.FuncSig) int {
+	key := g.signature(sig)
+	i, ok := g.dispatchers[key]
+	if !ok {
+		i = len(g.sigs)
+		g.dispatchers[key] = i
+		g.sigs = append(g.sigs, g.m.Signature(sig))
+	}
+	return i
+}
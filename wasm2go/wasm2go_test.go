@@ -0,0 +1,390 @@
+package wasm2go
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sprt/wasm/ast"
+	"github.com/sprt/wasm/interp"
+)
+
+func parse(t *testing.T, src string) *ast.Module {
+	t.Helper()
+	m, err := ast.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return m
+}
+
+const testModule = `(module
+	(import "env" "add" (func $add (param i32 i32) (result i32)))
+	(import "env" "fail" (func $fail))
+	(import "env" "base" (global $base i32))
+	(type $ii (func (param i32) (result i32)))
+	(memory 1 2)
+	(data (i32.const 16) "\01\02\03\04\ff\ff\ff\ff")
+	(table 4 anyfunc)
+	(elem (i32.const 0) $double $square $swap)
+	(global $counter (mut i32) (get_global $base))
+	(global $pi f64 (f64.const 3.14159))
+	(export "counter" (global $counter))
+	(export "memory" (memory 0))
+
+	(start $init)
+	(func $init (set_global $counter (i32.const 1)))
+
+	(func $double (type $ii) (i32.mul (get_local 0) (i32.const 2)))
+	(func $square (type $ii) (i32.mul (get_local 0) (get_local 0)))
+	(func $swap (param i64) (result i64) (i64.rotl (get_local 0) (i64.const 32)))
+
+	(func (export "fac") (param i64) (result i64)
+		(if (result i64) (i64.eqz (get_local 0))
+			(then (i64.const 1))
+			(else (i64.mul (get_local 0) (call 6 (i64.sub (get_local 0) (i64.const 1)))))))
+
+	(func (export "fac-iter") (param i64) (result i64) (local i64)
+		(set_local 1 (i64.const 1))
+		(block $done
+			(loop $next
+				(br_if $done (i64.eqz (get_local 0)))
+				(set_local 1 (i64.mul (get_local 1) (get_local 0)))
+				(set_local 0 (i64.sub (get_local 0) (i64.const 1)))
+				(br $next)))
+		(get_local 1))
+
+	(func (export "swap-locals") (param i32 i32) (result i32)
+		(get_local 0)
+		(set_local 0 (get_local 1))
+		(set_local 1)
+		(i32.sub (get_local 0) (get_local 1)))
+
+	(func (export "tee") (param i32) (result i32)
+		(i32.add (get_local 0) (tee_local 0 (i32.const 10))))
+
+	(func (export "switch") (param i32) (result i32)
+		(block $default
+			(block $two
+				(block $one
+					(block $zero
+						(br_table $zero $one $two $default (get_local 0)))
+					(return (i32.const 100)))
+				(br 1))
+			(return (i32.const 102)))
+		(block (result i32) (br 0 (i32.const 103))))
+
+	(func (export "select") (param i32) (result f32)
+		(select (f32.const 1.5) (f32.const -0) (get_local 0)))
+
+	(func (export "div") (param i32 i32) (result i32)
+		(i32.div_s (get_local 0) (get_local 1)))
+	(func (export "rem-u") (param i64 i64) (result i64)
+		(i64.rem_u (get_local 0) (get_local 1)))
+	(func (export "shifts") (param i32) (result i32)
+		(i32.xor (i32.shr_u (get_local 0) (i32.const 33))
+			(i32.xor (i32.shr_s (get_local 0) (i32.const 4))
+				(i32.rotr (get_local 0) (i32.const 8)))))
+	(func (export "bits") (param i64) (result i64)
+		(i64.add (i64.clz (get_local 0))
+			(i64.add (i64.ctz (get_local 0)) (i64.popcnt (get_local 0)))))
+	(func (export "lt-u") (param i32 i32) (result i32)
+		(i32.lt_u (get_local 0) (get_local 1)))
+	(func (export "unsigned-const") (param i32 i64) (result i64)
+		(i64.add
+			(i64.extend_u/i32
+				(i32.add (i32.shr_u (i32.const -5) (get_local 0))
+					(i32.add (i32.rotl (i32.const -1) (get_local 0))
+						(i32.add (i32.rotr (i32.const -2) (get_local 0))
+							(i32.lt_u (i32.const -1) (get_local 0))))))
+			(i64.add (i64.shr_u (i64.const -5) (get_local 1))
+				(i64.add (i64.rotl (i64.const -1) (get_local 1))
+					(i64.add (i64.rotr (i64.const -2) (get_local 1))
+						(i64.extend_u/i32 (i64.lt_u (get_local 1) (i64.const -1))))))))
+	(func (export "const-overflow") (result i32)
+		(i32.add (i32.const 0x7fffffff) (i32.const 1)))
+
+	(func (export "fma") (param f64 f64 f64) (result f64)
+		(f64.add (f64.mul (get_local 0) (get_local 1)) (get_local 2)))
+	(func (export "f32-ops") (param f32 f32) (result f32)
+		(f32.add (f32.min (get_local 0) (get_local 1))
+			(f32.add (f32.sqrt (get_local 0)) (f32.copysign (get_local 1) (get_local 0)))))
+	(func (export "nearest") (param f64) (result f64)
+		(f64.nearest (get_local 0)))
+	(func (export "neg") (param f64) (result f64)
+		(f64.neg (get_local 0)))
+	(func (export "max") (param f64 f64) (result f64)
+		(f64.max (get_local 0) (get_local 1)))
+	(func (export "pi") (result f64) (get_global $pi))
+
+	(func (export "trunc") (param f64) (result i32)
+		(i32.trunc_s/f64 (get_local 0)))
+	(func (export "trunc-u") (param f32) (result i64)
+		(i64.trunc_u/f32 (get_local 0)))
+	(func (export "convert") (param i64) (result f32)
+		(f32.convert_u/i64 (get_local 0)))
+	(func (export "reinterpret") (param f32) (result i32)
+		(i32.reinterpret/f32 (get_local 0)))
+	(func (export "extend") (param i32) (result i64)
+		(i64.add (i64.extend_s/i32 (get_local 0)) (i64.extend_u/i32 (get_local 0))))
+
+	(func (export "load") (param i32) (result i64)
+		(i64.add (i64.load32_s offset=4 (get_local 0))
+			(i64.extend_u/i32 (i32.load8_s (get_local 0)))))
+	(func (export "store") (param i32 f64) (result i64)
+		(f64.store (get_local 0) (get_local 1))
+		(i64.load16_u offset=6 (get_local 0)))
+	(func (export "grow") (param i32) (result i32)
+		(drop (grow_memory (get_local 0)))
+		(current_memory))
+
+	(func (export "call-indirect") (param i32 i32) (result i32)
+		(call_indirect $ii (get_local 1) (get_local 0)))
+	(func (export "import") (param i32) (result i32)
+		(call $add (get_local 0) (get_global $counter)))
+	(func (export "import-fail") (call $fail))
+	(func (export "bump") (result i32)
+		(set_global $counter (i32.add (get_global $counter) (i32.const 1)))
+		(get_global $counter))
+
+	(func (export "unreachable") (param i32) (result i32)
+		(block (result i32)
+			(br_if 0 (i32.const 7) (get_local 0))
+			(drop)
+			(unreachable)))
+	(func $recurse (export "recurse") (call $recurse))
+	(func (export "dead") (result i32)
+		(loop (br 0))
+		(i32.const 1))
+	(func (export "nested") (param i32) (result i32)
+		(i32.add
+			(get_local 0)
+			(block (result i32)
+				(set_local 0 (i32.const 5))
+				(if (result i32) (get_local 0)
+					(then (return (i32.const -1)))
+					(else (i32.const 2)))))))`
+
+// testCalls are calls of the exported functions of testModule.
+var testCalls = []struct {
+	name string
+	args []interp.Value
+}{
+	{"fac", []interp.Value{interp.Int64(20)}},
+	{"fac-iter", []interp.Value{interp.Int64(20)}},
+	{"swap-locals", []interp.Value{interp.Int32(1), interp.Int32(5)}},
+	{"tee", []interp.Value{interp.Int32(1)}},
+	{"switch", []interp.Value{interp.Int32(0)}},
+	{"switch", []interp.Value{interp.Int32(1)}},
+	{"switch", []interp.Value{interp.Int32(2)}},
+	{"switch", []interp.Value{interp.Int32(3)}},
+	{"switch", []interp.Value{interp.Int32(-1)}},
+	{"select", []interp.Value{interp.Int32(0)}},
+	{"select", []interp.Value{interp.Int32(2)}},
+	{"div", []interp.Value{interp.Int32(-7), interp.Int32(2)}},
+	{"div", []interp.Value{interp.Int32(1), interp.Int32(0)}},
+	{"div", []interp.Value{interp.Int32(-1 << 31), interp.Int32(-1)}},
+	{"rem-u", []interp.Value{interp.Int64(-7), interp.Int64(3)}},
+	{"shifts", []interp.Value{interp.Int32(-123456789)}},
+	{"bits", []interp.Value{interp.Int64(0xf0f00)}},
+	{"lt-u", []interp.Value{interp.Int32(-1), interp.Int32(1)}},
+	{"unsigned-const", []interp.Value{interp.Int32(3), interp.Int64(3)}},
+	{"const-overflow", nil},
+	{"fma", []interp.Value{interp.Float64(0.1), interp.Float64(10), interp.Float64(-1)}},
+	{"f32-ops", []interp.Value{interp.Float32(2), interp.Float32(-0.5)}},
+	{"nearest", []interp.Value{interp.Float64(2.5)}},
+	{"neg", []interp.Value{interp.Float64(0)}},
+	{"max", []interp.Value{interp.ValueOf(interp.F64, 1<<63), interp.Float64(0)}},
+	{"pi", nil},
+	{"trunc", []interp.Value{interp.Float64(-3.9)}},
+	{"trunc", []interp.Value{interp.Float64(1e10)}},
+	{"trunc-u", []interp.Value{interp.Float32(-1)}},
+	{"convert", []interp.Value{interp.Int64(-1)}},
+	{"reinterpret", []interp.Value{interp.Float32(-2)}},
+	{"extend", []interp.Value{interp.Int32(-2)}},
+	{"load", []interp.Value{interp.Int32(16)}},
+	{"load", []interp.Value{interp.Int32(65535)}},
+	{"store", []interp.Value{interp.Int32(8), interp.Float64(-2)}},
+	{"store", []interp.Value{interp.Int32(-1), interp.Float64(1)}},
+	{"grow", []interp.Value{interp.Int32(1)}},
+	{"grow", []interp.Value{interp.Int32(1)}},
+	{"call-indirect", []interp.Value{interp.Int32(0), interp.Int32(21)}},
+	{"call-indirect", []interp.Value{interp.Int32(1), interp.Int32(5)}},
+	{"call-indirect", []interp.Value{interp.Int32(2), interp.Int32(5)}},
+	{"call-indirect", []interp.Value{interp.Int32(3), interp.Int32(5)}},
+	{"call-indirect", []interp.Value{interp.Int32(4), interp.Int32(5)}},
+	{"import", []interp.Value{interp.Int32(2)}},
+	{"import-fail", nil},
+	{"bump", nil},
+	{"import", []interp.Value{interp.Int32(2)}},
+	{"unreachable", []interp.Value{interp.Int32(1)}},
+	{"unreachable", []interp.Value{interp.Int32(0)}},
+	{"recurse", nil},
+	{"bump", nil},
+	{"nested", []interp.Value{interp.Int32(1)}},
+}
+
+// format formats the results of a call as the generated driver does.
+func formatResults(results []interp.Value, err error) string {
+	var s []string
+	for _, v := range results {
+		s = append(s, v.String())
+	}
+	return fmt.Sprintf("%s %v", strings.Join(s, " "), err)
+}
+
+// driver is the main function of the program calling testCalls.
+const driver = `package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type imports struct{}
+
+func (imports) EnvAdd(x, y int32) (int32, error) { return x + y, nil }
+func (imports) EnvFail() error                  { return errors.New("failed") }
+func (imports) EnvBase() int32                   { return 42 }
+
+func show(xs ...interface{}) {
+	var s []string
+	err := xs[len(xs)-1]
+	for _, x := range xs[:len(xs)-1] {
+		if err != nil {
+			break
+		}
+		switch x := x.(type) {
+		case int32:
+			s = append(s, fmt.Sprintf("i32:%d", x))
+		case int64:
+			s = append(s, fmt.Sprintf("i64:%d", x))
+		case float32:
+			s = append(s, fmt.Sprintf("f32:%v", x))
+		case float64:
+			s = append(s, fmt.Sprintf("f64:%v", x))
+		}
+	}
+	fmt.Printf("%s %v\n", strings.Join(s, " "), err)
+}
+
+func main() {
+	m, err := New(imports{})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(m.Counter(), len(m.Memory()))
+`
+
+func TestGenerate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go run in short mode")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+
+	// Interpret the calls.
+	ctx := context.Background()
+	add := interp.NewHostFunc(interp.FuncType{Params: []interp.ValueType{interp.I32, interp.I32}, Results: []interp.ValueType{interp.I32}},
+		func(_ context.Context, args []interp.Value) ([]interp.Value, error) {
+			return []interp.Value{interp.Int32(args[0].Int32() + args[1].Int32())}, nil
+		})
+	fail := interp.NewHostFunc(interp.FuncType{}, func(context.Context, []interp.Value) ([]interp.Value, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	inst, err := interp.Instantiate(ctx, parse(t, testModule), interp.Imports{"env": {
+		"add":  add,
+		"fail": fail,
+		"base": interp.NewGlobal(interp.Int32(42), false),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := inst.Export("counter").(*interp.Global).Get()
+	want := []string{fmt.Sprintf("%d %d", counter.Int32(), len(inst.Memory().Bytes()))}
+	for _, c := range testCalls {
+		want = append(want, formatResults(inst.Invoke(ctx, c.name, c.args...)))
+	}
+
+	// Generate and run a program making the same calls.
+	var buf bytes.Buffer
+	if err := Generate(&buf, parse(t, testModule), "main"); err != nil {
+		t.Fatal(err)
+	}
+	var main strings.Builder
+	main.WriteString(driver)
+	for _, c := range testCalls {
+		args := make([]string, len(c.args))
+		for i, v := range c.args {
+			switch v.Type() {
+			case interp.I32:
+				args[i] = fmt.Sprintf("int32(%d)", v.Int32())
+			case interp.I64:
+				args[i] = fmt.Sprintf("int64(%d)", v.Int64())
+			case interp.F32:
+				args[i] = fmt.Sprintf("math.Float32frombits(%#x)", v.Bits())
+			case interp.F64:
+				args[i] = fmt.Sprintf("math.Float64frombits(%#x)", v.Bits())
+			}
+		}
+		fmt.Fprintf(&main, "\tshow(m.%s(%s))\n", exportName(c.name), strings.Join(args, ", "))
+	}
+	main.WriteString("}\n")
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":    "module wasm2gotest\n\ngo 1.21\n",
+		"module.go": buf.String(),
+		"main.go":   strings.Replace(main.String(), "\"fmt\"\n", "\"fmt\"\n\t\"math\"\n", 1),
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{{"vet", "."}, {"run", "."}} {
+		cmd := exec.Command(gobin, args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("go %s: %v\n%s\ngenerated code:\n%s", args[0], err, out, buf.String())
+		}
+		if args[0] != "run" {
+			continue
+		}
+		got := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+		if len(got) != len(want) {
+			t.Fatalf("got %d lines of output, want %d:\n%s", len(got), len(want), out)
+		}
+		for i := range want {
+			call := "New"
+			if i > 0 {
+				call = testCalls[i-1].name + fmt.Sprint(testCalls[i-1].args)
+			}
+			if got[i] != want[i] {
+				t.Errorf("%s: got %q, want %q", call, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestGenerateUnsupported(t *testing.T) {
+	for _, src := range []string{
+		`(module (import "env" "mem" (memory 1)))`,
+		`(module (import "env" "table" (table 1 anyfunc)))`,
+		`(module (import "env" "g" (global (mut i32))))`,
+	} {
+		err := Generate(new(bytes.Buffer), parse(t, src), "p")
+		if err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("%s: got error %v, want unsupported", src, err)
+		}
+	}
+}